@@ -0,0 +1,313 @@
+package fastcache
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// chunksPerAlloc is the number of chunks allocated at once by mmap-based allocators.
+const chunksPerAlloc = 1024
+
+// Allocator allocates memory for cache chunks.
+//
+// Every cache stores its data in 64KB chunks obtained from the allocator.
+// The allocator for the cache may be set via Config.Allocator.
+// Caches without the configured allocator use DefaultAllocator.
+//
+// Allocator must be safe for concurrent use, since it may be shared by multiple caches.
+type Allocator interface {
+	// GetChunk returns a chunk with 64KB length and capacity.
+	//
+	// The contents of the returned chunk is undefined.
+	// GetChunk must panic if the memory cannot be allocated.
+	GetChunk() []byte
+
+	// PutChunk returns the chunk obtained via GetChunk to the allocator.
+	//
+	// The chunk may have any length up to its capacity.
+	// The chunk mustn't be used after PutChunk.
+	PutChunk(chunk []byte)
+
+	// UpdateStats adds allocator stats to s.
+	//
+	// The stats cover all the chunks of the allocator, not only the chunks of a single cache.
+	UpdateStats(s *AllocatorStats)
+
+	// ReleaseMemory returns the memory occupied by free chunks to the OS.
+	//
+	// Chunks obtained via GetChunk and not returned via PutChunk mustn't be affected.
+	ReleaseMemory()
+}
+
+// AllocatorStats contains stats for the chunk allocator.
+//
+// Stats are per allocator, so they cover all the caches using the same allocator,
+// including DefaultAllocator shared by caches without Config.Allocator.
+// Such stats aren't additive: summing Stats obtained from multiple caches
+// counts the shared allocator multiple times. Call UpdateStats on the allocator
+// itself once when aggregating stats for multiple caches.
+type AllocatorStats struct {
+	// AllocatedChunks is the number of chunks allocated by the allocator.
+	AllocatedChunks uint64
+
+	// FreeChunks is the number of allocated chunks, which are ready for reuse.
+	FreeChunks uint64
+
+	// ReleasedChunks is the number of free chunks, whose memory is returned to the OS.
+	//
+	// The memory is re-populated when these chunks are reused.
+	ReleasedChunks uint64
+
+	// InUseChunks is the number of chunks obtained via GetChunk and not returned via PutChunk yet.
+	InUseChunks uint64
+}
+
+// MmapAllocatorOptions contains options for NewMmapAllocatorOptions.
+type MmapAllocatorOptions struct {
+	// HugePages enables transparent huge pages for the allocated memory.
+	//
+	// See NewHugePageAllocator for details.
+	HugePages bool
+
+	// Dir is an optional directory for the file backing the allocated memory.
+	//
+	// Anonymous memory is allocated if Dir is empty. See NewFileAllocator for details.
+	Dir string
+
+	// MaxFreeChunks is the maximum number of free chunks kept for reuse.
+	//
+	// The memory of free chunks above the limit is unmapped, so it is returned to the OS.
+	// There is no limit if MaxFreeChunks is zero.
+	MaxFreeChunks int
+
+	// IdleTimeout is the duration after which the memory of free chunks,
+	// which weren't reused during this time, is returned to the OS.
+	//
+	// The chunks remain available for reuse, while the OS re-populates their memory on the next access.
+	// The memory of idle chunks isn't returned to the OS if IdleTimeout is zero.
+	IdleTimeout time.Duration
+}
+
+func (opts *MmapAllocatorOptions) validate() error {
+	if opts.MaxFreeChunks < 0 {
+		return fmt.Errorf("MaxFreeChunks cannot be negative; got %d", opts.MaxFreeChunks)
+	}
+	if opts.IdleTimeout < 0 {
+		return fmt.Errorf("IdleTimeout cannot be negative; got %s", opts.IdleTimeout)
+	}
+	return nil
+}
+
+// DefaultAllocator returns the allocator used by caches without Config.Allocator.
+//
+// It allocates chunks via anonymous mmap on platforms supporting it,
+// so GOGC doesn't take into account the cache size. Chunks are allocated
+// from the Go heap on other platforms. Free chunks are kept for reuse
+// by all the caches using DefaultAllocator.
+func DefaultAllocator() Allocator {
+	return defaultAllocator
+}
+
+// NewHeapAllocator returns an allocator, which allocates chunks from the Go heap.
+//
+// Chunks returned to the allocator are released by the Go garbage collector.
+// Note that GOGC takes into account the cache size for chunks allocated from the heap.
+func NewHeapAllocator() Allocator {
+	return &heapAllocator{}
+}
+
+type heapAllocator struct {
+	inUse atomic.Int64
+}
+
+func (a *heapAllocator) GetChunk() []byte {
+	a.inUse.Add(1)
+	return make([]byte, chunkSize)
+}
+
+func (a *heapAllocator) PutChunk(chunk []byte) {
+	a.inUse.Add(-1)
+}
+
+func (a *heapAllocator) UpdateStats(s *AllocatorStats) {
+	n := uint64(a.inUse.Load())
+	s.AllocatedChunks += n
+	s.InUseChunks += n
+}
+
+// ReleaseMemory forces the Go garbage collector to return unused heap memory to the OS.
+//
+// This affects the whole Go heap, so it may be expensive.
+func (a *heapAllocator) ReleaseMemory() {
+	debug.FreeOSMemory()
+}
+
+// zeroingAllocator zeroes chunks obtained from the wrapped allocator.
+//
+// It is used for buckets, which mustn't contain stale data from previously released chunks.
+type zeroingAllocator struct {
+	Allocator
+}
+
+func (za zeroingAllocator) GetChunk() []byte {
+	chunk := za.Allocator.GetChunk()
+	clear(chunk)
+	return chunk
+}
+
+// TrackingAllocator tracks chunks obtained from the wrapped allocator.
+//
+// It is intended for tests, which need to verify that caches don't leak chunks.
+// PutChunk panics if the chunk wasn't obtained via GetChunk or is returned twice.
+type TrackingAllocator struct {
+	a Allocator
+
+	mu     sync.Mutex
+	chunks map[*byte]struct{}
+}
+
+// NewTrackingAllocator returns an allocator, which tracks chunks obtained from a.
+//
+// NewHeapAllocator is used if a is nil.
+func NewTrackingAllocator(a Allocator) *TrackingAllocator {
+	if a == nil {
+		a = NewHeapAllocator()
+	}
+	return &TrackingAllocator{
+		a:      a,
+		chunks: make(map[*byte]struct{}),
+	}
+}
+
+// GetChunk returns a chunk from the wrapped allocator.
+func (ta *TrackingAllocator) GetChunk() []byte {
+	chunk := ta.a.GetChunk()
+	p := unsafe.SliceData(chunk)
+	ta.mu.Lock()
+	ta.chunks[p] = struct{}{}
+	ta.mu.Unlock()
+	return chunk
+}
+
+// PutChunk returns the chunk to the wrapped allocator.
+func (ta *TrackingAllocator) PutChunk(chunk []byte) {
+	p := unsafe.SliceData(chunk)
+	ta.mu.Lock()
+	_, ok := ta.chunks[p]
+	delete(ta.chunks, p)
+	ta.mu.Unlock()
+	if !ok {
+		panic(fmt.Errorf("BUG: the chunk at %p wasn't obtained via GetChunk or is already returned", p))
+	}
+	ta.a.PutChunk(chunk)
+}
+
+// UpdateStats adds stats for the wrapped allocator to s.
+func (ta *TrackingAllocator) UpdateStats(s *AllocatorStats) {
+	ta.a.UpdateStats(s)
+}
+
+// ReleaseMemory returns the memory occupied by free chunks of the wrapped allocator to the OS.
+func (ta *TrackingAllocator) ReleaseMemory() {
+	ta.a.ReleaseMemory()
+}
+
+// CheckLeaks returns an error if some chunks obtained via GetChunk weren't returned via PutChunk.
+//
+// Call it after Cache.Reset for all the caches using ta.
+func (ta *TrackingAllocator) CheckLeaks() error {
+	ta.mu.Lock()
+	n := len(ta.chunks)
+	ta.mu.Unlock()
+	if n > 0 {
+		return fmt.Errorf("%d chunks obtained via GetChunk weren't returned via PutChunk", n)
+	}
+	return nil
+}
+
+// ReleaseMemory returns the memory occupied by free chunks of the allocator for c to the OS.
+//
+// Call it after Reset or after other operations releasing big amounts of cache memory,
+// so the process RSS drops. The allocator may be shared with other caches,
+// for example DefaultAllocator is shared by all the caches without Config.Allocator.
+// Free chunks released by these caches are returned to the OS too.
+//
+// Chunks used by caches, including chunks retained by snapshots in progress,
+// aren't affected. Memory mapped from snapshot files by LoadFromFileMmap is unmapped
+// as soon as all its chunks are released by the cache, so it never becomes free chunks.
+func (c *Cache) ReleaseMemory() {
+	c.allocator().ReleaseMemory()
+}
+
+// allocator returns the allocator for c.
+func (c *Cache) allocator() Allocator {
+	if c.alloc == nil {
+		return defaultAllocator
+	}
+	return c.alloc
+}
+
+// setAllocator sets the allocator for c to a.
+//
+// Chunks already loaded into c are copied to chunks obtained from a.
+// It must be called before c is used concurrently.
+func (c *Cache) setAllocator(a Allocator) {
+	c.alloc = a
+	for i := range c.buckets[:] {
+		c.buckets[i].setAllocator(a)
+	}
+}
+
+// allocator returns the allocator for b.
+func (b *bucket) allocator() Allocator {
+	if b.alloc == nil {
+		return defaultAllocator
+	}
+	return b.alloc
+}
+
+func (b *bucket) setAllocator(a Allocator) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, chunk := range b.chunks {
+		if chunk == nil {
+			continue
+		}
+		chunkCopy := a.GetChunk()
+		// Copy the whole chunk, since entries from the previous generation may be located beyond len(chunk).
+		copy(chunkCopy, chunk[:cap(chunk)])
+		b.putChunk(chunk)
+		b.chunks[i] = chunkCopy[:len(chunk)]
+	}
+	b.alloc = a
+}
+
+// getChunk returns a chunk from the allocator for b.
+func (b *bucket) getChunk() []byte {
+	return b.allocator().GetChunk()
+}
+
+// putChunk returns the chunk to the allocator for b.
+//
+// It is a no-op for nil chunk. Chunks mapped from snapshot files by LoadFromFileMmap
+// are released to the mapped region instead, since they weren't obtained from the allocator.
+func (b *bucket) putChunk(chunk []byte) {
+	if chunk == nil {
+		return
+	}
+	for i, r := range b.mapped {
+		if !r.contains(chunk) {
+			continue
+		}
+		if r.release() {
+			// The region is unmapped, so it mustn't be matched against chunks anymore.
+			b.mapped = append(b.mapped[:i], b.mapped[i+1:]...)
+		}
+		return
+	}
+	b.allocator().PutChunk(chunk)
+}
@@ -0,0 +1,352 @@
+package fastcache
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAllocators(t *testing.T) {
+	fileAllocator, err := NewFileAllocator(t.TempDir())
+	if err != nil && err != errMmapUnsupported {
+		t.Fatalf("cannot create file allocator: %s", err)
+	}
+	allocators := map[string]Allocator{
+		"heap":     NewHeapAllocator(),
+		"mmap":     NewMmapAllocator(),
+		"hugepage": NewHugePageAllocator(),
+		"tracking": NewTrackingAllocator(nil),
+	}
+	if fileAllocator != nil {
+		allocators["file"] = fileAllocator
+	}
+	for name, a := range allocators {
+		t.Run(name, func(t *testing.T) {
+			defer a.ReleaseMemory()
+			testAllocator(t, a)
+		})
+	}
+}
+
+func testAllocator(t *testing.T, a Allocator) {
+	const chunksCount = chunksPerAlloc + 1
+	chunks := make([][]byte, chunksCount)
+	for i := range chunks {
+		chunk := a.GetChunk()
+		if len(chunk) != chunkSize || cap(chunk) != chunkSize {
+			t.Fatalf("unexpected chunk len=%d, cap=%d; want %d", len(chunk), cap(chunk), chunkSize)
+		}
+		// Touch only the chunk bounds in order to keep the memory usage low.
+		chunk[0] = byte(i)
+		chunk[chunkSize-1] = byte(i)
+		chunks[i] = chunk
+	}
+	for i, chunk := range chunks {
+		if chunk[0] != byte(i) || chunk[chunkSize-1] != byte(i) {
+			t.Fatalf("unexpected contents for chunks[%d]; the chunk may overlap with other chunks", i)
+		}
+	}
+
+	var s AllocatorStats
+	a.UpdateStats(&s)
+	if s.InUseChunks != chunksCount {
+		t.Fatalf("unexpected InUseChunks; got %d; want %d", s.InUseChunks, chunksCount)
+	}
+	if s.AllocatedChunks != s.InUseChunks+s.FreeChunks {
+		t.Fatalf("AllocatedChunks=%d must be equal to InUseChunks=%d + FreeChunks=%d", s.AllocatedChunks, s.InUseChunks, s.FreeChunks)
+	}
+
+	for _, chunk := range chunks {
+		a.PutChunk(chunk[:0])
+	}
+	s = AllocatorStats{}
+	a.UpdateStats(&s)
+	if s.InUseChunks != 0 {
+		t.Fatalf("unexpected InUseChunks after returning all the chunks; got %d; want 0", s.InUseChunks)
+	}
+	if s.AllocatedChunks != s.FreeChunks {
+		t.Fatalf("AllocatedChunks=%d must be equal to FreeChunks=%d", s.AllocatedChunks, s.FreeChunks)
+	}
+}
+
+func TestTrackingAllocator(t *testing.T) {
+	ta := NewTrackingAllocator(nil)
+	chunk := ta.GetChunk()
+	if err := ta.CheckLeaks(); err == nil {
+		t.Fatalf("expecting non-nil error for leaked chunk")
+	}
+	ta.PutChunk(chunk)
+	if err := ta.CheckLeaks(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Returning the chunk twice must panic.
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expecting panic when returning the chunk twice")
+		}
+	}()
+	ta.PutChunk(chunk)
+}
+
+func TestCacheAllocator(t *testing.T) {
+	ta := NewTrackingAllocator(nil)
+	c, err := NewFromConfig(&Config{
+		MaxBytes:  1,
+		Allocator: ta,
+	})
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	// SetBig is called before Set, since its subvalues occupy whole chunks.
+	c.SetBig([]byte("big"), make([]byte, 2*chunkSize))
+	const itemsCount = 100000
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		c.Set(k, v)
+	}
+
+	var s Stats
+	c.UpdateStats(&s)
+	if s.InUseChunks == 0 {
+		t.Fatalf("InUseChunks must be positive")
+	}
+	if s.InUseChunks*chunkSize < s.BytesSize {
+		t.Fatalf("InUseChunks=%d cannot hold BytesSize=%d", s.InUseChunks, s.BytesSize)
+	}
+
+	filePath := filepath.Join(t.TempDir(), "cache")
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	if err := c.SaveToFileOptions(filePath, &SaveOptions{Consistent: true}); err != nil {
+		t.Fatalf("cannot save consistent snapshot: %s", err)
+	}
+	opts := &SaveOptions{
+		Codec: CodecMmap,
+		Filter: func(k, v []byte) bool {
+			return len(k)%2 == 0
+		},
+	}
+	if err := c.SaveToFileOptions(filePath, opts); err != nil {
+		t.Fatalf("cannot save filtered snapshot: %s", err)
+	}
+	c.Reset()
+	if err := ta.CheckLeaks(); err != nil {
+		t.Fatalf("unexpected leaks after Reset: %s", err)
+	}
+
+	// Loaded data must be copied into chunks from the configured allocator.
+	for _, load := range []func() (*Cache, error){
+		func() (*Cache, error) {
+			return LoadFromFileConfig(filePath, &Config{
+				Allocator: ta,
+			})
+		},
+		func() (*Cache, error) {
+			c, err := LoadFromFileMmap(filePath)
+			if err != nil {
+				return nil, err
+			}
+			c.setAllocator(ta)
+			return c, nil
+		},
+	} {
+		c, err := load()
+		if err != nil {
+			t.Fatalf("cannot load cache: %s", err)
+		}
+		for i := range itemsCount {
+			k := []byte(fmt.Sprintf("key %d", i))
+			if len(k)%2 != 0 {
+				continue
+			}
+			vExpected := fmt.Sprintf("value %d", i)
+			if v := c.Get(nil, k); string(v) != vExpected {
+				t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+			}
+		}
+		c.Reset()
+		if err := ta.CheckLeaks(); err != nil {
+			t.Fatalf("unexpected leaks after Reset of the loaded cache: %s", err)
+		}
+	}
+}
+
+func TestMmapAllocatorMaxFreeChunks(t *testing.T) {
+	if _, ok := DefaultAllocator().(*heapAllocator); ok {
+		t.Skip("mmap isn't supported on this platform")
+	}
+	const maxFreeChunks = 10
+	a, err := NewMmapAllocatorOptions(&MmapAllocatorOptions{
+		MaxFreeChunks: maxFreeChunks,
+	})
+	if err != nil {
+		t.Fatalf("cannot create allocator: %s", err)
+	}
+	testAllocator(t, a)
+
+	var s AllocatorStats
+	a.UpdateStats(&s)
+	if s.FreeChunks != maxFreeChunks {
+		t.Fatalf("unexpected FreeChunks; got %d; want %d", s.FreeChunks, maxFreeChunks)
+	}
+
+	a.ReleaseMemory()
+	s = AllocatorStats{}
+	a.UpdateStats(&s)
+	if s.AllocatedChunks != 0 || s.FreeChunks != 0 {
+		t.Fatalf("unexpected stats after ReleaseMemory; got AllocatedChunks=%d, FreeChunks=%d; want zeros", s.AllocatedChunks, s.FreeChunks)
+	}
+}
+
+func TestMmapAllocatorIdleTimeout(t *testing.T) {
+	if _, ok := DefaultAllocator().(*heapAllocator); ok {
+		t.Skip("mmap isn't supported on this platform")
+	}
+	for _, hugePages := range []bool{false, true} {
+		opts := &MmapAllocatorOptions{
+			HugePages:   hugePages,
+			IdleTimeout: 10 * time.Millisecond,
+		}
+		t.Run(fmt.Sprintf("hugePages=%v", hugePages), func(t *testing.T) {
+			testMmapAllocatorIdleTimeout(t, opts)
+		})
+	}
+	t.Run("file", func(t *testing.T) {
+		testMmapAllocatorIdleTimeout(t, &MmapAllocatorOptions{
+			Dir:         t.TempDir(),
+			IdleTimeout: 10 * time.Millisecond,
+		})
+	})
+}
+
+func testMmapAllocatorIdleTimeout(t *testing.T, opts *MmapAllocatorOptions) {
+	a, err := NewMmapAllocatorOptions(opts)
+	if err != nil {
+		t.Fatalf("cannot create allocator: %s", err)
+	}
+	defer a.ReleaseMemory()
+
+	chunks := make([][]byte, 10)
+	for i := range chunks {
+		chunk := a.GetChunk()
+		for j := range chunk {
+			chunk[j] = byte(i)
+		}
+		chunks[i] = chunk
+	}
+	for _, chunk := range chunks {
+		a.PutChunk(chunk)
+	}
+
+	// Wait until the memory of all the free chunks is returned to the OS.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var s AllocatorStats
+		a.UpdateStats(&s)
+		if s.ReleasedChunks == s.FreeChunks {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout when waiting for releasing idle chunks; ReleasedChunks=%d, FreeChunks=%d", s.ReleasedChunks, s.FreeChunks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Released chunks must remain usable.
+	chunk := a.GetChunk()
+	for j := range chunk {
+		chunk[j] = 42
+	}
+	for j := range chunk {
+		if chunk[j] != 42 {
+			t.Fatalf("unexpected byte at position %d in the reused chunk; got %d; want 42", j, chunk[j])
+		}
+	}
+	var s AllocatorStats
+	a.UpdateStats(&s)
+	if s.ReleasedChunks != s.FreeChunks {
+		t.Fatalf("unexpected ReleasedChunks after reusing the chunk; got %d; want %d", s.ReleasedChunks, s.FreeChunks)
+	}
+	a.PutChunk(chunk)
+}
+
+func TestMmapAllocatorOptionsInvalid(t *testing.T) {
+	for _, opts := range []*MmapAllocatorOptions{
+		{MaxFreeChunks: -1},
+		{IdleTimeout: -time.Second},
+	} {
+		if _, err := NewMmapAllocatorOptions(opts); err == nil {
+			t.Fatalf("expecting non-nil error for opts=%+v", opts)
+		}
+	}
+}
+
+func TestCacheReleaseMemory(t *testing.T) {
+	a, err := NewMmapAllocatorOptions(nil)
+	if err != nil {
+		t.Fatalf("cannot create allocator: %s", err)
+	}
+	c, err := NewFromConfig(&Config{
+		MaxBytes:  1,
+		Allocator: a,
+	})
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer c.Reset()
+
+	const itemsCount = 10000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+
+	// Chunks retained by the snapshot in progress must survive Reset and ReleaseMemory.
+	fc := c.consistentSnapshot()
+	c.Reset()
+	c.ReleaseMemory()
+	var s Stats
+	c.UpdateStats(&s)
+	if s.FreeChunks != 0 {
+		t.Fatalf("unexpected FreeChunks after ReleaseMemory; got %d; want 0", s.FreeChunks)
+	}
+	if s.InUseChunks == 0 {
+		t.Fatalf("chunks retained by the snapshot must remain in use")
+	}
+	store := NewMemorySnapshotStore()
+	err = fc.save(store, 1, &SaveOptions{}, nil)
+	c.releaseSnapshot()
+	if err != nil {
+		t.Fatalf("cannot save snapshot: %s", err)
+	}
+	c1, err := LoadFromStore(context.Background(), store, nil)
+	if err != nil {
+		t.Fatalf("cannot load snapshot: %s", err)
+	}
+	defer c1.Reset()
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		vExpected := fmt.Sprintf("value %d", i)
+		if v := c1.Get(nil, k); string(v) != vExpected {
+			t.Fatalf("unexpected value in snapshot for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+
+	// All the memory must be returned after the snapshot is released.
+	c.ReleaseMemory()
+	s.Reset()
+	c.UpdateStats(&s)
+	if s.AllocatedChunks != 0 || s.InUseChunks != 0 {
+		t.Fatalf("unexpected stats after ReleaseMemory; got AllocatedChunks=%d, InUseChunks=%d; want zeros", s.AllocatedChunks, s.InUseChunks)
+	}
+
+	// The cache must remain usable.
+	c.Set([]byte("key"), []byte("value"))
+	if v := c.Get(nil, []byte("key")); string(v) != "value" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "value")
+	}
+}
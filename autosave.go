@@ -0,0 +1,238 @@
+package fastcache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultAutoSaveRetention is the default value for AutoSaveOptions.Retention.
+const defaultAutoSaveRetention = 3
+
+// autoSaveSnapshotPrefix is the prefix for snapshot dirs created by AutoSaver.
+const autoSaveSnapshotPrefix = "snapshot."
+
+// autoSaveTimestampFormat is the format for timestamps in snapshot dir names created by AutoSaver.
+//
+// Names with timestamps in this format are sorted in chronological order.
+const autoSaveTimestampFormat = "20060102T150405.000000000Z"
+
+var autoSaveSnapshotRegexp = regexp.MustCompile(`^snapshot\.\d{8}T\d{6}\.\d{9}Z$`)
+
+// AutoSaveOptions contains options for Cache.StartAutoSave.
+type AutoSaveOptions struct {
+	// SaveOptions contains options for saving snapshots.
+	SaveOptions
+
+	// Retention is the number of the newest snapshots to keep.
+	//
+	// 3 snapshots are kept by default.
+	Retention int
+
+	// OnError is called when a snapshot cannot be saved in background.
+	//
+	// Errors are ignored if OnError is nil.
+	OnError func(err error)
+}
+
+// AutoSaver periodically saves cache snapshots in background.
+//
+// Use Cache.StartAutoSave for creating AutoSaver.
+type AutoSaver struct {
+	c        *Cache
+	dir      string
+	s        SnapshotStore
+	interval time.Duration
+	opts     AutoSaveOptions
+
+	// saveMu serializes snapshots.
+	saveMu sync.Mutex
+
+	// ctx is used for periodic snapshots. It is cancelled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// StartAutoSave starts saving cache snapshots to dir every interval in background.
+//
+// Every snapshot is saved into a separate subdirectory of dir named after
+// the snapshot timestamp. Only opts.Retention newest snapshots are kept.
+// LoadFromFile* called with dir loads the newest valid snapshot from dir,
+// falling back to older snapshots if the newest snapshot is corrupted.
+//
+// opts may be nil. Call AutoSaver.Stop for stopping background saving.
+func (c *Cache) StartAutoSave(dir string, interval time.Duration, opts *AutoSaveOptions) (*AutoSaver, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive; got %s", interval)
+	}
+	var o AutoSaveOptions
+	if opts != nil {
+		o = *opts
+	}
+	if err := o.Codec.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateEncryptionKey(o.EncryptionKey, o.Codec); err != nil {
+		return nil, err
+	}
+	if o.Retention <= 0 {
+		o.Retention = defaultAutoSaveRetention
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create dir %q: %s", dir, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	as := &AutoSaver{
+		c:        c,
+		dir:      dir,
+		s:        NewFileSnapshotStore(dir),
+		interval: interval,
+		opts:     o,
+		ctx:      ctx,
+		cancel:   cancel,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go as.run()
+	return as, nil
+}
+
+func (as *AutoSaver) run() {
+	defer close(as.doneCh)
+
+	t := time.NewTicker(as.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-as.stopCh:
+			return
+		case <-t.C:
+			if err := as.save(as.ctx); err != nil && as.opts.OnError != nil {
+				as.opts.OnError(err)
+			}
+		}
+	}
+}
+
+// Stop stops background saving and saves the final snapshot.
+//
+// Stop waits until the currently running snapshot is finished before saving
+// the final snapshot. If ctx is done before that, then the running snapshot
+// is cancelled, the final snapshot isn't saved and Stop returns ctx.Err().
+// If ctx is done while saving the final snapshot, then it is cancelled
+// and Stop returns ctx.Err(). Previously saved snapshots remain untouched
+// in these cases.
+//
+// The cache isn't accessed by the AutoSaver after Stop returns,
+// so the cache may be closed or reset after that.
+//
+// Subsequent calls to Stop return nil without saving snapshots.
+func (as *AutoSaver) Stop(ctx context.Context) error {
+	stopped := false
+	as.stopOnce.Do(func() {
+		close(as.stopCh)
+		stopped = true
+	})
+	if !stopped {
+		return nil
+	}
+
+	select {
+	case <-as.doneCh:
+		as.cancel()
+	case <-ctx.Done():
+		// Cancel the running snapshot and wait until the background goroutine exits,
+		// so it doesn't access the cache after Stop returns.
+		as.cancel()
+		<-as.doneCh
+		return ctx.Err()
+	}
+	if err := as.save(ctx); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return nil
+}
+
+// save saves a new snapshot and removes snapshots exceeding the retention.
+//
+// The snapshot is cancelled when ctx is done.
+func (as *AutoSaver) save(ctx context.Context) error {
+	as.saveMu.Lock()
+	defer as.saveMu.Unlock()
+
+	name := autoSaveSnapshotPrefix + time.Now().UTC().Format(autoSaveTimestampFormat)
+	snapshotPath := filepath.Join(as.dir, name)
+	if err := as.c.SaveToFileContext(ctx, snapshotPath, &as.opts.SaveOptions); err != nil {
+		// Remove the incomplete snapshot, so it isn't picked up by loaders.
+		_ = removeObjects(as.s, name)
+		return fmt.Errorf("cannot save snapshot to %q: %w", snapshotPath, err)
+	}
+	names, err := readAutoSaveSnapshotNames(as.s)
+	if err != nil {
+		return fmt.Errorf("cannot read snapshots at %q: %w", as.dir, err)
+	}
+	for len(names) > as.opts.Retention {
+		if err := removeObjects(as.s, names[0]); err != nil {
+			return fmt.Errorf("cannot remove outdated snapshot: %s", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// readAutoSaveSnapshotNames returns names of snapshots created by AutoSaver in s
+// sorted from the oldest to the newest.
+func readAutoSaveSnapshotNames(s SnapshotStore) ([]string, error) {
+	objectNames, err := s.List(autoSaveSnapshotPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, objectName := range objectNames {
+		name, _, ok := strings.Cut(objectName, "/")
+		if !ok || !autoSaveSnapshotRegexp.MatchString(name) {
+			continue
+		}
+		// Object names are sorted, so objects for the same snapshot are adjacent.
+		if len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// snapshotCandidates returns stores with snapshots, which may be loaded from s, ordered by preference.
+//
+// s is returned as is if it doesn't contain snapshots created by AutoSaver.
+func snapshotCandidates(s SnapshotStore) []SnapshotStore {
+	if isSnapshotDir(s) {
+		return []SnapshotStore{s}
+	}
+	names, err := readAutoSaveSnapshotNames(s)
+	if err != nil || len(names) == 0 {
+		return []SnapshotStore{s}
+	}
+	candidates := make([]SnapshotStore, 0, len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		candidates = append(candidates, subStore(s, names[i]))
+	}
+	return candidates
+}
+
+// isSnapshotDir returns true if s contains a snapshot saved by SaveToFile*.
+func isSnapshotDir(s SnapshotStore) bool {
+	return objectExists(s, currentSnapshotFilename) || objectExists(s, metadataFilename)
+}
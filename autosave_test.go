@@ -0,0 +1,227 @@
+package fastcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAutoSave(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "autosave")
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+
+	errCh := make(chan error, 10)
+	opts := &AutoSaveOptions{
+		Retention: 2,
+		OnError: func(err error) {
+			select {
+			case errCh <- err:
+			default:
+			}
+		},
+	}
+	as, err := c.StartAutoSave(dir, 10*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("StartAutoSave error: %s", err)
+	}
+
+	const itemsCount = 1000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+		if i%100 == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if err := as.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error: %s", err)
+	}
+	if err := as.Stop(context.Background()); err != nil {
+		t.Fatalf("unexpected error on the second Stop call: %s", err)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("unexpected background error: %s", err)
+	default:
+	}
+
+	names, err := readAutoSaveSnapshotNames(NewFileSnapshotStore(dir))
+	if err != nil {
+		t.Fatalf("cannot read snapshot names: %s", err)
+	}
+	if len(names) == 0 || len(names) > opts.Retention {
+		t.Fatalf("unexpected number of snapshots; got %d; want from 1 to %d", len(names), opts.Retention)
+	}
+
+	// The final snapshot must contain all the entries.
+	c1, err := LoadFromFile(dir)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c1.Reset()
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		vExpected := fmt.Sprintf("value %d", i)
+		v := c1.Get(nil, k)
+		if string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+}
+
+func TestAutoSaveRetention(t *testing.T) {
+	dir := t.TempDir()
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+
+	opts := &AutoSaveOptions{
+		Retention: 3,
+	}
+	as, err := c.StartAutoSave(dir, time.Hour, opts)
+	if err != nil {
+		t.Fatalf("StartAutoSave error: %s", err)
+	}
+	var allNames []string
+	for i := range 5 {
+		c.Set([]byte("key"), []byte(fmt.Sprintf("value %d", i)))
+		if err := as.save(context.Background()); err != nil {
+			t.Fatalf("cannot save snapshot #%d: %s", i, err)
+		}
+		names, err := readAutoSaveSnapshotNames(NewFileSnapshotStore(dir))
+		if err != nil {
+			t.Fatalf("cannot read snapshot names: %s", err)
+		}
+		allNames = append(allNames, names[len(names)-1])
+	}
+	names, err := readAutoSaveSnapshotNames(NewFileSnapshotStore(dir))
+	if err != nil {
+		t.Fatalf("cannot read snapshot names: %s", err)
+	}
+	namesExpected := allNames[len(allNames)-opts.Retention:]
+	if fmt.Sprint(names) != fmt.Sprint(namesExpected) {
+		t.Fatalf("unexpected snapshots left after retention; got %q; want %q", names, namesExpected)
+	}
+
+	// Corrupt the newest snapshot. The previous snapshot must be loaded instead.
+	newestPath := mustResolveSnapshotDir(t, filepath.Join(dir, names[len(names)-1]))
+	if err := os.WriteFile(newestPath+"/data.0.bin", []byte("corrupted"), 0644); err != nil {
+		t.Fatalf("cannot corrupt the newest snapshot: %s", err)
+	}
+	c1, err := LoadFromFile(dir)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	v := c1.Get(nil, []byte("key"))
+	c1.Reset()
+	if string(v) != "value 3" {
+		t.Fatalf("unexpected value loaded from the previous snapshot; got %q; want %q", v, "value 3")
+	}
+
+	// Corrupt all the snapshots. LoadFromFile must fail.
+	for _, name := range names {
+		snapshotPath := mustResolveSnapshotDir(t, filepath.Join(dir, name))
+		if err := os.Remove(snapshotPath + "/metadata.bin"); err != nil {
+			t.Fatalf("cannot remove metadata: %s", err)
+		}
+	}
+	if _, err := LoadFromFile(dir); err == nil {
+		t.Fatalf("expecting non-nil error when all the snapshots are corrupted")
+	}
+
+	// Stop must save a valid snapshot, which can be loaded.
+	c.Set([]byte("key"), []byte("final value"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := as.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %s", err)
+	}
+	c2, err := LoadFromFile(dir)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c2.Reset()
+	if v := c2.Get(nil, []byte("key")); string(v) != "final value" {
+		t.Fatalf("unexpected value loaded from the final snapshot; got %q; want %q", v, "final value")
+	}
+}
+
+func TestAutoSaveStopCancelsRunningSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+	v := make([]byte, 1000)
+	for i := range 10000 {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), v)
+	}
+
+	started := make(chan struct{})
+	var startOnce sync.Once
+	errCh := make(chan error, 10)
+	opts := &AutoSaveOptions{
+		SaveOptions: SaveOptions{
+			// Make the periodic snapshot slow, so it is still running when Stop is called.
+			MaxBytesPerSecond: 64 * 1024,
+			Progress: func(p Progress) {
+				startOnce.Do(func() {
+					close(started)
+				})
+			},
+		},
+		OnError: func(err error) {
+			errCh <- err
+		},
+	}
+	as, err := c.StartAutoSave(dir, time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("StartAutoSave error: %s", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout when waiting for the periodic snapshot")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := as.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	// The background goroutine must be stopped when Stop returns.
+	select {
+	case <-as.doneCh:
+	default:
+		t.Fatalf("the background goroutine is still running after Stop")
+	}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected error for the cancelled snapshot; got %v; want %v", err, context.Canceled)
+		}
+	default:
+		t.Fatalf("expecting the running snapshot to be cancelled")
+	}
+}
+
+func TestAutoSaveInvalidOptions(t *testing.T) {
+	c := New(1024)
+	defer c.Reset()
+
+	dir := t.TempDir()
+	if _, err := c.StartAutoSave(dir, 0, nil); err == nil {
+		t.Fatalf("expecting non-nil error for zero interval")
+	}
+	opts := &AutoSaveOptions{
+		SaveOptions: SaveOptions{
+			Codec: Codec(1234),
+		},
+	}
+	if _, err := c.StartAutoSave(dir, time.Second, opts); err == nil {
+		t.Fatalf("expecting non-nil error for invalid codec")
+	}
+}
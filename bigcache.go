@@ -42,6 +42,14 @@ func (c *Cache) SetBig(k, v []byte) {
 	valueLen := len(v)
 	valueHash := xxhash.Sum64(v)
 
+	// The whole (k, v) is recorded in the write-ahead log together with the metavalue,
+	// so the subvalues are set without logging.
+	var walRec *bytesBuf
+	if c.wal != nil {
+		walRec = getWALBuf()
+		walRec.B = appendWALRecord(walRec.B[:0], walOpSetBig, k, v)
+	}
+
 	// Split v into chunks with up to 64Kb each.
 	subkey := getSubkeyBuf()
 	var i uint64
@@ -55,13 +63,18 @@ func (c *Cache) SetBig(k, v []byte) {
 		}
 		subvalue := v[:subvalueLen]
 		v = v[subvalueLen:]
-		c.Set(subkey.B, subvalue)
+		c.set(subkey.B, subvalue, nil)
 	}
 
 	// Write metavalue, which consists of valueHash and valueLen.
 	subkey.B = marshalUint64(subkey.B[:0], valueHash)
 	subkey.B = marshalUint64(subkey.B, uint64(valueLen))
-	c.Set(k, subkey.B)
+	if walRec == nil {
+		c.set(k, subkey.B, nil)
+	} else {
+		c.set(k, subkey.B, walRec.B)
+		putWALBuf(walRec)
+	}
 	putSubkeyBuf(subkey)
 }
 
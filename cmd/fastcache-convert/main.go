@@ -0,0 +1,94 @@
+// fastcache-convert rewrites a snapshot saved by fastcache.Cache.SaveToFile* into a new snapshot.
+//
+// Usage:
+//
+//	fastcache-convert -src=/path/to/snapshot -dst=/path/to/new/snapshot [-maxBytes=...] [-codec=...] [-files=...] [-skipPrefix=...]
+//
+// The command may change the capacity, the codec and the number of data files
+// of the snapshot, and drop entries with the given key prefixes.
+// It works offline with bounded memory usage, so it may convert snapshots
+// bigger than the available RAM.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/VictoriaMetrics/fastcache"
+)
+
+var (
+	srcPath  = flag.String("src", "", "Path to the source snapshot saved by fastcache.Cache.SaveToFile*")
+	dstPath  = flag.String("dst", "", "Path to the converted snapshot. It is replaced atomically")
+	maxBytes = flag.Int("maxBytes", 0, "Capacity of the converted snapshot in bytes. The capacity of the source snapshot is kept if zero")
+	codec    = flag.String("codec", "snappy", "Codec for data files of the converted snapshot. Supported codecs: snappy, none, flate, mmap")
+	files    = flag.Int("files", 0, "The number of data files in the converted snapshot. The number of data files in the source snapshot is kept if zero")
+)
+
+var skipPrefixes prefixesFlag
+
+func init() {
+	flag.Var(&skipPrefixes, "skipPrefix", "Drop entries with the given key prefix. May be set multiple times or contain comma-separated prefixes")
+}
+
+func main() {
+	flag.Parse()
+	if *srcPath == "" {
+		log.Fatalf("missing -src flag")
+	}
+	if *dstPath == "" {
+		log.Fatalf("missing -dst flag")
+	}
+	c, err := parseCodec(*codec)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	opts := &fastcache.ConvertOptions{
+		MaxBytes:     *maxBytes,
+		Codec:        c,
+		Files:        *files,
+		SkipPrefixes: skipPrefixes,
+	}
+	cs, err := fastcache.ConvertSnapshot(*srcPath, *dstPath, opts)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	fmt.Printf("buckets: %d\n", cs.Buckets)
+	fmt.Printf("entries: %d\n", cs.Entries)
+	fmt.Printf("skippedEntries: %d\n", cs.SkippedEntries)
+	fmt.Printf("droppedEntries: %d\n", cs.DroppedEntries)
+	fmt.Printf("invalidEntries: %d\n", cs.InvalidEntries)
+}
+
+func parseCodec(s string) (fastcache.Codec, error) {
+	for _, c := range []fastcache.Codec{fastcache.CodecSnappy, fastcache.CodecNone, fastcache.CodecFlate, fastcache.CodecMmap} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported -codec=%q; supported values: snappy, none, flate, mmap", s)
+}
+
+// prefixesFlag is a flag, which may be set multiple times.
+type prefixesFlag [][]byte
+
+func (pf *prefixesFlag) String() string {
+	a := make([]string, len(*pf))
+	for i, prefix := range *pf {
+		a[i] = string(prefix)
+	}
+	return strings.Join(a, ",")
+}
+
+func (pf *prefixesFlag) Set(s string) error {
+	for _, prefix := range strings.Split(s, ",") {
+		if prefix == "" {
+			return fmt.Errorf("empty prefix isn't allowed")
+		}
+		*pf = append(*pf, []byte(prefix))
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// fastcache-inspect prints the contents of a snapshot saved by fastcache.Cache.SaveToFile*.
+//
+// Usage:
+//
+//	fastcache-inspect -snapshot=/path/to/snapshot [-buckets] [-dump=hex|json] [-key=... | -keyHex=...]
+//		[-encryptionKeyID=... -encryptionKeyFile=...]
+//
+// The command prints the snapshot geometry, the totals over all the buckets
+// and the results of integrity verification. It exits with non-zero code
+// if the snapshot is corrupted.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/VictoriaMetrics/fastcache"
+)
+
+var (
+	snapshotPath = flag.String("snapshot", "", "Path to the snapshot saved by fastcache.Cache.SaveToFile*")
+	showBuckets  = flag.Bool("buckets", false, "Whether to print per-bucket entries and fill")
+	dumpFormat   = flag.String("dump", "", "Dump all the entries in the given format. Supported formats: hex, json. "+
+		"The hex format prints 'bucket key value' lines with hex-encoded keys and values. "+
+		"The json format prints JSON lines with base64-encoded keys and values")
+	key    = flag.String("key", "", "Look up the given key in the snapshot. Values stored with SetBig are looked up too")
+	keyHex = flag.String("keyHex", "", "Look up the given hex-encoded key in the snapshot. Values stored with SetBig are looked up too")
+
+	encryptionKeyID   = flag.String("encryptionKeyID", "", "ID of the key for decrypting the snapshot saved with fastcache.SaveOptions.EncryptionKey")
+	encryptionKeyFile = flag.String("encryptionKeyFile", "", "Path to the file with the raw AES key for -encryptionKeyID")
+)
+
+func main() {
+	flag.Parse()
+	if *snapshotPath == "" {
+		log.Fatalf("missing -snapshot flag")
+	}
+	switch *dumpFormat {
+	case "", "hex", "json":
+	default:
+		log.Fatalf("unsupported -dump=%q; supported values: hex, json", *dumpFormat)
+	}
+
+	var keys []*fastcache.EncryptionKey
+	if *encryptionKeyFile != "" {
+		if *encryptionKeyID == "" {
+			log.Fatalf("missing -encryptionKeyID flag for -encryptionKeyFile")
+		}
+		k, err := os.ReadFile(*encryptionKeyFile)
+		if err != nil {
+			log.Fatalf("cannot read -encryptionKeyFile: %s", err)
+		}
+		keys = append(keys, &fastcache.EncryptionKey{
+			ID:  *encryptionKeyID,
+			Key: k,
+		})
+	}
+
+	si, err := fastcache.InspectSnapshot(*snapshotPath, keys)
+	if err != nil {
+		log.Fatalf("cannot inspect snapshot: %s", err)
+	}
+	defer si.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	ok, err := inspect(bw, si)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Fatalf("cannot write output: %s", err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// inspect writes the information about si to w.
+//
+// It returns false if the snapshot is corrupted.
+func inspect(w io.Writer, si *fastcache.SnapshotInspector) (bool, error) {
+	switch {
+	case *key != "":
+		return true, lookupKey(w, si, []byte(*key))
+	case *keyHex != "":
+		k, err := hex.DecodeString(*keyHex)
+		if err != nil {
+			return false, fmt.Errorf("cannot decode -keyHex: %w", err)
+		}
+		return true, lookupKey(w, si, k)
+	case *dumpFormat != "":
+		return true, dumpEntries(w, si, *dumpFormat)
+	}
+
+	writeGeometry(w, si.Geometry())
+	bis := si.Buckets()
+	writeTotals(w, bis)
+	if *showBuckets {
+		fmt.Fprintf(w, "\nbucket\tentries\tchunks\tidx\tgen\tfill\n")
+		for _, bi := range bis {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%.2f%%\n", bi.Num, bi.Entries, bi.Chunks, bi.Idx, bi.Gen, fillPercent(bi.UsedBytes, bi.MaxBytes))
+		}
+	}
+	// Write errors are returned by the caller when flushing w.
+	return writeReport(w, si.Report()), nil
+}
+
+func writeGeometry(w io.Writer, g *fastcache.SnapshotGeometry) {
+	fmt.Fprintf(w, "version: %d\n", g.Version)
+	fmt.Fprintf(w, "codec: %s\n", g.Codec)
+	fmt.Fprintf(w, "buckets: %d\n", g.BucketsCount)
+	fmt.Fprintf(w, "chunkSize: %d\n", g.ChunkSize)
+	fmt.Fprintf(w, "maxBucketChunks: %d\n", g.MaxBucketChunks)
+	fmt.Fprintf(w, "maxBytes: %d\n", g.MaxBytes)
+	if len(g.Files) == 0 {
+		fmt.Fprintf(w, "files: legacy snapshot without manifest\n")
+		return
+	}
+	fmt.Fprintf(w, "files:\n")
+	for _, f := range g.Files {
+		fmt.Fprintf(w, "  %s: %d bytes, %d buckets\n", f.Name, f.Size, f.Buckets)
+	}
+}
+
+func writeTotals(w io.Writer, bis []fastcache.BucketInfo) {
+	var entries int
+	var usedBytes, maxBytes uint64
+	for _, bi := range bis {
+		entries += bi.Entries
+		usedBytes += bi.UsedBytes
+		maxBytes += bi.MaxBytes
+	}
+	fmt.Fprintf(w, "entries: %d\n", entries)
+	fmt.Fprintf(w, "usedBytes: %d\n", usedBytes)
+	fmt.Fprintf(w, "fill: %.2f%%\n", fillPercent(usedBytes, maxBytes))
+}
+
+// writeReport writes the integrity report to w.
+//
+// It returns false if the report contains integrity issues.
+func writeReport(w io.Writer, report *fastcache.LoadReport) bool {
+	fmt.Fprintf(w, "\nintegrity:\n")
+	fmt.Fprintf(w, "  bucketsRestored: %d\n", report.BucketsRestored)
+	fmt.Fprintf(w, "  bucketsReset: %d\n", report.BucketsReset)
+	fmt.Fprintf(w, "  invalidEntries: %d\n", report.InvalidEntries)
+	for _, ff := range report.FailedFiles {
+		fmt.Fprintf(w, "  failed file %s: %s\n", ff.Name, ff.Err)
+	}
+	ok := report.BucketsReset == 0 && report.InvalidEntries == 0 && len(report.FailedFiles) == 0
+	if ok {
+		fmt.Fprintf(w, "  status: ok\n")
+	} else {
+		fmt.Fprintf(w, "  status: corrupted\n")
+	}
+	return ok
+}
+
+func lookupKey(w io.Writer, si *fastcache.SnapshotInspector, k []byte) error {
+	v, ok := si.Get(k)
+	if ok && len(v) == 16 {
+		// The value may be the metavalue for the value stored with SetBig.
+		if bv, ok := si.GetBig(k); ok {
+			v = bv
+		}
+	}
+	if !ok {
+		_, err := fmt.Fprintf(w, "key %q is missing\n", k)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "value for key %q: %q\nhex: %x\n", k, v, v)
+	return err
+}
+
+// jsonEntry is an entry printed by -dump=json.
+type jsonEntry struct {
+	Bucket int    `json:"bucket"`
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value"`
+}
+
+func dumpEntries(w io.Writer, si *fastcache.SnapshotInspector, format string) error {
+	if format == "hex" {
+		return si.VisitEntries(func(bucketNum int, k, v []byte) error {
+			_, err := fmt.Fprintf(w, "%d %x %x\n", bucketNum, k, v)
+			return err
+		})
+	}
+	je := json.NewEncoder(w)
+	return si.VisitEntries(func(bucketNum int, k, v []byte) error {
+		return je.Encode(&jsonEntry{
+			Bucket: bucketNum,
+			Key:    k,
+			Value:  v,
+		})
+	})
+}
+
+func fillPercent(used, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(used) / float64(total)
+}
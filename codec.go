@@ -0,0 +1,110 @@
+package fastcache
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// Codec is a compression codec for snapshot data files.
+//
+// The codec is recorded in the snapshot metadata, so LoadFromFile* automatically
+// selects the right decompressor.
+type Codec uint64
+
+const (
+	// CodecSnappy compresses data files with snappy.
+	//
+	// This is the default codec, which provides a good balance between speed and compression ratio.
+	CodecSnappy Codec = 0
+
+	// CodecNone stores data files without compression.
+	//
+	// This is the fastest codec for snapshots stored on local fast disks.
+	CodecNone Codec = 1
+
+	// CodecFlate compresses data files with compress/flate from the standard library.
+	//
+	// It provides better compression ratio than CodecSnappy at the cost of higher CPU usage,
+	// so it is suitable for cold backups.
+	CodecFlate Codec = 2
+
+	// CodecMmap stores data files without compression, with bucket chunks aligned to chunk size.
+	//
+	// Such snapshots may be mapped directly into memory by LoadFromFileMmap,
+	// so the cache may serve reads immediately after opening the snapshot.
+	// They may be loaded with LoadFromFile* as well.
+	CodecMmap Codec = 3
+)
+
+// String returns human-readable codec name.
+func (codec Codec) String() string {
+	switch codec {
+	case CodecSnappy:
+		return "snappy"
+	case CodecNone:
+		return "none"
+	case CodecFlate:
+		return "flate"
+	case CodecMmap:
+		return "mmap"
+	default:
+		return fmt.Sprintf("Codec(%d)", uint64(codec))
+	}
+}
+
+func (codec Codec) validate() error {
+	switch codec {
+	case CodecSnappy, CodecNone, CodecFlate, CodecMmap:
+		return nil
+	default:
+		return fmt.Errorf("unsupported codec %s", codec)
+	}
+}
+
+// newCodecWriter returns a writer, which compresses data with the given codec before writing it to w.
+//
+// The returned writer must be closed in order to flush the buffered data to w.
+func newCodecWriter(codec Codec, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CodecSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	case CodecNone:
+		return &bufferedWriteCloser{
+			Writer: bufio.NewWriterSize(w, 64*1024),
+		}, nil
+	case CodecFlate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	case CodecMmap:
+		return nil, fmt.Errorf("codec %s cannot be used for streams", codec)
+	default:
+		return nil, codec.validate()
+	}
+}
+
+// newCodecReader returns a reader, which decompresses data read from r with the given codec.
+func newCodecReader(codec Codec, r io.Reader) (io.Reader, error) {
+	switch codec {
+	case CodecSnappy:
+		return snappy.NewReader(r), nil
+	case CodecNone:
+		return bufio.NewReaderSize(r, 64*1024), nil
+	case CodecFlate:
+		return flate.NewReader(r), nil
+	case CodecMmap:
+		return nil, fmt.Errorf("codec %s cannot be used for streams", codec)
+	default:
+		return nil, codec.validate()
+	}
+}
+
+type bufferedWriteCloser struct {
+	*bufio.Writer
+}
+
+func (bwc *bufferedWriteCloser) Close() error {
+	return bwc.Flush()
+}
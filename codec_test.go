@@ -0,0 +1,128 @@
+package fastcache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCodecWriterReader(t *testing.T) {
+	data := bytes.Repeat([]byte("foobar baz "), 100000)
+	for _, codec := range []Codec{CodecSnappy, CodecNone, CodecFlate} {
+		var bb bytes.Buffer
+		zw, err := newCodecWriter(codec, &bb)
+		if err != nil {
+			t.Fatalf("cannot create %s writer: %s", codec, err)
+		}
+		if _, err := zw.Write(data); err != nil {
+			t.Fatalf("cannot write data with %s: %s", codec, err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close %s writer: %s", codec, err)
+		}
+		if codec == CodecNone && bb.Len() != len(data) {
+			t.Fatalf("unexpected data length for %s; got %d; want %d", codec, bb.Len(), len(data))
+		}
+		if codec != CodecNone && bb.Len() >= len(data) {
+			t.Fatalf("data isn't compressed by %s; compressed length: %d; original length: %d", codec, bb.Len(), len(data))
+		}
+		zr, err := newCodecReader(codec, &bb)
+		if err != nil {
+			t.Fatalf("cannot create %s reader: %s", codec, err)
+		}
+		result, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("cannot read data with %s: %s", codec, err)
+		}
+		if !bytes.Equal(result, data) {
+			t.Fatalf("unexpected data read with %s", codec)
+		}
+	}
+
+	invalidCodec := Codec(100)
+	if _, err := newCodecWriter(invalidCodec, io.Discard); err == nil {
+		t.Fatalf("expecting non-nil error for invalid codec writer")
+	}
+	if _, err := newCodecReader(invalidCodec, bytes.NewReader(nil)); err == nil {
+		t.Fatalf("expecting non-nil error for invalid codec reader")
+	}
+}
+
+func TestSaveLoadFileCodec(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+	const itemsCount = 10000
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		c.Set(k, v)
+	}
+
+	for _, codec := range []Codec{CodecSnappy, CodecNone, CodecFlate} {
+		filePath := filepath.Join(tmpDir, codec.String())
+		opts := &SaveOptions{
+			Codec: codec,
+		}
+		if err := c.SaveToFileOptions(filePath, opts); err != nil {
+			t.Fatalf("SaveToFileOptions error for %s: %s", codec, err)
+		}
+		sh, err := loadMetadata(NewFileSnapshotStore(mustResolveSnapshotDir(t, filePath)))
+		if err != nil {
+			t.Fatalf("cannot load metadata for %s: %s", codec, err)
+		}
+		if sh.codec != codec {
+			t.Fatalf("unexpected codec in metadata; got %s; want %s", sh.codec, codec)
+		}
+
+		c1, err := LoadFromFile(filePath)
+		if err != nil {
+			t.Fatalf("LoadFromFile error for %s: %s", codec, err)
+		}
+		for i := range itemsCount {
+			k := []byte(fmt.Sprintf("key %d", i))
+			v := []byte(fmt.Sprintf("value %d", i))
+			if vv := c1.Get(nil, k); string(vv) != string(v) {
+				t.Fatalf("unexpected value for key %q with %s; got %q; want %q", k, codec, vv, v)
+			}
+		}
+		c1.Reset()
+	}
+
+	// Uncompressed snapshot must be bigger than compressed snapshots.
+	sizeNone := dirSize(t, mustResolveSnapshotDir(t, filepath.Join(tmpDir, CodecNone.String())))
+	for _, codec := range []Codec{CodecSnappy, CodecFlate} {
+		if size := dirSize(t, mustResolveSnapshotDir(t, filepath.Join(tmpDir, codec.String()))); size >= sizeNone {
+			t.Fatalf("unexpected snapshot size for %s; got %d bytes; want less than %d bytes", codec, size, sizeNone)
+		}
+	}
+
+	// Invalid codec must be rejected.
+	opts := &SaveOptions{
+		Codec: Codec(100),
+	}
+	if err := c.SaveToFileOptions(filepath.Join(tmpDir, "invalid"), opts); err == nil {
+		t.Fatalf("expecting non-nil error for invalid codec")
+	}
+}
+
+func dirSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", dir, err)
+	}
+	var n int64
+	for _, de := range des {
+		fi, err := de.Info()
+		if err != nil {
+			t.Fatalf("cannot stat %q: %s", de.Name(), err)
+		}
+		n += fi.Size()
+	}
+	return n
+}
@@ -0,0 +1,123 @@
+package fastcache
+
+import (
+	"maps"
+)
+
+// bucketSnapshot holds the state of a bucket at the moment of the consistent snapshot.
+//
+// The state is captured lazily - either by the first modification of the bucket
+// after the snapshot is started or by the snapshot itself. Chunks are shared
+// between the bucket and the captured state until they are modified by the bucket.
+type bucketSnapshot struct {
+	// frozen is the captured state of the bucket.
+	frozen *bucket
+
+	// captured is set after the bucket state is captured into frozen.
+	captured bool
+
+	// shared contains flags for chunks shared between the bucket and frozen.
+	shared []bool
+
+	// owned contains flags for frozen chunks, which are no longer referenced by the bucket.
+	owned []bool
+}
+
+// consistentSnapshot returns the point-in-time copy of c.
+//
+// The returned copy must be used only for saving, and it must be released
+// with releaseSnapshot after that. c may be modified while the copy is in use.
+func (c *Cache) consistentSnapshot() *Cache {
+	c.snapshotMu.Lock()
+
+	var fc Cache
+	// Lock all the buckets in order to start the snapshot at the same moment for all of them.
+	// The lock is held only for marking the buckets, so concurrent operations aren't blocked for long.
+	for i := range c.buckets[:] {
+		c.buckets[i].mu.Lock()
+	}
+	for i := range c.buckets[:] {
+		fc.buckets[i].alloc = c.buckets[i].alloc
+		c.buckets[i].snap = &bucketSnapshot{
+			frozen: &fc.buckets[i],
+		}
+	}
+	for i := range c.buckets[:] {
+		c.buckets[i].mu.Unlock()
+	}
+
+	// Capture the state of buckets, which weren't modified since the snapshot start.
+	for i := range c.buckets[:] {
+		b := &c.buckets[i]
+		b.mu.Lock()
+		b.snap.captureLocked(b)
+		b.mu.Unlock()
+	}
+	return &fc
+}
+
+// releaseSnapshot releases the copy of c obtained via consistentSnapshot.
+func (c *Cache) releaseSnapshot() {
+	for i := range c.buckets[:] {
+		b := &c.buckets[i]
+		b.mu.Lock()
+		s := b.snap
+		for chunkIdx, owned := range s.owned {
+			if owned {
+				b.putChunk(s.frozen.chunks[chunkIdx])
+			}
+		}
+		b.snap = nil
+		b.mu.Unlock()
+	}
+	c.snapshotMu.Unlock()
+}
+
+// captureLocked captures the state of b into s.frozen if it isn't captured yet.
+//
+// It must be called before the modification of b.
+func (s *bucketSnapshot) captureLocked(b *bucket) {
+	if s.captured {
+		return
+	}
+	f := s.frozen
+	f.m = maps.Clone(b.m)
+	f.chunks = make([][]byte, len(b.chunks))
+	copy(f.chunks, b.chunks)
+	f.idx = b.idx
+	f.gen = b.gen
+	s.shared = make([]bool, len(b.chunks))
+	for i, chunk := range b.chunks {
+		s.shared[i] = chunk != nil
+	}
+	s.owned = make([]bool, len(b.chunks))
+	s.captured = true
+}
+
+// copyChunkLocked replaces the chunk shared with s.frozen in b with its copy.
+//
+// It must be called before writing to b.chunks[chunkIdx].
+func (s *bucketSnapshot) copyChunkLocked(b *bucket, chunkIdx uint64) {
+	if !s.shared[chunkIdx] {
+		return
+	}
+	chunk := b.chunks[chunkIdx]
+	chunkCopy := b.getChunk()
+	// Copy the whole chunk, since entries from the previous generation may be located beyond len(chunk).
+	copy(chunkCopy, chunk[:cap(chunk)])
+	b.chunks[chunkIdx] = chunkCopy[:len(chunk)]
+	s.shared[chunkIdx] = false
+	s.owned[chunkIdx] = true
+}
+
+// releaseChunkLocked marks the chunk at chunkIdx as released by b.
+//
+// It returns false if the chunk is shared with s.frozen, so it mustn't be returned to the pool by b.
+func (s *bucketSnapshot) releaseChunkLocked(chunkIdx int) bool {
+	if !s.shared[chunkIdx] {
+		return true
+	}
+	s.shared[chunkIdx] = false
+	s.owned[chunkIdx] = true
+	return false
+}
@@ -0,0 +1,184 @@
+package fastcache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSaveToFileConsistent(t *testing.T) {
+	tmpDir := t.TempDir()
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+
+	// Every round writes the round number to all the keys in the same order.
+	// A consistent snapshot must contain keys with non-increasing round numbers,
+	// which differ by no more than one.
+	const keysCount = 1000
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 1; ; round++ {
+			v := []byte(strconv.Itoa(round))
+			for j := range keysCount {
+				c.Set([]byte(fmt.Sprintf("key %d", j)), v)
+			}
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+		}
+	}()
+
+	opts := &SaveOptions{
+		Consistent: true,
+	}
+	for i := range 10 {
+		filePath := filepath.Join(tmpDir, fmt.Sprintf("snapshot.%d", i))
+		if err := c.SaveToFileOptions(filePath, opts); err != nil {
+			t.Fatalf("SaveToFileOptions error: %s", err)
+		}
+		c1, err := LoadFromFile(filePath)
+		if err != nil {
+			t.Fatalf("LoadFromFile error: %s", err)
+		}
+		prevRound := -1
+		firstRound := -1
+		for j := range keysCount {
+			v := c1.Get(nil, []byte(fmt.Sprintf("key %d", j)))
+			round := 0
+			if len(v) > 0 {
+				round, err = strconv.Atoi(string(v))
+				if err != nil {
+					t.Fatalf("unexpected value for key %d: %q", j, v)
+				}
+			}
+			if j == 0 {
+				firstRound = round
+			} else if round > prevRound || firstRound-round > 1 {
+				t.Fatalf("inconsistent snapshot #%d: key %d has round %d, while the previous key has round %d and the first key has round %d",
+					i, j, round, prevRound, firstRound)
+			}
+			prevRound = round
+		}
+		c1.Reset()
+	}
+	close(stopCh)
+	wg.Wait()
+
+	// The cache must contain the last written values after the snapshots.
+	v0 := c.Get(nil, []byte("key 0"))
+	for j := range keysCount {
+		k := []byte(fmt.Sprintf("key %d", j))
+		if v := c.Get(nil, k); string(v) != string(v0) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, v0)
+		}
+	}
+}
+
+func TestSaveToFileConsistentBig(t *testing.T) {
+	tmpDir := t.TempDir()
+	c := New(bucketsCount * chunkSize * 4)
+	defer c.Reset()
+
+	// Values stored with SetBig must be saved intact.
+	bigValue := func(round int) []byte {
+		return bytes.Repeat([]byte(strconv.Itoa(round%10)), 3*chunkSize)
+	}
+	c.SetBig([]byte("big key"), bigValue(0))
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 1; ; round++ {
+			c.SetBig([]byte("big key"), bigValue(round))
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+		}
+	}()
+
+	opts := &SaveOptions{
+		Consistent: true,
+	}
+	for i := range 10 {
+		filePath := filepath.Join(tmpDir, fmt.Sprintf("snapshot.%d", i))
+		if err := c.SaveToFileOptions(filePath, opts); err != nil {
+			t.Fatalf("SaveToFileOptions error: %s", err)
+		}
+		c1, err := LoadFromFile(filePath)
+		if err != nil {
+			t.Fatalf("LoadFromFile error: %s", err)
+		}
+		v := c1.GetBig(nil, []byte("big key"))
+		c1.Reset()
+		if len(v) != 3*chunkSize || !bytes.Equal(v, bytes.Repeat(v[:1], len(v))) {
+			t.Fatalf("unexpected big value in snapshot #%d; got %d bytes", i, len(v))
+		}
+	}
+	close(stopCh)
+	wg.Wait()
+}
+
+func TestSaveToFileConsistentReset(t *testing.T) {
+	tmpDir := t.TempDir()
+	c := New(1)
+	defer c.Reset()
+
+	const itemsCount = 1000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+
+	// Reset the cache after the snapshot is started. The snapshot must contain all the entries.
+	fc := c.consistentSnapshot()
+	c.Reset()
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("new key %d", i)), []byte(fmt.Sprintf("new value %d", i)))
+	}
+	filePath := filepath.Join(tmpDir, "snapshot")
+	if err := os.MkdirAll(filePath, 0755); err != nil {
+		t.Fatalf("cannot create dir: %s", err)
+	}
+	err := fc.save(NewFileSnapshotStore(filePath), 1, &SaveOptions{}, nil)
+	c.releaseSnapshot()
+	if err != nil {
+		t.Fatalf("cannot save snapshot: %s", err)
+	}
+
+	c1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c1.Reset()
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		vExpected := fmt.Sprintf("value %d", i)
+		if v := c1.Get(nil, k); string(v) != vExpected {
+			t.Fatalf("unexpected value in snapshot for key %q; got %q; want %q", k, v, vExpected)
+		}
+		k = []byte(fmt.Sprintf("new key %d", i))
+		if c1.Has(k) {
+			t.Fatalf("unexpected key %q in snapshot", k)
+		}
+	}
+
+	// The cache must contain only the new entries.
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("new key %d", i))
+		vExpected := fmt.Sprintf("new value %d", i)
+		if v := c.Get(nil, k); string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+}
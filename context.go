@@ -0,0 +1,139 @@
+package fastcache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Progress contains the progress of SaveToFileContext or LoadFromFileContext.
+type Progress struct {
+	// BucketsProcessed is the number of processed buckets.
+	BucketsProcessed int
+
+	// BucketsTotal is the total number of buckets to process.
+	BucketsTotal int
+
+	// BytesProcessed is the number of bytes written to or read from data files.
+	BytesProcessed uint64
+}
+
+// LoadOptions contains options for LoadFromFileContext.
+type LoadOptions struct {
+	// MaxBytes is enforced in the same way as in LoadFromFileMaxBytes if it is greater than 0.
+	MaxBytes int
+
+	// Progress is an optional callback, which is called after every loaded bucket.
+	//
+	// Calls to Progress are serialized.
+	Progress func(p Progress)
+
+	// EncryptionKeys contains keys for decrypting snapshots saved with SaveOptions.EncryptionKey.
+	//
+	// The key is selected by the key ID recorded in the snapshot metadata,
+	// so keys used for the previous saves may be kept here during key rotation.
+	EncryptionKeys []*EncryptionKey
+}
+
+// SaveToFileContext atomically saves cache data to the given filePath
+// using the given opts.
+//
+// The save is cancelled when ctx is done. The previous snapshot at filePath
+// remains untouched in this case and ctx.Err() is returned.
+//
+// See SaveToFileOptions for details.
+func (c *Cache) SaveToFileContext(ctx context.Context, filePath string, opts *SaveOptions) error {
+	return c.notifySave(filePath, func() error {
+		return c.saveToFile(ctx, filePath, opts)
+	})
+}
+
+// LoadFromFileContext loads cache data from the given filePath using the given opts.
+//
+// The load is cancelled when ctx is done. ctx.Err() is returned in this case.
+//
+// opts may be nil.
+func LoadFromFileContext(ctx context.Context, filePath string, opts *LoadOptions) (*Cache, error) {
+	var o LoadOptions
+	if opts != nil {
+		o = *opts
+	}
+	ic := newIOControl(ctx, 0, o.Progress)
+	c, _, err := loadSnapshotFile(filePath, o.MaxBytes, false, ic, o.EncryptionKeys, nil)
+	return c, err
+}
+
+// ioControl controls snapshot I/O: cancellation, rate limit and progress reporting.
+//
+// nil ioControl means no cancellation, rate limit and progress reporting.
+type ioControl struct {
+	ctx      context.Context
+	rl       *rateLimiter
+	progress func(p Progress)
+
+	mu sync.Mutex
+	p  Progress
+}
+
+func newIOControl(ctx context.Context, maxBytesPerSecond int64, progress func(p Progress)) *ioControl {
+	return &ioControl{
+		ctx:      ctx,
+		rl:       newRateLimiter(maxBytesPerSecond),
+		progress: progress,
+	}
+}
+
+// err returns non-nil error if the I/O is cancelled.
+func (ic *ioControl) err() error {
+	if ic == nil {
+		return nil
+	}
+	return ic.ctx.Err()
+}
+
+// wrapErr returns the error for the cancelled I/O if err is caused by the cancellation.
+//
+// Otherwise err is returned as is.
+func (ic *ioControl) wrapErr(err error, format string, args ...any) error {
+	if ctxErr := ic.err(); ctxErr != nil {
+		return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), ctxErr)
+	}
+	return err
+}
+
+// start resets the progress for processing bucketsTotal buckets.
+func (ic *ioControl) start(bucketsTotal int) {
+	if ic == nil {
+		return
+	}
+	ic.mu.Lock()
+	ic.p = Progress{
+		BucketsTotal: bucketsTotal,
+	}
+	ic.mu.Unlock()
+}
+
+// bucketProcessed registers the processed bucket with n processed bytes.
+func (ic *ioControl) bucketProcessed(n uint64) {
+	if ic == nil || ic.progress == nil {
+		return
+	}
+	ic.mu.Lock()
+	ic.p.BucketsProcessed++
+	ic.p.BytesProcessed += n
+	ic.progress(ic.p)
+	ic.mu.Unlock()
+}
+
+// writer returns w limited by ic.
+func (ic *ioControl) writer(w io.Writer) io.Writer {
+	if ic == nil || ic.rl == nil {
+		return w
+	}
+	return &rateLimitedWriter{
+		w:   w,
+		rl:  ic.rl,
+		ctx: ic.ctx,
+	}
+}
@@ -0,0 +1,160 @@
+package fastcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoadContextProgress(t *testing.T) {
+	for _, codec := range []Codec{CodecSnappy, CodecNone, CodecMmap} {
+		t.Run(codec.String(), func(t *testing.T) {
+			testSaveLoadContextProgress(t, codec)
+		})
+	}
+}
+
+func testSaveLoadContextProgress(t *testing.T, codec Codec) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	const itemsCount = 1000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+
+	var saveProgress []Progress
+	opts := &SaveOptions{
+		Codec: codec,
+		Progress: func(p Progress) {
+			saveProgress = append(saveProgress, p)
+		},
+	}
+	if err := c.SaveToFileContext(context.Background(), filePath, opts); err != nil {
+		t.Fatalf("SaveToFileContext error: %s", err)
+	}
+	checkProgress(t, saveProgress)
+
+	var loadProgress []Progress
+	lopts := &LoadOptions{
+		MaxBytes: 1,
+		Progress: func(p Progress) {
+			loadProgress = append(loadProgress, p)
+		},
+	}
+	c1, err := LoadFromFileContext(context.Background(), filePath, lopts)
+	if err != nil {
+		t.Fatalf("LoadFromFileContext error: %s", err)
+	}
+	defer c1.Reset()
+	checkProgress(t, loadProgress)
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		vExpected := fmt.Sprintf("value %d", i)
+		if v := c1.Get(nil, k); string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+
+	// MaxBytes must be enforced.
+	lopts = &LoadOptions{
+		MaxBytes: bucketsCount * chunkSize * 2,
+	}
+	if _, err := LoadFromFileContext(context.Background(), filePath, lopts); err == nil {
+		t.Fatalf("expecting non-nil error for unexpected MaxBytes")
+	}
+}
+
+func checkProgress(t *testing.T, progress []Progress) {
+	t.Helper()
+	if len(progress) != bucketsCount {
+		t.Fatalf("unexpected number of progress calls; got %d; want %d", len(progress), bucketsCount)
+	}
+	var prev Progress
+	for i, p := range progress {
+		if p.BucketsProcessed != i+1 {
+			t.Fatalf("unexpected BucketsProcessed at call #%d; got %d; want %d", i, p.BucketsProcessed, i+1)
+		}
+		if p.BucketsTotal != bucketsCount {
+			t.Fatalf("unexpected BucketsTotal at call #%d; got %d; want %d", i, p.BucketsTotal, bucketsCount)
+		}
+		if p.BytesProcessed < prev.BytesProcessed {
+			t.Fatalf("BytesProcessed mustn't decrease; got %d after %d", p.BytesProcessed, prev.BytesProcessed)
+		}
+		prev = p
+	}
+	if prev.BytesProcessed == 0 {
+		t.Fatalf("BytesProcessed must be positive")
+	}
+}
+
+func TestSaveToFileContextCancel(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("key"), []byte("old value"))
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	snapshotDir := mustResolveSnapshotDir(t, filePath)
+
+	// Cancel the save in the middle.
+	c.Set([]byte("key"), []byte("new value"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := &SaveOptions{
+		Progress: func(p Progress) {
+			if p.BucketsProcessed == p.BucketsTotal/2 {
+				cancel()
+			}
+		},
+	}
+	err := c.SaveToFileContext(ctx, filePath, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.Canceled)
+	}
+
+	// The previous snapshot must remain untouched.
+	if dir := mustResolveSnapshotDir(t, filePath); dir != snapshotDir {
+		t.Fatalf("unexpected snapshot dir after cancelled save; got %q; want %q", dir, snapshotDir)
+	}
+	c1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c1.Reset()
+	if v := c1.Get(nil, []byte("key")); string(v) != "old value" {
+		t.Fatalf("unexpected value after cancelled save; got %q; want %q", v, "old value")
+	}
+
+	// Already cancelled save must fail.
+	if err := c.SaveToFileContext(ctx, filePath, &SaveOptions{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestLoadFromFileContextCancel(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("key"), []byte("value"))
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := &LoadOptions{
+		Progress: func(p Progress) {
+			cancel()
+		},
+	}
+	c1, err := LoadFromFileContext(ctx, filePath, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.Canceled)
+	}
+	if c1 != nil {
+		t.Fatalf("expecting nil cache for cancelled load")
+	}
+}
@@ -0,0 +1,362 @@
+package fastcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ConvertOptions contains options for ConvertSnapshot.
+type ConvertOptions struct {
+	// MaxBytes is the capacity of the converted snapshot.
+	//
+	// The capacity of the source snapshot is kept if MaxBytes <= 0.
+	// Otherwise entries are re-packed into the new capacity in the same way
+	// as LoadFromFileRepack does.
+	MaxBytes int
+
+	// Codec is the codec for data files of the converted snapshot.
+	Codec Codec
+
+	// Files is the number of data files in the converted snapshot.
+	//
+	// The number of data files in the source snapshot is kept if Files <= 0.
+	Files int
+
+	// SkipPrefixes contains key prefixes for entries, which must be dropped from the converted snapshot.
+	//
+	// The remaining entries are re-packed into new chunks, so the converted snapshot
+	// doesn't contain the data for the dropped entries.
+	// Only keys stored with Set are matched. Values stored with SetBig become
+	// inaccessible if their keys match, while their parts remain in the snapshot.
+	SkipPrefixes [][]byte
+}
+
+// ConvertStats contains stats for the snapshot converted by ConvertSnapshot.
+type ConvertStats struct {
+	// Buckets is the number of converted buckets.
+	Buckets int
+
+	// Entries is the number of entries in the converted snapshot.
+	Entries uint64
+
+	// SkippedEntries is the number of entries dropped because of ConvertOptions.SkipPrefixes.
+	SkippedEntries uint64
+
+	// DroppedEntries is the number of entries, which didn't fit ConvertOptions.MaxBytes.
+	DroppedEntries uint64
+
+	// InvalidEntries is the number of dropped corrupted entries.
+	InvalidEntries uint64
+}
+
+// ConvertSnapshot converts the snapshot at srcPath into a new snapshot at dstPath according to opts.
+//
+// The conversion works offline without loading the whole snapshot into memory.
+// Buckets are streamed from the source data files one by one, so the memory usage
+// is bounded by a few buckets per source data file.
+//
+// The snapshot at dstPath is replaced atomically. srcPath and dstPath must differ.
+func ConvertSnapshot(srcPath, dstPath string, opts *ConvertOptions) (*ConvertStats, error) {
+	if err := opts.Codec.validate(); err != nil {
+		return nil, err
+	}
+	if err := checkDistinctPaths(srcPath, dstPath); err != nil {
+		return nil, err
+	}
+	srcStore, err := resolveSnapshotStore(NewFileSnapshotStore(srcPath))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open snapshot at %q: %w", srcPath, err)
+	}
+	srcSh, err := loadMetadata(srcStore)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open snapshot at %q: %w", srcPath, err)
+	}
+	if srcSh.incremental {
+		return nil, fmt.Errorf("cache file %s contains incremental snapshot; it cannot be converted", srcPath)
+	}
+	if srcSh.keyID != "" {
+		return nil, fmt.Errorf("cache file %s contains encrypted snapshot; it cannot be converted", srcPath)
+	}
+	if err := validateMaxChunks(srcSh.maxBucketChunks); err != nil {
+		return nil, fmt.Errorf("cannot convert snapshot at %q: %w", srcPath, err)
+	}
+	srcFiles := srcSh.files
+	if srcSh.version == 0 {
+		srcFiles, err = readLegacyDataFiles(srcStore)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxChunks := srcSh.maxBucketChunks
+	if opts.MaxBytes > 0 {
+		maxChunks, err = maxBucketChunksForBytes(opts.MaxBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	filesCount := opts.Files
+	if filesCount <= 0 {
+		filesCount = max(len(srcFiles), 1)
+	}
+	filesCount = min(filesCount, bucketsCount)
+
+	sh := newSnapshotHeader(maxChunks)
+	sh.codec = opts.Codec
+	var cs ConvertStats
+	err = writeSnapshotAtomic(NewFileSnapshotStore(dstPath), nil, func(dstStore SnapshotStore) error {
+		cv := &converter{
+			maxChunks:    maxChunks,
+			skipPrefixes: opts.SkipPrefixes,
+			stats:        &cs,
+		}
+		cv.files = make([]*convertFile, filesCount)
+		for i := range cv.files {
+			cf, err := newConvertFile(dstStore, i, opts.Codec)
+			if err != nil {
+				cv.close()
+				return err
+			}
+			cv.files[i] = cf
+		}
+		var buckets [bucketsCount]bucket
+		if len(opts.SkipPrefixes) > 0 {
+			// Zero new chunks, so the space left after dropped entries doesn't contain stale data.
+			for i := range buckets[:] {
+				buckets[i].alloc = zeroingAllocator{defaultAllocator}
+			}
+		}
+		var claims bucketClaims
+		loadFile := func(f *snapshotFile) error {
+			onLoaded := func(bucketNum uint64) error {
+				return cv.convertBucket(&buckets[bucketNum], bucketNum)
+			}
+			if srcSh.codec == CodecMmap {
+				return loadAlignedBuckets(buckets[:], &claims, srcStore, f, srcSh, false, nil, onLoaded)
+			}
+			return loadBuckets(buckets[:], &claims, srcStore, f, srcSh, (*bucket).Load, nil, onLoaded)
+		}
+		err := loadDataFiles(srcFiles, loadFile)
+		// Release buckets, which weren't converted because of errors.
+		for i := range buckets[:] {
+			buckets[i].unload()
+		}
+		if err != nil {
+			cv.close()
+			return err
+		}
+		for _, cf := range cv.files {
+			f, err := cf.finish()
+			if err != nil {
+				cv.close()
+				return err
+			}
+			sh.files = append(sh.files, f)
+		}
+		return saveMetadata(sh, dstStore)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert snapshot %q to %q: %w", srcPath, dstPath, err)
+	}
+	return &cs, nil
+}
+
+// converter converts buckets loaded from the source snapshot and writes them to the destination data files.
+type converter struct {
+	maxChunks    uint64
+	skipPrefixes [][]byte
+	files        []*convertFile
+
+	mu        sync.Mutex
+	stats     *ConvertStats
+	converted [bucketsCount]bool
+}
+
+// convertBucket converts b loaded from the source snapshot and writes it to the destination data file.
+//
+// b is released after that.
+func (cv *converter) convertBucket(b *bucket, bucketNum uint64) error {
+	defer b.unload()
+
+	invalid := b.verify()
+	b.cleanLocked()
+	skipped := 0
+	if len(cv.skipPrefixes) > 0 {
+		for h, v := range b.m {
+			k, _, ok := readChunksEntry(b.chunks, v&((1<<bucketSizeBits)-1))
+			if ok && hasAnyPrefix(k, cv.skipPrefixes) {
+				delete(b.m, h)
+				skipped++
+			}
+		}
+	}
+	dropped := 0
+	if skipped > 0 || uint64(len(b.chunks)) != cv.maxChunks {
+		// Re-pack the remaining entries into new chunks, so the data for skipped entries isn't written.
+		dropped = b.repack(cv.maxChunks)
+	}
+
+	cv.mu.Lock()
+	if cv.converted[bucketNum] {
+		cv.mu.Unlock()
+		return corruptionErrorf("duplicate bucket[%d] in the source snapshot", bucketNum)
+	}
+	cv.converted[bucketNum] = true
+	cv.stats.Buckets++
+	cv.stats.Entries += uint64(len(b.m))
+	cv.stats.SkippedEntries += uint64(skipped)
+	cv.stats.DroppedEntries += uint64(dropped)
+	cv.stats.InvalidEntries += invalid
+	cv.mu.Unlock()
+
+	cf := cv.files[bucketNum%uint64(len(cv.files))]
+	return cf.writeBucket(b, bucketNum)
+}
+
+// close closes all the destination data files.
+func (cv *converter) close() {
+	for _, cf := range cv.files {
+		if cf != nil {
+			_ = cf.dataFile.Close()
+		}
+	}
+}
+
+// checkDistinctPaths returns an error if srcPath and dstPath refer to the same snapshot.
+func checkDistinctPaths(srcPath, dstPath string) error {
+	srcAbs, err := filepath.Abs(srcPath)
+	if err != nil {
+		return fmt.Errorf("cannot obtain absolute path for %q: %s", srcPath, err)
+	}
+	dstAbs, err := filepath.Abs(dstPath)
+	if err != nil {
+		return fmt.Errorf("cannot obtain absolute path for %q: %s", dstPath, err)
+	}
+	same := srcAbs == dstAbs
+	if !same {
+		// Detect paths referring to the same dir via symlinks.
+		srcFi, errSrc := os.Stat(srcPath)
+		dstFi, errDst := os.Stat(dstPath)
+		same = errSrc == nil && errDst == nil && os.SameFile(srcFi, dstFi)
+	}
+	if same {
+		return fmt.Errorf("cannot convert snapshot %q in place; dstPath must differ from srcPath", srcPath)
+	}
+	return nil
+}
+
+func hasAnyPrefix(k []byte, prefixes [][]byte) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// convertFile is a data file of the converted snapshot.
+//
+// It is written in the same format as data files written by saveBuckets and saveAlignedBuckets.
+type convertFile struct {
+	mu sync.Mutex
+
+	f        snapshotFile
+	dataPath string
+	codec    Codec
+	dataFile io.WriteCloser
+	fw       *countingWriter
+	cw       *crcWriter
+
+	// zw is used for all the codecs except CodecMmap.
+	zw io.WriteCloser
+
+	// bw is used for CodecMmap.
+	bw *bufio.Writer
+}
+
+func newConvertFile(s SnapshotStore, fileNum int, codec Codec) (*convertFile, error) {
+	cf := &convertFile{
+		f: snapshotFile{
+			name: fmt.Sprintf("data.%d.bin", fileNum),
+		},
+		codec: codec,
+	}
+	cf.dataPath = cf.f.name
+	dataFile, err := s.Create(cf.dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create %q: %s", cf.dataPath, err)
+	}
+	cf.dataFile = dataFile
+	if codec == CodecMmap {
+		cf.bw = bufio.NewWriterSize(dataFile, chunkSize)
+		cf.fw = &countingWriter{
+			w: cf.bw,
+		}
+		cf.cw = &crcWriter{
+			w: cf.fw,
+		}
+		return cf, nil
+	}
+	cf.fw = &countingWriter{
+		w: dataFile,
+	}
+	zw, err := newCodecWriter(codec, cf.fw)
+	if err != nil {
+		_ = dataFile.Close()
+		return nil, err
+	}
+	cf.zw = zw
+	cf.cw = &crcWriter{
+		w: zw,
+	}
+	return cf, nil
+}
+
+func (cf *convertFile) writeBucket(b *bucket, bucketNum uint64) error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if cf.codec == CodecMmap {
+		if err := writeUint64(cf.fw, bucketNum); err != nil {
+			return fmt.Errorf("cannot write bucketNum=%d to %q: %s", bucketNum, cf.dataPath, err)
+		}
+		cf.cw.crc = 0
+		if err := b.saveAligned(cf.cw, cf.fw); err != nil {
+			return fmt.Errorf("cannot save bucket[%d] to %q: %s", bucketNum, cf.dataPath, err)
+		}
+	} else {
+		if err := writeUint64(cf.zw, bucketNum); err != nil {
+			return fmt.Errorf("cannot write bucketNum=%d to %q: %s", bucketNum, cf.dataPath, err)
+		}
+		cf.cw.crc = 0
+		if err := b.Save(cf.cw); err != nil {
+			return fmt.Errorf("cannot save bucket[%d] to %q: %s", bucketNum, cf.dataPath, err)
+		}
+	}
+	cf.f.buckets = append(cf.f.buckets, snapshotBucket{
+		num: bucketNum,
+		crc: cf.cw.crc,
+	})
+	return nil
+}
+
+// finish flushes and closes cf. It returns the manifest entry for cf.
+func (cf *convertFile) finish() (snapshotFile, error) {
+	if cf.codec == CodecMmap {
+		if err := cf.bw.Flush(); err != nil {
+			return cf.f, fmt.Errorf("cannot flush data to %q: %s", cf.dataPath, err)
+		}
+	} else if err := cf.zw.Close(); err != nil {
+		return cf.f, fmt.Errorf("cannot close %s writer for %q: %s", cf.codec, cf.dataPath, err)
+	}
+	if err := cf.dataFile.Close(); err != nil {
+		return cf.f, fmt.Errorf("cannot close %q: %s", cf.dataPath, err)
+	}
+	cf.f.size = cf.fw.n
+	return cf.f, nil
+}
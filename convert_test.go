@@ -0,0 +1,213 @@
+package fastcache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvertSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcPath := filepath.Join(tmpDir, "src")
+	const maxBytes = bucketsCount * chunkSize * 2
+	c := New(maxBytes)
+	defer c.Reset()
+	const itemsCount = 10000
+	// Values are big enough for overflowing the cache with the halved capacity.
+	padding := strings.Repeat("x", 1500)
+	value := func(i int) string {
+		return fmt.Sprintf("value %d", i) + padding
+	}
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(value(i)))
+		c.Set([]byte(fmt.Sprintf("skip %d", i)), []byte(value(i)))
+	}
+	if err := c.SaveToFileConcurrent(srcPath, 3); err != nil {
+		t.Fatalf("SaveToFileConcurrent error: %s", err)
+	}
+	sh, err := loadMetadata(NewFileSnapshotStore(mustResolveSnapshotDir(t, srcPath)))
+	if err != nil {
+		t.Fatalf("cannot load metadata: %s", err)
+	}
+	srcFiles := len(sh.files)
+
+	f := func(name string, opts *ConvertOptions, filesExpected int, maxBytesExpected int) *ConvertStats {
+		t.Helper()
+		dstPath := filepath.Join(tmpDir, name)
+		cs, err := ConvertSnapshot(srcPath, dstPath, opts)
+		if err != nil {
+			t.Fatalf("%s: ConvertSnapshot error: %s", name, err)
+		}
+		if cs.Buckets != bucketsCount || cs.InvalidEntries != 0 {
+			t.Fatalf("%s: unexpected stats: %+v", name, cs)
+		}
+		si, err := InspectSnapshot(dstPath, nil)
+		if err != nil {
+			t.Fatalf("%s: InspectSnapshot error: %s", name, err)
+		}
+		defer si.Close()
+		g := si.Geometry()
+		if g.Codec != opts.Codec || len(g.Files) != filesExpected || g.MaxBytes != maxBytesExpected {
+			t.Fatalf("%s: unexpected geometry: %+v", name, g)
+		}
+		report := si.Report()
+		if report.BucketsRestored != bucketsCount || report.BucketsReset != 0 || len(report.FailedFiles) != 0 {
+			t.Fatalf("%s: unexpected report: %+v", name, report)
+		}
+		entries := uint64(0)
+		for _, bi := range si.Buckets() {
+			entries += uint64(bi.Entries)
+		}
+		if entries != cs.Entries {
+			t.Fatalf("%s: unexpected number of entries; got %d; want %d", name, entries, cs.Entries)
+		}
+		err = si.VisitEntries(func(bucketNum int, k, v []byte) error {
+			if len(opts.SkipPrefixes) > 0 && strings.HasPrefix(string(k), "skip ") {
+				return fmt.Errorf("unexpected key %q", k)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		return cs
+	}
+
+	// Change the codec.
+	for _, codec := range []Codec{CodecSnappy, CodecNone, CodecFlate, CodecMmap} {
+		cs := f("codec_"+codec.String(), &ConvertOptions{Codec: codec}, srcFiles, maxBytes)
+		if cs.Entries != 2*itemsCount || cs.SkippedEntries != 0 || cs.DroppedEntries != 0 {
+			t.Fatalf("unexpected stats for codec %s: %+v", codec, cs)
+		}
+	}
+	c1, err := LoadFromFileMmap(filepath.Join(tmpDir, "codec_mmap"))
+	if err != nil {
+		t.Fatalf("LoadFromFileMmap error: %s", err)
+	}
+	for i := range itemsCount {
+		k := fmt.Sprintf("key %d", i)
+		if v := c1.Get(nil, []byte(k)); string(v) != value(i) {
+			t.Fatalf("unexpected value for key %q; got %d bytes", k, len(v))
+		}
+	}
+	c1.Reset()
+
+	// Change the number of files.
+	f("files_1", &ConvertOptions{Files: 1}, 1, maxBytes)
+	f("files_5", &ConvertOptions{Files: 5}, 5, maxBytes)
+	f("files_max", &ConvertOptions{Files: 1e6}, bucketsCount, maxBytes)
+
+	// Skip prefixes.
+	cs := f("skip", &ConvertOptions{SkipPrefixes: [][]byte{[]byte("skip ")}}, srcFiles, maxBytes)
+	if cs.Entries != itemsCount || cs.SkippedEntries != itemsCount {
+		t.Fatalf("unexpected stats for skipped prefixes: %+v", cs)
+	}
+
+	// Increase the capacity.
+	cs = f("grow", &ConvertOptions{MaxBytes: 2 * maxBytes}, srcFiles, 2*maxBytes)
+	if cs.Entries != 2*itemsCount || cs.DroppedEntries != 0 {
+		t.Fatalf("unexpected stats for the increased capacity: %+v", cs)
+	}
+
+	// Decrease the capacity, so some entries are dropped.
+	cs = f("shrink", &ConvertOptions{MaxBytes: 1}, srcFiles, bucketsCount*chunkSize)
+	if cs.DroppedEntries == 0 || cs.Entries+cs.DroppedEntries != 2*itemsCount {
+		t.Fatalf("unexpected stats for the decreased capacity: %+v", cs)
+	}
+	c2, err := LoadFromFile(filepath.Join(tmpDir, "shrink"))
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	// The most recently written entries must be kept.
+	k := fmt.Sprintf("skip %d", itemsCount-1)
+	if v := c2.Get(nil, []byte(k)); string(v) != value(itemsCount-1) {
+		t.Fatalf("unexpected value for key %q; got %d bytes", k, len(v))
+	}
+	c2.Reset()
+}
+
+func TestConvertSnapshotInvalid(t *testing.T) {
+	tmpDir := t.TempDir()
+	dstPath := filepath.Join(tmpDir, "dst")
+	if _, err := ConvertSnapshot(filepath.Join(tmpDir, "missing"), dstPath, &ConvertOptions{}); err == nil {
+		t.Fatalf("expecting non-nil error for missing snapshot")
+	}
+
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("key"), []byte("value"))
+	incrementalPath := filepath.Join(tmpDir, "incremental")
+	if err := c.SaveIncremental(incrementalPath); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	if _, err := ConvertSnapshot(incrementalPath, dstPath, &ConvertOptions{}); err == nil {
+		t.Fatalf("expecting non-nil error for incremental snapshot")
+	}
+
+	srcPath := filepath.Join(tmpDir, "src")
+	if err := c.SaveToFile(srcPath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	if _, err := ConvertSnapshot(srcPath, dstPath, &ConvertOptions{Codec: 123}); err == nil {
+		t.Fatalf("expecting non-nil error for invalid codec")
+	}
+	if _, err := ConvertSnapshot(srcPath, srcPath+"/.", &ConvertOptions{}); err == nil {
+		t.Fatalf("expecting non-nil error for converting the snapshot in place")
+	}
+}
+
+func TestConvertSnapshotSkipPrefixesScrubsData(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcPath := filepath.Join(tmpDir, "src")
+	c := New(bucketsCount * chunkSize)
+	defer c.Reset()
+	for i := range 1000 {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+		c.Set([]byte(fmt.Sprintf("secret %d", i)), []byte(fmt.Sprintf("password %d", i)))
+	}
+	if err := c.SaveToFile(srcPath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	// The capacity is kept, so the skipped entries must be removed from chunks.
+	dstPath := filepath.Join(tmpDir, "dst")
+	opts := &ConvertOptions{
+		Codec:        CodecNone,
+		SkipPrefixes: [][]byte{[]byte("secret ")},
+	}
+	cs, err := ConvertSnapshot(srcPath, dstPath, opts)
+	if err != nil {
+		t.Fatalf("ConvertSnapshot error: %s", err)
+	}
+	if cs.Entries != 1000 || cs.SkippedEntries != 1000 {
+		t.Fatalf("unexpected stats: %+v", cs)
+	}
+	dir := mustResolveSnapshotDir(t, dstPath)
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", dir, err)
+	}
+	for _, de := range des {
+		data, err := os.ReadFile(filepath.Join(dir, de.Name()))
+		if err != nil {
+			t.Fatalf("cannot read %q: %s", de.Name(), err)
+		}
+		if bytes.Contains(data, []byte("password")) {
+			t.Fatalf("%q contains data for the skipped entries", de.Name())
+		}
+	}
+	c1, err := LoadFromFile(dstPath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c1.Reset()
+	for i := range 1000 {
+		k := fmt.Sprintf("key %d", i)
+		if v := c1.Get(nil, []byte(k)); string(v) != fmt.Sprintf("value %d", i) {
+			t.Fatalf("unexpected value for key %q: %q", k, v)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package fastcache
+
+import (
+	"fmt"
+)
+
+// CorruptionError is returned when a snapshot contains corrupted or malicious data.
+//
+// Use errors.As for detecting it.
+type CorruptionError struct {
+	// Reason describes the detected corruption.
+	Reason string
+}
+
+// Error implements error interface.
+func (e *CorruptionError) Error() string {
+	return "corrupted snapshot data: " + e.Reason
+}
+
+func corruptionErrorf(format string, args ...any) error {
+	return &CorruptionError{
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// maxBucketEntries returns the maximum number of index entries for a bucket with maxChunks chunks.
+//
+// Every entry occupies at least 4 bytes in chunks. The index may also contain entries
+// for up to a generation of overwritten data, which wasn't cleaned yet.
+func maxBucketEntries(maxChunks uint64) uint64 {
+	return 2 * maxChunks * chunkSize / 4
+}
+
+// validateMaxChunks verifies maxChunks obtained from snapshot metadata.
+func validateMaxChunks(maxChunks uint64) error {
+	if maxChunks == 0 {
+		return corruptionErrorf("the number of chunks per bucket cannot be zero")
+	}
+	if maxChunks >= maxBucketSize/chunkSize {
+		return corruptionErrorf("too big number of chunks per bucket=%d; should be smaller than %d", maxChunks, maxBucketSize/chunkSize)
+	}
+	return nil
+}
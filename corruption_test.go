@@ -0,0 +1,228 @@
+package fastcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestReadBucketIndexHostile(t *testing.T) {
+	f := func(name string, bIdx, bGen, kvsLen uint64, maxChunks uint64) {
+		t.Helper()
+		var bb bytes.Buffer
+		for _, u := range []uint64{bIdx, bGen, kvsLen} {
+			if err := writeUint64(&bb, u); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, _, _, err := readBucketIndex(&bb, maxChunks)
+		var ce *CorruptionError
+		if !errors.As(err, &ce) {
+			t.Fatalf("%s: expecting CorruptionError; got %v", name, err)
+		}
+	}
+	f("huge_kvs_len", 0, 1, 1<<60, 1)
+	f("overflowing_kvs_len", 0, 1, 1<<63, 1)
+	f("too_many_entries", 0, 1, maxBucketEntries(2)+1, 2)
+	f("zero_max_chunks", 0, 1, 0, 0)
+	f("huge_max_chunks", 0, 1, 0, 1<<60)
+
+	// A truncated index mustn't be read into memory at once.
+	var bb bytes.Buffer
+	for _, u := range []uint64{0, 1, maxBucketEntries(1)} {
+		if err := writeUint64(&bb, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, err := readBucketIndex(&bb, 1); err == nil {
+		t.Fatalf("expecting non-nil error for truncated index")
+	}
+}
+
+func TestBucketLoadInvalidIndex(t *testing.T) {
+	f := func(name string, bIdx, bGen uint64, m map[uint64]uint64, chunksLen uint64) {
+		t.Helper()
+		var bb bytes.Buffer
+		u64s := []uint64{bIdx, bGen, uint64(len(m))}
+		for k, v := range m {
+			u64s = append(u64s, k, v)
+		}
+		u64s = append(u64s, chunksLen)
+		for _, u := range u64s {
+			if err := writeUint64(&bb, u); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bb.Write(make([]byte, chunksLen*chunkSize))
+		var b bucket
+		err := b.Load(&bb, 2)
+		var ce *CorruptionError
+		if !errors.As(err, &ce) {
+			t.Fatalf("%s: expecting CorruptionError; got %v", name, err)
+		}
+	}
+	f("bidx_without_chunks", 100, 2, nil, 0)
+	f("bidx_past_chunks", chunkSize+100, 2, nil, 1)
+	f("too_many_chunks", 0, 2, nil, 3)
+}
+
+func TestBucketLoadOutOfRangeIndexEntries(t *testing.T) {
+	// Index entries pointing outside the chunks aren't structural corruption.
+	// The bucket must be loaded, while such entries must be dropped by verify.
+	m := map[uint64]uint64{
+		1: 1<<bucketSizeBits | chunkSize,
+		2: 1<<bucketSizeBits | 100*chunkSize,
+		3: 1<<bucketSizeBits | 10,
+	}
+	var bb bytes.Buffer
+	u64s := []uint64{100, 2, uint64(len(m))}
+	for k, v := range m {
+		u64s = append(u64s, k, v)
+	}
+	u64s = append(u64s, 1)
+	for _, u := range u64s {
+		if err := writeUint64(&bb, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chunk := make([]byte, chunkSize)
+	chunk[13] = 1
+	chunk[14] = 'k'
+	bb.Write(chunk)
+
+	var b bucket
+	if err := b.Load(&bb, 2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Reset()
+	if dropped := b.verify(); dropped != 2 {
+		t.Fatalf("unexpected number of dropped entries; got %d; want 2", dropped)
+	}
+	if _, ok := b.m[3]; !ok || len(b.m) != 1 {
+		t.Fatalf("unexpected index after verify: %v", b.m)
+	}
+}
+
+func TestLoadFromFileCorruptionError(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("key"), []byte("value"))
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	snapshotDir := mustResolveSnapshotDir(t, filePath)
+	sh, err := loadMetadata(NewFileSnapshotStore(snapshotDir))
+	if err != nil {
+		t.Fatalf("cannot load metadata: %s", err)
+	}
+	sh.files[0].buckets[0].crc++
+	if err := saveMetadata(sh, NewFileSnapshotStore(snapshotDir)); err != nil {
+		t.Fatalf("cannot save metadata: %s", err)
+	}
+	_, err = LoadFromFile(filePath)
+	var ce *CorruptionError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expecting CorruptionError; got %v", err)
+	}
+}
+
+func TestLoadBucketsDuplicateBucket(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("key"), []byte("value"))
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	s := NewFileSnapshotStore(mustResolveSnapshotDir(t, filePath))
+	sh, err := loadMetadata(s)
+	if err != nil {
+		t.Fatalf("cannot load metadata: %s", err)
+	}
+
+	// Loading the same data file twice simulates buckets listed in multiple data files.
+	// The buckets claimed by the first load mustn't be touched by the second load.
+	var c1 Cache
+	defer c1.Reset()
+	var claims bucketClaims
+	f := &sh.files[0]
+	if err := loadBuckets(c1.buckets[:], &claims, s, f, sh, (*bucket).Load, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = loadBuckets(c1.buckets[:], &claims, s, f, sh, (*bucket).Load, nil, nil)
+	var ce *CorruptionError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expecting CorruptionError; got %v", err)
+	}
+	for _, b := range f.buckets {
+		if len(c1.buckets[b.num].chunks) == 0 {
+			t.Fatalf("bucket[%d] must remain loaded after the duplicate is rejected", b.num)
+		}
+	}
+}
+
+func FuzzLoadBuckets(f *testing.F) {
+	const maxChunks = 2
+
+	// Seed the corpus with valid and hostile data files.
+	c := New(bucketsCount * chunkSize * maxChunks)
+	for i := range 1000 {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	var bb bytes.Buffer
+	for i := range 3 {
+		if err := writeUint64(&bb, uint64(i)); err != nil {
+			f.Fatal(err)
+		}
+		if err := c.buckets[i].Save(&bb); err != nil {
+			f.Fatal(err)
+		}
+	}
+	c.Reset()
+	f.Add(uint8(CodecNone), bb.Bytes())
+	bb.Reset()
+	for _, u := range []uint64{0, 0, 1, 1 << 60} {
+		if err := writeUint64(&bb, u); err != nil {
+			f.Fatal(err)
+		}
+	}
+	f.Add(uint8(CodecNone), bb.Bytes())
+	f.Add(uint8(CodecSnappy), []byte("sNaPpY"))
+
+	dir := f.TempDir()
+	f.Fuzz(func(t *testing.T, codec uint8, data []byte) {
+		sh := newSnapshotHeader(maxChunks)
+		// Legacy snapshots have no manifest, so the data is loaded without checksum verification.
+		sh.version = 0
+		sh.codec = Codec(codec % uint8(CodecMmap))
+		file := &snapshotFile{
+			name: "data.0.bin",
+		}
+		if err := os.WriteFile(filepath.Join(dir, file.name), data, 0644); err != nil {
+			t.Fatalf("cannot write data file: %s", err)
+		}
+
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		allocStart := ms.TotalAlloc
+
+		var c Cache
+		_ = loadBuckets(c.buckets[:], &bucketClaims{}, NewFileSnapshotStore(dir), file, sh, (*bucket).Load, nil, nil)
+		for i := range c.buckets[:] {
+			c.buckets[i].verify()
+		}
+		c.Reset()
+
+		// Allocations must be bounded by the size of the data file.
+		runtime.ReadMemStats(&ms)
+		allocated := ms.TotalAlloc - allocStart
+		if maxAllocated := uint64(16<<20 + 1024*len(data)); allocated > maxAllocated {
+			t.Fatalf("too big memory allocations for %d bytes of data; got %d bytes; want no more than %d bytes", len(data), allocated, maxAllocated)
+		}
+	})
+}
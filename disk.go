@@ -0,0 +1,579 @@
+package fastcache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// diskSegmentMaxSize is the maximum size of a disk tier segment file.
+const diskSegmentMaxSize = 1 << diskOffsetBits
+
+// Disk locations for entries are encoded as segmentID | offset | kvLen in a single uint64.
+const (
+	diskKVLenBits     = 16
+	diskOffsetBits    = 26
+	diskSegmentIDBits = 64 - diskKVLenBits - diskOffsetBits
+)
+
+var errDiskTierClosed = errors.New("the disk tier is closed")
+
+// errDiskLocStale is returned when the entry location points to the segment, which has been already removed.
+var errDiskLocStale = errors.New("the disk tier segment has been removed")
+
+// diskTier is a log-structured store for entries evicted from memory.
+//
+// Entries are appended to segment files. The oldest segment is removed
+// when the disk tier capacity is exceeded.
+type diskTier struct {
+	dir         string
+	segmentSize uint64
+	maxSegments int
+
+	mu sync.RWMutex
+
+	// segments contains live segments ordered from the oldest to the newest.
+	// Segment ids are consecutive.
+	segments      []*diskSegment
+	nextSegmentID uint64
+	closed        bool
+
+	hits       uint64
+	reads      uint64
+	readBytes  uint64
+	writes     uint64
+	writeBytes uint64
+	errors     uint64
+}
+
+type diskSegment struct {
+	id uint64
+	f  *os.File
+
+	// size is the size of the space reserved in f. It is protected by diskTier.mu.
+	size uint64
+
+	// refs is the number of references to the segment.
+	//
+	// The disk tier holds a reference while the segment is live, and every in-flight read
+	// and write holds a reference, so f isn't closed during the I/O without holding diskTier.mu.
+	// f is closed and removed when the last reference is released.
+	refs atomic.Int64
+}
+
+var diskSegmentRegexp = regexp.MustCompile(`^[0-9a-f]{16}\.seg$`)
+
+// openDiskTier opens the disk tier with maxBytes capacity at dir.
+//
+// Segment files left at dir by the previous process are removed, since the index for them is lost.
+func openDiskTier(dir string, maxBytes int64) (*diskTier, error) {
+	if maxBytes < 2*chunkSize {
+		return nil, fmt.Errorf("too small disk tier capacity=%d bytes; it must be at least %d bytes", maxBytes, 2*chunkSize)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create disk tier dir %q: %s", dir, err)
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read disk tier dir %q: %s", dir, err)
+	}
+	for _, de := range des {
+		if de.IsDir() || !diskSegmentRegexp.MatchString(de.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, de.Name())
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("cannot remove stale disk tier segment %q: %s", path, err)
+		}
+	}
+
+	// Use at least 16 segments, so the disk tier doesn't lose too much data when the oldest segment is removed.
+	segmentSize := uint64(maxBytes) / 16
+	if segmentSize < chunkSize {
+		segmentSize = chunkSize
+	}
+	if segmentSize > diskSegmentMaxSize {
+		segmentSize = diskSegmentMaxSize
+	}
+	return &diskTier{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSegments: int(uint64(maxBytes) / segmentSize),
+	}, nil
+}
+
+// write writes data to seg at the given offset reserved via reserve.
+//
+// It is called without holding dt.mu, so concurrent writes from distinct buckets
+// don't wait for each other's disk I/O.
+func (dt *diskTier) write(seg *diskSegment, offset uint64, data []byte) error {
+	if _, err := seg.f.WriteAt(data, int64(offset)); err != nil {
+		atomic.AddUint64(&dt.errors, 1)
+		return fmt.Errorf("cannot write to disk tier segment %q: %s", seg.f.Name(), err)
+	}
+	atomic.AddUint64(&dt.writes, 1)
+	atomic.AddUint64(&dt.writeBytes, uint64(len(data)))
+	return nil
+}
+
+// reserve reserves size bytes in the newest segment and returns the segment with the offset of the reserved space.
+//
+// The returned segment must be released via releaseSegment after writing the data.
+func (dt *diskTier) reserve(size uint64) (*diskSegment, uint64, error) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	if dt.closed {
+		return nil, 0, errDiskTierClosed
+	}
+	var seg *diskSegment
+	if n := len(dt.segments); n > 0 {
+		seg = dt.segments[n-1]
+	}
+	if seg == nil || seg.size+size > dt.segmentSize {
+		var err error
+		seg, err = dt.addSegmentLocked()
+		if err != nil {
+			atomic.AddUint64(&dt.errors, 1)
+			return nil, 0, err
+		}
+	}
+	offset := seg.size
+	seg.size += size
+	seg.refs.Add(1)
+	return seg, offset, nil
+}
+
+func (dt *diskTier) addSegmentLocked() (*diskSegment, error) {
+	id := dt.nextSegmentID
+	path := filepath.Join(dt.dir, fmt.Sprintf("%016x.seg", id))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create disk tier segment: %s", err)
+	}
+	dt.nextSegmentID++
+	seg := &diskSegment{
+		id: id,
+		f:  f,
+	}
+	seg.refs.Store(1)
+	dt.segments = append(dt.segments, seg)
+	for len(dt.segments) > dt.maxSegments {
+		dt.removeSegmentLocked(dt.segments[0])
+		dt.segments = dt.segments[1:]
+	}
+	return seg, nil
+}
+
+// removeSegmentLocked releases the reference to seg held by the disk tier.
+//
+// seg is removed after in-flight reads and writes for it are finished.
+func (dt *diskTier) removeSegmentLocked(seg *diskSegment) {
+	dt.releaseSegment(seg)
+}
+
+// releaseSegment releases the reference to seg and removes seg if it was the last reference.
+func (dt *diskTier) releaseSegment(seg *diskSegment) {
+	if seg.refs.Add(-1) > 0 {
+		return
+	}
+	path := seg.f.Name()
+	if err := seg.f.Close(); err != nil {
+		atomic.AddUint64(&dt.errors, 1)
+	}
+	if err := os.Remove(path); err != nil {
+		atomic.AddUint64(&dt.errors, 1)
+	}
+}
+
+// read appends the data for the entry at loc to dst and returns the result.
+func (dt *diskTier) read(dst []byte, loc uint64) ([]byte, error) {
+	segmentID, offset, kvLen := unpackDiskLoc(loc)
+
+	dt.mu.RLock()
+	if dt.closed {
+		dt.mu.RUnlock()
+		return dst, errDiskTierClosed
+	}
+	seg := dt.getSegmentLocked(segmentID)
+	if seg == nil || offset+kvLen > seg.size {
+		dt.mu.RUnlock()
+		return dst, errDiskLocStale
+	}
+	// Read the data without holding dt.mu, so the read doesn't block spills from other buckets.
+	seg.refs.Add(1)
+	dt.mu.RUnlock()
+	defer dt.releaseSegment(seg)
+
+	dstLen := len(dst)
+	dst = slices.Grow(dst, int(kvLen))[:dstLen+int(kvLen)]
+	if _, err := seg.f.ReadAt(dst[dstLen:], int64(offset)); err != nil {
+		atomic.AddUint64(&dt.errors, 1)
+		return dst[:dstLen], fmt.Errorf("cannot read %d bytes at offset %d from disk tier segment %q: %s", kvLen, offset, seg.f.Name(), err)
+	}
+	atomic.AddUint64(&dt.reads, 1)
+	atomic.AddUint64(&dt.readBytes, kvLen)
+	return dst, nil
+}
+
+// getSegmentLocked returns live segment for the given segmentID, which contains only the lower diskSegmentIDBits.
+//
+// nil is returned if the segment has been already removed.
+func (dt *diskTier) getSegmentLocked(segmentID uint64) *diskSegment {
+	n := len(dt.segments)
+	if n == 0 {
+		return nil
+	}
+	first := dt.segments[0].id
+	last := dt.segments[n-1].id
+	id := resolveDiskSegmentID(segmentID, first, last)
+	if id < first || id > last {
+		return nil
+	}
+	return dt.segments[id-first]
+}
+
+// segmentsRange returns ids of the oldest and the newest live segments.
+//
+// ok is false if there are no live segments.
+func (dt *diskTier) segmentsRange() (uint64, uint64, bool) {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+
+	n := len(dt.segments)
+	if n == 0 {
+		return 0, 0, false
+	}
+	return dt.segments[0].id, dt.segments[n-1].id, true
+}
+
+// reset removes all the data from the disk tier.
+func (dt *diskTier) reset() {
+	dt.mu.Lock()
+	for _, seg := range dt.segments {
+		dt.removeSegmentLocked(seg)
+	}
+	dt.segments = nil
+	dt.mu.Unlock()
+
+	atomic.StoreUint64(&dt.hits, 0)
+	atomic.StoreUint64(&dt.reads, 0)
+	atomic.StoreUint64(&dt.readBytes, 0)
+	atomic.StoreUint64(&dt.writes, 0)
+	atomic.StoreUint64(&dt.writeBytes, 0)
+	atomic.StoreUint64(&dt.errors, 0)
+}
+
+// close removes all the data from the disk tier and closes it.
+func (dt *diskTier) close() {
+	dt.mu.Lock()
+	for _, seg := range dt.segments {
+		dt.removeSegmentLocked(seg)
+	}
+	dt.segments = nil
+	dt.closed = true
+	dt.mu.Unlock()
+}
+
+func (dt *diskTier) UpdateStats(s *Stats) {
+	s.DiskHits += atomic.LoadUint64(&dt.hits)
+	s.DiskReads += atomic.LoadUint64(&dt.reads)
+	s.DiskReadBytes += atomic.LoadUint64(&dt.readBytes)
+	s.DiskWrites += atomic.LoadUint64(&dt.writes)
+	s.DiskWriteBytes += atomic.LoadUint64(&dt.writeBytes)
+	s.DiskErrors += atomic.LoadUint64(&dt.errors)
+
+	dt.mu.RLock()
+	for _, seg := range dt.segments {
+		s.DiskBytesSize += seg.size
+	}
+	dt.mu.RUnlock()
+	s.DiskMaxBytesSize += uint64(dt.maxSegments) * dt.segmentSize
+}
+
+func packDiskLoc(segmentID, offset, kvLen uint64) uint64 {
+	segmentID &= (1 << diskSegmentIDBits) - 1
+	return segmentID<<(diskOffsetBits+diskKVLenBits) | offset<<diskKVLenBits | kvLen
+}
+
+func unpackDiskLoc(loc uint64) (uint64, uint64, uint64) {
+	segmentID := loc >> (diskOffsetBits + diskKVLenBits)
+	offset := (loc >> diskKVLenBits) & ((1 << diskOffsetBits) - 1)
+	kvLen := loc & ((1 << diskKVLenBits) - 1)
+	return segmentID, offset, kvLen
+}
+
+// resolveDiskSegmentID returns the full segment id for segmentID containing only the lower diskSegmentIDBits
+// given the ids of the oldest and the newest live segments.
+func resolveDiskSegmentID(segmentID, first, last uint64) uint64 {
+	delta := (last - segmentID) & ((1 << diskSegmentIDBits) - 1)
+	if delta > last {
+		// The segment has been created before the first segment.
+		return first - 1
+	}
+	return last - delta
+}
+
+// setDiskTier enables the disk tier dt for b.
+//
+// It must be called before b is used concurrently.
+func (b *bucket) setDiskTier(dt *diskTier) {
+	b.disk = dt
+	b.dm = make(map[uint64]uint64)
+}
+
+// diskSpill contains live entries copied from a bucket chunk, which must be written to the disk tier.
+//
+// The entries are copied and the space for them is reserved under the bucket lock,
+// while they are written after releasing the lock. Until then they are read from sb.
+type diskSpill struct {
+	dt     *diskTier
+	seg    *diskSegment
+	offset uint64
+	sb     *spillBuf
+
+	// writing is set when a goroutine starts writing the spill. It is protected by bucket.mu.
+	writing bool
+}
+
+// spillChunkLocked moves live entries from b.chunks[chunkIdx] to the disk tier before the chunk is overwritten.
+//
+// The entries are copied to a pending spill, which must be written by writeSpills after releasing b.mu.
+func (b *bucket) spillChunkLocked(chunkIdx uint64) {
+	chunk := b.chunks[chunkIdx]
+	if len(chunk) == 0 {
+		return
+	}
+	sb := getSpillBuf()
+	chunkOffset := chunkIdx * chunkSize
+	for idx := uint64(0); idx+4 <= uint64(len(chunk)); {
+		kvLenBuf := chunk[idx : idx+4]
+		keyLen := (uint64(kvLenBuf[0]) << 8) | uint64(kvLenBuf[1])
+		valLen := (uint64(kvLenBuf[2]) << 8) | uint64(kvLenBuf[3])
+		kvLen := 4 + keyLen + valLen
+		if idx+kvLen > uint64(len(chunk)) {
+			// Corrupted data or the end of data in the chunk loaded from file.
+			break
+		}
+		h := xxhash.Sum64(chunk[idx+4 : idx+4+keyLen])
+		if v, ok := b.m[h]; ok && v&((1<<bucketSizeBits)-1) == chunkOffset+idx {
+			sb.hs = append(sb.hs, h)
+			sb.offsets = append(sb.offsets, uint64(len(sb.buf)))
+			sb.buf = append(sb.buf, chunk[idx:idx+kvLen]...)
+		}
+		idx += kvLen
+	}
+	if len(sb.hs) == 0 {
+		putSpillBuf(sb)
+		return
+	}
+	seg, offset, err := b.disk.reserve(uint64(len(sb.buf)))
+	if err != nil {
+		// The entries are evicted from the cache in the same way as without the disk tier.
+		putSpillBuf(sb)
+		return
+	}
+	sb.offsets = append(sb.offsets, uint64(len(sb.buf)))
+	for i, h := range sb.hs {
+		kvLen := sb.offsets[i+1] - sb.offsets[i]
+		b.dm[h] = packDiskLoc(seg.id, offset+sb.offsets[i], kvLen)
+		delete(b.m, h)
+	}
+	b.spills = append(b.spills, &diskSpill{
+		dt:     b.disk,
+		seg:    seg,
+		offset: offset,
+		sb:     sb,
+	})
+	b.spillsPending.Add(1)
+	b.purgeDiskIndexLocked()
+}
+
+// writeSpills writes pending spills of b to the disk tier.
+//
+// It must be called without holding b.mu after every operation, which may spill chunks.
+func (b *bucket) writeSpills() {
+	if b.spillsPending.Load() == 0 {
+		return
+	}
+	b.mu.Lock()
+	var spills []*diskSpill
+	for _, ds := range b.spills {
+		if !ds.writing {
+			ds.writing = true
+			spills = append(spills, ds)
+		}
+	}
+	b.spillsPending.Add(-int64(len(spills)))
+	b.mu.Unlock()
+
+	for _, ds := range spills {
+		err := ds.dt.write(ds.seg, ds.offset, ds.sb.buf)
+
+		b.mu.Lock()
+		if err != nil && b.dm != nil {
+			// The entries are evicted from the cache in the same way as without the disk tier.
+			sb := ds.sb
+			for i, h := range sb.hs {
+				kvLen := sb.offsets[i+1] - sb.offsets[i]
+				if b.dm[h] == packDiskLoc(ds.seg.id, ds.offset+sb.offsets[i], kvLen) {
+					delete(b.dm, h)
+				}
+			}
+		}
+		b.spills = slices.DeleteFunc(b.spills, func(x *diskSpill) bool {
+			return x == ds
+		})
+		b.mu.Unlock()
+
+		ds.dt.releaseSegment(ds.seg)
+		putSpillBuf(ds.sb)
+	}
+}
+
+// readSpillLocked appends the data for the entry at loc to dst if the entry is in a pending spill.
+//
+// It returns false if the entry isn't found in pending spills.
+func (b *bucket) readSpillLocked(dst []byte, loc uint64) ([]byte, bool) {
+	segmentID, offset, kvLen := unpackDiskLoc(loc)
+	for _, ds := range b.spills {
+		if ds.seg.id&((1<<diskSegmentIDBits)-1) != segmentID || offset < ds.offset {
+			continue
+		}
+		start := offset - ds.offset
+		if start+kvLen <= uint64(len(ds.sb.buf)) {
+			return append(dst, ds.sb.buf[start:start+kvLen]...), true
+		}
+	}
+	return dst, false
+}
+
+// purgeDiskIndexLocked removes entries pointing to removed disk tier segments from b.dm.
+//
+// The purge is performed only after the oldest segment changes since the previous purge.
+func (b *bucket) purgeDiskIndexLocked() {
+	first, last, ok := b.disk.segmentsRange()
+	if !ok || first == b.dmFirstSegmentID {
+		return
+	}
+	for h, loc := range b.dm {
+		segmentID, _, _ := unpackDiskLoc(loc)
+		if resolveDiskSegmentID(segmentID, first, last) < first {
+			delete(b.dm, h)
+		}
+	}
+	b.dmFirstSegmentID = first
+}
+
+// getFromDisk searches for the entry for k in the disk tier dt and promotes it back to memory if it is found.
+func (b *bucket) getFromDisk(dt *diskTier, dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
+	bb := getDiskBuf()
+	defer putDiskBuf(bb)
+
+	b.mu.RLock()
+	loc, ok := b.dm[h]
+	pending := false
+	if ok {
+		bb.B, pending = b.readSpillLocked(bb.B[:0], loc)
+	}
+	b.mu.RUnlock()
+	if !ok {
+		return dst, false
+	}
+
+	var err error
+	if !pending {
+		bb.B, err = dt.read(bb.B[:0], loc)
+	}
+	if err != nil {
+		if err == errDiskLocStale {
+			b.mu.Lock()
+			if b.dm[h] == loc {
+				delete(b.dm, h)
+			}
+			b.mu.Unlock()
+		}
+		return dst, false
+	}
+	kv := bb.B
+	keyLen := (uint64(kv[0]) << 8) | uint64(kv[1])
+	valLen := (uint64(kv[2]) << 8) | uint64(kv[3])
+	if 4+keyLen+valLen != uint64(len(kv)) {
+		atomic.AddUint64(&b.corruptions, 1)
+		if b.obs != nil {
+			b.obs.OnCorruption()
+		}
+		return dst, false
+	}
+	if string(k) != string(kv[4:4+keyLen]) {
+		atomic.AddUint64(&b.collisions, 1)
+		if b.obs != nil {
+			b.obs.OnCollision(k)
+		}
+		return dst, false
+	}
+	v := kv[4+keyLen:]
+	atomic.AddUint64(&dt.hits, 1)
+
+	// Promote the entry back to memory unless it has been modified in the meantime.
+	evicted := 0
+	b.mu.Lock()
+	if dmLoc, ok := b.dm[h]; ok && dmLoc == loc {
+		evicted = b.setLocked(k, v, h)
+	}
+	b.mu.Unlock()
+	b.writeSpills()
+	if b.obs != nil && evicted > 0 {
+		b.obs.OnEvict(evicted)
+	}
+
+	if returnDst {
+		dst = append(dst, v...)
+	}
+	return dst, true
+}
+
+type spillBuf struct {
+	buf     []byte
+	hs      []uint64
+	offsets []uint64
+}
+
+func getSpillBuf() *spillBuf {
+	v := spillBufPool.Get()
+	if v == nil {
+		return &spillBuf{}
+	}
+	return v.(*spillBuf)
+}
+
+func putSpillBuf(sb *spillBuf) {
+	sb.buf = sb.buf[:0]
+	sb.hs = sb.hs[:0]
+	sb.offsets = sb.offsets[:0]
+	spillBufPool.Put(sb)
+}
+
+var spillBufPool sync.Pool
+
+func getDiskBuf() *bytesBuf {
+	v := diskBufPool.Get()
+	if v == nil {
+		return &bytesBuf{}
+	}
+	return v.(*bytesBuf)
+}
+
+func putDiskBuf(bb *bytesBuf) {
+	bb.B = bb.B[:0]
+	diskBufPool.Put(bb)
+}
+
+var diskBufPool sync.Pool
@@ -0,0 +1,350 @@
+package fastcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+func TestDiskTier(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk")
+	cfg := &Config{
+		MaxBytes:     bucketsCount * chunkSize,
+		DiskPath:     diskPath,
+		DiskMaxBytes: 256 * 1024 * 1024,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+
+	// Write twice more data than the memory capacity, so the first entries are spilled to disk.
+	itemsCount := 2 * cfg.MaxBytes / len(diskTestValue(nil))
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		c.Set(k, diskTestValue(k))
+	}
+	var s Stats
+	c.UpdateStats(&s)
+	if s.DiskWrites == 0 || s.DiskWriteBytes == 0 || s.DiskEntriesCount == 0 || s.DiskBytesSize == 0 {
+		t.Fatalf("expecting non-zero disk tier stats after overflowing the memory; got %+v", s)
+	}
+	if s.DiskMaxBytesSize != uint64(cfg.DiskMaxBytes) {
+		t.Fatalf("unexpected DiskMaxBytesSize; got %d; want %d", s.DiskMaxBytesSize, cfg.DiskMaxBytes)
+	}
+	if s.DiskErrors != 0 {
+		t.Fatalf("unexpected disk errors: %d", s.DiskErrors)
+	}
+
+	// The first entry must be promoted to memory after reading it from disk.
+	k := []byte("key 0")
+	for range 2 {
+		if v := c.Get(nil, k); string(v) != string(diskTestValue(k)) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, diskTestValue(k))
+		}
+	}
+	s.Reset()
+	c.UpdateStats(&s)
+	if s.DiskReads != 1 || s.DiskHits != 1 {
+		t.Fatalf("unexpected disk reads for the promoted entry; got %d reads, %d hits; want 1 read, 1 hit", s.DiskReads, s.DiskHits)
+	}
+
+	// All the entries must be available either in memory or on disk.
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v, ok := c.HasGet(nil, k)
+		if !ok {
+			t.Fatalf("cannot find entry for key %q", k)
+		}
+		if string(v) != string(diskTestValue(k)) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, diskTestValue(k))
+		}
+	}
+	s.Reset()
+	c.UpdateStats(&s)
+	if s.DiskHits == 0 || s.DiskReads == 0 || s.DiskReadBytes == 0 {
+		t.Fatalf("expecting non-zero disk tier read stats; got %+v", s)
+	}
+	if s.Misses != 0 {
+		t.Fatalf("unexpected number of misses; got %d; want 0", s.Misses)
+	}
+
+	// Deleted and overwritten entries mustn't be resurrected from disk.
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if i%2 == 0 {
+			c.Del(k)
+		} else {
+			c.Set(k, []byte("new value"))
+		}
+	}
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v, ok := c.HasGet(nil, k)
+		if i%2 == 0 {
+			if ok {
+				t.Fatalf("unexpected entry for the deleted key %q: %q", k, v)
+			}
+		} else if !ok || string(v) != "new value" {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, "new value")
+		}
+	}
+
+	// Close must remove the disk tier data, while the cache must remain usable.
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	des, err := os.ReadDir(diskPath)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", diskPath, err)
+	}
+	if len(des) != 0 {
+		t.Fatalf("unexpected files left at %q after Close: %d", diskPath, len(des))
+	}
+	for i := range c.buckets[:] {
+		if b := &c.buckets[i]; b.disk != nil || b.dm != nil {
+			t.Fatalf("the disk tier must be detached from bucket[%d] after Close", i)
+		}
+	}
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("overflow key %d", i)), diskTestValue(nil))
+	}
+	s.Reset()
+	c.UpdateStats(&s)
+	if s.DiskEntriesCount != 0 || s.DiskBytesSize != 0 {
+		t.Fatalf("unexpected disk tier stats after Close: %+v", s)
+	}
+	if v := c.Get(nil, []byte("key 0")); v != nil {
+		t.Fatalf("unexpected value read from the closed disk tier: %q", v)
+	}
+}
+
+func TestDiskTierOverflow(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk")
+
+	// Stale segments must be removed on start.
+	if err := os.MkdirAll(diskPath, 0755); err != nil {
+		t.Fatalf("cannot create %q: %s", diskPath, err)
+	}
+	stalePath := filepath.Join(diskPath, "0000000000000005.seg")
+	if err := os.WriteFile(stalePath, []byte("foobar"), 0644); err != nil {
+		t.Fatalf("cannot create %q: %s", stalePath, err)
+	}
+
+	cfg := &Config{
+		MaxBytes:     bucketsCount * chunkSize,
+		DiskPath:     diskPath,
+		DiskMaxBytes: 4 * 1024 * 1024,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	defer func() {
+		_ = c.Close()
+	}()
+	if _, err := os.Stat(stalePath); !os.IsNotExist(err) {
+		t.Fatalf("stale segment %q must be removed; stat error: %v", stalePath, err)
+	}
+
+	itemsCount := 4 * cfg.MaxBytes / len(diskTestValue(nil))
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		c.Set(k, diskTestValue(k))
+	}
+	var s Stats
+	c.UpdateStats(&s)
+	if s.DiskBytesSize > s.DiskMaxBytesSize {
+		t.Fatalf("too big disk tier size; got %d bytes; mustn't exceed %d bytes", s.DiskBytesSize, s.DiskMaxBytesSize)
+	}
+	if s.DiskErrors != 0 {
+		t.Fatalf("unexpected disk errors: %d", s.DiskErrors)
+	}
+
+	// The oldest entries must be evicted from the disk tier.
+	if v := c.Get(nil, []byte("key 0")); v != nil {
+		t.Fatalf("unexpected value for the evicted entry: %q", v)
+	}
+	// The newest entries must be available.
+	for i := itemsCount - 100; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if v := c.Get(nil, k); string(v) != string(diskTestValue(k)) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, diskTestValue(k))
+		}
+	}
+
+	// Reset must remove disk tier data.
+	c.Reset()
+	s.Reset()
+	c.UpdateStats(&s)
+	if s.DiskEntriesCount != 0 || s.DiskBytesSize != 0 {
+		t.Fatalf("unexpected disk tier stats after Reset: %+v", s)
+	}
+}
+
+func TestDiskTierPendingSpill(t *testing.T) {
+	cfg := &Config{
+		MaxBytes:     bucketsCount * chunkSize,
+		DiskPath:     filepath.Join(t.TempDir(), "disk"),
+		DiskMaxBytes: 4 * 1024 * 1024,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	defer func() {
+		_ = c.Close()
+	}()
+
+	k := []byte("key")
+	c.Set(k, diskTestValue(k))
+	b := &c.buckets[xxhash.Sum64(k)%bucketsCount]
+
+	// Spill the chunk without writing the spill to disk.
+	// The entry must be readable from the pending spill in the meantime.
+	b.mu.Lock()
+	b.spillChunkLocked(0)
+	pending := len(b.spills)
+	b.mu.Unlock()
+	if pending != 1 {
+		t.Fatalf("unexpected number of pending spills; got %d; want 1", pending)
+	}
+	var s Stats
+	c.UpdateStats(&s)
+	if s.DiskWrites != 0 || s.DiskEntriesCount != 1 {
+		t.Fatalf("unexpected stats for the pending spill; got %d writes, %d entries; want 0 writes, 1 entry", s.DiskWrites, s.DiskEntriesCount)
+	}
+	if v := c.Get(nil, k); string(v) != string(diskTestValue(k)) {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, diskTestValue(k))
+	}
+
+	// The pending spill must be written after promoting the entry back to memory.
+	s.Reset()
+	c.UpdateStats(&s)
+	if s.DiskReads != 0 || s.DiskHits != 1 || s.DiskWrites != 1 {
+		t.Fatalf("unexpected disk stats; got %d reads, %d hits, %d writes; want 0 reads, 1 hit, 1 write", s.DiskReads, s.DiskHits, s.DiskWrites)
+	}
+	b.mu.RLock()
+	pending = len(b.spills)
+	b.mu.RUnlock()
+	if pending != 0 {
+		t.Fatalf("unexpected number of pending spills after writing them; got %d; want 0", pending)
+	}
+}
+
+func TestDiskSegmentRefs(t *testing.T) {
+	dt, err := openDiskTier(filepath.Join(t.TempDir(), "disk"), 4*chunkSize)
+	if err != nil {
+		t.Fatalf("cannot open disk tier: %s", err)
+	}
+	seg, offset, err := dt.reserve(3)
+	if err != nil {
+		t.Fatalf("cannot reserve space: %s", err)
+	}
+	path := seg.f.Name()
+
+	// The segment must remain usable until the reference obtained via reserve is released.
+	dt.close()
+	if err := dt.write(seg, offset, []byte("foo")); err != nil {
+		t.Fatalf("cannot write to the segment removed from the disk tier: %s", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("the referenced segment must exist; stat error: %s", err)
+	}
+	dt.releaseSegment(seg)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the segment must be removed after releasing the last reference; stat error: %v", err)
+	}
+}
+
+func TestDiskTierInvalidConfig(t *testing.T) {
+	cfg := &Config{
+		MaxBytes:     bucketsCount * chunkSize,
+		DiskPath:     filepath.Join(t.TempDir(), "disk"),
+		DiskMaxBytes: chunkSize,
+	}
+	if _, err := NewFromConfig(cfg); err == nil {
+		t.Fatalf("expecting non-nil error for too small DiskMaxBytes")
+	}
+}
+
+func TestDiskLoc(t *testing.T) {
+	f := func(segmentID, offset, kvLen uint64) {
+		t.Helper()
+		loc := packDiskLoc(segmentID, offset, kvLen)
+		segmentIDLow, offsetResult, kvLenResult := unpackDiskLoc(loc)
+		if offsetResult != offset || kvLenResult != kvLen {
+			t.Fatalf("unexpected offset and kvLen; got %d, %d; want %d, %d", offsetResult, kvLenResult, offset, kvLen)
+		}
+		first := uint64(0)
+		if segmentID > 10 {
+			first = segmentID - 10
+		}
+		last := segmentID + 10
+		if id := resolveDiskSegmentID(segmentIDLow, first, last); id != segmentID {
+			t.Fatalf("unexpected segment id; got %d; want %d", id, segmentID)
+		}
+	}
+	f(0, 0, 0)
+	f(1, 123, 456)
+	f(1<<diskSegmentIDBits-1, diskSegmentMaxSize-1, chunkSize-1)
+	f(1<<diskSegmentIDBits, 0, 10)
+	f(5<<diskSegmentIDBits+3, 1234, 5678)
+
+	// Segments older than the first live segment must be resolved to ids smaller than first.
+	if id := resolveDiskSegmentID(3, 5, 10); id >= 5 {
+		t.Fatalf("unexpected id for the removed segment: %d", id)
+	}
+}
+
+// diskTestValue returns a 1000-byte value for the key k.
+func diskTestValue(k []byte) []byte {
+	v := make([]byte, 1000)
+	copy(v, k)
+	return v
+}
+
+func TestDiskTierConcurrent(t *testing.T) {
+	cfg := &Config{
+		MaxBytes:     bucketsCount * chunkSize,
+		DiskPath:     filepath.Join(t.TempDir(), "disk"),
+		DiskMaxBytes: 8 * 1024 * 1024,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	defer func() {
+		_ = c.Close()
+	}()
+
+	const workers = 4
+	itemsCount := 2 * cfg.MaxBytes / len(diskTestValue(nil)) / workers
+	resultCh := make(chan error, workers)
+	for n := range workers {
+		go func() {
+			for i := range itemsCount {
+				k := []byte(fmt.Sprintf("key %d-%d", n, i))
+				c.Set(k, diskTestValue(k))
+				k = []byte(fmt.Sprintf("key %d-%d", n, i/2))
+				if v := c.Get(nil, k); v != nil && string(v) != string(diskTestValue(k)) {
+					resultCh <- fmt.Errorf("unexpected value for key %q; got %q; want %q", k, v, diskTestValue(k))
+					return
+				}
+			}
+			resultCh <- nil
+		}()
+	}
+	for range workers {
+		if err := <-resultCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package fastcache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// EncryptionKey is a key for authenticated encryption of snapshot data files.
+//
+// Data files are encrypted with AES-GCM. The key ID is recorded in the snapshot metadata,
+// so the snapshot is decrypted with the right key after key rotation.
+type EncryptionKey struct {
+	// ID identifies the key. It mustn't be empty.
+	//
+	// Keys with distinct contents must have distinct IDs.
+	ID string
+
+	// Key is the AES key. It must contain 16, 24 or 32 bytes.
+	Key []byte
+}
+
+// encryptionSaltSize is the size of the random salt generated for every encrypted snapshot.
+const encryptionSaltSize = 16
+
+// encryptedSegmentSize is the maximum size of plaintext in a single encrypted segment of a data file.
+const encryptedSegmentSize = 64 * 1024
+
+func (ek *EncryptionKey) validate(codec Codec) error {
+	if ek.ID == "" {
+		return fmt.Errorf("encryption key ID mustn't be empty")
+	}
+	if len(ek.ID) > 255 {
+		return fmt.Errorf("too long encryption key ID; got %d bytes; it cannot exceed 255 bytes", len(ek.ID))
+	}
+	switch len(ek.Key) {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("invalid size for the encryption key %q; got %d bytes; want 16, 24 or 32 bytes", ek.ID, len(ek.Key))
+	}
+	if codec == CodecMmap {
+		return fmt.Errorf("%s codec cannot be used with encryption", codec)
+	}
+	return nil
+}
+
+// validateEncryptionKey verifies whether ek may be used for encrypting data files with the given codec.
+//
+// ek may be nil, which means no encryption.
+func validateEncryptionKey(ek *EncryptionKey, codec Codec) error {
+	if ek == nil {
+		return nil
+	}
+	return ek.validate(codec)
+}
+
+// setEncryptionKey enables encryption of data files in sh with ek.
+func (sh *snapshotHeader) setEncryptionKey(ek *EncryptionKey) error {
+	if err := ek.validate(sh.codec); err != nil {
+		return err
+	}
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("cannot generate encryption salt: %s", err)
+	}
+	sh.keyID = ek.ID
+	sh.key = append([]byte(nil), ek.Key...)
+	sh.salt = salt
+	return nil
+}
+
+// openEncryption selects the key for decrypting data files in sh from keys
+// and authenticates the metadata of sh with it.
+//
+// It is a no-op if data files in sh aren't encrypted.
+func (sh *snapshotHeader) openEncryption(keys []*EncryptionKey) error {
+	if sh.keyID == "" {
+		return nil
+	}
+	var ek *EncryptionKey
+	for _, k := range keys {
+		if k != nil && k.ID == sh.keyID {
+			ek = k
+			break
+		}
+	}
+	if ek == nil {
+		return fmt.Errorf("snapshot data is encrypted with the key %q, which is missing in the provided encryption keys", sh.keyID)
+	}
+	if err := ek.validate(sh.codec); err != nil {
+		return err
+	}
+	aead, err := newSnapshotAEAD(ek.Key, sh.salt, "metadata")
+	if err != nil {
+		return err
+	}
+	var nonce [12]byte
+	if _, err := aead.Open(nil, nonce[:], sh.tag, sh.authData); err != nil {
+		return corruptionErrorf("cannot authenticate snapshot metadata with the key %q; the metadata may be tampered or the key may be wrong", sh.keyID)
+	}
+	sh.key = append([]byte(nil), ek.Key...)
+	return nil
+}
+
+// metadataTag returns the tag, which authenticates metadata of the encrypted snapshot sh.
+func (sh *snapshotHeader) metadataTag(metadata []byte) ([]byte, error) {
+	aead, err := newSnapshotAEAD(sh.key, sh.salt, "metadata")
+	if err != nil {
+		return nil, err
+	}
+	var nonce [12]byte
+	return aead.Seal(nil, nonce[:], nil, metadata), nil
+}
+
+// newDataWriter returns a writer for the data file with the given name in the snapshot sh.
+//
+// The returned writer compresses data with sh.codec and encrypts it if sh is encrypted.
+// It must be closed in order to flush the buffered data to w.
+func (sh *snapshotHeader) newDataWriter(name string, w io.Writer) (io.WriteCloser, error) {
+	if sh.keyID == "" {
+		return newCodecWriter(sh.codec, w)
+	}
+	aead, err := newSnapshotAEAD(sh.key, sh.salt, "data file "+name)
+	if err != nil {
+		return nil, err
+	}
+	ew := &encryptWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, encryptedSegmentSize),
+	}
+	zw, err := newCodecWriter(sh.codec, ew)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedDataWriter{
+		zw: zw,
+		ew: ew,
+	}, nil
+}
+
+// newDataReader returns a reader for the data file with the given name in the snapshot sh.
+//
+// The returned reader decrypts data if sh is encrypted and decompresses it with sh.codec.
+func (sh *snapshotHeader) newDataReader(name string, r io.Reader) (io.Reader, error) {
+	if sh.keyID != "" {
+		if sh.key == nil {
+			return nil, fmt.Errorf("snapshot data is encrypted with the key %q, which is missing in the provided encryption keys", sh.keyID)
+		}
+		aead, err := newSnapshotAEAD(sh.key, sh.salt, "data file "+name)
+		if err != nil {
+			return nil, err
+		}
+		r = &decryptReader{
+			r:    r,
+			aead: aead,
+			buf:  make([]byte, encryptedSegmentSize+aead.Overhead()),
+		}
+	}
+	return newCodecReader(sh.codec, r)
+}
+
+// newSnapshotAEAD returns AES-GCM for the given purpose in the snapshot with the given salt.
+//
+// Every data file and the metadata are encrypted with distinct keys derived from key,
+// so nonces may be safely generated from segment numbers.
+func newSnapshotAEAD(key, salt []byte, purpose string) (cipher.AEAD, error) {
+	k, err := hkdf.Key(sha256.New, key, salt, "fastcache snapshot "+purpose, 32)
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive encryption key: %s", err)
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create AES cipher: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create AES-GCM: %s", err)
+	}
+	return aead, nil
+}
+
+// encryptedDataWriter compresses data with zw and then encrypts it with ew.
+type encryptedDataWriter struct {
+	zw io.WriteCloser
+	ew *encryptWriter
+}
+
+func (w *encryptedDataWriter) Write(p []byte) (int, error) {
+	return w.zw.Write(p)
+}
+
+func (w *encryptedDataWriter) Close() error {
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	return w.ew.Close()
+}
+
+// encryptWriter encrypts data written to it and writes it to w in segments.
+//
+// Every segment contains up to encryptedSegmentSize bytes of plaintext sealed with aead.
+// The segment number is used as a nonce, so segments cannot be reordered.
+// The last segment is marked as final, so truncated data is detected when reading it.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	sealed []byte
+	seq    uint64
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		p = p[m:]
+		n += m
+		if len(ew.buf) == cap(ew.buf) {
+			if err := ew.flush(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the final segment.
+func (ew *encryptWriter) Close() error {
+	return ew.flush(true)
+}
+
+func (ew *encryptWriter) flush(final bool) error {
+	ew.sealed = ew.aead.Seal(ew.sealed[:0], segmentNonce(ew.seq), ew.buf, segmentAdditionalData(final))
+	ew.seq++
+	ew.buf = ew.buf[:0]
+	if _, err := ew.w.Write(ew.sealed); err != nil {
+		return fmt.Errorf("cannot write encrypted data: %w", err)
+	}
+	return nil
+}
+
+// decryptReader decrypts data written by encryptWriter.
+type decryptReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	plain []byte
+	seq   uint64
+	final bool
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.final {
+			return 0, io.EOF
+		}
+		if err := dr.readSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) readSegment() error {
+	n, err := io.ReadFull(dr.r, dr.buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Only the final segment may be shorter than the maximum segment size.
+		dr.final = true
+	} else if err != nil {
+		return fmt.Errorf("cannot read encrypted segment #%d: %w", dr.seq, err)
+	}
+	if dr.final && n < dr.aead.Overhead() {
+		return corruptionErrorf("missing final encrypted segment; the data may be truncated")
+	}
+	plain, err := dr.aead.Open(dr.buf[:0], segmentNonce(dr.seq), dr.buf[:n], segmentAdditionalData(dr.final))
+	if err != nil {
+		return corruptionErrorf("cannot decrypt segment #%d: %s; the data may be tampered", dr.seq, err)
+	}
+	dr.seq++
+	dr.plain = plain
+	return nil
+}
+
+func segmentNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, seq)
+	return nonce
+}
+
+func segmentAdditionalData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
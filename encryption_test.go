@@ -0,0 +1,252 @@
+package fastcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptWriterDecryptReader(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	salt := make([]byte, encryptionSaltSize)
+	newAEAD := func() *encryptWriter {
+		t.Helper()
+		aead, err := newSnapshotAEAD(key, salt, "test")
+		if err != nil {
+			t.Fatalf("cannot create AEAD: %s", err)
+		}
+		return &encryptWriter{
+			aead: aead,
+			buf:  make([]byte, 0, encryptedSegmentSize),
+		}
+	}
+	encrypt := func(data []byte) []byte {
+		t.Helper()
+		var bb bytes.Buffer
+		ew := newAEAD()
+		ew.w = &bb
+		if _, err := ew.Write(data); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := ew.Close(); err != nil {
+			t.Fatalf("cannot close writer: %s", err)
+		}
+		return bb.Bytes()
+	}
+	decrypt := func(encrypted []byte) ([]byte, error) {
+		t.Helper()
+		aead := newAEAD().aead
+		dr := &decryptReader{
+			r:    bytes.NewReader(encrypted),
+			aead: aead,
+			buf:  make([]byte, encryptedSegmentSize+aead.Overhead()),
+		}
+		return io.ReadAll(dr)
+	}
+
+	for _, n := range []int{0, 1, 1000, encryptedSegmentSize - 1, encryptedSegmentSize, 3*encryptedSegmentSize + 123} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		encrypted := encrypt(data)
+		if n > 0 && bytes.Contains(encrypted, data[:min(n, 64)]) {
+			t.Fatalf("encrypted data contains plaintext for n=%d", n)
+		}
+		result, err := decrypt(encrypted)
+		if err != nil {
+			t.Fatalf("cannot decrypt data for n=%d: %s", n, err)
+		}
+		if !bytes.Equal(result, data) {
+			t.Fatalf("unexpected decrypted data for n=%d", n)
+		}
+
+		// Truncated data must be detected.
+		segmentLen := encryptedSegmentSize + 16
+		truncateLens := []int{len(encrypted) - 1}
+		if len(encrypted) > segmentLen {
+			truncateLens = append(truncateLens, segmentLen)
+		}
+		for _, truncateLen := range truncateLens {
+			_, err := decrypt(encrypted[:truncateLen])
+			var ce *CorruptionError
+			if !errors.As(err, &ce) {
+				t.Fatalf("expecting CorruptionError for data truncated to %d bytes out of %d bytes; got %v", truncateLen, len(encrypted), err)
+			}
+		}
+
+		// Modified data must be detected.
+		tampered := append([]byte(nil), encrypted...)
+		tampered[len(tampered)/2] ^= 1
+		if _, err := decrypt(tampered); err == nil {
+			t.Fatalf("expecting non-nil error for tampered data for n=%d", n)
+		}
+	}
+
+	// Reordered segments must be detected.
+	data := bytes.Repeat([]byte("x"), 2*encryptedSegmentSize+1)
+	encrypted := encrypt(data)
+	segmentLen := encryptedSegmentSize + 16
+	var reordered []byte
+	reordered = append(reordered, encrypted[segmentLen:2*segmentLen]...)
+	reordered = append(reordered, encrypted[:segmentLen]...)
+	reordered = append(reordered, encrypted[2*segmentLen:]...)
+	if _, err := decrypt(reordered); err == nil {
+		t.Fatalf("expecting non-nil error for reordered segments")
+	}
+}
+
+func TestSaveLoadEncrypted(t *testing.T) {
+	tmpDir := t.TempDir()
+	k1 := &EncryptionKey{
+		ID:  "key1",
+		Key: []byte("0123456789abcdef0123456789abcdef"),
+	}
+	k2 := &EncryptionKey{
+		ID:  "key2",
+		Key: []byte("fedcba9876543210"),
+	}
+
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+	const itemsCount = 10000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("secret value %d", i)))
+	}
+	checkCache := func(c *Cache) {
+		t.Helper()
+		for i := range itemsCount {
+			k := fmt.Sprintf("key %d", i)
+			vExpected := fmt.Sprintf("secret value %d", i)
+			if v := c.Get(nil, []byte(k)); string(v) != vExpected {
+				t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+			}
+		}
+	}
+	load := func(filePath string, keys ...*EncryptionKey) (*Cache, error) {
+		return LoadFromFileContext(context.Background(), filePath, &LoadOptions{
+			EncryptionKeys: keys,
+		})
+	}
+
+	for _, codec := range []Codec{CodecSnappy, CodecNone, CodecFlate} {
+		filePath := filepath.Join(tmpDir, "snapshot_"+codec.String())
+		opts := &SaveOptions{
+			Codec:         codec,
+			EncryptionKey: k1,
+		}
+		if err := c.SaveToFileOptions(filePath, opts); err != nil {
+			t.Fatalf("SaveToFileOptions error for codec %s: %s", codec, err)
+		}
+		data, err := os.ReadFile(filepath.Join(mustResolveSnapshotDir(t, filePath), "data.0.bin"))
+		if err != nil {
+			t.Fatalf("cannot read data file: %s", err)
+		}
+		if bytes.Contains(data, []byte("secret value")) {
+			t.Fatalf("data file contains plaintext values for codec %s", codec)
+		}
+		c1, err := load(filePath, k2, k1)
+		if err != nil {
+			t.Fatalf("cannot load encrypted snapshot for codec %s: %s", codec, err)
+		}
+		checkCache(c1)
+		c1.Reset()
+	}
+
+	filePath := filepath.Join(tmpDir, "snapshot_none")
+
+	// The snapshot cannot be loaded without the key.
+	if _, err := LoadFromFile(filePath); err == nil {
+		t.Fatalf("expecting non-nil error when loading encrypted snapshot without keys")
+	}
+	if _, err := load(filePath, k2); err == nil {
+		t.Fatalf("expecting non-nil error when loading encrypted snapshot without the matching key")
+	}
+
+	// The wrong key with the same ID must be detected.
+	wrongKey := &EncryptionKey{
+		ID:  k1.ID,
+		Key: k2.Key,
+	}
+	_, err := load(filePath, wrongKey)
+	var ce *CorruptionError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expecting CorruptionError for the wrong key; got %v", err)
+	}
+
+	// Rotate the key.
+	if err := c.SaveToFileOptions(filePath, &SaveOptions{Codec: CodecNone, EncryptionKey: k2}); err != nil {
+		t.Fatalf("SaveToFileOptions error: %s", err)
+	}
+	if _, err := load(filePath, k1); err == nil {
+		t.Fatalf("expecting non-nil error when loading the snapshot with the previous key")
+	}
+	c1, err := load(filePath, k1, k2)
+	if err != nil {
+		t.Fatalf("cannot load snapshot after key rotation: %s", err)
+	}
+	checkCache(c1)
+	c1.Reset()
+
+	// Tampered data file must be detected.
+	snapshotDir := mustResolveSnapshotDir(t, filePath)
+	dataPath := filepath.Join(snapshotDir, "data.0.bin")
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("cannot read data file: %s", err)
+	}
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatalf("cannot write data file: %s", err)
+	}
+	_, err = load(filePath, k2)
+	if !errors.As(err, &ce) {
+		t.Fatalf("expecting CorruptionError for tampered data file; got %v", err)
+	}
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatalf("cannot write data file: %s", err)
+	}
+
+	// Tampered metadata must be detected.
+	sh, err := loadMetadata(NewFileSnapshotStore(snapshotDir))
+	if err != nil {
+		t.Fatalf("cannot load metadata: %s", err)
+	}
+	sh.files[0].buckets = sh.files[0].buckets[1:]
+	if err := saveMetadata(sh, NewFileSnapshotStore(snapshotDir)); err != nil {
+		t.Fatalf("cannot save metadata: %s", err)
+	}
+	_, err = load(filePath, k2)
+	if !errors.As(err, &ce) {
+		t.Fatalf("expecting CorruptionError for tampered metadata; got %v", err)
+	}
+}
+
+func TestSaveEncryptedInvalidKey(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	f := func(ek *EncryptionKey, codec Codec) {
+		t.Helper()
+		opts := &SaveOptions{
+			Codec:         codec,
+			EncryptionKey: ek,
+		}
+		if err := c.SaveToFileOptions(filePath, opts); err == nil {
+			t.Fatalf("expecting non-nil error for key %+v and codec %s", ek, codec)
+		}
+		if _, err := c.StartAutoSave(filePath, 0, &AutoSaveOptions{SaveOptions: *opts}); err == nil {
+			t.Fatalf("expecting non-nil error for StartAutoSave with key %+v and codec %s", ek, codec)
+		}
+	}
+	key := []byte("0123456789abcdef")
+	f(&EncryptionKey{Key: key}, CodecSnappy)
+	f(&EncryptionKey{ID: "key", Key: key[:10]}, CodecSnappy)
+	f(&EncryptionKey{ID: "key", Key: key}, CodecMmap)
+}
@@ -0,0 +1,348 @@
+package fastcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// ExportFormat is the format of records written by Cache.Export.
+type ExportFormat int
+
+const (
+	// ExportJSONLines writes every record as a JSON object on a separate line:
+	//
+	//	{"key":"<base64>","value":"<base64>","big":true}
+	//
+	// Keys and values are base64-encoded. The "big" field is set for values stored with SetBig.
+	ExportJSONLines ExportFormat = 0
+
+	// ExportBinary writes records in compact length-prefixed binary format.
+	//
+	// The stream starts with a magic header. Every record consists of the record type byte,
+	// followed by uvarint-encoded key length, the key, uvarint-encoded value length and the value.
+	// The stream ends with the zero record type byte, so truncated streams are detected.
+	ExportBinary ExportFormat = 1
+)
+
+// String returns human-readable format name.
+func (format ExportFormat) String() string {
+	switch format {
+	case ExportJSONLines:
+		return "jsonl"
+	case ExportBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("ExportFormat(%d)", int(format))
+	}
+}
+
+// exportMagic is written at the beginning of the stream in ExportBinary format.
+const exportMagic = "FCEXPT\x00\x01"
+
+// Record types in ExportBinary format.
+const (
+	exportRecordEnd    = 0
+	exportRecordSet    = 1
+	exportRecordSetBig = 2
+)
+
+// exportRecord is a record in ExportJSONLines format.
+type exportRecord struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Big   bool   `json:"big,omitempty"`
+}
+
+// Export writes all the entries from c to w as logical key-value records in the given format.
+//
+// Unlike snapshots, exported records don't depend on the cache geometry,
+// so they may be imported with Import into a cache of any size or processed by other systems.
+// Values stored with SetBig are reassembled into a single record.
+// Entries evicted to the disk tier aren't exported.
+//
+// Export may be called concurrently with other operations on the cache.
+// Entries modified during the export may be missing in the exported records.
+func (c *Cache) Export(w io.Writer, format ExportFormat) error {
+	switch format {
+	case ExportJSONLines, ExportBinary:
+	default:
+		return fmt.Errorf("unsupported export format %s", format)
+	}
+
+	// Collect values stored with SetBig, so their subvalues aren't exported as separate records.
+	bigValues := make(map[uint64]uint64)
+	var buf []byte
+	err := c.visitEntries(func(k, v []byte) error {
+		if len(v) != 16 {
+			return nil
+		}
+		var ok bool
+		buf, ok = c.peekBig(buf[:0], v)
+		if ok {
+			bigValues[unmarshalUint64(v)] = unmarshalUint64(v[8:])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	var je *json.Encoder
+	if format == ExportJSONLines {
+		je = json.NewEncoder(bw)
+	} else if _, err := bw.WriteString(exportMagic); err != nil {
+		return fmt.Errorf("cannot write export magic: %w", err)
+	}
+	writeRecord := func(k, v []byte, big bool) error {
+		if je != nil {
+			return je.Encode(&exportRecord{
+				Key:   k,
+				Value: v,
+				Big:   big,
+			})
+		}
+		recordType := byte(exportRecordSet)
+		if big {
+			recordType = exportRecordSetBig
+		}
+		buf = append(buf[:0], recordType)
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+		_, err := bw.Write(v)
+		return err
+	}
+	var bigValue []byte
+	err = c.visitEntries(func(k, v []byte) error {
+		if isBigSubkey(k, bigValues) {
+			return nil
+		}
+		if len(v) == 16 {
+			if valueLen, ok := bigValues[unmarshalUint64(v)]; ok && valueLen == unmarshalUint64(v[8:]) {
+				bigValue, ok = c.peekBig(bigValue[:0], v)
+				if !ok {
+					// The value has been evicted or overwritten in the meantime.
+					return nil
+				}
+				return writeRecord(k, bigValue, true)
+			}
+		}
+		return writeRecord(k, v, false)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot write exported record: %w", err)
+	}
+	if je == nil {
+		if err := bw.WriteByte(exportRecordEnd); err != nil {
+			return fmt.Errorf("cannot write the end of exported records: %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("cannot write exported records: %w", err)
+	}
+	return nil
+}
+
+// Import reads records written by Export from r and stores them in c.
+//
+// The format of records is detected automatically.
+// Records with values stored with SetBig are stored with SetBig.
+func (c *Cache) Import(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(exportMagic))
+	if err == nil && string(magic) == exportMagic {
+		_, _ = br.Discard(len(exportMagic))
+		return c.importBinary(br)
+	}
+	return c.importJSONLines(br)
+}
+
+func (c *Cache) importJSONLines(r io.Reader) error {
+	jd := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var rec exportRecord
+		if err := jd.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("cannot parse record #%d: %w", n, err)
+		}
+		c.importRecord(rec.Key, rec.Value, rec.Big)
+	}
+}
+
+func (c *Cache) importBinary(br *bufio.Reader) error {
+	var k, v bytes.Buffer
+	for n := 1; ; n++ {
+		recordType, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("cannot read record type for record #%d: %w", n, err)
+		}
+		switch recordType {
+		case exportRecordEnd:
+			return nil
+		case exportRecordSet, exportRecordSetBig:
+		default:
+			return fmt.Errorf("unexpected type %d for record #%d", recordType, n)
+		}
+		if err := readExportBytes(br, &k); err != nil {
+			return fmt.Errorf("cannot read key for record #%d: %w", n, err)
+		}
+		if err := readExportBytes(br, &v); err != nil {
+			return fmt.Errorf("cannot read value for record #%d: %w", n, err)
+		}
+		c.importRecord(k.Bytes(), v.Bytes(), recordType == exportRecordSetBig)
+	}
+}
+
+// readExportBytes reads length-prefixed bytes from br into bb.
+//
+// bb grows while the data is read, so a corrupted length doesn't result in a huge memory allocation.
+func readExportBytes(br *bufio.Reader, bb *bytes.Buffer) error {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("cannot read length: %w", err)
+	}
+	if n > 1<<62 {
+		return fmt.Errorf("too big length=%d", n)
+	}
+	bb.Reset()
+	if _, err := io.CopyN(bb, br, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Cache) importRecord(k, v []byte, big bool) {
+	if big {
+		c.SetBig(k, v)
+	} else {
+		c.Set(k, v)
+	}
+}
+
+// visitEntries calls f for every entry stored in memory in c.
+//
+// Entries of every bucket are copied under the bucket lock, so f may access c.
+// f mustn't hold k and v after returning.
+func (c *Cache) visitEntries(f func(k, v []byte) error) error {
+	var be bucketEntries
+	for i := range c.buckets[:] {
+		c.buckets[i].copyEntries(&be)
+		for j := range be.hs {
+			k, v := be.get(j)
+			if err := f(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bucketEntries holds copies of entries from a bucket.
+type bucketEntries struct {
+	buf  []byte
+	ends []int
+	hs   []uint64
+}
+
+// get returns the key and the value for the entry number i.
+func (be *bucketEntries) get(i int) ([]byte, []byte) {
+	start := 0
+	if i > 0 {
+		start = be.ends[2*i-1]
+	}
+	kEnd := be.ends[2*i]
+	return be.buf[start:kEnd], be.buf[kEnd:be.ends[2*i+1]]
+}
+
+// copyEntries copies entries from b to be in the order they were written to b.
+//
+// It returns the number of chunks in b.
+func (b *bucket) copyEntries(be *bucketEntries) int {
+	be.buf = be.buf[:0]
+	be.ends = be.ends[:0]
+	be.hs = be.hs[:0]
+	b.mu.Lock()
+	evicted := b.cleanLocked()
+	for _, e := range b.entriesLocked() {
+		k, v, ok := readChunksEntry(b.chunks, e.idx)
+		if !ok {
+			continue
+		}
+		be.buf = append(be.buf, k...)
+		be.ends = append(be.ends, len(be.buf))
+		be.buf = append(be.buf, v...)
+		be.ends = append(be.ends, len(be.buf))
+		be.hs = append(be.hs, e.h)
+	}
+	chunksLen := len(b.chunks)
+	b.mu.Unlock()
+	if b.obs != nil && evicted > 0 {
+		b.obs.OnEvict(evicted)
+	}
+	return chunksLen
+}
+
+// peekBig appends the value stored with SetBig for the given metavalue to dst.
+//
+// It returns false if the value is missing or corrupted. Unlike GetBig, stats aren't updated.
+func (c *Cache) peekBig(dst, metavalue []byte) ([]byte, bool) {
+	valueHash := unmarshalUint64(metavalue)
+	valueLen := unmarshalUint64(metavalue[8:])
+	subkey := getSubkeyBuf()
+	defer putSubkeyBuf(subkey)
+	dstLen := len(dst)
+	for i := uint64(0); uint64(len(dst)-dstLen) < valueLen; i++ {
+		subkey.B = marshalUint64(subkey.B[:0], valueHash)
+		subkey.B = marshalUint64(subkey.B, i)
+		h := xxhash.Sum64(subkey.B)
+		b := &c.buckets[h%bucketsCount]
+		b.mu.RLock()
+		subvalue, ok := b.lookupLocked(subkey.B, h)
+		dst = append(dst, subvalue...)
+		b.mu.RUnlock()
+		if !ok || len(subvalue) == 0 {
+			return dst[:dstLen], false
+		}
+	}
+	v := dst[dstLen:]
+	if uint64(len(v)) != valueLen || xxhash.Sum64(v) != valueHash {
+		return dst[:dstLen], false
+	}
+	return dst, true
+}
+
+// isBigSubkey returns true if k is a subkey for one of bigValues.
+//
+// bigValues maps valueHash to valueLen for values stored with SetBig.
+func isBigSubkey(k []byte, bigValues map[uint64]uint64) bool {
+	if len(k) != 16 {
+		return false
+	}
+	valueLen, ok := bigValues[unmarshalUint64(k)]
+	if !ok {
+		return false
+	}
+	subvaluesCount := (valueLen + maxSubvalueLen - 1) / maxSubvalueLen
+	return unmarshalUint64(k[8:]) < subvaluesCount
+}
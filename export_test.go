@@ -0,0 +1,123 @@
+package fastcache
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	c := New(bucketsCount * chunkSize * 4)
+	defer c.Reset()
+	const itemsCount = 1000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	// A regular 16-byte value mustn't be confused with the metavalue for SetBig.
+	c.Set([]byte("16 bytes"), []byte("0123456789abcdef"))
+	c.Set([]byte("empty"), nil)
+	bigValues := map[string][]byte{
+		"big empty": nil,
+		"big small": []byte("small value"),
+		"big large": bytes.Repeat([]byte("large value "), 3*chunkSize/12),
+	}
+	for k, v := range bigValues {
+		c.SetBig([]byte(k), v)
+	}
+	recordsExpected := itemsCount + 2 + len(bigValues)
+
+	checkCache := func(c *Cache) {
+		t.Helper()
+		for i := range itemsCount {
+			k := fmt.Sprintf("key %d", i)
+			vExpected := fmt.Sprintf("value %d", i)
+			if v := c.Get(nil, []byte(k)); string(v) != vExpected {
+				t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+			}
+		}
+		if v := c.Get(nil, []byte("16 bytes")); string(v) != "0123456789abcdef" {
+			t.Fatalf("unexpected value for 16-byte value; got %q", v)
+		}
+		if v, ok := c.HasGet(nil, []byte("empty")); !ok || len(v) != 0 {
+			t.Fatalf("unexpected value for empty value; got %q, ok=%v", v, ok)
+		}
+		for k, vExpected := range bigValues {
+			if v := c.GetBig(nil, []byte(k)); !bytes.Equal(v, vExpected) {
+				t.Fatalf("unexpected big value for key %q; got %d bytes; want %d bytes", k, len(v), len(vExpected))
+			}
+		}
+	}
+
+	for _, format := range []ExportFormat{ExportJSONLines, ExportBinary} {
+		var bb bytes.Buffer
+		if err := c.Export(&bb, format); err != nil {
+			t.Fatalf("Export error for %s format: %s", format, err)
+		}
+		var s Stats
+		c.UpdateStats(&s)
+		if s.GetCalls != 0 || s.GetBigCalls != 0 {
+			t.Fatalf("Export mustn't update stats; got GetCalls=%d, GetBigCalls=%d", s.GetCalls, s.GetBigCalls)
+		}
+		if format == ExportJSONLines {
+			if n := strings.Count(bb.String(), "\n"); n != recordsExpected {
+				t.Fatalf("unexpected number of exported records; got %d; want %d", n, recordsExpected)
+			}
+		}
+
+		// Import into the cache with another geometry.
+		data := bb.Bytes()
+		c1 := New(bucketsCount * chunkSize * 8)
+		if err := c1.Import(bytes.NewReader(data)); err != nil {
+			t.Fatalf("Import error for %s format: %s", format, err)
+		}
+		var s1 Stats
+		c1.UpdateStats(&s1)
+		// Every big value occupies the metavalue and its subvalues.
+		if s1.EntriesCount < uint64(recordsExpected) {
+			t.Fatalf("unexpected number of imported entries; got %d; want at least %d", s1.EntriesCount, recordsExpected)
+		}
+		checkCache(c1)
+		c1.Reset()
+
+		// Truncated binary stream must be detected.
+		if format == ExportBinary {
+			for _, n := range []int{len(exportMagic) + 1, len(data) / 2, len(data) - 1} {
+				c2 := New(1)
+				if err := c2.Import(bytes.NewReader(data[:n])); err == nil {
+					t.Fatalf("expecting non-nil error for the stream truncated to %d bytes", n)
+				}
+				c2.Reset()
+			}
+		}
+	}
+}
+
+func TestExportImportInvalid(t *testing.T) {
+	c := New(1)
+	defer c.Reset()
+	var bb bytes.Buffer
+	if err := c.Export(&bb, ExportFormat(123)); err == nil {
+		t.Fatalf("expecting non-nil error for unsupported format")
+	}
+
+	f := func(data string) {
+		t.Helper()
+		if err := c.Import(strings.NewReader(data)); err == nil {
+			t.Fatalf("expecting non-nil error for %q", data)
+		}
+	}
+	f("foobar")
+	f(`{"key":"a2V5","value":"dmFsdWU="}` + "\n" + `{"key":`)
+	f(`{"key":"not base64"}`)
+	f(exportMagic + "\x05")
+	f(exportMagic + "\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01")
+
+	// Empty input contains no records.
+	if err := c.Import(strings.NewReader("")); err != nil {
+		t.Fatalf("unexpected error for empty input: %s", err)
+	}
+	if err := c.Import(strings.NewReader(exportMagic + "\x00")); err != nil {
+		t.Fatalf("unexpected error for empty binary stream: %s", err)
+	}
+}
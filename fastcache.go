@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	xxhash "github.com/cespare/xxhash/v2"
 )
@@ -45,6 +46,7 @@ type Stats struct {
 	// Corruptions is the number of detected corruptions of the cache.
 	//
 	// Corruptions may occur when corrupted cache is loaded from file.
+	// Invalid index entries are detected and dropped during the load.
 	Corruptions uint64
 
 	// EntriesCount is the current number of entries in the cache.
@@ -56,8 +58,66 @@ type Stats struct {
 	// MaxBytesSize is the maximum allowed size of the cache in bytes (aka capacity).
 	MaxBytesSize uint64
 
+	// DiskEntriesCount is the current number of entries in the disk tier.
+	//
+	// It may include entries from the already removed disk tier segments.
+	DiskEntriesCount uint64
+
+	// DiskBytesSize is the current size of the disk tier in bytes.
+	DiskBytesSize uint64
+
+	// DiskMaxBytesSize is the maximum allowed size of the disk tier in bytes.
+	DiskMaxBytesSize uint64
+
+	// DiskHits is the number of Get calls served from the disk tier.
+	DiskHits uint64
+
+	// DiskReads is the number of reads from the disk tier.
+	DiskReads uint64
+
+	// DiskReadBytes is the number of bytes read from the disk tier.
+	DiskReadBytes uint64
+
+	// DiskWrites is the number of writes to the disk tier.
+	DiskWrites uint64
+
+	// DiskWriteBytes is the number of bytes written to the disk tier.
+	DiskWriteBytes uint64
+
+	// DiskErrors is the number of I/O errors in the disk tier.
+	DiskErrors uint64
+
+	// WALWrites is the number of writes to the write-ahead log.
+	WALWrites uint64
+
+	// WALBytesWritten is the number of bytes written to the write-ahead log.
+	WALBytesWritten uint64
+
+	// WALSyncs is the number of fsync calls for the write-ahead log.
+	WALSyncs uint64
+
+	// WALErrors is the number of I/O errors in the write-ahead log.
+	WALErrors uint64
+
+	// WALReplaySkippedBytes is the number of bytes skipped when replaying the write-ahead log
+	// on cache creation, since they contain torn or corrupted records.
+	//
+	// Torn records are usually caused by a crash in the middle of the write.
+	// The value isn't reset by Reset.
+	WALReplaySkippedBytes uint64
+
+	// RepackDroppedEntries is the number of entries dropped when re-packing
+	// the snapshot loaded by LoadFromFileRepack into the cache with smaller capacity.
+	RepackDroppedEntries uint64
+
 	// BigStats contains stats for GetBig/SetBig methods.
 	BigStats
+
+	// AllocatorStats contains stats for the chunk allocator of the cache.
+	//
+	// These stats aren't additive across caches sharing the same allocator.
+	// See AllocatorStats for details.
+	AllocatorStats
 }
 
 // Reset resets s, so it may be re-used again in Cache.UpdateStats.
@@ -107,11 +167,99 @@ func (bs *BigStats) reset() {
 // Concurrent goroutines may call any Cache methods on the same cache instance.
 //
 // Call Reset when the cache is no longer needed. This reclaims the allocated
-// memory.
+// memory. Call ReleaseMemory after that for returning the reclaimed memory to the OS.
 type Cache struct {
 	buckets [bucketsCount]bucket
 
 	bigStats BigStats
+
+	// obs is an optional observer for cache operations.
+	obs Observer
+
+	// disk is an optional disk tier for entries evicted from memory.
+	disk *diskTier
+
+	// wal is an optional write-ahead log for cache modifications.
+	wal *wal
+
+	// walReplaySkippedBytes is the number of bytes skipped when replaying the write-ahead log.
+	walReplaySkippedBytes uint64
+
+	// alloc is the allocator for cache chunks. DefaultAllocator is used if it is nil.
+	alloc Allocator
+
+	// incrMu serializes SaveIncremental calls.
+	incrMu sync.Mutex
+
+	// snapshotMu serializes consistent snapshots.
+	snapshotMu sync.Mutex
+
+	// incrChainID and incrSeq identify the last incremental snapshot saved by SaveIncremental.
+	incrChainID uint64
+	incrSeq     uint64
+
+	// repackDroppedEntries is the number of entries dropped by LoadFromFileRepack.
+	repackDroppedEntries uint64
+}
+
+// Config is the configuration for NewFromConfig and LoadFromFileConfig.
+type Config struct {
+	// MaxBytes is the cache capacity in bytes.
+	//
+	// See New for details.
+	MaxBytes int
+
+	// Observer is an optional observer for cache operations.
+	//
+	// There is no overhead if Observer is nil.
+	Observer Observer
+
+	// DiskPath is an optional directory for the disk tier.
+	//
+	// If DiskPath is set, then entries are spilled to the disk tier
+	// when the memory occupied by them is about to be overwritten.
+	// Get falls back to the disk tier on memory miss and promotes
+	// the found entries back to memory.
+	//
+	// The directory must be used only by a single cache. The disk tier
+	// isn't persisted across restarts and isn't saved by SaveToFile*.
+	// Call Cache.Close for removing the disk tier data.
+	DiskPath string
+
+	// DiskMaxBytes is the disk tier capacity in bytes.
+	//
+	// It must be set if DiskPath is set.
+	DiskMaxBytes int64
+
+	// WALPath is an optional directory for the write-ahead log (WAL).
+	//
+	// If WALPath is set, then Set, SetBig, Del and Reset operations are recorded
+	// in the WAL. The WAL is replayed on top of the cache created by NewFromConfig
+	// or loaded by LoadFromFileConfig, so the operations made after the last
+	// snapshot survive a crash. The WAL is truncated after each successful
+	// SaveToFile* call, so SaveToFile* must save the cache to the same filePath
+	// the cache is loaded from with LoadFromFileConfig.
+	//
+	// The directory must be used only by a single cache.
+	// Call Cache.Close for flushing the WAL before exit.
+	WALPath string
+
+	// WALSyncMode defines durability guarantees for the WAL.
+	//
+	// WALSyncPeriodic is used by default.
+	WALSyncMode WALSyncMode
+
+	// WALFlushInterval is the interval for writing buffered WAL records to disk
+	// in WALSyncPeriodic and WALSyncNone modes.
+	//
+	// One second is used by default.
+	WALFlushInterval time.Duration
+
+	// Allocator is an optional allocator for cache memory.
+	//
+	// DefaultAllocator is used if Allocator is nil.
+	// LoadFromFileConfig copies the loaded data into chunks obtained from Allocator.
+	Allocator Allocator
 }
 
 // New returns new cache with the given maxBytes capacity in bytes.
@@ -132,6 +280,95 @@ func New(maxBytes int) *Cache {
 	return &c
 }
 
+// NewFromConfig returns new cache with the given cfg.
+func NewFromConfig(cfg *Config) (*Cache, error) {
+	if cfg.MaxBytes <= 0 {
+		return nil, fmt.Errorf("MaxBytes must be greater than 0; got %d", cfg.MaxBytes)
+	}
+	c := New(cfg.MaxBytes)
+	if err := c.applyConfig(cfg); err != nil {
+		_ = c.Close()
+		c.Reset()
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyConfig applies cfg options except of MaxBytes to c.
+//
+// It must be called before c is used concurrently.
+func (c *Cache) applyConfig(cfg *Config) error {
+	if cfg.Allocator != nil {
+		c.setAllocator(cfg.Allocator)
+	}
+	if cfg.DiskPath != "" {
+		dt, err := openDiskTier(cfg.DiskPath, cfg.DiskMaxBytes)
+		if err != nil {
+			return err
+		}
+		c.disk = dt
+		for i := range c.buckets[:] {
+			c.buckets[i].setDiskTier(dt)
+		}
+	}
+	if cfg.WALPath != "" {
+		ids, err := readWALSegmentIDs(cfg.WALPath)
+		if err != nil {
+			return err
+		}
+		if err := c.replayWAL(cfg.WALPath, ids); err != nil {
+			return fmt.Errorf("cannot replay WAL at %q: %w", cfg.WALPath, err)
+		}
+		segmentID := uint64(0)
+		if len(ids) > 0 {
+			segmentID = ids[len(ids)-1] + 1
+		}
+		w, err := openWAL(cfg.WALPath, segmentID, cfg.WALSyncMode, cfg.WALFlushInterval)
+		if err != nil {
+			return err
+		}
+		c.wal = w
+		for i := range c.buckets[:] {
+			c.buckets[i].setWAL(w)
+		}
+	}
+	c.setObserver(cfg.Observer)
+	return nil
+}
+
+// Close flushes the write-ahead log of c, releases resources occupied
+// by the disk tier of c and removes its data. Snapshot files mapped
+// into memory by LoadFromFileMmap remain mapped until Reset.
+//
+// c may be used as an in-memory cache after Close. Operations on c
+// aren't recorded in the write-ahead log after Close, and snapshots
+// saved after Close leave the write-ahead log untouched.
+func (c *Cache) Close() error {
+	var err error
+	if c.wal != nil {
+		err = c.wal.close()
+	}
+	if c.disk != nil {
+		// Detach the disk tier from buckets before closing it, so Set doesn't spill entries to the closed disk tier.
+		for i := range c.buckets[:] {
+			b := &c.buckets[i]
+			b.mu.Lock()
+			b.disk = nil
+			b.dm = nil
+			b.mu.Unlock()
+		}
+		c.disk.close()
+	}
+	return err
+}
+
+func (c *Cache) setObserver(obs Observer) {
+	c.obs = obs
+	for i := range c.buckets[:] {
+		c.buckets[i].obs = obs
+	}
+}
+
 // Set stores (k, v) in the cache.
 //
 // Get must be used for reading the stored entry.
@@ -146,9 +383,24 @@ func New(maxBytes int) *Cache {
 //
 // k and v contents may be modified after returning from Set.
 func (c *Cache) Set(k, v []byte) {
+	if c.wal == nil {
+		c.set(k, v, nil)
+		return
+	}
+	bb := getWALBuf()
+	bb.B = appendWALRecord(bb.B[:0], walOpSet, k, v)
+	c.set(k, v, bb.B)
+	putWALBuf(bb)
+}
+
+// set stores (k, v) in the cache and appends walRec to the write-ahead log if walRec isn't nil.
+func (c *Cache) set(k, v, walRec []byte) {
+	if c.obs != nil {
+		c.obs.OnSet(k, v)
+	}
 	h := xxhash.Sum64(k)
 	idx := h % bucketsCount
-	c.buckets[idx].Set(k, v, h)
+	c.buckets[idx].setLogged(k, v, h, walRec)
 }
 
 // Get appends value by the key k to dst and returns the result.
@@ -161,7 +413,10 @@ func (c *Cache) Set(k, v []byte) {
 func (c *Cache) Get(dst, k []byte) []byte {
 	h := xxhash.Sum64(k)
 	idx := h % bucketsCount
-	dst, _ = c.buckets[idx].Get(dst, k, h, true)
+	dst, found := c.buckets[idx].Get(dst, k, h, true)
+	if c.obs != nil {
+		c.observeGet(k, found)
+	}
 	return dst
 }
 
@@ -171,7 +426,11 @@ func (c *Cache) Get(dst, k []byte) []byte {
 func (c *Cache) HasGet(dst, k []byte) ([]byte, bool) {
 	h := xxhash.Sum64(k)
 	idx := h % bucketsCount
-	return c.buckets[idx].Get(dst, k, h, true)
+	dst, found := c.buckets[idx].Get(dst, k, h, true)
+	if c.obs != nil {
+		c.observeGet(k, found)
+	}
+	return dst, found
 }
 
 // Has returns true if entry for the given key k exists in the cache.
@@ -179,29 +438,69 @@ func (c *Cache) Has(k []byte) bool {
 	h := xxhash.Sum64(k)
 	idx := h % bucketsCount
 	_, ok := c.buckets[idx].Get(nil, k, h, false)
+	if c.obs != nil {
+		c.observeGet(k, ok)
+	}
 	return ok
 }
 
+func (c *Cache) observeGet(k []byte, found bool) {
+	if found {
+		c.obs.OnGetHit(k)
+	} else {
+		c.obs.OnGetMiss(k)
+	}
+}
+
 // Del deletes value for the given k from the cache.
 //
 // k contents may be modified after returning from Del.
 func (c *Cache) Del(k []byte) {
+	if c.obs != nil {
+		c.obs.OnDel(k)
+	}
 	h := xxhash.Sum64(k)
 	idx := h % bucketsCount
-	c.buckets[idx].Del(h)
+	if c.wal == nil {
+		c.buckets[idx].Del(h)
+		return
+	}
+	bb := getWALBuf()
+	bb.B = appendWALRecord(bb.B[:0], walOpDel, k, nil)
+	c.buckets[idx].delLogged(h, bb.B)
+	putWALBuf(bb)
 }
 
 // Reset removes all the items from the cache.
 func (c *Cache) Reset() {
+	if c.wal != nil {
+		// The WAL segment mustn't be rotated until the buckets are reset.
+		c.wal.resetMu.Lock()
+		defer c.wal.resetMu.Unlock()
+		bb := getWALBuf()
+		bb.B = appendWALRecord(bb.B[:0], walOpReset, nil, nil)
+		if seq := c.wal.append(bb.B); seq > 0 {
+			// The error is reported via Cache.WALError.
+			_ = c.wal.commit(seq)
+		}
+		putWALBuf(bb)
+	}
 	for i := range c.buckets[:] {
 		c.buckets[i].Reset()
 	}
+	if c.disk != nil {
+		c.disk.reset()
+	}
 	c.bigStats.reset()
+	atomic.StoreUint64(&c.repackDroppedEntries, 0)
 }
 
 // UpdateStats adds cache stats to s.
 //
 // Call s.Reset before calling UpdateStats if s is re-used.
+//
+// s.AllocatorStats is counted multiple times if s is passed to UpdateStats
+// of multiple caches sharing the same allocator. See AllocatorStats for details.
 func (c *Cache) UpdateStats(s *Stats) {
 	for i := range c.buckets[:] {
 		c.buckets[i].UpdateStats(s)
@@ -212,6 +511,15 @@ func (c *Cache) UpdateStats(s *Stats) {
 	s.InvalidMetavalueErrors += atomic.LoadUint64(&c.bigStats.InvalidMetavalueErrors)
 	s.InvalidValueLenErrors += atomic.LoadUint64(&c.bigStats.InvalidValueLenErrors)
 	s.InvalidValueHashErrors += atomic.LoadUint64(&c.bigStats.InvalidValueHashErrors)
+	s.RepackDroppedEntries += atomic.LoadUint64(&c.repackDroppedEntries)
+	if c.disk != nil {
+		c.disk.UpdateStats(s)
+	}
+	s.WALReplaySkippedBytes += atomic.LoadUint64(&c.walReplaySkippedBytes)
+	if c.wal != nil {
+		c.wal.UpdateStats(s)
+	}
+	c.allocator().UpdateStats(&s.AllocatorStats)
 }
 
 type bucket struct {
@@ -234,8 +542,50 @@ type bucket struct {
 	// idx points to chunks for writing the next (k, v) pair.
 	idx uint64
 
+	// dirty is set when the bucket is modified after the last incremental snapshot.
+	dirty bool
+
+	// dirtyChunks contains flags for chunks modified after the last incremental snapshot.
+	dirtyChunks []bool
+
 	collisions  uint64
 	corruptions uint64
+
+	// obs is an optional observer for bucket operations.
+	obs Observer
+
+	// disk is an optional disk tier for entries evicted from b.chunks.
+	//
+	// It is set before the bucket is used and isn't changed afterwards.
+	disk *diskTier
+
+	// dm maps hash(k) to the location of (k, v) pair in the disk tier.
+	dm map[uint64]uint64
+
+	// dmFirstSegmentID is the id of the oldest disk tier segment during the last purge of dm.
+	dmFirstSegmentID uint64
+
+	// spills contains spills, which aren't written to the disk tier yet.
+	spills []*diskSpill
+
+	// spillsPending is the number of spills, which aren't picked up by writeSpills yet.
+	spillsPending atomic.Int64
+
+	// wal is an optional write-ahead log for bucket modifications.
+	//
+	// It is set before the bucket is used and isn't changed afterwards.
+	wal *wal
+
+	// snap is the consistent snapshot in progress for the bucket.
+	snap *bucketSnapshot
+
+	// alloc is the allocator for chunks. DefaultAllocator is used if it is nil.
+	//
+	// It is set before the bucket is used and isn't changed afterwards.
+	alloc Allocator
+
+	// mapped contains regions mapped from snapshot files by LoadFromFileMmap, which may be referenced by chunks.
+	mapped []*mappedRegion
 }
 
 func (b *bucket) Init(maxBytes uint64) {
@@ -247,20 +597,30 @@ func (b *bucket) Init(maxBytes uint64) {
 	}
 	maxChunks := (maxBytes + chunkSize - 1) / chunkSize
 	b.chunks = make([][]byte, maxChunks)
+	b.dirtyChunks = make([]bool, maxChunks)
 	b.m = make(map[uint64]uint64)
 	b.Reset()
 }
 
 func (b *bucket) Reset() {
 	b.mu.Lock()
+	if b.snap != nil {
+		b.snap.captureLocked(b)
+	}
 	chunks := b.chunks
 	for i := range chunks {
-		putChunk(chunks[i])
+		if b.snap == nil || b.snap.releaseChunkLocked(i) {
+			b.putChunk(chunks[i])
+		}
 		chunks[i] = nil
 	}
 	b.m = make(map[uint64]uint64)
+	if b.dm != nil {
+		b.dm = make(map[uint64]uint64)
+	}
 	b.idx = 0
 	b.gen = 1
+	b.dirty = true
 	atomic.StoreUint64(&b.getCalls, 0)
 	atomic.StoreUint64(&b.setCalls, 0)
 	atomic.StoreUint64(&b.misses, 0)
@@ -269,7 +629,10 @@ func (b *bucket) Reset() {
 	b.mu.Unlock()
 }
 
-func (b *bucket) cleanLocked() {
+// cleanLocked removes entries for overwritten chunks from b.m.
+//
+// It returns the number of removed entries.
+func (b *bucket) cleanLocked() int {
 	bGen := b.gen & ((1 << genSizeBits) - 1)
 	bIdx := b.idx
 	bm := b.m
@@ -295,6 +658,7 @@ func (b *bucket) cleanLocked() {
 		}
 		b.m = bmNew
 	}
+	return len(bm) - newItems
 }
 
 func (b *bucket) UpdateStats(s *Stats) {
@@ -306,6 +670,7 @@ func (b *bucket) UpdateStats(s *Stats) {
 
 	b.mu.RLock()
 	s.EntriesCount += uint64(len(b.m))
+	s.DiskEntriesCount += uint64(len(b.dm))
 	bytesSize := uint64(0)
 	for _, chunk := range b.chunks {
 		bytesSize += uint64(cap(chunk))
@@ -316,18 +681,21 @@ func (b *bucket) UpdateStats(s *Stats) {
 }
 
 func (b *bucket) Set(k, v []byte, h uint64) {
+	b.setLogged(k, v, h, nil)
+}
+
+// setLogged stores (k, v) in b and appends walRec to the write-ahead log if walRec isn't nil.
+//
+// walRec is appended under the bucket lock, so the order of records in the write-ahead log
+// matches the order of modifications for every key.
+func (b *bucket) setLogged(k, v []byte, h uint64, walRec []byte) {
 	atomic.AddUint64(&b.setCalls, 1)
 	if len(k) >= (1<<16) || len(v) >= (1<<16) {
 		// Too big key or value - its length cannot be encoded
 		// with 2 bytes (see below). Skip the entry.
 		return
 	}
-	var kvLenBuf [4]byte
-	kvLenBuf[0] = byte(uint16(len(k)) >> 8)
-	kvLenBuf[1] = byte(len(k))
-	kvLenBuf[2] = byte(uint16(len(v)) >> 8)
-	kvLenBuf[3] = byte(len(v))
-	kvLen := uint64(len(kvLenBuf) + len(k) + len(v))
+	kvLen := uint64(4 + len(k) + len(v))
 	if kvLen >= chunkSize {
 		// Do not store too big keys and values, since they do not
 		// fit a chunk.
@@ -335,6 +703,43 @@ func (b *bucket) Set(k, v []byte, h uint64) {
 	}
 
 	b.mu.Lock()
+	evicted := b.setLocked(k, v, h)
+	seq := b.appendWALLocked(walRec)
+	b.mu.Unlock()
+	b.writeSpills()
+	if seq > 0 {
+		// The error is reported via Cache.WALError.
+		_ = b.wal.commit(seq)
+	}
+	if b.obs != nil && evicted > 0 {
+		b.obs.OnEvict(evicted)
+	}
+}
+
+// appendWALLocked appends walRec to the write-ahead log and returns its sequence number.
+//
+// 0 is returned if walRec isn't appended.
+func (b *bucket) appendWALLocked(walRec []byte) uint64 {
+	if walRec == nil || b.wal == nil {
+		return 0
+	}
+	return b.wal.append(walRec)
+}
+
+// setLocked stores (k, v) in b.
+//
+// It returns the number of entries evicted from b.
+func (b *bucket) setLocked(k, v []byte, h uint64) int {
+	var kvLenBuf [4]byte
+	kvLenBuf[0] = byte(uint16(len(k)) >> 8)
+	kvLenBuf[1] = byte(len(k))
+	kvLenBuf[2] = byte(uint16(len(v)) >> 8)
+	kvLenBuf[3] = byte(len(v))
+	kvLen := uint64(len(kvLenBuf) + len(k) + len(v))
+
+	if b.snap != nil {
+		b.snap.captureLocked(b)
+	}
 	chunks := b.chunks
 	needClean := false
 	idx := b.idx
@@ -356,11 +761,17 @@ func (b *bucket) Set(k, v []byte, h uint64) {
 			idxNew = idx + kvLen
 			chunkIdx = chunkIdxNew
 		}
+		if b.disk != nil {
+			b.spillChunkLocked(chunkIdx)
+		}
 		chunks[chunkIdx] = chunks[chunkIdx][:0]
 	}
+	if b.snap != nil {
+		b.snap.copyChunkLocked(b, chunkIdx)
+	}
 	chunk := chunks[chunkIdx]
 	if chunk == nil {
-		chunk = getChunk()
+		chunk = b.getChunk()
 		chunk = chunk[:0]
 	}
 	chunk = append(chunk, kvLenBuf[:]...)
@@ -369,17 +780,25 @@ func (b *bucket) Set(k, v []byte, h uint64) {
 	chunks[chunkIdx] = chunk
 	b.m[h] = idx | (b.gen << bucketSizeBits)
 	b.idx = idxNew
+	b.dirty = true
+	b.dirtyChunks[chunkIdx] = true
+	if b.dm != nil {
+		delete(b.dm, h)
+	}
 	if needClean {
-		b.cleanLocked()
+		return b.cleanLocked()
 	}
-	b.mu.Unlock()
+	return 0
 }
 
 func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
 	b.mu.RLock()
 	atomic.AddUint64(&b.getCalls, 1)
 	found := false
+	collision := false
+	corruption := false
 	chunks := b.chunks
+	dt := b.disk
 	v := b.m[h]
 	bGen := b.gen & ((1 << genSizeBits) - 1)
 	if v > 0 {
@@ -390,6 +809,7 @@ func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
 			if chunkIdx >= uint64(len(chunks)) {
 				// Corrupted data during the load from file. Just skip it.
 				atomic.AddUint64(&b.corruptions, 1)
+				corruption = true
 				goto end
 			}
 			chunk := chunks[chunkIdx]
@@ -397,6 +817,7 @@ func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
 			if idx+4 >= chunkSize {
 				// Corrupted data during the load from file. Just skip it.
 				atomic.AddUint64(&b.corruptions, 1)
+				corruption = true
 				goto end
 			}
 			kvLenBuf := chunk[idx : idx+4]
@@ -406,6 +827,7 @@ func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
 			if idx+keyLen+valLen >= chunkSize {
 				// Corrupted data during the load from file. Just skip it.
 				atomic.AddUint64(&b.corruptions, 1)
+				corruption = true
 				goto end
 			}
 			if string(k) == string(chunk[idx:idx+keyLen]) {
@@ -416,19 +838,48 @@ func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
 				found = true
 			} else {
 				atomic.AddUint64(&b.collisions, 1)
+				collision = true
 			}
 		}
 	}
 end:
 	b.mu.RUnlock()
+	if !found && !collision && !corruption && dt != nil {
+		dst, found = b.getFromDisk(dt, dst, k, h, returnDst)
+	}
 	if !found {
 		atomic.AddUint64(&b.misses, 1)
 	}
+	if b.obs != nil {
+		if collision {
+			b.obs.OnCollision(k)
+		}
+		if corruption {
+			b.obs.OnCorruption()
+		}
+	}
 	return dst, found
 }
 
 func (b *bucket) Del(h uint64) {
+	b.delLogged(h, nil)
+}
+
+// delLogged deletes the entry for h from b and appends walRec to the write-ahead log if walRec isn't nil.
+func (b *bucket) delLogged(h uint64, walRec []byte) {
 	b.mu.Lock()
+	if b.snap != nil {
+		b.snap.captureLocked(b)
+	}
 	delete(b.m, h)
+	if b.dm != nil {
+		delete(b.dm, h)
+	}
+	b.dirty = true
+	seq := b.appendWALLocked(walRec)
 	b.mu.Unlock()
+	if seq > 0 {
+		// The error is reported via Cache.WALError.
+		_ = b.wal.commit(seq)
+	}
 }
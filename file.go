@@ -1,16 +1,17 @@
 package fastcache
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"io/fs"
 	"regexp"
 	"runtime"
-
-	"github.com/golang/snappy"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // SaveToFile atomically saves cache data to the given filePath using a single
@@ -35,44 +36,251 @@ func (c *Cache) SaveToFile(filePath string) error {
 //
 // See also SaveToFile.
 func (c *Cache) SaveToFileConcurrent(filePath string, concurrency int) error {
-	// Create dir if it doesn't exist.
-	dir := filepath.Dir(filePath)
-	if _, err := os.Stat(dir); err != nil {
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("cannot stat %q: %s", dir, err)
-		}
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("cannot create dir %q: %s", dir, err)
-		}
+	opts := &SaveOptions{
+		Concurrency: concurrency,
 	}
+	return c.SaveToFileOptions(filePath, opts)
+}
+
+// SaveOptions contains options for Cache.SaveToFileOptions.
+type SaveOptions struct {
+	// Concurrency is the number of CPU cores to use for saving.
+	//
+	// All the available CPU cores are used if Concurrency <= 0.
+	Concurrency int
+
+	// Codec is the compression codec for data files.
+	//
+	// CodecSnappy is used by default.
+	Codec Codec
+
+	// Consistent enables point-in-time consistent snapshots.
+	//
+	// By default buckets are saved one by one, so the snapshot may contain
+	// the state of different buckets at different moments. For example,
+	// a value stored with SetBig may be saved with its metavalue, but without some
+	// of its sub-values. If Consistent is set, then the state of all the buckets
+	// is captured at a single moment. Concurrent operations on the cache aren't
+	// blocked while the snapshot is saved, but modified chunks are copied
+	// and the bucket indexes are duplicated in memory until the snapshot is saved.
+	Consistent bool
+
+	// MaxBytesPerSecond limits the rate of writing the snapshot to disk.
+	//
+	// The rate isn't limited if MaxBytesPerSecond <= 0.
+	MaxBytesPerSecond int64
+
+	// Progress is an optional callback, which is called after every saved bucket.
+	//
+	// Calls to Progress are serialized.
+	Progress func(p Progress)
+
+	// EncryptionKey is an optional key for encrypting data files with AES-GCM.
+	//
+	// The key ID is recorded in the snapshot metadata. The snapshot may be loaded
+	// only with LoadFromFileContext, which is given the key in LoadOptions.EncryptionKeys.
+	// Keys may be rotated across saves: every snapshot is decrypted with the key it was saved with.
+	//
+	// EncryptionKey cannot be used with CodecMmap.
+	EncryptionKey *EncryptionKey
+
+	// Filter is an optional predicate for selecting entries to save.
+	//
+	// If Filter is set, then only entries for which it returns true are saved.
+	// Kept entries are compacted in the saved buckets, so the snapshot contains
+	// only the data needed for them. Filter mustn't hold k and v after returning.
+	// It may be called concurrently from multiple goroutines.
+	//
+	// Values stored with SetBig consist of multiple entries, so they may become
+	// inaccessible after loading the snapshot if Filter drops some of these entries.
+	Filter func(k, v []byte) bool
+}
+
+// SaveToFileOptions atomically saves cache data to the given filePath
+// using the given opts.
+//
+// SaveToFileOptions may be called concurrently with other operations
+// on the cache. Concurrent calls for the same filePath aren't supported.
+//
+// All the saved files and directories are fsynced, and the previous snapshot
+// at filePath is removed only after the new snapshot is complete,
+// so filePath contains a complete snapshot even after power loss.
+//
+// The saved data may be loaded with LoadFromFile*.
+//
+// See also SaveToFileContext for cancellable saving.
+func (c *Cache) SaveToFileOptions(filePath string, opts *SaveOptions) error {
+	return c.SaveToFileContext(context.Background(), filePath, opts)
+}
+
+func (c *Cache) saveToFile(ctx context.Context, filePath string, opts *SaveOptions) error {
+	if err := c.saveToStore(ctx, NewFileSnapshotStore(filePath), opts); err != nil {
+		return fmt.Errorf("cannot save cache data to %q: %w", filePath, err)
+	}
+	return nil
+}
 
-	// Save cache data into a temporary directory.
-	tmpDir, err := ioutil.TempDir(dir, "fastcache.tmp.")
+func (c *Cache) saveToStore(ctx context.Context, s SnapshotStore, opts *SaveOptions) error {
+	if err := opts.Codec.validate(); err != nil {
+		return err
+	}
+	if err := validateEncryptionKey(opts.EncryptionKey, opts.Codec); err != nil {
+		return err
+	}
+	if c.wal == nil {
+		return c.saveToStoreAtomic(ctx, s, opts)
+	}
+
+	// Start a new WAL segment before saving the snapshot. All the operations recorded
+	// in the previous segments are applied to the cache before the snapshot is started,
+	// so these segments may be removed after the snapshot is saved.
+	// Operations recorded in the new segment are replayed on top of the snapshot.
+	c.wal.saveMu.Lock()
+	defer c.wal.saveMu.Unlock()
+	segmentID, err := c.wal.rotate()
+	if errors.Is(err, errWALClosed) {
+		// Operations on c aren't recorded in the WAL after Cache.Close,
+		// so save c as an in-memory cache and leave the WAL segments untouched.
+		return c.saveToStoreAtomic(ctx, s, opts)
+	}
 	if err != nil {
-		return fmt.Errorf("cannot create temporary dir inside %q: %s", dir, err)
+		return fmt.Errorf("cannot rotate WAL: %w", err)
 	}
-	defer func() {
-		if tmpDir != "" {
-			_ = os.RemoveAll(tmpDir)
-		}
-	}()
+	if err := c.saveToStoreAtomic(ctx, s, opts); err != nil {
+		return err
+	}
+	if err := c.wal.removeSegmentsBefore(segmentID); err != nil {
+		return fmt.Errorf("cannot truncate WAL after saving the snapshot: %w", err)
+	}
+	return nil
+}
+
+// saveToStoreAtomic durably saves cache data to s.
+//
+// The data is saved into a new versioned dir inside s and then the pointer object
+// is atomically switched to the new dir, so a complete snapshot exists in s
+// at every moment, even on power loss.
+//
+// The previous snapshot remains untouched if ctx is done before the new snapshot is saved.
+func (c *Cache) saveToStoreAtomic(ctx context.Context, s SnapshotStore, opts *SaveOptions) error {
+	concurrency := opts.Concurrency
 	gomaxprocs := runtime.GOMAXPROCS(-1)
 	if concurrency <= 0 || concurrency > gomaxprocs {
 		concurrency = gomaxprocs
 	}
-	if err := c.save(tmpDir, concurrency); err != nil {
-		return fmt.Errorf("cannot save cache data to temporary dir %q: %s", tmpDir, err)
+	ic := newIOControl(ctx, opts.MaxBytesPerSecond, opts.Progress)
+	return writeSnapshotAtomic(s, ic, func(snapshotStore SnapshotStore) error {
+		src := c
+		if opts.Consistent {
+			src = c.consistentSnapshot()
+			defer c.releaseSnapshot()
+		}
+		return src.save(snapshotStore, concurrency, opts, ic)
+	})
+}
+
+// writeSnapshotAtomic durably writes a new snapshot to s with writeSnapshot.
+//
+// writeSnapshot must write the snapshot into the given store for the next versioned dir inside s.
+// The pointer object is then switched to the new dir.
+// The previous snapshot remains untouched if writeSnapshot fails or if ic is cancelled.
+func writeSnapshotAtomic(s SnapshotStore, ic *ioControl, writeSnapshot func(snapshotStore SnapshotStore) error) error {
+	currentName, err := readCurrentSnapshotName(s)
+	if err != nil {
+		return err
+	}
+
+	// The dir may be left by interrupted save. It isn't referenced by the pointer object, so it is safe to remove it.
+	name := nextSnapshotName(currentName)
+	if err := removeObjects(s, name); err != nil {
+		return fmt.Errorf("cannot remove incomplete snapshot %q: %w", name, err)
+	}
+	if err := writeSnapshot(subStore(s, name)); err != nil {
+		_ = removeObjects(s, name)
+		err = fmt.Errorf("cannot save cache data to %q: %w", name, err)
+		return ic.wrapErr(err, "cannot save cache data to %q", name)
+	}
+	if err := ic.err(); err != nil {
+		_ = removeObjects(s, name)
+		return fmt.Errorf("cannot save cache data to %q: %w", name, err)
+	}
+
+	// Atomically switch to the new snapshot.
+	if err := writeObjectAtomic(s, currentSnapshotFilename, []byte(name+"\n")); err != nil {
+		return err
+	}
+
+	// The previous snapshot is no longer needed.
+	return removeStaleSnapshots(s, name)
+}
+
+// currentSnapshotFilename is the name of the pointer object to the current snapshot dir inside SaveToFile* filePath.
+const currentSnapshotFilename = "current"
+
+var snapshotNameRegexp = regexp.MustCompile(`^version\.[0-9a-f]{16}$`)
+
+// nextSnapshotName returns the name for the snapshot dir following currentName.
+//
+// currentName may be empty if there are no snapshots yet.
+func nextSnapshotName(currentName string) string {
+	var version uint64
+	if currentName != "" {
+		version, _ = strconv.ParseUint(strings.TrimPrefix(currentName, "version."), 16, 64)
+	}
+	return fmt.Sprintf("version.%016x", version+1)
+}
+
+// readCurrentSnapshotName returns the name of the current snapshot dir inside s.
+//
+// An empty name is returned if s has no pointer object, e.g. if it contains the snapshot in the legacy layout.
+func readCurrentSnapshotName(s SnapshotStore) (string, error) {
+	data, err := readObject(s, currentSnapshotFilename, 1024)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
 	}
+	name := strings.TrimSpace(string(data))
+	if !snapshotNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("unexpected contents of %q: %q; it must contain snapshot dir name", currentSnapshotFilename, data)
+	}
+	return name, nil
+}
 
-	// Remove old filePath contents, since os.Rename may return
-	// error if filePath dir exists.
-	if err := os.RemoveAll(filePath); err != nil {
-		return fmt.Errorf("cannot remove old contents at %q: %s", filePath, err)
+// resolveSnapshotStore returns the store with the current snapshot data for the given SaveToFile* store s.
+func resolveSnapshotStore(s SnapshotStore) (SnapshotStore, error) {
+	name, err := readCurrentSnapshotName(s)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		// The snapshot in the legacy layout is stored directly in s.
+		return s, nil
 	}
-	if err := os.Rename(tmpDir, filePath); err != nil {
-		return fmt.Errorf("cannot move temporary dir %q to %q: %s", tmpDir, filePath, err)
+	return subStore(s, name), nil
+}
+
+// removeStaleSnapshots removes snapshots in s except of the snapshot with the given name.
+//
+// It also removes data left by interrupted saves and the snapshot in the legacy layout.
+func removeStaleSnapshots(s SnapshotStore, name string) error {
+	names, err := s.List("")
+	if err != nil {
+		return fmt.Errorf("cannot list objects: %w", err)
+	}
+	for _, objectName := range names {
+		if dir, _, ok := strings.Cut(objectName, "/"); ok {
+			if dir == name || !snapshotNameRegexp.MatchString(dir) && !strings.HasPrefix(dir, "fastcache.tmp.") {
+				continue
+			}
+		} else if objectName != metadataFilename && !dataFileRegexp.MatchString(objectName) {
+			continue
+		}
+		if err := s.Remove(objectName); err != nil {
+			return fmt.Errorf("cannot remove stale snapshot data at %q: %w", objectName, err)
+		}
 	}
-	tmpDir = ""
 	return nil
 }
 
@@ -80,6 +288,7 @@ func (c *Cache) SaveToFileConcurrent(filePath string, concurrency int) error {
 // enforcing that the cache capacity matches the provided maxBytes value.
 //
 // Returns an error if the stored cache's capacity differs from maxBytes.
+// Use LoadFromFileRepack for loading the cache data into a different capacity.
 //
 // See SaveToFile* for functions that persist cache data to a file.
 func LoadFromFileMaxBytes(filePath string, maxBytes int) (*Cache, error) {
@@ -89,6 +298,7 @@ func LoadFromFileMaxBytes(filePath string, maxBytes int) (*Cache, error) {
 // LoadFromFile loads cache data from the given filePath.
 //
 // See SaveToFile* for saving cache data to file.
+// See LoadFromFileWithReport for loading partially corrupted files.
 func LoadFromFile(filePath string) (*Cache, error) {
 	return load(filePath, 0)
 }
@@ -97,6 +307,9 @@ func LoadFromFile(filePath string) (*Cache, error) {
 //
 // The function falls back to creating new cache with the given maxBytes
 // capacity if error occurs during loading the cache from file.
+//
+// See LoadFromFileRepack for preserving cache data if the capacity of the saved
+// cache differs from maxBytes.
 func LoadFromFileOrNew(filePath string, maxBytes int) *Cache {
 	c, err := load(filePath, maxBytes)
 	if err == nil {
@@ -105,22 +318,85 @@ func LoadFromFileOrNew(filePath string, maxBytes int) *Cache {
 	return New(maxBytes)
 }
 
-func (c *Cache) save(dir string, workersCount int) error {
-	if err := saveMetadata(c, dir); err != nil {
+// LoadFromFileConfig loads cache data from the given filePath and applies
+// the given cfg to the loaded cache.
+//
+// cfg.MaxBytes is enforced in the same way as in LoadFromFileMaxBytes
+// if it is greater than 0.
+//
+// See SaveToFile* for saving cache data to file.
+func LoadFromFileConfig(filePath string, cfg *Config) (*Cache, error) {
+	var c *Cache
+	err := notifyLoad(cfg.Observer, filePath, func() error {
+		var err error
+		c, err = load(filePath, cfg.MaxBytes)
 		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.applyConfig(cfg); err != nil {
+		_ = c.Close()
+		c.Reset()
+		return nil, err
 	}
+	return c, nil
+}
+
+func (c *Cache) save(s SnapshotStore, workersCount int, opts *SaveOptions, ic *ioControl) error {
+	sh := newSnapshotHeader(uint64(cap(c.buckets[0].chunks)))
+	sh.codec = opts.Codec
+	if opts.EncryptionKey != nil {
+		if err := sh.setEncryptionKey(opts.EncryptionKey); err != nil {
+			return err
+		}
+	}
+	return c.saveSnapshot(s, workersCount, sh, nil, (*bucket).Save, opts.Filter, ic)
+}
+
+// saveSnapshot saves buckets with the given bucketNums to s by workersCount concurrent workers
+// and then writes sh with the manifest of the saved data files to s.
+//
+// All the buckets are saved if bucketNums is nil.
+// Only entries passing filter are saved if filter isn't nil.
+// Writing data files is controlled by ic if it isn't nil.
+func (c *Cache) saveSnapshot(s SnapshotStore, workersCount int, sh *snapshotHeader, bucketNums []int, saveBucket bucketSaver, filter func(k, v []byte) bool, ic *ioControl) error {
+	if bucketNums == nil {
+		bucketNums = make([]int, len(c.buckets))
+		for i := range bucketNums {
+			bucketNums[i] = i
+		}
+	}
+	ic.start(len(bucketNums))
 
 	// Save buckets by workersCount concurrent workers.
 	workCh := make(chan int, workersCount)
-	results := make(chan error)
+	type result struct {
+		f   snapshotFile
+		err error
+	}
+	results := make(chan result)
 	for i := range workersCount {
 		go func(workerNum int) {
-			results <- saveBuckets(c.buckets[:], workCh, dir, workerNum)
+			var f snapshotFile
+			var err error
+			if sh.codec == CodecMmap {
+				f, err = saveAlignedBuckets(c.buckets[:], workCh, s, workerNum, filter, ic)
+			} else {
+				f, err = saveBuckets(c.buckets[:], workCh, s, workerNum, sh, filterBucketSaver(saveBucket, filter), ic)
+			}
+			// Drain the remaining work on error, so the feeder isn't blocked.
+			for range workCh {
+			}
+			results <- result{
+				f:   f,
+				err: err,
+			}
 		}(i)
 	}
 	// Feed workers with work
-	for i := range c.buckets[:] {
-		workCh <- i
+	for _, bucketNum := range bucketNums {
+		workCh <- bucketNum
 	}
 	close(workCh)
 
@@ -128,169 +404,604 @@ func (c *Cache) save(dir string, workersCount int) error {
 	var err error
 	for range workersCount {
 		result := <-results
-		if result != nil && err == nil {
-			err = result
+		if result.err != nil && err == nil {
+			err = result.err
 		}
+		sh.files = append(sh.files, result.f)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Save metadata after all the data files are written,
+	// so it references only complete data files.
+	return saveMetadata(sh, s)
 }
 
 func load(filePath string, maxBytes int) (*Cache, error) {
-	maxBucketChunks, err := loadMetadata(filePath)
+	c, _, err := loadSnapshotFile(filePath, maxBytes, false, nil, nil, nil)
+	return c, err
+}
+
+// loadSnapshotFile loads the full snapshot from filePath.
+//
+// See loadSnapshot for details.
+func loadSnapshotFile(filePath string, maxBytes int, mapped bool, ic *ioControl, keys []*EncryptionKey, report *LoadReport) (*Cache, *snapshotHeader, error) {
+	c, sh, err := loadSnapshot(NewFileSnapshotStore(filePath), maxBytes, mapped, ic, keys, report)
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("cannot load snapshot from %q: %w", filePath, err)
+	}
+	return c, sh, nil
+}
+
+// loadSnapshot loads the full snapshot from s.
+//
+// If s contains snapshots saved by AutoSaver, then the newest valid snapshot is loaded.
+//
+// Snapshots saved with CodecMmap are mapped into memory instead of reading them if mapped is set
+// and s stores them in files.
+//
+// Reading data files is controlled by ic if it isn't nil.
+//
+// Encrypted data files are decrypted with the matching key from keys.
+//
+// If report isn't nil, then data files, which cannot be loaded, are registered in report
+// instead of returning an error.
+//
+// It returns the loaded cache and the snapshot header.
+func loadSnapshot(s SnapshotStore, maxBytes int, mapped bool, ic *ioControl, keys []*EncryptionKey, report *LoadReport) (*Cache, *snapshotHeader, error) {
+	var errs []error
+	for _, candidate := range snapshotCandidates(s) {
+		c, sh, err := loadSnapshotDir(candidate, maxBytes, mapped, ic, keys, report)
+		if err == nil {
+			return c, sh, nil
+		}
+		if ctxErr := ic.err(); ctxErr != nil {
+			// Do not fall back to older snapshots if the load is cancelled.
+			return nil, nil, fmt.Errorf("cannot load snapshot: %w", ctxErr)
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return nil, nil, errs[0]
+	}
+	return nil, nil, fmt.Errorf("cannot load any of %d snapshots: %w", len(errs), errors.Join(errs...))
+}
+
+// loadSnapshotDir loads the full snapshot saved by SaveToFile* to s.
+func loadSnapshotDir(s SnapshotStore, maxBytes int, mapped bool, ic *ioControl, keys []*EncryptionKey, report *LoadReport) (*Cache, *snapshotHeader, error) {
+	s, err := resolveSnapshotStore(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	sh, err := loadMetadata(s)
+	if err != nil {
+		return nil, nil, err
 	}
+	if sh.incremental {
+		return nil, nil, fmt.Errorf("cache file contains incremental snapshot; use LoadIncremental for loading it")
+	}
+	if err := sh.openEncryption(keys); err != nil {
+		return nil, nil, fmt.Errorf("cannot load cache file: %w", err)
+	}
+	maxBucketChunks := sh.maxBucketChunks
 	if maxBytes > 0 {
 		maxBucketBytes := uint64((maxBytes + bucketsCount - 1) / bucketsCount)
 		expectedBucketChunks := (maxBucketBytes + chunkSize - 1) / chunkSize
 		if maxBucketChunks != expectedBucketChunks {
-			return nil, fmt.Errorf("cache file %s contains unexpected number of bucket chunks; got %d; want %d", filePath, maxBucketChunks, expectedBucketChunks)
+			return nil, nil, fmt.Errorf("cache file contains unexpected number of bucket chunks; got %d; want %d", maxBucketChunks, expectedBucketChunks)
 		}
 	}
 
-	// Read bucket files from filePath dir.
-	d, err := os.Open(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("cannot open %q: %w", filePath, err)
+	files := sh.files
+	bucketsTotal := 0
+	if sh.version == 0 {
+		files, err = readLegacyDataFiles(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Legacy snapshots contain all the buckets.
+		bucketsTotal = bucketsCount
 	}
-	defer func() {
-		_ = d.Close()
-	}()
-	fis, err := d.Readdir(-1)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read files from %q: %s", filePath, err)
+	for _, f := range files {
+		bucketsTotal += len(f.buckets)
 	}
-	results := make(chan error)
-	workersCount := 0
+	ic.start(bucketsTotal)
 	var c Cache
-	for _, fi := range fis {
-		fn := fi.Name()
-		if fi.IsDir() || !dataFileRegexp.MatchString(fn) {
-			continue
-		}
-		workersCount++
-		go func(dataPath string) {
-			results <- loadBuckets(c.buckets[:], dataPath, maxBucketChunks)
-		}(filePath + "/" + fn)
+	var claims bucketClaims
+	loadFile := func(f *snapshotFile) error {
+		return loadBuckets(c.buckets[:], &claims, s, f, sh, (*bucket).Load, ic, nil)
 	}
-	err = nil
-	for range workersCount {
-		result := <-results
-		if result != nil && err == nil {
-			err = result
+	if sh.codec == CodecMmap {
+		loadFile = func(f *snapshotFile) error {
+			return loadAlignedBuckets(c.buckets[:], &claims, s, f, sh, mapped, ic, nil)
 		}
 	}
-	if err != nil {
-		return nil, err
+	if report != nil {
+		*report = LoadReport{}
+		loadFile = report.tolerantLoader(loadFile)
+	}
+	if err := loadDataFiles(files, loadFile); err != nil {
+		c.Reset()
+		return nil, nil, err
 	}
 	// Initialize buckets, which could be missing due to incomplete or corrupted files in the cache.
 	// It is better initializing such buckets instead of returning error, since the rest of buckets
 	// contain valid data.
+	bucketsReset := 0
+	var invalidEntries uint64
 	for i := range c.buckets[:] {
 		b := &c.buckets[i]
 		if len(b.chunks) == 0 {
 			b.chunks = make([][]byte, maxBucketChunks)
+			b.dirtyChunks = make([]bool, maxBucketChunks)
 			b.m = make(map[uint64]uint64)
+			b.dirty = true
+			bucketsReset++
+			continue
 		}
+		invalidEntries += b.verify()
+	}
+	if report != nil {
+		report.BucketsRestored = bucketsCount - bucketsReset
+		report.BucketsReset = bucketsReset
+		report.InvalidEntries = invalidEntries
 	}
-	return &c, nil
+	return &c, sh, nil
 }
 
-func saveMetadata(c *Cache, dir string) error {
-	metadataPath := dir + "/metadata.bin"
-	metadataFile, err := os.Create(metadataPath)
-	if err != nil {
-		return fmt.Errorf("cannot create %q: %s", metadataPath, err)
+// loadDataFiles concurrently loads the given data files with loadFile.
+func loadDataFiles(files []snapshotFile, loadFile func(f *snapshotFile) error) error {
+	results := make(chan error)
+	for _, f := range files {
+		go func(f snapshotFile) {
+			results <- loadFile(&f)
+		}(f)
 	}
-	defer func() {
-		_ = metadataFile.Close()
-	}()
-	maxBucketChunks := uint64(cap(c.buckets[0].chunks))
-	if err := writeUint64(metadataFile, maxBucketChunks); err != nil {
-		return fmt.Errorf("cannot write maxBucketChunks=%d to %q: %s", maxBucketChunks, metadataPath, err)
+	var err error
+	for range files {
+		result := <-results
+		if result != nil && err == nil {
+			err = result
+		}
 	}
-	return nil
+	return err
+}
+
+// bucketClaims tracks buckets claimed by data files, which are loaded concurrently.
+//
+// A bucket is loaded only by the data file, which claimed it, so corrupted snapshots
+// listing the same bucket in multiple data files cannot make loaders race on the bucket.
+type bucketClaims struct {
+	mu      sync.Mutex
+	claimed [bucketsCount]bool
+}
+
+// claim claims the bucket with the given bucketNum.
+//
+// It returns false if the bucket is already claimed.
+func (bc *bucketClaims) claim(bucketNum uint64) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.claimed[bucketNum] {
+		return false
+	}
+	bc.claimed[bucketNum] = true
+	return true
+}
+
+// snapshotStream reads buckets from a full snapshot without loading the whole snapshot into memory.
+type snapshotStream struct {
+	s     SnapshotStore
+	sh    *snapshotHeader
+	files []snapshotFile
+}
+
+// openSnapshotStream opens the full snapshot saved by SaveToFile* to s for streaming.
+//
+// If s contains snapshots saved by AutoSaver, then the newest snapshot with valid metadata is opened.
+// Encrypted data files are decrypted with the matching key from keys.
+func openSnapshotStream(s SnapshotStore, keys []*EncryptionKey) (*snapshotStream, error) {
+	var errs []error
+	for _, candidate := range snapshotCandidates(s) {
+		ss, err := openSnapshotStreamDir(candidate, keys)
+		if err == nil {
+			return ss, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return nil, errs[0]
+	}
+	return nil, fmt.Errorf("cannot open any of %d snapshots: %w", len(errs), errors.Join(errs...))
 }
 
-func loadMetadata(dir string) (uint64, error) {
-	metadataPath := dir + "/metadata.bin"
-	metadataFile, err := os.Open(metadataPath)
+func openSnapshotStreamDir(s SnapshotStore, keys []*EncryptionKey) (*snapshotStream, error) {
+	s, err := resolveSnapshotStore(s)
 	if err != nil {
-		return 0, fmt.Errorf("cannot open %q: %w", metadataPath, err)
+		return nil, err
 	}
-	defer func() {
-		_ = metadataFile.Close()
-	}()
-	maxBucketChunks, err := readUint64(metadataFile)
+	sh, err := loadMetadata(s)
 	if err != nil {
-		return 0, fmt.Errorf("cannot read maxBucketChunks from %q: %s", metadataPath, err)
+		return nil, err
+	}
+	if sh.incremental {
+		return nil, fmt.Errorf("cache file contains incremental snapshot; it cannot be streamed")
 	}
-	if maxBucketChunks == 0 {
-		return 0, fmt.Errorf("invalid maxBucketChunks=0 read from %q", metadataPath)
+	if err := validateMaxChunks(sh.maxBucketChunks); err != nil {
+		return nil, err
+	}
+	if err := sh.openEncryption(keys); err != nil {
+		return nil, fmt.Errorf("cannot open cache file: %w", err)
+	}
+	files := sh.files
+	if sh.version == 0 {
+		files, err = readLegacyDataFiles(s)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return maxBucketChunks, nil
+	return &snapshotStream{
+		s:     s,
+		sh:    sh,
+		files: files,
+	}, nil
+}
+
+// forEachBucket calls onBucket for every bucket in the snapshot.
+//
+// Data files are read concurrently, so onBucket may be called from concurrent goroutines.
+// The bucket passed to onBucket is released after onBucket returns, so the memory usage
+// is bounded by a bucket per data file. Bucket chunks are obtained from alloc if it isn't nil.
+func (ss *snapshotStream) forEachBucket(alloc Allocator, onBucket func(b *bucket, bucketNum uint64) error) error {
+	return ss.forEachBucketInFiles(ss.files, alloc, nil, onBucket)
+}
+
+// forEachBucketInFiles calls onBucket for every bucket in the given data files of the snapshot.
+//
+// Data files, which cannot be read, are registered in report instead of returning an error if report isn't nil.
+// See forEachBucket for details.
+func (ss *snapshotStream) forEachBucketInFiles(files []snapshotFile, alloc Allocator, report *LoadReport, onBucket func(b *bucket, bucketNum uint64) error) error {
+	var buckets [bucketsCount]bucket
+	if alloc != nil {
+		for i := range buckets[:] {
+			buckets[i].alloc = alloc
+		}
+	}
+	var claims bucketClaims
+	loadFile := func(f *snapshotFile) error {
+		onLoaded := func(bucketNum uint64) error {
+			b := &buckets[bucketNum]
+			defer b.unload()
+			return onBucket(b, bucketNum)
+		}
+		if ss.sh.codec == CodecMmap {
+			return loadAlignedBuckets(buckets[:], &claims, ss.s, f, ss.sh, false, nil, onLoaded)
+		}
+		return loadBuckets(buckets[:], &claims, ss.s, f, ss.sh, (*bucket).Load, nil, onLoaded)
+	}
+	if report != nil {
+		loadFile = report.tolerantLoader(loadFile)
+	}
+	err := loadDataFiles(files, loadFile)
+	// Release buckets, which weren't passed to onBucket because of errors.
+	for i := range buckets[:] {
+		buckets[i].unload()
+	}
+	return err
+}
+
+// filesForBuckets returns data files, which contain buckets with the given bucketNums.
+//
+// All the data files are returned for legacy snapshots, since they have no manifest.
+func (ss *snapshotStream) filesForBuckets(bucketNums map[uint64]bool) []snapshotFile {
+	if ss.sh.version == 0 {
+		return ss.files
+	}
+	var files []snapshotFile
+	for _, f := range ss.files {
+		for _, b := range f.buckets {
+			if bucketNums[b.num] {
+				files = append(files, f)
+				break
+			}
+		}
+	}
+	return files
+}
+
+// readLegacyDataFiles returns data files for the snapshot in the legacy format in s.
+//
+// Legacy snapshots have no manifest, so all the objects matching dataFileRegexp are returned.
+func readLegacyDataFiles(s SnapshotStore) ([]snapshotFile, error) {
+	names, err := s.List("data.")
+	if err != nil {
+		return nil, fmt.Errorf("cannot list data files: %w", err)
+	}
+	var files []snapshotFile
+	for _, name := range names {
+		if !dataFileRegexp.MatchString(name) {
+			continue
+		}
+		files = append(files, snapshotFile{
+			name: name,
+		})
+	}
+	return files, nil
 }
 
 var dataFileRegexp = regexp.MustCompile(`^data\.\d+\.bin$`)
 
-func saveBuckets(buckets []bucket, workCh <-chan int, dir string, workerNum int) error {
-	dataPath := fmt.Sprintf("%s/data.%d.bin", dir, workerNum)
-	dataFile, err := os.Create(dataPath)
+// bucketSaver writes b to w.
+type bucketSaver func(b *bucket, w io.Writer) error
+
+// bucketLoader reads b from r.
+type bucketLoader func(b *bucket, r io.Reader, maxChunks uint64) error
+
+func saveBuckets(buckets []bucket, workCh <-chan int, s SnapshotStore, workerNum int, sh *snapshotHeader, saveBucket bucketSaver, ic *ioControl) (snapshotFile, error) {
+	f := snapshotFile{
+		name: fmt.Sprintf("data.%d.bin", workerNum),
+	}
+	dataPath := f.name
+	dataFile, err := s.Create(dataPath)
 	if err != nil {
-		return fmt.Errorf("cannot create %q: %s", dataPath, err)
+		return f, fmt.Errorf("cannot create %q: %s", dataPath, err)
 	}
 	defer func() {
-		_ = dataFile.Close()
+		if dataFile != nil {
+			_ = dataFile.Close()
+		}
 	}()
-	zw := snappy.NewBufferedWriter(dataFile)
+	fw := &countingWriter{
+		w: ic.writer(dataFile),
+	}
+	zw, err := sh.newDataWriter(f.name, fw)
+	if err != nil {
+		return f, err
+	}
+	cw := &crcWriter{
+		w: zw,
+	}
 	for bucketNum := range workCh {
+		if err := ic.err(); err != nil {
+			return f, fmt.Errorf("cannot save bucket[%d] to %q: %w", bucketNum, dataPath, err)
+		}
+		n := fw.n
 		if err := writeUint64(zw, uint64(bucketNum)); err != nil {
-			return fmt.Errorf("cannot write bucketNum=%d to %q: %s", bucketNum, dataPath, err)
+			return f, fmt.Errorf("cannot write bucketNum=%d to %q: %s", bucketNum, dataPath, err)
 		}
-		if err := buckets[bucketNum].Save(zw); err != nil {
-			return fmt.Errorf("cannot save bucket[%d] to %q: %s", bucketNum, dataPath, err)
+		cw.crc = 0
+		if err := saveBucket(&buckets[bucketNum], cw); err != nil {
+			return f, fmt.Errorf("cannot save bucket[%d] to %q: %s", bucketNum, dataPath, err)
 		}
+		f.buckets = append(f.buckets, snapshotBucket{
+			num: uint64(bucketNum),
+			crc: cw.crc,
+		})
+		ic.bucketProcessed(fw.n - n)
 	}
 	if err := zw.Close(); err != nil {
-		return fmt.Errorf("cannot close snappy.Writer for %q: %s", dataPath, err)
+		return f, fmt.Errorf("cannot close %s writer for %q: %s", sh.codec, dataPath, err)
 	}
-	return nil
+	err = dataFile.Close()
+	dataFile = nil
+	if err != nil {
+		return f, fmt.Errorf("cannot close %q: %s", dataPath, err)
+	}
+	f.size = fw.n
+	return f, nil
 }
 
-func loadBuckets(buckets []bucket, dataPath string, maxChunks uint64) error {
-	dataFile, err := os.Open(dataPath)
+// loadBuckets loads buckets from the data file f of the snapshot sh located in s.
+//
+// The loaded buckets are verified against the manifest in f if the snapshot isn't in the legacy format.
+// Every bucket is claimed in claims before loading it. claims must be shared by all the data files of the snapshot.
+// onLoaded is called for every verified bucket if it isn't nil.
+func loadBuckets(buckets []bucket, claims *bucketClaims, s SnapshotStore, f *snapshotFile, sh *snapshotHeader, loadBucket bucketLoader, ic *ioControl, onLoaded func(bucketNum uint64) error) error {
+	dataPath := f.name
+	dataFile, err := s.Open(dataPath)
 	if err != nil {
 		return fmt.Errorf("cannot open %q: %s", dataPath, err)
 	}
 	defer func() {
 		_ = dataFile.Close()
 	}()
-	zr := snappy.NewReader(dataFile)
+	var expectedCRCs map[uint64]uint32
+	if sh.version > 0 {
+		if size := uint64(dataFile.Size()); size != f.size {
+			return corruptionErrorf("unexpected size for %q; got %d bytes; want %d bytes; the file may be truncated or overwritten", dataPath, size, f.size)
+		}
+		expectedCRCs = make(map[uint64]uint32, len(f.buckets))
+		for _, b := range f.buckets {
+			expectedCRCs[b.num] = b.crc
+		}
+	}
+	fr := &offsetReader{
+		r: dataFile,
+	}
+	zr, err := sh.newDataReader(f.name, fr)
+	if err != nil {
+		return err
+	}
+	cr := &crcReader{
+		r: zr,
+	}
 	for {
+		if err := ic.err(); err != nil {
+			return fmt.Errorf("cannot load buckets from %q: %w", dataPath, err)
+		}
+		n := fr.n
 		bucketNum, err := readUint64(zr)
 		if err == io.EOF {
 			// Reached the end of file.
-			return nil
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read bucketNum from %q: %w", dataPath, err)
 		}
 		if bucketNum >= uint64(len(buckets)) {
-			return fmt.Errorf("unexpected bucketNum read from %q: %d; must be smaller than %d", dataPath, bucketNum, len(buckets))
+			return corruptionErrorf("unexpected bucketNum read from %q: %d; must be smaller than %d", dataPath, bucketNum, len(buckets))
+		}
+		// Verify the bucket against the manifest and claim it before loading,
+		// so data files loaded concurrently never load the same bucket.
+		var crcExpected uint32
+		if expectedCRCs != nil {
+			crc, ok := expectedCRCs[bucketNum]
+			if !ok {
+				return corruptionErrorf("unexpected bucket[%d] in %q; it is missing in the manifest or duplicated", bucketNum, dataPath)
+			}
+			crcExpected = crc
+			delete(expectedCRCs, bucketNum)
+		}
+		if !claims.claim(bucketNum) {
+			return corruptionErrorf("duplicate bucket[%d] in %q; it is already loaded from another data file", bucketNum, dataPath)
 		}
-		if err := buckets[bucketNum].Load(zr, maxChunks); err != nil {
-			return fmt.Errorf("cannot load bucket[%d] from %q: %s", bucketNum, dataPath, err)
+		cr.crc = 0
+		if err := loadBucket(&buckets[bucketNum], cr, sh.maxBucketChunks); err != nil {
+			return fmt.Errorf("cannot load bucket[%d] from %q: %w", bucketNum, dataPath, err)
+		}
+		ic.bucketProcessed(fr.n - n)
+		if expectedCRCs != nil && cr.crc != crcExpected {
+			// Do not leave the corrupted bucket in the cache.
+			buckets[bucketNum].unload()
+			return corruptionErrorf("checksum mismatch for bucket[%d] in %q; got 0x%08x; want 0x%08x", bucketNum, dataPath, cr.crc, crcExpected)
+		}
+		if onLoaded != nil {
+			if err := onLoaded(bucketNum); err != nil {
+				return err
+			}
 		}
 	}
+	if len(expectedCRCs) > 0 {
+		return corruptionErrorf("%d buckets listed in the manifest are missing in %q", len(expectedCRCs), dataPath)
+	}
+	return nil
 }
 
 func (b *bucket) Save(w io.Writer) error {
-	b.mu.Lock()
-	b.cleanLocked()
-	b.mu.Unlock()
+	return b.save(w, false, false)
+}
+
+// save writes b to w.
+//
+// Only chunks modified since the last incremental snapshot are written if dirtyOnly is set.
+// Dirty flags for b are cleared if clearDirty is set.
+//
+// The bucket data is copied under the lock and then written to w without holding the lock,
+// so concurrent operations on b aren't blocked by slow w.
+func (b *bucket) save(w io.Writer, dirtyOnly, clearDirty bool) error {
+	bc := getBucketCopy()
+	defer putBucketCopy(bc)
+	b.copyForSave(bc, dirtyOnly, clearDirty)
+
+	if _, err := w.Write(bc.header.B); err != nil {
+		return fmt.Errorf("cannot write bucket index: %s", err)
+	}
+	for i, chunk := range bc.chunks {
+		if dirtyOnly {
+			if err := writeUint64(w, bc.chunkIdxs[i]); err != nil {
+				return fmt.Errorf("cannot write index for b.chunks[%d]: %s", bc.chunkIdxs[i], err)
+			}
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return fmt.Errorf("cannot write b.chunks[%d]: %s", bc.chunkIdxs[i], err)
+		}
+	}
+	return nil
+}
+
+// bucketCopy holds a copy of bucket data for writing it without holding the bucket lock.
+type bucketCopy struct {
+	// header contains the bucket index in the format written by bucket.writeIndexLocked.
+	//
+	// It also contains the number of dirty chunks for incremental snapshots.
+	header bytesBuf
+
+	// chunks contains copies of the bucket chunks.
+	chunks [][]byte
+
+	// chunkIdxs contains indexes for chunks in the bucket.
+	chunkIdxs []uint64
+
+	// alloc is the allocator for chunks.
+	alloc Allocator
+}
+
+// copyForSave copies the data to be saved from b to bc.
+//
+// Only chunks modified since the last incremental snapshot are copied if dirtyOnly is set.
+// Dirty flags for b are cleared if clearDirty is set.
+func (b *bucket) copyForSave(bc *bucketCopy, dirtyOnly, clearDirty bool) {
+	b.clean()
 
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	// Store b.idx, b.gen and b.m to w.
+	// Writes to bytesBuf cannot fail.
+	chunksLen, _ := b.writeIndexLocked(&bc.header)
+	bc.alloc = b.allocator()
+	for chunkIdx := range chunksLen {
+		if dirtyOnly && !b.dirtyChunks[chunkIdx] {
+			continue
+		}
+		chunk := b.getChunk()
+		copy(chunk, b.chunks[chunkIdx][:chunkSize])
+		bc.chunks = append(bc.chunks, chunk)
+		bc.chunkIdxs = append(bc.chunkIdxs, uint64(chunkIdx))
+	}
+	if dirtyOnly {
+		_ = writeUint64(&bc.header, uint64(len(bc.chunks)))
+	}
+
+	if clearDirty {
+		// It is safe to clear dirty flags under the read lock, since they are modified
+		// only under the write lock and by incremental snapshots, which are serialized.
+		b.dirty = false
+		clear(b.dirtyChunks)
+	}
+}
+
+func (bb *bytesBuf) Write(p []byte) (int, error) {
+	bb.B = append(bb.B, p...)
+	return len(p), nil
+}
+
+var bucketCopyPool sync.Pool
+
+func getBucketCopy() *bucketCopy {
+	v := bucketCopyPool.Get()
+	if v == nil {
+		return &bucketCopy{}
+	}
+	return v.(*bucketCopy)
+}
+
+func putBucketCopy(bc *bucketCopy) {
+	for _, chunk := range bc.chunks {
+		bc.alloc.PutChunk(chunk)
+	}
+	clear(bc.chunks)
+	bc.alloc = nil
+	bc.chunks = bc.chunks[:0]
+	bc.chunkIdxs = bc.chunkIdxs[:0]
+	bc.header.B = bc.header.B[:0]
+	bucketCopyPool.Put(bc)
+}
+
+// clean removes entries for overwritten chunks from b.m.
+func (b *bucket) clean() {
+	b.mu.Lock()
+	evicted := b.cleanLocked()
+	b.mu.Unlock()
+	if b.obs != nil && evicted > 0 {
+		b.obs.OnEvict(evicted)
+	}
+}
 
+// writeIndexLocked writes b.idx, b.gen, b.m and len(b.chunks) to w.
+//
+// It returns len(b.chunks).
+func (b *bucket) writeIndexLocked(w io.Writer) (int, error) {
 	bIdx := b.idx
 	bGen := b.gen
 	chunksLen := 0
@@ -310,108 +1021,141 @@ func (b *bucket) Save(w io.Writer) error {
 	}
 
 	if err := writeUint64(w, bIdx); err != nil {
-		return fmt.Errorf("cannot write b.idx: %s", err)
+		return 0, fmt.Errorf("cannot write b.idx: %s", err)
 	}
 	if err := writeUint64(w, bGen); err != nil {
-		return fmt.Errorf("cannot write b.gen: %s", err)
+		return 0, fmt.Errorf("cannot write b.gen: %s", err)
 	}
 	if err := writeUint64(w, uint64(len(kvs))/2/8); err != nil {
-		return fmt.Errorf("cannot write len(b.m): %s", err)
+		return 0, fmt.Errorf("cannot write len(b.m): %s", err)
 	}
 	if _, err := w.Write(kvs); err != nil {
-		return fmt.Errorf("cannot write b.m: %s", err)
+		return 0, fmt.Errorf("cannot write b.m: %s", err)
 	}
-
-	// Store b.chunks to w.
 	if err := writeUint64(w, uint64(chunksLen)); err != nil {
-		return fmt.Errorf("cannot write len(b.chunks): %s", err)
-	}
-	for chunkIdx := range chunksLen {
-		chunk := b.chunks[chunkIdx][:chunkSize]
-		if _, err := w.Write(chunk); err != nil {
-			return fmt.Errorf("cannot write b.chunks[%d]: %s", chunkIdx, err)
-		}
+		return 0, fmt.Errorf("cannot write len(b.chunks): %s", err)
 	}
-
-	return nil
+	return chunksLen, nil
 }
 
 func (b *bucket) Load(r io.Reader, maxChunks uint64) error {
-	if maxChunks == 0 {
-		return fmt.Errorf("the number of chunks per bucket cannot be zero")
-	}
-	bIdx, err := readUint64(r)
+	bIdx, bGen, m, err := readBucketIndex(r, maxChunks)
 	if err != nil {
-		return fmt.Errorf("cannot read b.idx: %s", err)
-	}
-	bGen, err := readUint64(r)
-	if err != nil {
-		return fmt.Errorf("cannot read b.gen: %s", err)
+		return err
 	}
-	kvsLen, err := readUint64(r)
+	chunksLen, err := readChunksLen(r, bIdx, maxChunks)
 	if err != nil {
-		return fmt.Errorf("cannot read len(b.m): %s", err)
-	}
-	kvsLen *= 2 * 8
-	kvs := make([]byte, kvsLen)
-	if _, err := io.ReadFull(r, kvs); err != nil {
-		return fmt.Errorf("cannot read b.m: %s", err)
+		return err
 	}
-	m := make(map[uint64]uint64, kvsLen/2/8)
-	for len(kvs) > 0 {
-		k := binary.LittleEndian.Uint64(kvs)
-		kvs = kvs[8:]
-		v := binary.LittleEndian.Uint64(kvs)
-		kvs = kvs[8:]
-		m[k] = v
+	chunks := make([][]byte, maxChunks)
+	for chunkIdx := range chunksLen {
+		chunk := b.getChunk()
+		chunks[chunkIdx] = chunk
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			// Free up allocated chunks before returning the error.
+			for _, chunk := range chunks {
+				b.putChunk(chunk)
+			}
+			return fmt.Errorf("cannot read b.chunks[%d]: %w", chunkIdx, err)
+		}
 	}
+	b.setLoaded(chunks, chunksLen, m, bIdx, bGen)
+	return nil
+}
 
-	maxBytes := maxChunks * chunkSize
-	if maxBytes >= maxBucketSize {
-		return fmt.Errorf("too big maxBytes=%d; should be smaller than %d", maxBytes, maxBucketSize)
+// readChunksLen reads len(b.chunks) written by bucket.save from r
+// and verifies it against bIdx and maxChunks.
+func readChunksLen(r io.Reader, bIdx, maxChunks uint64) (uint64, error) {
+	if err := validateMaxChunks(maxChunks); err != nil {
+		return 0, err
 	}
-	chunks := make([][]byte, maxChunks)
 	chunksLen, err := readUint64(r)
 	if err != nil {
-		return fmt.Errorf("cannot read len(b.chunks): %s", err)
+		return 0, fmt.Errorf("cannot read len(b.chunks): %w", err)
+	}
+	if chunksLen > maxChunks {
+		return 0, corruptionErrorf("chunksLen=%d cannot exceed maxChunks=%d", chunksLen, maxChunks)
 	}
-	if chunksLen > uint64(maxChunks) {
-		return fmt.Errorf("chunksLen=%d cannot exceed maxChunks=%d", chunksLen, maxChunks)
+	if chunksLen == 0 && bIdx > 0 {
+		return 0, corruptionErrorf("bIdx=%d must be zero for a bucket without chunks", bIdx)
 	}
 	currChunkIdx := bIdx / chunkSize
 	if currChunkIdx > 0 && currChunkIdx >= chunksLen {
-		return fmt.Errorf("too big bIdx=%d; should be smaller than %d", bIdx, chunksLen*chunkSize)
-	}
-	for chunkIdx := range chunksLen {
-		chunk := getChunk()
-		chunks[chunkIdx] = chunk
-		if _, err := io.ReadFull(r, chunk); err != nil {
-			// Free up allocated chunks before returning the error.
-			for _, chunk := range chunks {
-				if chunk != nil {
-					putChunk(chunk)
-				}
-			}
-			return fmt.Errorf("cannot read b.chunks[%d]: %s", chunkIdx, err)
-		}
+		return 0, corruptionErrorf("too big bIdx=%d; should be smaller than %d", bIdx, chunksLen*chunkSize)
 	}
+	return chunksLen, nil
+}
+
+// setLoaded replaces b contents with the loaded chunks and index.
+//
+// The first chunksLen chunks must have chunkSize length.
+func (b *bucket) setLoaded(chunks [][]byte, chunksLen uint64, m map[uint64]uint64, bIdx, bGen uint64) {
 	// Adjust len for the chunk pointed by currChunkIdx.
 	if chunksLen > 0 {
+		currChunkIdx := bIdx / chunkSize
 		chunkLen := bIdx % chunkSize
 		chunks[currChunkIdx] = chunks[currChunkIdx][:chunkLen]
 	}
 
 	b.mu.Lock()
 	for _, chunk := range b.chunks {
-		putChunk(chunk)
+		b.putChunk(chunk)
 	}
 	b.chunks = chunks
 	b.m = m
 	b.idx = bIdx
 	b.gen = bGen
+	b.dirty = true
+	b.dirtyChunks = make([]bool, len(chunks))
+	for chunkIdx := range chunksLen {
+		b.dirtyChunks[chunkIdx] = true
+	}
 	b.mu.Unlock()
+}
 
-	return nil
+// readBucketIndex reads b.idx, b.gen and b.m written by bucket.save from r.
+//
+// The memory allocated for b.m is bounded by maxChunks and by the size of data read from r,
+// so corrupted data cannot trigger huge allocations.
+func readBucketIndex(r io.Reader, maxChunks uint64) (uint64, uint64, map[uint64]uint64, error) {
+	if err := validateMaxChunks(maxChunks); err != nil {
+		return 0, 0, nil, err
+	}
+	bIdx, err := readUint64(r)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("cannot read b.idx: %w", err)
+	}
+	bGen, err := readUint64(r)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("cannot read b.gen: %w", err)
+	}
+	kvsLen, err := readUint64(r)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("cannot read len(b.m): %w", err)
+	}
+	if maxEntries := maxBucketEntries(maxChunks); kvsLen > maxEntries {
+		return 0, 0, nil, corruptionErrorf("too big len(b.m)=%d; cannot exceed %d", kvsLen, maxEntries)
+	}
+
+	// Read b.m in batches, so the allocated memory grows only with the actually read data.
+	const batchLen = 4096
+	kvs := make([]byte, min(kvsLen, batchLen)*2*8)
+	m := make(map[uint64]uint64, min(kvsLen, batchLen))
+	for kvsLen > 0 {
+		n := min(kvsLen, batchLen)
+		kvsLen -= n
+		buf := kvs[:n*2*8]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, 0, nil, fmt.Errorf("cannot read b.m: %w", err)
+		}
+		for len(buf) > 0 {
+			k := binary.LittleEndian.Uint64(buf)
+			v := binary.LittleEndian.Uint64(buf[8:])
+			buf = buf[16:]
+			m[k] = v
+		}
+	}
+	return bIdx, bGen, m, nil
 }
 
 func writeUint64(w io.Writer, u uint64) error {
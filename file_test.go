@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 func TestSaveLoadSmall(t *testing.T) {
@@ -59,6 +61,152 @@ func TestLoadFileNotExist(t *testing.T) {
 	}
 }
 
+func TestSaveToFileVersioned(t *testing.T) {
+	tmpDir := t.TempDir()
+	c := New(1)
+	defer c.Reset()
+
+	checkValue := func(filePath, vExpected string) {
+		t.Helper()
+		c1, err := LoadFromFile(filePath)
+		if err != nil {
+			t.Fatalf("LoadFromFile error: %s", err)
+		}
+		defer c1.Reset()
+		if v := c1.Get(nil, []byte("key")); string(v) != vExpected {
+			t.Fatalf("unexpected value; got %q; want %q", v, vExpected)
+		}
+	}
+	checkLayout := func(filePath string) {
+		t.Helper()
+		name, err := readCurrentSnapshotName(NewFileSnapshotStore(filePath))
+		if err != nil {
+			t.Fatalf("cannot read the current snapshot name: %s", err)
+		}
+		des, err := os.ReadDir(filePath)
+		if err != nil {
+			t.Fatalf("cannot read %q: %s", filePath, err)
+		}
+		var names []string
+		for _, de := range des {
+			names = append(names, de.Name())
+		}
+		namesExpected := []string{currentSnapshotFilename, name}
+		if fmt.Sprint(names) != fmt.Sprint(namesExpected) {
+			t.Fatalf("unexpected contents of %q; got %q; want %q", filePath, names, namesExpected)
+		}
+	}
+
+	// Save the snapshot in the legacy layout.
+	srcPath := filepath.Join(tmpDir, "src")
+	c.Set([]byte("key"), []byte("legacy"))
+	if err := c.SaveToFile(srcPath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	checkLayout(srcPath)
+	filePath := filepath.Join(tmpDir, "legacy")
+	if err := os.Rename(mustResolveSnapshotDir(t, srcPath), filePath); err != nil {
+		t.Fatalf("cannot create legacy snapshot: %s", err)
+	}
+	checkValue(filePath, "legacy")
+
+	// Leave the data from an interrupted save.
+	for _, name := range []string{"fastcache.tmp.123", nextSnapshotName("")} {
+		if err := os.MkdirAll(filepath.Join(filePath, name), 0755); err != nil {
+			t.Fatalf("cannot create dir: %s", err)
+		}
+		if err := os.WriteFile(filepath.Join(filePath, name, "data.0.bin"), []byte("foobar"), 0644); err != nil {
+			t.Fatalf("cannot create file: %s", err)
+		}
+	}
+
+	// Save the snapshot over the legacy snapshot.
+	for i := range 3 {
+		v := fmt.Sprintf("value %d", i)
+		c.Set([]byte("key"), []byte(v))
+		if err := c.SaveToFile(filePath); err != nil {
+			t.Fatalf("SaveToFile error: %s", err)
+		}
+		checkLayout(filePath)
+		checkValue(filePath, v)
+	}
+
+	// The previous snapshot must remain valid until the pointer file is updated.
+	name, err := readCurrentSnapshotName(NewFileSnapshotStore(filePath))
+	if err != nil {
+		t.Fatalf("cannot read the current snapshot name: %s", err)
+	}
+	nextPath := filepath.Join(filePath, nextSnapshotName(name))
+	if err := os.MkdirAll(nextPath, 0755); err != nil {
+		t.Fatalf("cannot create dir: %s", err)
+	}
+	checkValue(filePath, "value 2")
+
+	// Invalid pointer file must result in error.
+	if err := os.WriteFile(filepath.Join(filePath, currentSnapshotFilename), []byte("../foo"), 0644); err != nil {
+		t.Fatalf("cannot write pointer file: %s", err)
+	}
+	if _, err := LoadFromFile(filePath); err == nil {
+		t.Fatalf("expecting non-nil error for invalid pointer file")
+	}
+}
+
+func TestBucketSaveUnlocked(t *testing.T) {
+	c := New(1)
+	defer c.Reset()
+	k := []byte("key")
+	h := xxhash.Sum64(k)
+	b := &c.buckets[h%bucketsCount]
+	b.Set(k, []byte("value"), h)
+
+	// Block the save on the first write. Concurrent Set to the bucket mustn't be blocked.
+	w := &blockingWriter{
+		startCh:   make(chan struct{}),
+		releaseCh: make(chan struct{}),
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- b.Save(w)
+	}()
+	<-w.startCh
+	b.Set(k, []byte("new value"), h)
+	if v := c.Get(nil, k); string(v) != "new value" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "new value")
+	}
+	close(w.releaseCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// blockingWriter blocks the first Write call until releaseCh is closed.
+type blockingWriter struct {
+	startCh   chan struct{}
+	releaseCh chan struct{}
+	started   bool
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		close(w.startCh)
+		<-w.releaseCh
+	}
+	return len(p), nil
+}
+
+func mustResolveSnapshotDir(t *testing.T, filePath string) string {
+	t.Helper()
+	name, err := readCurrentSnapshotName(NewFileSnapshotStore(filePath))
+	if err != nil {
+		t.Fatalf("cannot resolve snapshot dir for %q: %s", filePath, err)
+	}
+	if name == "" {
+		return filePath
+	}
+	return filepath.Join(filePath, name)
+}
+
 func TestSaveLoadFile(t *testing.T) {
 	for _, concurrency := range []int{0, 1, 2, 4, 10} {
 		t.Run(fmt.Sprintf("concurrency_%d", concurrency), func(t *testing.T) {
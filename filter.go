@@ -0,0 +1,60 @@
+package fastcache
+
+import (
+	"io"
+)
+
+// SaveToFileFiltered atomically saves only cache entries passing filter to the given filePath.
+//
+// filter is called for every entry stored in memory. The entry is saved only if filter returns true.
+// filter mustn't hold k and v after returning. It may be called concurrently from multiple goroutines.
+//
+// The saved snapshot may be loaded with LoadFromFile*.
+// See SaveOptions.Filter for details.
+func (c *Cache) SaveToFileFiltered(filePath string, filter func(k, v []byte) bool) error {
+	opts := &SaveOptions{
+		Filter: filter,
+	}
+	return c.SaveToFileOptions(filePath, opts)
+}
+
+// filtered returns a copy of b, which contains only entries passing filter.
+//
+// Entries are copied to the new ring buffer in the order they were written to b,
+// so the copy occupies only the space needed for the kept entries.
+// The rest of the ring buffer is zeroed, so it doesn't contain the data for the dropped entries.
+// The returned bucket must be released with unload when it is no longer needed.
+//
+// filter is called without holding the lock on b.
+func (b *bucket) filtered(filter func(k, v []byte) bool) *bucket {
+	var be bucketEntries
+	maxChunks := b.copyEntries(&be)
+	fb := &bucket{
+		chunks:      make([][]byte, maxChunks),
+		dirtyChunks: make([]bool, maxChunks),
+		m:           make(map[uint64]uint64, len(be.hs)),
+		gen:         1,
+		alloc:       zeroingAllocator{b.allocator()},
+	}
+	for i, h := range be.hs {
+		k, v := be.get(i)
+		if filter(k, v) {
+			fb.setLocked(k, v, h)
+		}
+	}
+	return fb
+}
+
+// filterBucketSaver returns bucketSaver, which saves only entries passing filter with saveBucket.
+//
+// saveBucket is returned as is if filter is nil.
+func filterBucketSaver(saveBucket bucketSaver, filter func(k, v []byte) bool) bucketSaver {
+	if filter == nil {
+		return saveBucket
+	}
+	return func(b *bucket, w io.Writer) error {
+		fb := b.filtered(filter)
+		defer fb.unload()
+		return saveBucket(fb, w)
+	}
+}
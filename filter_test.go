@@ -0,0 +1,119 @@
+package fastcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveToFileFiltered(t *testing.T) {
+	tmpDir := t.TempDir()
+	c := New(bucketsCount * chunkSize * 4)
+	defer c.Reset()
+	const itemsCount = 50000
+	// Values are big enough for occupying multiple chunks per bucket.
+	value := func(i int) string {
+		return fmt.Sprintf("value %d ", i) + strings.Repeat("x", 2000)
+	}
+	for i := range itemsCount {
+		prefix := "keep"
+		if i%4 != 0 {
+			prefix = "drop"
+		}
+		c.Set([]byte(fmt.Sprintf("%s %d", prefix, i)), []byte(value(i)))
+	}
+	filter := func(k, v []byte) bool {
+		return strings.HasPrefix(string(k), "keep ")
+	}
+	checkCache := func(c *Cache) {
+		t.Helper()
+		for i := range itemsCount {
+			k := fmt.Sprintf("keep %d", i)
+			if i%4 != 0 {
+				k = fmt.Sprintf("drop %d", i)
+				if c.Has([]byte(k)) {
+					t.Fatalf("unexpected entry for key %q", k)
+				}
+				continue
+			}
+			if v := c.Get(nil, []byte(k)); string(v) != value(i) {
+				t.Fatalf("unexpected value for key %q; got %d bytes; want %d bytes", k, len(v), len(value(i)))
+			}
+		}
+		var s Stats
+		c.UpdateStats(&s)
+		if s.EntriesCount != itemsCount/4 {
+			t.Fatalf("unexpected number of entries; got %d; want %d", s.EntriesCount, itemsCount/4)
+		}
+	}
+	snapshotSize := func(filePath string) int64 {
+		t.Helper()
+		fi, err := os.Stat(filepath.Join(mustResolveSnapshotDir(t, filePath), "data.0.bin"))
+		if err != nil {
+			t.Fatalf("cannot stat data file: %s", err)
+		}
+		return fi.Size()
+	}
+
+	for _, codec := range []Codec{CodecNone, CodecMmap} {
+		fullPath := filepath.Join(tmpDir, "full_"+codec.String())
+		if err := c.SaveToFileOptions(fullPath, &SaveOptions{Codec: codec, Concurrency: 1}); err != nil {
+			t.Fatalf("SaveToFileOptions error: %s", err)
+		}
+		filteredPath := filepath.Join(tmpDir, "filtered_"+codec.String())
+		opts := &SaveOptions{
+			Codec:       codec,
+			Concurrency: 1,
+			Filter:      filter,
+		}
+		if err := c.SaveToFileOptions(filteredPath, opts); err != nil {
+			t.Fatalf("SaveToFileOptions error: %s", err)
+		}
+		if fullSize, filteredSize := snapshotSize(fullPath), snapshotSize(filteredPath); filteredSize >= fullSize/2 {
+			t.Fatalf("too big filtered snapshot for codec %s; got %d bytes; full snapshot has %d bytes", codec, filteredSize, fullSize)
+		}
+		c1, err := LoadFromFile(filteredPath)
+		if err != nil {
+			t.Fatalf("LoadFromFile error: %s", err)
+		}
+		checkCache(c1)
+		c1.Reset()
+	}
+
+	filePath := filepath.Join(tmpDir, "filtered")
+	if err := c.SaveToFileFiltered(filePath, filter); err != nil {
+		t.Fatalf("SaveToFileFiltered error: %s", err)
+	}
+	c1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	checkCache(c1)
+	c1.Reset()
+
+	// The source cache must remain untouched.
+	var s Stats
+	c.UpdateStats(&s)
+	if s.EntriesCount != itemsCount {
+		t.Fatalf("unexpected number of entries in the source cache; got %d; want %d", s.EntriesCount, itemsCount)
+	}
+
+	// The filter may access the cache.
+	opts := &SaveOptions{
+		Consistent: true,
+		Filter: func(k, v []byte) bool {
+			return filter(k, v) && c.Has(k)
+		},
+	}
+	if err := c.SaveToFileOptions(filePath, opts); err != nil {
+		t.Fatalf("SaveToFileOptions error: %s", err)
+	}
+	c1, err = LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	checkCache(c1)
+	c1.Reset()
+}
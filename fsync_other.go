@@ -0,0 +1,9 @@
+//go:build appengine || windows || wasm || tinygo.wasm || js
+// +build appengine windows wasm tinygo.wasm js
+
+package fastcache
+
+// syncDir is no-op on platforms, which don't support fsync for directories.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !appengine && !windows && !wasm && !tinygo.wasm && !js
+// +build !appengine,!windows,!wasm,!tinygo.wasm,!js
+
+package fastcache
+
+import (
+	"fmt"
+	"os"
+)
+
+// syncDir fsyncs dir, so the created, renamed and removed entries in dir persist on power loss.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open dir %q: %s", dir, err)
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return fmt.Errorf("cannot fsync dir %q: %s", dir, err)
+	}
+	if err := d.Close(); err != nil {
+		return fmt.Errorf("cannot close dir %q: %s", dir, err)
+	}
+	return nil
+}
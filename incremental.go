@@ -0,0 +1,462 @@
+package fastcache
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SaveIncremental saves changes made to c since the previous SaveIncremental call to dir.
+//
+// The first call writes a full base snapshot to dir. Subsequent calls write
+// increments containing only buckets and chunks modified since the previous call.
+// The full base snapshot is written again if dir doesn't contain the chain
+// of snapshots created by c, for example after SaveIncremental error.
+//
+// The saved data may be loaded with LoadIncremental.
+// Use CompactIncremental for merging increments into the base snapshot.
+//
+// SaveIncremental may be called concurrently with other operations on the cache.
+// Concurrent SaveIncremental calls are serialized.
+func (c *Cache) SaveIncremental(dir string) error {
+	return c.notifySave(dir, func() error {
+		return c.saveIncremental(dir)
+	})
+}
+
+func (c *Cache) saveIncremental(dir string) error {
+	c.incrMu.Lock()
+	defer c.incrMu.Unlock()
+
+	s := NewFileSnapshotStore(dir)
+	chain, err := readIncrementalChain(s)
+	if err != nil {
+		return fmt.Errorf("cannot read snapshots at %q: %w", dir, err)
+	}
+	if c.incrChainID == 0 || chain == nil || chain.chainID != c.incrChainID || chain.lastSeq != c.incrSeq {
+		err = c.saveIncrementalBase(s)
+	} else {
+		err = c.saveIncrement(s)
+	}
+	if err != nil {
+		// Dirty flags may be already cleared for some buckets,
+		// so force writing the full base snapshot on the next call.
+		c.incrChainID = 0
+		return fmt.Errorf("cannot save snapshot to %q: %w", dir, err)
+	}
+	return nil
+}
+
+func (c *Cache) saveIncrementalBase(s SnapshotStore) error {
+	chainID := uint64(time.Now().UnixNano())
+	if chainID <= c.incrChainID {
+		chainID = c.incrChainID + 1
+	}
+	name := incrementalSnapshotName(incrementalBasePrefix, chainID, 0)
+	sh := newSnapshotHeader(uint64(cap(c.buckets[0].chunks)))
+	sh.chainID = chainID
+	saveBucket := func(b *bucket, w io.Writer) error {
+		return b.save(w, false, true)
+	}
+	if err := c.writeIncrementalSnapshot(s, name, sh, nil, saveBucket); err != nil {
+		return err
+	}
+	c.incrChainID = chainID
+	c.incrSeq = 0
+
+	// Remove snapshots from the previous chains and leftovers from interrupted saves.
+	chain, err := readIncrementalChain(s)
+	if err != nil {
+		return err
+	}
+	if err := removeIncrementalSnapshots(s, chain.stale); err != nil {
+		return err
+	}
+	return removeIncrementalSnapshots(s, chain.incomplete)
+}
+
+func (c *Cache) saveIncrement(s SnapshotStore) error {
+	var bucketNums []int
+	for i := range c.buckets[:] {
+		if c.buckets[i].isDirty() {
+			bucketNums = append(bucketNums, i)
+		}
+	}
+	if len(bucketNums) == 0 {
+		// Nothing to save.
+		return nil
+	}
+	seq := c.incrSeq + 1
+	name := incrementalSnapshotName(incrementalIncrPrefix, c.incrChainID, seq)
+	sh := newSnapshotHeader(uint64(cap(c.buckets[0].chunks)))
+	sh.chainID = c.incrChainID
+	sh.seq = seq
+	sh.incremental = true
+	saveBucket := func(b *bucket, w io.Writer) error {
+		return b.save(w, true, true)
+	}
+	if err := c.writeIncrementalSnapshot(s, name, sh, bucketNums, saveBucket); err != nil {
+		return err
+	}
+	c.incrSeq = seq
+	return nil
+}
+
+// writeIncrementalSnapshot atomically writes the snapshot with the given name to s.
+//
+// The snapshot becomes visible to readIncrementalChain after its metadata.bin is written.
+func (c *Cache) writeIncrementalSnapshot(s SnapshotStore, name string, sh *snapshotHeader, bucketNums []int, saveBucket bucketSaver) error {
+	// The snapshot may be left by interrupted save. It is incomplete, so it is safe to remove it.
+	if err := removeObjects(s, name); err != nil {
+		return fmt.Errorf("cannot remove incomplete snapshot %q: %w", name, err)
+	}
+	if err := c.saveSnapshot(subStore(s, name), runtime.GOMAXPROCS(-1), sh, bucketNums, saveBucket, nil, nil); err != nil {
+		_ = removeObjects(s, name)
+		return fmt.Errorf("cannot save cache data to %q: %w", name, err)
+	}
+	return nil
+}
+
+// LoadIncremental loads cache data saved by Cache.SaveIncremental from dir.
+//
+// It loads the base snapshot and then applies the chain of increments on top of it.
+// Subsequent SaveIncremental calls on the returned cache continue the chain in dir.
+func LoadIncremental(dir string) (*Cache, error) {
+	c, _, err := loadIncremental(NewFileSnapshotStore(dir))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load snapshots from %q: %w", dir, err)
+	}
+	return c, nil
+}
+
+func loadIncremental(s SnapshotStore) (*Cache, *incrementalChain, error) {
+	chain, err := readIncrementalChain(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	if chain == nil {
+		return nil, nil, fmt.Errorf("cannot find base snapshot: %w", fs.ErrNotExist)
+	}
+	c, sh, err := loadSnapshot(subStore(s, chain.baseName), 0, false, nil, nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load base snapshot %q: %w", chain.baseName, err)
+	}
+	if sh.chainID != chain.chainID || sh.seq != chain.baseSeq {
+		c.Reset()
+		return nil, nil, fmt.Errorf("unexpected chainID=%d, seq=%d in %q; want chainID=%d, seq=%d", sh.chainID, sh.seq, chain.baseName, chain.chainID, chain.baseSeq)
+	}
+	for _, incr := range chain.incrs {
+		if err := c.applyIncrement(s, incr.name, chain.chainID, incr.seq, sh.maxBucketChunks); err != nil {
+			c.Reset()
+			return nil, nil, err
+		}
+	}
+	for i := range c.buckets[:] {
+		b := &c.buckets[i]
+		// Drop index entries pointing past valid chunks, since they aren't rejected during the load.
+		b.verify()
+		b.clearDirty()
+	}
+	c.incrChainID = chain.chainID
+	c.incrSeq = chain.lastSeq
+	return c, chain, nil
+}
+
+func (c *Cache) applyIncrement(s SnapshotStore, name string, chainID, seq, maxBucketChunks uint64) error {
+	incrStore := subStore(s, name)
+	sh, err := loadMetadata(incrStore)
+	if err != nil {
+		return fmt.Errorf("cannot load increment %q: %w", name, err)
+	}
+	if !sh.incremental || sh.chainID != chainID || sh.seq != seq {
+		return fmt.Errorf("unexpected snapshot at %q; got incremental=%v, chainID=%d, seq=%d; want incremental=true, chainID=%d, seq=%d",
+			name, sh.incremental, sh.chainID, sh.seq, chainID, seq)
+	}
+	if sh.maxBucketChunks != maxBucketChunks {
+		return fmt.Errorf("unexpected maxBucketChunks=%d at %q; want %d", sh.maxBucketChunks, name, maxBucketChunks)
+	}
+	var claims bucketClaims
+	loadFile := func(f *snapshotFile) error {
+		return loadBuckets(c.buckets[:], &claims, incrStore, f, sh, (*bucket).LoadIncremental, nil, nil)
+	}
+	if err := loadDataFiles(sh.files, loadFile); err != nil {
+		return fmt.Errorf("cannot load increment %q: %w", name, err)
+	}
+	return nil
+}
+
+// CompactIncremental merges increments saved by Cache.SaveIncremental in dir
+// into a new base snapshot and removes the merged increments.
+//
+// CompactIncremental may be called while a cache continues saving increments to dir,
+// but it mustn't be called concurrently with another CompactIncremental call for the same dir.
+func CompactIncremental(dir string) error {
+	if err := compactIncremental(NewFileSnapshotStore(dir)); err != nil {
+		return fmt.Errorf("cannot compact snapshots at %q: %w", dir, err)
+	}
+	return nil
+}
+
+func compactIncremental(s SnapshotStore) error {
+	c, chain, err := loadIncremental(s)
+	if err != nil {
+		return err
+	}
+	defer c.Reset()
+	if len(chain.incrs) > 0 {
+		name := incrementalSnapshotName(incrementalBasePrefix, chain.chainID, chain.lastSeq)
+		sh := newSnapshotHeader(uint64(cap(c.buckets[0].chunks)))
+		sh.chainID = chain.chainID
+		sh.seq = chain.lastSeq
+		if err := c.writeIncrementalSnapshot(s, name, sh, nil, (*bucket).Save); err != nil {
+			return err
+		}
+		chain.stale = append(chain.stale, chain.baseName)
+		for _, incr := range chain.incrs {
+			chain.stale = append(chain.stale, incr.name)
+		}
+	}
+	return removeIncrementalSnapshots(s, chain.stale)
+}
+
+const (
+	incrementalBasePrefix = "base"
+	incrementalIncrPrefix = "incr"
+)
+
+var incrementalSnapshotRegexp = regexp.MustCompile(`^(base|incr)\.([0-9a-f]{16})\.([0-9a-f]{16})$`)
+
+func incrementalSnapshotName(prefix string, chainID, seq uint64) string {
+	return fmt.Sprintf("%s.%016x.%016x", prefix, chainID, seq)
+}
+
+// incrementalChain describes the chain of incremental snapshots in a store.
+type incrementalChain struct {
+	chainID uint64
+
+	// baseName and baseSeq are the name and the sequence number of the base snapshot.
+	baseName string
+	baseSeq  uint64
+
+	// incrs contains increments, which must be applied on top of the base snapshot.
+	incrs []incrementalSnapshot
+
+	// lastSeq is the sequence number of the last snapshot in the chain.
+	lastSeq uint64
+
+	// stale contains names of snapshots, which aren't needed for loading the chain.
+	stale []string
+
+	// incomplete contains names of snapshots without metadata.bin and temporary dirs,
+	// which may be left after interrupted saves.
+	incomplete []string
+}
+
+type incrementalSnapshot struct {
+	name string
+	seq  uint64
+}
+
+// readIncrementalChain reads the newest chain of incremental snapshots from s.
+//
+// nil is returned if s contains no base snapshots.
+func readIncrementalChain(s SnapshotStore) (*incrementalChain, error) {
+	objectNames, err := s.List("")
+	if err != nil {
+		return nil, fmt.Errorf("cannot list objects: %w", err)
+	}
+	// Collect dirs with objects and mark dirs with metadata.bin as complete.
+	var dirs []string
+	complete := make(map[string]bool)
+	for _, objectName := range objectNames {
+		dir, fn, ok := strings.Cut(objectName, "/")
+		if !ok {
+			continue
+		}
+		if len(dirs) == 0 || dirs[len(dirs)-1] != dir {
+			dirs = append(dirs, dir)
+		}
+		if fn == metadataFilename {
+			complete[dir] = true
+		}
+	}
+
+	var bases, incrs []incrementalSnapshot
+	var incomplete []string
+	for _, name := range dirs {
+		match := incrementalSnapshotRegexp.FindStringSubmatch(name)
+		if match == nil {
+			if strings.HasPrefix(name, "tmp.") {
+				// Leftover from the interrupted save.
+				incomplete = append(incomplete, name)
+			}
+			continue
+		}
+		if !complete[name] {
+			// The snapshot is being written or its save has been interrupted.
+			incomplete = append(incomplete, name)
+			continue
+		}
+		seq, _ := strconv.ParseUint(match[3], 16, 64)
+		s := incrementalSnapshot{
+			name: name,
+			seq:  seq,
+		}
+		if match[1] == incrementalBasePrefix {
+			bases = append(bases, s)
+		} else {
+			incrs = append(incrs, s)
+		}
+	}
+	if len(bases) == 0 {
+		return nil, nil
+	}
+
+	// Select the newest base snapshot.
+	chain := &incrementalChain{}
+	for _, s := range bases {
+		chainID := parseIncrementalChainID(s.name)
+		if chainID > chain.chainID || chainID == chain.chainID && s.seq > chain.baseSeq {
+			chain.chainID = chainID
+			chain.baseSeq = s.seq
+			chain.baseName = s.name
+		}
+	}
+	for _, s := range bases {
+		if s.name != chain.baseName {
+			chain.stale = append(chain.stale, s.name)
+		}
+	}
+
+	// Collect increments, which must be applied on top of the selected base snapshot.
+	sort.Slice(incrs, func(i, j int) bool {
+		return incrs[i].seq < incrs[j].seq
+	})
+	chain.lastSeq = chain.baseSeq
+	for _, s := range incrs {
+		if parseIncrementalChainID(s.name) != chain.chainID || s.seq <= chain.baseSeq {
+			chain.stale = append(chain.stale, s.name)
+			continue
+		}
+		if s.seq != chain.lastSeq+1 {
+			// The gap in the chain. Increments after the gap cannot be applied.
+			chain.stale = append(chain.stale, s.name)
+			continue
+		}
+		chain.incrs = append(chain.incrs, s)
+		chain.lastSeq = s.seq
+	}
+	chain.incomplete = incomplete
+	return chain, nil
+}
+
+func parseIncrementalChainID(name string) uint64 {
+	match := incrementalSnapshotRegexp.FindStringSubmatch(name)
+	chainID, _ := strconv.ParseUint(match[2], 16, 64)
+	return chainID
+}
+
+func removeIncrementalSnapshots(s SnapshotStore, names []string) error {
+	for _, name := range names {
+		if err := removeObjects(s, name); err != nil {
+			return fmt.Errorf("cannot remove stale snapshot %q: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (b *bucket) isDirty() bool {
+	b.mu.RLock()
+	dirty := b.dirty
+	b.mu.RUnlock()
+	return dirty
+}
+
+func (b *bucket) clearDirty() {
+	b.mu.Lock()
+	b.dirty = false
+	clear(b.dirtyChunks)
+	b.mu.Unlock()
+}
+
+// LoadIncremental applies the increment written by bucket.save with dirtyOnly set to b.
+func (b *bucket) LoadIncremental(r io.Reader, maxChunks uint64) error {
+	bIdx, bGen, m, err := readBucketIndex(r, maxChunks)
+	if err != nil {
+		return err
+	}
+	chunksLen, err := readChunksLen(r, bIdx, maxChunks)
+	if err != nil {
+		return err
+	}
+	dirtyChunks, err := readUint64(r)
+	if err != nil {
+		return fmt.Errorf("cannot read the number of dirty chunks: %s", err)
+	}
+	if dirtyChunks > chunksLen {
+		return corruptionErrorf("the number of dirty chunks=%d cannot exceed chunksLen=%d", dirtyChunks, chunksLen)
+	}
+	newChunks := make(map[uint64][]byte, dirtyChunks)
+	freeNewChunks := func() {
+		for _, chunk := range newChunks {
+			b.putChunk(chunk)
+		}
+	}
+	for range dirtyChunks {
+		chunkIdx, err := readUint64(r)
+		if err != nil {
+			freeNewChunks()
+			return fmt.Errorf("cannot read dirty chunk index: %s", err)
+		}
+		if chunkIdx >= chunksLen || newChunks[chunkIdx] != nil {
+			freeNewChunks()
+			return corruptionErrorf("invalid dirty chunk index=%d; chunksLen=%d", chunkIdx, chunksLen)
+		}
+		chunk := b.getChunk()
+		newChunks[chunkIdx] = chunk
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			freeNewChunks()
+			return fmt.Errorf("cannot read b.chunks[%d]: %s", chunkIdx, err)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if uint64(len(b.chunks)) != maxChunks {
+		freeNewChunks()
+		return fmt.Errorf("unexpected number of chunks in the base bucket; got %d; want %d", len(b.chunks), maxChunks)
+	}
+	for chunkIdx := range chunksLen {
+		if b.chunks[chunkIdx] == nil && newChunks[chunkIdx] == nil {
+			freeNewChunks()
+			return corruptionErrorf("missing b.chunks[%d] in both the base snapshot and the increment", chunkIdx)
+		}
+	}
+	for chunkIdx, chunk := range newChunks {
+		b.putChunk(b.chunks[chunkIdx])
+		b.chunks[chunkIdx] = chunk
+	}
+	for chunkIdx := chunksLen; chunkIdx < maxChunks; chunkIdx++ {
+		b.putChunk(b.chunks[chunkIdx])
+		b.chunks[chunkIdx] = nil
+	}
+	for chunkIdx := range chunksLen {
+		b.chunks[chunkIdx] = b.chunks[chunkIdx][:chunkSize]
+	}
+	// Adjust len for the chunk pointed by currChunkIdx.
+	if chunksLen > 0 {
+		currChunkIdx := bIdx / chunkSize
+		b.chunks[currChunkIdx] = b.chunks[currChunkIdx][:bIdx%chunkSize]
+	}
+	b.m = m
+	b.idx = bIdx
+	b.gen = bGen
+	b.dirty = true
+	return nil
+}
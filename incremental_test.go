@@ -0,0 +1,217 @@
+package fastcache
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestSaveLoadIncremental(t *testing.T) {
+	dir := t.TempDir()
+
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+	for i := range 10000 {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+
+	// The first call must write the base snapshot.
+	if err := c.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	names := readIncrementalSnapshotNames(t, dir)
+	if len(names) != 1 || names[0][:4] != incrementalBasePrefix {
+		t.Fatalf("unexpected snapshots after the first SaveIncremental: %q", names)
+	}
+	checkIncrementalCache(t, dir, c)
+
+	// Modify a few keys. The increment must contain only the modified buckets.
+	for i := range 10 {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("new value %d", i)))
+	}
+	if err := c.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	names = readIncrementalSnapshotNames(t, dir)
+	if len(names) != 2 {
+		t.Fatalf("unexpected snapshots after the second SaveIncremental: %q", names)
+	}
+	sh, err := loadMetadata(NewFileSnapshotStore(dir + "/" + names[1]))
+	if err != nil {
+		t.Fatalf("cannot load increment metadata: %s", err)
+	}
+	if !sh.incremental || sh.seq != 1 {
+		t.Fatalf("unexpected increment header: incremental=%v, seq=%d", sh.incremental, sh.seq)
+	}
+	bucketsSaved := 0
+	for _, f := range sh.files {
+		bucketsSaved += len(f.buckets)
+	}
+	if bucketsSaved == 0 || bucketsSaved > 10 {
+		t.Fatalf("unexpected number of buckets in the increment; got %d; want from 1 to 10", bucketsSaved)
+	}
+	checkIncrementalCache(t, dir, c)
+
+	// Nothing changed - no increment must be written.
+	if err := c.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	if names := readIncrementalSnapshotNames(t, dir); len(names) != 2 {
+		t.Fatalf("unexpected snapshots after SaveIncremental without changes: %q", names)
+	}
+
+	// Delete keys and overflow the cache, so chunks are overwritten.
+	for i := 10; i < 100; i++ {
+		c.Del([]byte(fmt.Sprintf("key %d", i)))
+	}
+	overflowValue := make([]byte, 1000)
+	for i := range 3 * bucketsCount * chunkSize * 2 / len(overflowValue) {
+		c.Set([]byte(fmt.Sprintf("overflow key %d", i)), overflowValue)
+	}
+	if err := c.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	checkIncrementalCache(t, dir, c)
+
+	// Reset the cache and save it.
+	c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+	if err := c.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	checkIncrementalCache(t, dir, c)
+
+	// Compact increments.
+	if err := CompactIncremental(dir); err != nil {
+		t.Fatalf("CompactIncremental error: %s", err)
+	}
+	names = readIncrementalSnapshotNames(t, dir)
+	if len(names) != 1 || names[0][:4] != incrementalBasePrefix {
+		t.Fatalf("unexpected snapshots after CompactIncremental: %q", names)
+	}
+	checkIncrementalCache(t, dir, c)
+
+	// The cache must continue the chain after the compaction.
+	c.Set([]byte("foo"), []byte("baz"))
+	if err := c.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	names = readIncrementalSnapshotNames(t, dir)
+	if len(names) != 2 || names[1][:4] != incrementalIncrPrefix {
+		t.Fatalf("unexpected snapshots after SaveIncremental following CompactIncremental: %q", names)
+	}
+	checkIncrementalCache(t, dir, c)
+
+	// The loaded cache must continue the chain.
+	c1, err := LoadIncremental(dir)
+	if err != nil {
+		t.Fatalf("LoadIncremental error: %s", err)
+	}
+	defer c1.Reset()
+	c1.Set([]byte("foo"), []byte("qux"))
+	if err := c1.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	names = readIncrementalSnapshotNames(t, dir)
+	if len(names) != 3 || names[2][:4] != incrementalIncrPrefix {
+		t.Fatalf("unexpected snapshots after SaveIncremental on the loaded cache: %q", names)
+	}
+	checkIncrementalCache(t, dir, c1)
+
+	// Another cache must start a new chain and remove the previous one.
+	c2 := New(bucketsCount * chunkSize)
+	defer c2.Reset()
+	c2.Set([]byte("aaa"), []byte("bbb"))
+	if err := c2.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	names = readIncrementalSnapshotNames(t, dir)
+	if len(names) != 1 || names[0][:4] != incrementalBasePrefix {
+		t.Fatalf("unexpected snapshots after SaveIncremental from another cache: %q", names)
+	}
+	checkIncrementalCache(t, dir, c2)
+}
+
+func TestLoadIncrementalMissing(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := LoadIncremental(dir); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+
+	// Incremental snapshots cannot be loaded with LoadFromFile.
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+	if err := c.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	c.Set([]byte("foo"), []byte("baz"))
+	if err := c.SaveIncremental(dir); err != nil {
+		t.Fatalf("SaveIncremental error: %s", err)
+	}
+	names := readIncrementalSnapshotNames(t, dir)
+	if _, err := LoadFromFile(dir + "/" + names[1]); err == nil {
+		t.Fatalf("expecting non-nil error when loading increment with LoadFromFile")
+	}
+
+	// The base snapshot is a regular snapshot.
+	c1, err := LoadFromFile(dir + "/" + names[0])
+	if err != nil {
+		t.Fatalf("cannot load base snapshot with LoadFromFile: %s", err)
+	}
+	defer c1.Reset()
+	if v := c1.Get(nil, []byte("foo")); string(v) != "bar" {
+		t.Fatalf("unexpected value in the base snapshot; got %q; want %q", v, "bar")
+	}
+}
+
+func readIncrementalSnapshotNames(t *testing.T, dir string) []string {
+	t.Helper()
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", dir, err)
+	}
+	var names []string
+	for _, de := range des {
+		names = append(names, de.Name())
+	}
+	sort.Slice(names, func(i, j int) bool {
+		// Sort base snapshots before increments.
+		if names[i][:4] != names[j][:4] {
+			return names[i][:4] == incrementalBasePrefix
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// checkIncrementalCache verifies that the cache loaded from dir contains the same entries as c.
+func checkIncrementalCache(t *testing.T, dir string, c *Cache) {
+	t.Helper()
+	c1, err := LoadIncremental(dir)
+	if err != nil {
+		t.Fatalf("LoadIncremental error: %s", err)
+	}
+	defer c1.Reset()
+	for i := range c.buckets[:] {
+		b := &c.buckets[i]
+		b1 := &c1.buckets[i]
+		b.mu.RLock()
+		if len(b.m) != len(b1.m) || b.idx != b1.idx || b.gen != b1.gen {
+			t.Fatalf("unexpected bucket[%d] state; got len(m)=%d, idx=%d, gen=%d; want len(m)=%d, idx=%d, gen=%d",
+				i, len(b1.m), b1.idx, b1.gen, len(b.m), b.idx, b.gen)
+		}
+		for h, v := range b.m {
+			if b1.m[h] != v {
+				t.Fatalf("unexpected index entry in bucket[%d] for hash %d; got %d; want %d", i, h, b1.m[h], v)
+			}
+			chunkIdx := (v & (maxBucketSize - 1)) / chunkSize
+			n := len(b.chunks[chunkIdx])
+			if len(b1.chunks[chunkIdx]) < n || string(b.chunks[chunkIdx]) != string(b1.chunks[chunkIdx][:n]) {
+				t.Fatalf("unexpected contents for bucket[%d].chunks[%d]", i, chunkIdx)
+			}
+		}
+		b.mu.RUnlock()
+	}
+}
@@ -0,0 +1,302 @@
+package fastcache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// SnapshotInspector provides read-only access to the contents of a snapshot saved by SaveToFile*.
+//
+// It is intended for offline analysis of snapshots. See cmd/fastcache-inspect.
+// The snapshot isn't loaded into memory as a whole. Instead, it is streamed
+// bucket by bucket on every access to entries, so big snapshots may be inspected
+// with bounded memory usage.
+type SnapshotInspector struct {
+	ss     *snapshotStream
+	report *LoadReport
+	bis    []BucketInfo
+}
+
+// SnapshotGeometry describes the layout of a snapshot.
+type SnapshotGeometry struct {
+	// Version is the snapshot format version. It is 0 for legacy snapshots without a manifest.
+	Version uint64
+
+	// Codec is the codec used for data files.
+	Codec Codec
+
+	// BucketsCount is the number of buckets in the snapshot.
+	BucketsCount int
+
+	// ChunkSize is the size of a single chunk in bytes.
+	ChunkSize int
+
+	// MaxBucketChunks is the maximum number of chunks per bucket.
+	MaxBucketChunks int
+
+	// MaxBytes is the capacity of the saved cache.
+	MaxBytes int
+
+	// Files contains the data files listed in the manifest.
+	//
+	// It is empty for legacy snapshots.
+	Files []SnapshotFileInfo
+}
+
+// SnapshotFileInfo describes a data file listed in the snapshot manifest.
+type SnapshotFileInfo struct {
+	// Name is the name of the data file.
+	Name string
+
+	// Size is the size of the data file in bytes.
+	Size uint64
+
+	// Buckets is the number of buckets stored in the data file.
+	Buckets int
+}
+
+// BucketInfo describes a bucket in the snapshot.
+type BucketInfo struct {
+	// Num is the bucket number.
+	Num int
+
+	// Entries is the number of entries in the bucket.
+	Entries int
+
+	// Chunks is the number of allocated chunks in the bucket.
+	Chunks int
+
+	// Idx is the write position in the bucket ring buffer.
+	Idx uint64
+
+	// Gen is the generation of the bucket ring buffer.
+	//
+	// The ring buffer has been overwritten at least once if Gen is greater than 1.
+	Gen uint64
+
+	// UsedBytes is the number of bytes occupied by the entries in the bucket ring buffer.
+	UsedBytes uint64
+
+	// MaxBytes is the size of the bucket ring buffer.
+	MaxBytes uint64
+}
+
+// InspectSnapshot opens the snapshot at filePath for inspection.
+//
+// The snapshot is read once in order to verify its integrity and to collect per-bucket information.
+// Corrupted data files don't result in an error - they are reported by SnapshotInspector.Report instead.
+// Encrypted snapshots are decrypted with the matching key from keys. keys may be nil for unencrypted snapshots.
+// Call SnapshotInspector.Close when the inspector is no longer needed.
+func InspectSnapshot(filePath string, keys []*EncryptionKey) (*SnapshotInspector, error) {
+	ss, err := openSnapshotStream(NewFileSnapshotStore(filePath), keys)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open snapshot at %q: %w", filePath, err)
+	}
+	si := &SnapshotInspector{
+		ss:     ss,
+		report: &LoadReport{},
+		bis:    make([]BucketInfo, bucketsCount),
+	}
+	maxBytes := ss.sh.maxBucketChunks * chunkSize
+	for i := range si.bis {
+		si.bis[i] = BucketInfo{
+			Num:      i,
+			MaxBytes: maxBytes,
+		}
+	}
+	var mu sync.Mutex
+	err = ss.forEachBucketInFiles(ss.files, nil, si.report, func(b *bucket, bucketNum uint64) error {
+		invalid := b.verify()
+		b.cleanLocked()
+		bi := BucketInfo{
+			Num:      int(bucketNum),
+			Entries:  len(b.m),
+			Idx:      b.idx,
+			Gen:      b.gen,
+			MaxBytes: uint64(len(b.chunks)) * chunkSize,
+		}
+		for _, chunk := range b.chunks {
+			if chunk != nil {
+				bi.Chunks++
+			}
+		}
+		bi.UsedBytes = b.idx
+		if b.gen > 1 {
+			bi.UsedBytes = bi.MaxBytes
+		}
+		mu.Lock()
+		si.bis[bucketNum] = bi
+		si.report.BucketsRestored++
+		si.report.InvalidEntries += invalid
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot inspect snapshot at %q: %w", filePath, err)
+	}
+	si.report.BucketsReset = bucketsCount - si.report.BucketsRestored
+	return si, nil
+}
+
+// Close releases resources occupied by si.
+func (si *SnapshotInspector) Close() {
+	// Nothing to release, since the snapshot is streamed on every access.
+}
+
+// Geometry returns the geometry of the inspected snapshot.
+func (si *SnapshotInspector) Geometry() *SnapshotGeometry {
+	sh := si.ss.sh
+	g := &SnapshotGeometry{
+		Version:         sh.version,
+		Codec:           sh.codec,
+		BucketsCount:    int(sh.bucketsCount),
+		ChunkSize:       int(sh.chunkSize),
+		MaxBucketChunks: int(sh.maxBucketChunks),
+		MaxBytes:        int(sh.bucketsCount * sh.maxBucketChunks * sh.chunkSize),
+	}
+	for _, f := range sh.files {
+		g.Files = append(g.Files, SnapshotFileInfo{
+			Name:    f.name,
+			Size:    f.size,
+			Buckets: len(f.buckets),
+		})
+	}
+	return g
+}
+
+// Report returns the integrity report for the inspected snapshot.
+func (si *SnapshotInspector) Report() *LoadReport {
+	return si.report
+}
+
+// Buckets returns information about all the buckets in the inspected snapshot.
+//
+// Buckets, which couldn't be read, are returned as empty buckets.
+func (si *SnapshotInspector) Buckets() []BucketInfo {
+	return append([]BucketInfo(nil), si.bis...)
+}
+
+// VisitEntries calls f for every entry in the inspected snapshot.
+//
+// The snapshot is streamed bucket by bucket. Entries of every bucket are visited in the order
+// they were written to the bucket, while buckets are visited in the order they are stored in data files.
+// Calls to f are serialized. f mustn't hold k and v after returning.
+// Visiting stops on the first error returned by f. Data files, which cannot be read, are skipped.
+func (si *SnapshotInspector) VisitEntries(f func(bucketNum int, k, v []byte) error) error {
+	var mu sync.Mutex
+	var visitErr error
+	var report LoadReport
+	err := si.ss.forEachBucketInFiles(si.ss.files, nil, &report, func(b *bucket, bucketNum uint64) error {
+		b.verify()
+		b.cleanLocked()
+		entries := b.entriesLocked()
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range entries {
+			if visitErr != nil {
+				return visitErr
+			}
+			k, v, ok := readChunksEntry(b.chunks, e.idx)
+			if !ok {
+				continue
+			}
+			visitErr = f(int(bucketNum), k, v)
+		}
+		return visitErr
+	})
+	if visitErr != nil {
+		return visitErr
+	}
+	return err
+}
+
+// Get returns the value for the given key k from the inspected snapshot.
+//
+// Only the bucket for k is read from the snapshot.
+// It returns false if k is missing in the snapshot or if its bucket cannot be read.
+// Use GetBig for values stored with SetBig.
+func (si *SnapshotInspector) Get(k []byte) ([]byte, bool) {
+	vs := si.getMulti([][]byte{k})
+	return vs[0], vs[0] != nil
+}
+
+// GetBig returns the value stored with SetBig for the given key k from the inspected snapshot.
+//
+// It returns false if k is missing in the snapshot, if the value for k wasn't stored with SetBig
+// or if some parts of the value are missing or corrupted.
+func (si *SnapshotInspector) GetBig(k []byte) ([]byte, bool) {
+	metavalue, ok := si.Get(k)
+	if !ok || len(metavalue) != 16 {
+		return nil, false
+	}
+	valueHash := unmarshalUint64(metavalue)
+	valueLen := unmarshalUint64(metavalue[8:])
+	if sh := si.ss.sh; valueLen > sh.bucketsCount*sh.maxBucketChunks*sh.chunkSize {
+		// The value cannot fit the snapshot, so k doesn't refer to a value stored with SetBig.
+		return nil, false
+	}
+	subkeysCount := (valueLen + maxSubvalueLen - 1) / maxSubvalueLen
+	subkeys := make([][]byte, subkeysCount)
+	for i := range subkeys {
+		subkey := marshalUint64(nil, valueHash)
+		subkeys[i] = marshalUint64(subkey, uint64(i))
+	}
+	v := make([]byte, 0, valueLen)
+	for _, subvalue := range si.getMulti(subkeys) {
+		if subvalue == nil {
+			return nil, false
+		}
+		v = append(v, subvalue...)
+	}
+	if uint64(len(v)) != valueLen || xxhash.Sum64(v) != valueHash {
+		return nil, false
+	}
+	return v, true
+}
+
+// getMulti returns values for the given keys from the inspected snapshot.
+//
+// Only the buckets for the given keys are read. nil is returned for missing keys.
+func (si *SnapshotInspector) getMulti(keys [][]byte) [][]byte {
+	hs := make([]uint64, len(keys))
+	bucketNums := make(map[uint64]bool)
+	for i, k := range keys {
+		hs[i] = xxhash.Sum64(k)
+		bucketNums[hs[i]%bucketsCount] = true
+	}
+	vs := make([][]byte, len(keys))
+	var mu sync.Mutex
+	var report LoadReport
+	remaining := len(bucketNums)
+	files := si.ss.filesForBuckets(bucketNums)
+	// Errors are registered in report, so the keys from buckets, which cannot be read, are treated as missing.
+	_ = si.ss.forEachBucketInFiles(files, nil, &report, func(b *bucket, bucketNum uint64) error {
+		if !bucketNums[bucketNum] {
+			return nil
+		}
+		b.verify()
+		mu.Lock()
+		defer mu.Unlock()
+		for i, k := range keys {
+			if hs[i]%bucketsCount != bucketNum {
+				continue
+			}
+			if v, ok := b.Get(nil, k, hs[i], true); ok {
+				vs[i] = append([]byte{}, v...)
+			}
+		}
+		remaining--
+		if remaining == 0 {
+			// Stop reading data files, since all the needed buckets are found.
+			return errLookupDone
+		}
+		return nil
+	})
+	return vs
+}
+
+var errLookupDone = errors.New("all the buckets are found")
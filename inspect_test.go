@@ -0,0 +1,177 @@
+package fastcache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspectSnapshot(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+	const itemsCount = 10000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	si, err := InspectSnapshot(filePath, nil)
+	if err != nil {
+		t.Fatalf("InspectSnapshot error: %s", err)
+	}
+	defer si.Close()
+
+	g := si.Geometry()
+	if g.Version != snapshotFormatVersion || g.Codec != CodecSnappy || g.BucketsCount != bucketsCount || g.ChunkSize != chunkSize || g.MaxBucketChunks != 2 {
+		t.Fatalf("unexpected geometry: %+v", g)
+	}
+	if g.MaxBytes != bucketsCount*chunkSize*2 {
+		t.Fatalf("unexpected MaxBytes; got %d; want %d", g.MaxBytes, bucketsCount*chunkSize*2)
+	}
+	if len(g.Files) != 1 || g.Files[0].Buckets != bucketsCount || g.Files[0].Size == 0 {
+		t.Fatalf("unexpected files: %+v", g.Files)
+	}
+
+	report := si.Report()
+	if report.BucketsRestored != bucketsCount || report.BucketsReset != 0 || report.InvalidEntries != 0 || len(report.FailedFiles) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	bis := si.Buckets()
+	if len(bis) != bucketsCount {
+		t.Fatalf("unexpected number of buckets; got %d; want %d", len(bis), bucketsCount)
+	}
+	entries := 0
+	for i, bi := range bis {
+		if bi.Num != i {
+			t.Fatalf("unexpected bucket number; got %d; want %d", bi.Num, i)
+		}
+		if bi.UsedBytes != bi.Idx || bi.MaxBytes != 2*chunkSize || bi.Chunks != 1 {
+			t.Fatalf("unexpected bucket info: %+v", bi)
+		}
+		entries += bi.Entries
+	}
+	if entries != itemsCount {
+		t.Fatalf("unexpected number of entries; got %d; want %d", entries, itemsCount)
+	}
+
+	m := make(map[string]string)
+	err = si.VisitEntries(func(bucketNum int, k, v []byte) error {
+		m[string(k)] = string(v)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VisitEntries error: %s", err)
+	}
+	if len(m) != itemsCount {
+		t.Fatalf("unexpected number of visited entries; got %d; want %d", len(m), itemsCount)
+	}
+	for i := range itemsCount {
+		k := fmt.Sprintf("key %d", i)
+		vExpected := fmt.Sprintf("value %d", i)
+		if v := m[k]; v != vExpected {
+			t.Fatalf("unexpected visited value for key %q; got %q; want %q", k, v, vExpected)
+		}
+		if i%1000 != 0 {
+			// Every Get streams the data file, so check only a few keys.
+			continue
+		}
+		if v, ok := si.Get([]byte(k)); !ok || string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+	if _, ok := si.Get([]byte("missing key")); ok {
+		t.Fatalf("unexpected value for missing key")
+	}
+
+	// Visiting must stop on error.
+	errStop := fmt.Errorf("stop")
+	n := 0
+	err = si.VisitEntries(func(bucketNum int, k, v []byte) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Fatalf("unexpected result for stopped visiting; err=%v, n=%d", err, n)
+	}
+}
+
+func TestInspectSnapshotEncryptedBig(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	ek := &EncryptionKey{
+		ID:  "key",
+		Key: []byte("0123456789abcdef"),
+	}
+	c := New(bucketsCount * chunkSize * 4)
+	defer c.Reset()
+	c.Set([]byte("key"), []byte("value"))
+	bigValue := bytes.Repeat([]byte("big value"), chunkSize)
+	c.SetBig([]byte("big key"), bigValue)
+	opts := &SaveOptions{
+		EncryptionKey: ek,
+	}
+	if err := c.SaveToFileOptions(filePath, opts); err != nil {
+		t.Fatalf("SaveToFileOptions error: %s", err)
+	}
+
+	if _, err := InspectSnapshot(filePath, nil); err == nil {
+		t.Fatalf("expecting non-nil error for encrypted snapshot without keys")
+	}
+	si, err := InspectSnapshot(filePath, []*EncryptionKey{ek})
+	if err != nil {
+		t.Fatalf("InspectSnapshot error: %s", err)
+	}
+	defer si.Close()
+	report := si.Report()
+	if report.BucketsRestored != bucketsCount || len(report.FailedFiles) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if v, ok := si.Get([]byte("key")); !ok || string(v) != "value" {
+		t.Fatalf("unexpected value for key; got %q; want %q", v, "value")
+	}
+	if v, ok := si.Get([]byte("big key")); !ok || len(v) != 16 {
+		t.Fatalf("expecting 16-byte metavalue for the big key; got %d bytes", len(v))
+	}
+	if v, ok := si.GetBig([]byte("big key")); !ok || !bytes.Equal(v, bigValue) {
+		t.Fatalf("unexpected value for the big key; got %d bytes; want %d bytes", len(v), len(bigValue))
+	}
+	if _, ok := si.GetBig([]byte("key")); ok {
+		t.Fatalf("unexpected big value for the key stored with Set")
+	}
+	if _, ok := si.GetBig([]byte("missing key")); ok {
+		t.Fatalf("unexpected big value for missing key")
+	}
+}
+
+func TestInspectSnapshotCorrupted(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("key"), []byte("value"))
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	snapshotDir := mustResolveSnapshotDir(t, filePath)
+	if err := os.Truncate(snapshotDir+"/data.0.bin", 10); err != nil {
+		t.Fatalf("cannot truncate data file: %s", err)
+	}
+
+	si, err := InspectSnapshot(filePath, nil)
+	if err != nil {
+		t.Fatalf("InspectSnapshot error: %s", err)
+	}
+	defer si.Close()
+	report := si.Report()
+	if len(report.FailedFiles) != 1 || report.BucketsReset != bucketsCount {
+		t.Fatalf("unexpected report for corrupted snapshot: %+v", report)
+	}
+
+	if _, err := InspectSnapshot(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Fatalf("expecting non-nil error for missing snapshot")
+	}
+}
@@ -3,10 +3,43 @@
 
 package fastcache
 
-func getChunk() []byte {
-	return make([]byte, chunkSize)
+var defaultAllocator = NewHeapAllocator()
+
+// NewMmapAllocator returns an allocator, which allocates chunks via anonymous mmap.
+//
+// The returned allocator allocates chunks from the Go heap on platforms without mmap support.
+func NewMmapAllocator() Allocator {
+	return NewHeapAllocator()
+}
+
+// NewHugePageAllocator returns an allocator, which allocates chunks via anonymous mmap
+// backed by transparent huge pages where possible.
+//
+// The returned allocator allocates chunks from the Go heap on platforms without mmap support.
+func NewHugePageAllocator() Allocator {
+	return NewHeapAllocator()
+}
+
+// NewFileAllocator returns an allocator, which allocates chunks via mmap of a file in dir.
+//
+// An error is returned on platforms without mmap support.
+func NewFileAllocator(dir string) (Allocator, error) {
+	return nil, errMmapUnsupported
 }
 
-func putChunk(chunk []byte) {
-	// No-op.
+// NewMmapAllocatorOptions returns an allocator, which allocates chunks via mmap with the given opts.
+//
+// The returned allocator allocates chunks from the Go heap on platforms without mmap support,
+// while an error is returned if opts.Dir is set.
+func NewMmapAllocatorOptions(opts *MmapAllocatorOptions) (Allocator, error) {
+	if opts == nil {
+		opts = &MmapAllocatorOptions{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.Dir != "" {
+		return nil, errMmapUnsupported
+	}
+	return NewHeapAllocator(), nil
 }
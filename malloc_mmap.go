@@ -5,50 +5,299 @@ package fastcache
 
 import (
 	"fmt"
+	"os"
 	"sync"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-const chunksPerAlloc = 1024
+var defaultAllocator = NewMmapAllocator()
 
-var (
-	freeChunks     []*[chunkSize]byte
-	freeChunksLock sync.Mutex
-)
+// NewMmapAllocator returns an allocator, which allocates chunks via anonymous mmap.
+//
+// Memory is allocated offheap, so GOGC doesn't take into account the cache size.
+// Free chunks are kept for reuse. Use NewMmapAllocatorOptions for returning
+// the memory of free chunks to the OS automatically.
+//
+// The returned allocator allocates chunks from the Go heap on platforms without mmap support.
+func NewMmapAllocator() Allocator {
+	a, _ := NewMmapAllocatorOptions(nil)
+	return a
+}
+
+// NewHugePageAllocator returns an allocator, which allocates chunks via anonymous mmap
+// backed by transparent huge pages where possible.
+//
+// Huge pages reduce TLB misses for big caches. Regular pages are used
+// if the OS doesn't support transparent huge pages.
+// Free chunks are kept for reuse.
+//
+// The returned allocator allocates chunks from the Go heap on platforms without mmap support.
+func NewHugePageAllocator() Allocator {
+	a, _ := NewMmapAllocatorOptions(&MmapAllocatorOptions{
+		HugePages: true,
+	})
+	return a
+}
+
+// NewFileAllocator returns an allocator, which allocates chunks via mmap of a file in dir.
+//
+// This allows placing the cache memory on a dedicated filesystem such as tmpfs or hugetlbfs.
+// The file is removed from dir right after its creation, so its space is reclaimed
+// when the process exits. The filesystem must have enough free space for the cache,
+// since the process crashes when accessing chunks, which couldn't be allocated on it.
+// Free chunks are kept for reuse.
+//
+// An error is returned on platforms without mmap support.
+func NewFileAllocator(dir string) (Allocator, error) {
+	return NewMmapAllocatorOptions(&MmapAllocatorOptions{
+		Dir: dir,
+	})
+}
+
+// NewMmapAllocatorOptions returns an allocator, which allocates chunks via mmap with the given opts.
+//
+// opts may be nil. In this case the returned allocator is equivalent to NewMmapAllocator.
+//
+// The returned allocator allocates chunks from the Go heap on platforms without mmap support,
+// while an error is returned if opts.Dir is set.
+func NewMmapAllocatorOptions(opts *MmapAllocatorOptions) (Allocator, error) {
+	if opts == nil {
+		opts = &MmapAllocatorOptions{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	a := &mmapAllocator{
+		mmap:          mmapAnon,
+		maxFreeChunks: opts.MaxFreeChunks,
+		idleTimeout:   opts.IdleTimeout,
+	}
+	if opts.Dir != "" {
+		f, err := os.CreateTemp(opts.Dir, "fastcache-chunks-*")
+		if err != nil {
+			return nil, fmt.Errorf("cannot create file for chunks: %w", err)
+		}
+		if err := os.Remove(f.Name()); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("cannot remove %q: %w", f.Name(), err)
+		}
+		fm := &fileMapper{
+			f: f,
+		}
+		a.mmap = fm.mmap
+		a.shared = true
+	}
+	if opts.HugePages {
+		mmap := a.mmap
+		a.mmap = func(size int) ([]byte, error) {
+			data, err := mmap(size)
+			if err != nil {
+				return nil, err
+			}
+			adviseHugePages(data)
+			return data, nil
+		}
+	}
+	return a, nil
+}
+
+// mmapAllocator allocates chunks in batches of up to chunksPerAlloc via mmap.
+type mmapAllocator struct {
+	// mmap maps size bytes of memory. It is called under mu.
+	mmap func(size int) ([]byte, error)
+
+	// shared is set if the memory is backed by a shared file mapping.
+	shared bool
+
+	// maxFreeChunks is the maximum number of free chunks. Zero means no limit.
+	maxFreeChunks int
+
+	// idleTimeout is the duration after which the memory of free chunks is returned to the OS.
+	//
+	// The memory of idle chunks isn't returned if idleTimeout is zero.
+	idleTimeout time.Duration
+
+	mu sync.Mutex
+
+	// free is a stack of free chunks.
+	//
+	// Chunks are ordered by freedAt, so the oldest chunks are at the bottom.
+	free []freeChunk
 
-func getChunk() []byte {
-	freeChunksLock.Lock()
-	if len(freeChunks) == 0 {
-		// Allocate offheap memory, so GOGC won't take into account cache size.
-		// This should reduce free memory waste.
-		data, err := unix.Mmap(-1, 0, chunkSize*chunksPerAlloc, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	// released is the number of chunks at the bottom of free, whose memory is returned to the OS.
+	released int
+
+	allocated uint64
+
+	// idleTimer returns the memory of idle free chunks to the OS. It is nil until the first use.
+	idleTimer *time.Timer
+
+	// idleTimerArmed is set when idleTimer is scheduled.
+	idleTimerArmed bool
+}
+
+type freeChunk struct {
+	p       *[chunkSize]byte
+	freedAt time.Time
+}
+
+func (a *mmapAllocator) GetChunk() []byte {
+	a.mu.Lock()
+	if len(a.free) == 0 {
+		chunksCount := chunksPerAlloc
+		if a.maxFreeChunks > 0 {
+			// Do not exceed maxFreeChunks with the newly allocated chunks.
+			chunksCount = min(chunksCount, a.maxFreeChunks+1)
+		}
+		size := chunkSize * chunksCount
+		data, err := a.mmap(size)
 		if err != nil {
-			panic(fmt.Errorf("cannot allocate %d bytes via mmap: %s", chunkSize*chunksPerAlloc, err))
+			panic(fmt.Errorf("cannot allocate %d bytes via mmap: %s", size, err))
 		}
+		now := time.Now()
 		for len(data) > 0 {
 			p := (*[chunkSize]byte)(unsafe.Pointer(&data[0]))
-			freeChunks = append(freeChunks, p)
+			a.free = append(a.free, freeChunk{
+				p:       p,
+				freedAt: now,
+			})
 			data = data[chunkSize:]
 		}
+		a.allocated += uint64(chunksCount)
 	}
-	n := len(freeChunks) - 1
-	p := freeChunks[n]
-	freeChunks[n] = nil
-	freeChunks = freeChunks[:n]
-	freeChunksLock.Unlock()
+	n := len(a.free) - 1
+	p := a.free[n].p
+	a.free[n] = freeChunk{}
+	a.free = a.free[:n]
+	if a.released > n {
+		a.released = n
+	}
+	a.mu.Unlock()
 	return p[:]
 }
 
-func putChunk(chunk []byte) {
-	if chunk == nil {
-		return
+func (a *mmapAllocator) PutChunk(chunk []byte) {
+	p := (*[chunkSize]byte)(unsafe.Pointer(unsafe.SliceData(chunk)))
+
+	a.mu.Lock()
+	if a.maxFreeChunks > 0 && len(a.free) >= a.maxFreeChunks {
+		// Unmap the oldest free chunk, since the recently used chunk is more likely to be in CPU caches.
+		// Shift the rest of the chunks instead of re-slicing a.free from the front,
+		// since the latter makes append re-allocate a.free over and over.
+		a.unmapLocked(a.free[0].p)
+		n := copy(a.free, a.free[1:])
+		a.free[n] = freeChunk{}
+		a.free = a.free[:n]
+		if a.released > 0 {
+			a.released--
+		}
+	}
+	a.free = append(a.free, freeChunk{
+		p:       p,
+		freedAt: time.Now(),
+	})
+	if a.idleTimeout > 0 && !a.idleTimerArmed {
+		a.scheduleIdleReleaseLocked(a.idleTimeout)
+	}
+	a.mu.Unlock()
+}
+
+func (a *mmapAllocator) UpdateStats(s *AllocatorStats) {
+	a.mu.Lock()
+	s.AllocatedChunks += a.allocated
+	s.FreeChunks += uint64(len(a.free))
+	s.ReleasedChunks += uint64(a.released)
+	s.InUseChunks += a.allocated - uint64(len(a.free))
+	a.mu.Unlock()
+}
+
+// ReleaseMemory unmaps all the free chunks.
+func (a *mmapAllocator) ReleaseMemory() {
+	a.mu.Lock()
+	for i := range a.free {
+		a.unmapLocked(a.free[i].p)
+		a.free[i] = freeChunk{}
+	}
+	a.free = a.free[:0]
+	a.released = 0
+	a.mu.Unlock()
+}
+
+// unmapLocked returns the memory of the free chunk p to the OS and unmaps it.
+func (a *mmapAllocator) unmapLocked(p *[chunkSize]byte) {
+	if a.shared {
+		// Release the file space occupied by the chunk, since munmap doesn't release it.
+		a.releaseLocked(p)
 	}
-	chunk = chunk[:chunkSize]
-	p := (*[chunkSize]byte)(unsafe.Pointer(&chunk[0]))
+	if err := unix.MunmapPtr(unsafe.Pointer(p), chunkSize); err != nil {
+		panic(fmt.Errorf("cannot unmap chunk at %p: %s", p, err))
+	}
+	a.allocated--
+}
 
-	freeChunksLock.Lock()
-	freeChunks = append(freeChunks, p)
-	freeChunksLock.Unlock()
+// releaseLocked returns the memory of the free chunk p to the OS, while keeping p mapped.
+//
+// p may be reused after that. The memory is re-populated with zero pages on the next access.
+func (a *mmapAllocator) releaseLocked(p *[chunkSize]byte) {
+	if err := unix.Madvise(p[:], releaseAdvice(a.shared)); err != nil {
+		panic(fmt.Errorf("cannot release memory for chunk at %p: %s", p, err))
+	}
+}
+
+// scheduleIdleReleaseLocked schedules releaseIdle call after d.
+func (a *mmapAllocator) scheduleIdleReleaseLocked(d time.Duration) {
+	if a.idleTimer == nil {
+		a.idleTimer = time.AfterFunc(d, a.releaseIdle)
+	} else {
+		a.idleTimer.Reset(d)
+	}
+	a.idleTimerArmed = true
+}
+
+// releaseIdle returns the memory of free chunks, which weren't reused during a.idleTimeout, to the OS.
+func (a *mmapAllocator) releaseIdle() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.idleTimerArmed = false
+	now := time.Now()
+	for a.released < len(a.free) {
+		fc := &a.free[a.released]
+		if idle := now.Sub(fc.freedAt); idle < a.idleTimeout {
+			// The remaining chunks were freed after fc.
+			a.scheduleIdleReleaseLocked(a.idleTimeout - idle)
+			return
+		}
+		a.releaseLocked(fc.p)
+		a.released++
+	}
+}
+
+func mmapAnon(size int) ([]byte, error) {
+	// Allocate offheap memory, so GOGC won't take into account cache size.
+	// This should reduce free memory waste.
+	return unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+}
+
+// fileMapper maps memory backed by the file f.
+type fileMapper struct {
+	f    *os.File
+	size int64
+}
+
+// mmap extends fm.f by size bytes and maps the added part into memory.
+func (fm *fileMapper) mmap(size int) ([]byte, error) {
+	offset := fm.size
+	if err := fm.f.Truncate(offset + int64(size)); err != nil {
+		return nil, err
+	}
+	data, err := unix.Mmap(int(fm.f.Fd()), offset, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	fm.size += int64(size)
+	return data, nil
 }
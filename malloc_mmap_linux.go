@@ -0,0 +1,25 @@
+//go:build linux && !appengine
+// +build linux,!appengine
+
+package fastcache
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// adviseHugePages asks the OS to back data with transparent huge pages.
+//
+// Errors are ignored, since regular pages are used if huge pages aren't supported.
+func adviseHugePages(data []byte) {
+	_ = unix.Madvise(data, unix.MADV_HUGEPAGE)
+}
+
+// releaseAdvice returns madvise advice for returning memory of free chunks to the OS.
+//
+// Memory backed by a shared file mapping is removed from the file, so tmpfs space is released too.
+func releaseAdvice(shared bool) int {
+	if shared {
+		return unix.MADV_REMOVE
+	}
+	return unix.MADV_DONTNEED
+}
@@ -0,0 +1,96 @@
+//go:build linux && !appengine
+// +build linux,!appengine
+
+package fastcache
+
+import (
+	"os"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMmapAllocatorIdleTimeoutResidency(t *testing.T) {
+	t.Run("anon", func(t *testing.T) {
+		testMmapAllocatorIdleTimeoutResidency(t, &MmapAllocatorOptions{
+			IdleTimeout: 10 * time.Millisecond,
+		})
+	})
+	t.Run("file", func(t *testing.T) {
+		testMmapAllocatorIdleTimeoutResidency(t, &MmapAllocatorOptions{
+			Dir:         t.TempDir(),
+			IdleTimeout: 10 * time.Millisecond,
+		})
+	})
+}
+
+func testMmapAllocatorIdleTimeoutResidency(t *testing.T, opts *MmapAllocatorOptions) {
+	a, err := NewMmapAllocatorOptions(opts)
+	if err != nil {
+		t.Fatalf("cannot create allocator: %s", err)
+	}
+	defer a.ReleaseMemory()
+
+	chunks := make([][]byte, 10)
+	for i := range chunks {
+		chunk := a.GetChunk()
+		for j := range chunk {
+			chunk[j] = byte(i + 1)
+		}
+		chunks[i] = chunk
+	}
+	if n := residentPagesCount(t, chunks); n == 0 {
+		t.Fatalf("expecting non-zero number of resident pages for the written chunks")
+	}
+	for _, chunk := range chunks {
+		a.PutChunk(chunk)
+	}
+
+	// Wait until the idle timer returns the memory of the free chunks to the OS.
+	// ReleaseMemory isn't called here, so only the timer may release the memory.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := residentPagesCount(t, chunks)
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout when waiting for the idle timer to release chunks; resident pages: %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var s AllocatorStats
+	a.UpdateStats(&s)
+	if s.ReleasedChunks != s.FreeChunks {
+		t.Fatalf("unexpected ReleasedChunks; got %d; want %d", s.ReleasedChunks, s.FreeChunks)
+	}
+
+	// The released chunks remain mapped and must read as zeros.
+	for i, chunk := range chunks {
+		for j := range chunk {
+			if chunk[j] != 0 {
+				t.Fatalf("unexpected byte at position %d in the released chunk #%d; got %d; want 0", j, i, chunk[j])
+			}
+		}
+	}
+}
+
+// residentPagesCount returns the number of memory pages of chunks, which reside in RAM.
+func residentPagesCount(t *testing.T, chunks [][]byte) int {
+	t.Helper()
+	pageSize := os.Getpagesize()
+	vec := make([]byte, (chunkSize+pageSize-1)/pageSize)
+	n := 0
+	for _, chunk := range chunks {
+		_, _, errno := unix.Syscall(unix.SYS_MINCORE, uintptr(unsafe.Pointer(&chunk[0])), uintptr(len(chunk)), uintptr(unsafe.Pointer(&vec[0])))
+		if errno != 0 {
+			t.Fatalf("mincore error: %s", errno)
+		}
+		for _, v := range vec {
+			n += int(v & 1)
+		}
+	}
+	return n
+}
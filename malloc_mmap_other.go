@@ -0,0 +1,19 @@
+//go:build !linux && !appengine && !windows && !wasm && !tinygo.wasm && !js
+// +build !linux,!appengine,!windows,!wasm,!tinygo.wasm,!js
+
+package fastcache
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// adviseHugePages is a no-op on platforms without transparent huge pages.
+func adviseHugePages(data []byte) {
+}
+
+// releaseAdvice returns madvise advice for returning memory of free chunks to the OS.
+//
+// The file space for shared file mappings isn't released on this platform.
+func releaseAdvice(shared bool) int {
+	return unix.MADV_DONTNEED
+}
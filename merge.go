@@ -0,0 +1,166 @@
+package fastcache
+
+import (
+	"fmt"
+)
+
+// MergePolicy defines how Cache.LoadFrom resolves conflicts between
+// the entries from the snapshot and the entries in the cache.
+type MergePolicy int
+
+const (
+	// MergeKeepExisting keeps the entries in the cache for keys, which exist in both the cache and the snapshot.
+	MergeKeepExisting MergePolicy = 0
+
+	// MergeOverwrite overwrites the entries in the cache with the entries from the snapshot.
+	MergeOverwrite MergePolicy = 1
+)
+
+// String returns human-readable name for policy.
+func (policy MergePolicy) String() string {
+	switch policy {
+	case MergeKeepExisting:
+		return "keep-existing"
+	case MergeOverwrite:
+		return "overwrite"
+	default:
+		return fmt.Sprintf("MergePolicy(%d)", int(policy))
+	}
+}
+
+func (policy MergePolicy) validate() error {
+	switch policy {
+	case MergeKeepExisting, MergeOverwrite:
+		return nil
+	default:
+		return fmt.Errorf("unsupported merge policy: %s", policy)
+	}
+}
+
+// mergeBatchSize is the maximum number of entries merged into a bucket under a single lock.
+//
+// This limits the latency of concurrent operations on the bucket during the merge.
+const mergeBatchSize = 1024
+
+// LoadFrom inserts the entries from the snapshot at filePath into c.
+//
+// Conflicts between the entries from the snapshot and the entries in c
+// are resolved according to policy. The entries are inserted in the order
+// they were written to the saved cache, so the oldest entries are evicted
+// first if the snapshot doesn't fit c.
+//
+// LoadFrom may be called concurrently with other operations on the cache,
+// for example in a separate goroutine for warming up the cache, which already
+// serves requests. The snapshot may have any capacity.
+//
+// The snapshot is merged bucket by bucket, so it isn't loaded into memory as a whole.
+// The entries merged before an error remain in c.
+//
+// The inserted entries are recorded in the write-ahead log if it is enabled.
+func (c *Cache) LoadFrom(filePath string, policy MergePolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	return notifyLoad(c.obs, filePath, func() error {
+		return c.loadFrom(filePath, policy)
+	})
+}
+
+func (c *Cache) loadFrom(filePath string, policy MergePolicy) error {
+	ss, err := openSnapshotStream(NewFileSnapshotStore(filePath), nil)
+	if err != nil {
+		return fmt.Errorf("cannot load snapshot from %q: %w", filePath, err)
+	}
+	// Merge every bucket as soon as it is loaded, so the snapshot isn't loaded into memory as a whole.
+	// Entries for the same key are located in the buckets with the same number in the snapshot and c.
+	err = ss.forEachBucket(c.allocator(), func(src *bucket, bucketNum uint64) error {
+		src.verify()
+		return c.buckets[bucketNum].merge(src, policy)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot load snapshot from %q: %w", filePath, err)
+	}
+	return nil
+}
+
+// merge inserts entries from src into b according to policy.
+//
+// src mustn't be used concurrently. An error is returned if the inserted entries cannot be written to the write-ahead log.
+func (b *bucket) merge(src *bucket, policy MergePolicy) error {
+	src.cleanLocked()
+	entries := src.entriesLocked()
+
+	var bb *bytesBuf
+	if b.wal != nil {
+		bb = getWALBuf()
+		defer putWALBuf(bb)
+	}
+	for len(entries) > 0 {
+		n := min(len(entries), mergeBatchSize)
+		batch := entries[:n]
+		entries = entries[n:]
+
+		evicted := 0
+		var seq uint64
+		b.mu.Lock()
+		for _, e := range batch {
+			k, v, ok := readChunksEntry(src.chunks, e.idx)
+			if !ok {
+				// Corrupted data loaded from file. Skip the entry.
+				continue
+			}
+			if policy == MergeKeepExisting && b.hasLocked(k, e.h) {
+				continue
+			}
+			evicted += b.setLocked(k, v, e.h)
+			if bb != nil {
+				bb.B = appendWALRecord(bb.B[:0], walOpSet, k, v)
+				seq = b.appendWALLocked(bb.B)
+			}
+		}
+		b.mu.Unlock()
+		b.writeSpills()
+		if b.obs != nil && evicted > 0 {
+			b.obs.OnEvict(evicted)
+		}
+		if seq > 0 {
+			if err := b.wal.commit(seq); err != nil {
+				return fmt.Errorf("cannot write merged entries to the write-ahead log: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// hasLocked returns true if b contains the entry for k with the hash h.
+//
+// Entries in the disk tier are detected by h only.
+func (b *bucket) hasLocked(k []byte, h uint64) bool {
+	if _, ok := b.dm[h]; ok {
+		return true
+	}
+	_, ok := b.lookupLocked(k, h)
+	return ok
+}
+
+// lookupLocked returns the value for k with the hash h stored in memory in b.
+//
+// The returned value points to b.chunks, so it is valid only while b is locked.
+// Stats aren't updated and the disk tier isn't searched.
+func (b *bucket) lookupLocked(k []byte, h uint64) ([]byte, bool) {
+	v, ok := b.m[h]
+	if !ok {
+		return nil, false
+	}
+	bGen := b.gen & ((1 << genSizeBits) - 1)
+	gen := v >> bucketSizeBits
+	idx := v & ((1 << bucketSizeBits) - 1)
+	if !(gen == bGen && idx < b.idx || gen+1 == bGen && idx >= b.idx || gen == maxGen && bGen == 1 && idx >= b.idx) {
+		return nil, false
+	}
+	kk, vv, ok := readChunksEntry(b.chunks, idx)
+	if !ok || string(kk) != string(k) {
+		return nil, false
+	}
+	return vv, true
+}
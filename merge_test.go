@@ -0,0 +1,230 @@
+package fastcache
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLoadFrom(t *testing.T) {
+	for _, policy := range []MergePolicy{MergeKeepExisting, MergeOverwrite} {
+		t.Run(policy.String(), func(t *testing.T) {
+			testLoadFrom(t, policy)
+		})
+	}
+}
+
+func testLoadFrom(t *testing.T, policy MergePolicy) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	const itemsCount = 10000
+
+	src := New(bucketsCount * chunkSize * 2)
+	defer src.Reset()
+	for i := range itemsCount {
+		src.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("src %d", i)))
+	}
+	if err := src.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	// The destination cache contains a half of keys from the snapshot and its own keys.
+	c := New(bucketsCount * chunkSize)
+	defer c.Reset()
+	for i := range itemsCount {
+		if i%2 == 0 {
+			c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("dst %d", i)))
+		}
+		c.Set([]byte(fmt.Sprintf("own key %d", i)), []byte(fmt.Sprintf("own %d", i)))
+	}
+
+	if err := c.LoadFrom(filePath, policy); err != nil {
+		t.Fatalf("LoadFrom error: %s", err)
+	}
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		vExpected := fmt.Sprintf("src %d", i)
+		if i%2 == 0 && policy == MergeKeepExisting {
+			vExpected = fmt.Sprintf("dst %d", i)
+		}
+		if v := c.Get(nil, k); string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+		k = []byte(fmt.Sprintf("own key %d", i))
+		vExpected = fmt.Sprintf("own %d", i)
+		if v := c.Get(nil, k); string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+}
+
+func TestLoadFromConcurrent(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	const itemsCount = 100000
+
+	src := New(bucketsCount * chunkSize * 4)
+	defer src.Reset()
+	for i := range itemsCount {
+		src.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err := src.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	c := New(bucketsCount * chunkSize * 4)
+	defer c.Reset()
+
+	// Warm up the cache in background while it serves requests.
+	var wg sync.WaitGroup
+	errCh := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errCh <- c.LoadFrom(filePath, MergeKeepExisting)
+	}()
+	var buf []byte
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("new key %d", i))
+		c.Set(k, k)
+		buf = c.Get(buf[:0], k)
+		if string(buf) != string(k) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, buf, k)
+		}
+	}
+	wg.Wait()
+	if err := <-errCh; err != nil {
+		t.Fatalf("LoadFrom error: %s", err)
+	}
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		vExpected := fmt.Sprintf("value %d", i)
+		if v := c.Get(nil, k); string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+}
+
+func TestLoadFromWAL(t *testing.T) {
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "snapshot")
+	const itemsCount = 1000
+
+	src := New(1)
+	defer src.Reset()
+	for i := range itemsCount {
+		src.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err := src.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	cfg := &Config{
+		MaxBytes: 1,
+		WALPath:  filepath.Join(tmpDir, "wal"),
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	if err := c.LoadFrom(filePath, MergeOverwrite); err != nil {
+		t.Fatalf("LoadFrom error: %s", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	// The merged entries must be restored from the WAL.
+	c1, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c1.Reset()
+	defer func() {
+		_ = c1.Close()
+	}()
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		vExpected := fmt.Sprintf("value %d", i)
+		if v := c1.Get(nil, k); string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+}
+
+func TestLoadFromInvalid(t *testing.T) {
+	c := New(1)
+	defer c.Reset()
+	if err := c.LoadFrom(filepath.Join(t.TempDir(), "missing"), MergeOverwrite); err == nil {
+		t.Fatalf("expecting non-nil error for missing snapshot")
+	}
+	if err := c.LoadFrom(t.TempDir(), MergePolicy(123)); err == nil {
+		t.Fatalf("expecting non-nil error for invalid policy")
+	}
+}
+
+func TestLoadFromMemoryUsage(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	const maxBytes = bucketsCount * chunkSize * 4
+	src := New(maxBytes)
+	defer src.Reset()
+	const itemsCount = 100000
+	for i := range itemsCount {
+		src.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err := src.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	pa := &peakAllocator{
+		Allocator: NewHeapAllocator(),
+	}
+	c, err := NewFromConfig(&Config{
+		MaxBytes:  maxBytes,
+		Allocator: pa,
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	if err := c.LoadFrom(filePath, MergeOverwrite); err != nil {
+		t.Fatalf("LoadFrom error: %s", err)
+	}
+	var s Stats
+	c.UpdateStats(&s)
+	if s.EntriesCount != itemsCount {
+		t.Fatalf("unexpected number of entries; got %d; want %d", s.EntriesCount, itemsCount)
+	}
+
+	// The snapshot must be merged bucket by bucket instead of loading it into memory as a whole.
+	pa.mu.Lock()
+	peak := pa.peak
+	pa.mu.Unlock()
+	// The merged cache has the same capacity as the snapshot, so it occupies the same number of chunks.
+	if extra := peak - s.InUseChunks; extra >= s.InUseChunks/2 {
+		t.Fatalf("too many chunks allocated during the merge; got %d extra chunks; the snapshot contains %d chunks", extra, s.InUseChunks)
+	}
+}
+
+// peakAllocator tracks the peak number of chunks in use.
+type peakAllocator struct {
+	Allocator
+
+	mu    sync.Mutex
+	inUse uint64
+	peak  uint64
+}
+
+func (pa *peakAllocator) GetChunk() []byte {
+	pa.mu.Lock()
+	pa.inUse++
+	pa.peak = max(pa.peak, pa.inUse)
+	pa.mu.Unlock()
+	return pa.Allocator.GetChunk()
+}
+
+func (pa *peakAllocator) PutChunk(chunk []byte) {
+	pa.mu.Lock()
+	pa.inUse--
+	pa.mu.Unlock()
+	pa.Allocator.PutChunk(chunk)
+}
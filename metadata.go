@@ -0,0 +1,400 @@
+package fastcache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// snapshotMagic is written at the beginning of metadata.bin.
+//
+// It allows distinguishing fastcache snapshots from foreign files.
+const snapshotMagic = "FCSNAP\x00\x01"
+
+// snapshotFormatVersion is the version of the snapshot format written by SaveToFile*.
+//
+// Version history:
+//
+//   - 0: legacy format. metadata.bin contains only maxBucketChunks.
+//   - 1: metadata.bin contains the magic, the format version, the cache geometry
+//     and the manifest of data files with per-bucket CRC32C checksums.
+//   - 2: metadata.bin contains the chain id and the sequence number for incremental snapshots.
+//   - 3: metadata.bin contains the compression codec for data files.
+//   - 4: metadata.bin contains the encryption key id and the salt for encrypted data files,
+//     and the tag authenticating the metadata of encrypted snapshots.
+const snapshotFormatVersion = 4
+
+// metadataFilename is the name of the snapshot metadata object.
+const metadataFilename = "metadata.bin"
+
+// maxMetadataSize is the maximum size of metadata.bin, which may be read.
+const maxMetadataSize = 64 * 1024 * 1024
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotHeader is the contents of metadata.bin.
+type snapshotHeader struct {
+	// version is the snapshot format version.
+	version uint64
+
+	// Cache geometry.
+	bucketsCount    uint64
+	chunkSize       uint64
+	bucketSizeBits  uint64
+	maxBucketChunks uint64
+
+	// chainID is the id of the chain of incremental snapshots the snapshot belongs to.
+	//
+	// It is 0 for snapshots created by SaveToFile*.
+	chainID uint64
+
+	// seq is the sequence number of the snapshot in the chain.
+	seq uint64
+
+	// incremental is set if the snapshot contains only changes since the previous snapshot in the chain.
+	incremental bool
+
+	// codec is the compression codec for data files.
+	codec Codec
+
+	// keyID is the id of the key used for encrypting data files.
+	//
+	// It is empty if data files aren't encrypted.
+	keyID string
+
+	// salt is the random salt for deriving encryption keys from the key with keyID.
+	salt []byte
+
+	// files is the manifest of data files in the snapshot.
+	//
+	// It is empty for legacy snapshots.
+	files []snapshotFile
+
+	// tag authenticates the metadata of the encrypted snapshot.
+	//
+	// It is recalculated by Marshal if key is set.
+	tag []byte
+
+	// authData is the metadata authenticated by tag. It is set by Unmarshal.
+	authData []byte
+
+	// key is the key with keyID. It isn't stored in metadata.
+	//
+	// It is set when data files are encrypted or decrypted.
+	key []byte
+}
+
+// snapshotFile describes a data file in the snapshot.
+type snapshotFile struct {
+	// name is the file name relative to the snapshot directory.
+	name string
+
+	// size is the file size in bytes.
+	size uint64
+
+	// buckets contains the buckets stored in the file.
+	buckets []snapshotBucket
+}
+
+// snapshotBucket describes a bucket stored in a data file.
+type snapshotBucket struct {
+	// num is the bucket number.
+	num uint64
+
+	// crc is CRC32C checksum of the uncompressed bucket data.
+	crc uint32
+}
+
+func newSnapshotHeader(maxBucketChunks uint64) *snapshotHeader {
+	return &snapshotHeader{
+		version:         snapshotFormatVersion,
+		bucketsCount:    bucketsCount,
+		chunkSize:       chunkSize,
+		bucketSizeBits:  bucketSizeBits,
+		maxBucketChunks: maxBucketChunks,
+	}
+}
+
+func (sh *snapshotHeader) Marshal(dst []byte) []byte {
+	dstLen := len(dst)
+	dst = append(dst, snapshotMagic...)
+	dst = binary.LittleEndian.AppendUint64(dst, sh.version)
+	dst = binary.LittleEndian.AppendUint64(dst, sh.bucketsCount)
+	dst = binary.LittleEndian.AppendUint64(dst, sh.chunkSize)
+	dst = binary.LittleEndian.AppendUint64(dst, sh.bucketSizeBits)
+	dst = binary.LittleEndian.AppendUint64(dst, sh.maxBucketChunks)
+	if sh.version >= 2 {
+		dst = binary.LittleEndian.AppendUint64(dst, sh.chainID)
+		dst = binary.LittleEndian.AppendUint64(dst, sh.seq)
+		dst = binary.LittleEndian.AppendUint64(dst, boolToUint64(sh.incremental))
+	}
+	if sh.version >= 3 {
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(sh.codec))
+	}
+	if sh.version >= 4 {
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(len(sh.keyID)))
+		dst = append(dst, sh.keyID...)
+		if sh.keyID != "" {
+			dst = append(dst, sh.salt...)
+		}
+	}
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(len(sh.files)))
+	for _, f := range sh.files {
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(len(f.name)))
+		dst = append(dst, f.name...)
+		dst = binary.LittleEndian.AppendUint64(dst, f.size)
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(len(f.buckets)))
+		for _, b := range f.buckets {
+			dst = binary.LittleEndian.AppendUint64(dst, b.num)
+			dst = binary.LittleEndian.AppendUint32(dst, b.crc)
+		}
+	}
+	if sh.version >= 4 && sh.keyID != "" {
+		if sh.key != nil {
+			tag, err := sh.metadataTag(dst[dstLen:])
+			if err != nil {
+				// This may happen only on invalid key, which is verified before encrypting data files.
+				panic(fmt.Errorf("BUG: cannot calculate metadata tag: %w", err))
+			}
+			sh.tag = tag
+		}
+		dst = append(dst, sh.tag...)
+	}
+	crc := crc32.Checksum(dst[dstLen:], crc32cTable)
+	dst = binary.LittleEndian.AppendUint32(dst, crc)
+	return dst
+}
+
+func (sh *snapshotHeader) Unmarshal(src []byte) error {
+	if len(src) < len(snapshotMagic) || string(src[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("missing snapshot magic")
+	}
+	if len(src) < len(snapshotMagic)+4 {
+		return fmt.Errorf("too short metadata; missing checksum")
+	}
+	crc := binary.LittleEndian.Uint32(src[len(src)-4:])
+	data := src[:len(src)-4]
+	if crcExpected := crc32.Checksum(data, crc32cTable); crc != crcExpected {
+		return fmt.Errorf("metadata checksum mismatch; got 0x%08x; want 0x%08x", crc, crcExpected)
+	}
+	data = data[len(snapshotMagic):]
+
+	u := &uint64Reader{src: data}
+	sh.version = u.next()
+	if u.err == nil && sh.version > snapshotFormatVersion {
+		return fmt.Errorf("unsupported snapshot format version %d; the maximum supported version is %d", sh.version, snapshotFormatVersion)
+	}
+	sh.bucketsCount = u.next()
+	sh.chunkSize = u.next()
+	sh.bucketSizeBits = u.next()
+	sh.maxBucketChunks = u.next()
+	if sh.version >= 2 {
+		sh.chainID = u.next()
+		sh.seq = u.next()
+		sh.incremental = u.next() != 0
+	}
+	if sh.version >= 3 {
+		sh.codec = Codec(u.next())
+	}
+	if sh.version >= 4 {
+		sh.keyID = string(u.nextBytes(u.nextLen(1)))
+		if sh.keyID != "" {
+			sh.salt = append([]byte(nil), u.nextBytes(encryptionSaltSize)...)
+		}
+	}
+	filesCount := u.nextLen(8 * 3)
+	sh.files = make([]snapshotFile, 0, filesCount)
+	for range filesCount {
+		var f snapshotFile
+		f.name = string(u.nextBytes(u.nextLen(1)))
+		f.size = u.next()
+		bucketsLen := u.nextLen(8 + 4)
+		f.buckets = make([]snapshotBucket, 0, bucketsLen)
+		for range bucketsLen {
+			var b snapshotBucket
+			b.num = u.next()
+			b.crc = u.nextUint32()
+			f.buckets = append(f.buckets, b)
+		}
+		sh.files = append(sh.files, f)
+	}
+	if sh.keyID != "" {
+		sh.authData = append([]byte(nil), src[:len(src)-4-len(u.src)]...)
+		sh.tag = append([]byte(nil), u.nextBytes(16)...)
+	}
+	if u.err != nil {
+		return u.err
+	}
+	if len(u.src) > 0 {
+		return fmt.Errorf("unexpected %d trailing bytes", len(u.src))
+	}
+	return sh.validate()
+}
+
+func (sh *snapshotHeader) validate() error {
+	if sh.bucketsCount != bucketsCount || sh.chunkSize != chunkSize || sh.bucketSizeBits != bucketSizeBits {
+		return fmt.Errorf("incompatible cache geometry: bucketsCount=%d, chunkSize=%d, bucketSizeBits=%d; want bucketsCount=%d, chunkSize=%d, bucketSizeBits=%d",
+			sh.bucketsCount, sh.chunkSize, sh.bucketSizeBits, bucketsCount, chunkSize, bucketSizeBits)
+	}
+	if sh.maxBucketChunks == 0 {
+		return fmt.Errorf("invalid maxBucketChunks=0")
+	}
+	if err := sh.codec.validate(); err != nil {
+		return err
+	}
+	if sh.keyID != "" && sh.codec == CodecMmap {
+		return fmt.Errorf("%s codec cannot be used with encryption", sh.codec)
+	}
+	seen := make(map[uint64]bool)
+	for _, f := range sh.files {
+		if !dataFileRegexp.MatchString(f.name) {
+			return fmt.Errorf("invalid data file name %q", f.name)
+		}
+		for _, b := range f.buckets {
+			if b.num >= bucketsCount {
+				return fmt.Errorf("invalid bucket number %d in %q; must be smaller than %d", b.num, f.name, bucketsCount)
+			}
+			if seen[b.num] {
+				return fmt.Errorf("duplicate bucket number %d in %q", b.num, f.name)
+			}
+			seen[b.num] = true
+		}
+	}
+	return nil
+}
+
+func boolToUint64(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// uint64Reader reads little-endian encoded values from src.
+//
+// The first error is stored in err; subsequent reads return zero values.
+type uint64Reader struct {
+	src []byte
+	err error
+}
+
+func (u *uint64Reader) next() uint64 {
+	if u.err != nil {
+		return 0
+	}
+	if len(u.src) < 8 {
+		u.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	n := binary.LittleEndian.Uint64(u.src)
+	u.src = u.src[8:]
+	return n
+}
+
+func (u *uint64Reader) nextUint32() uint32 {
+	if u.err != nil {
+		return 0
+	}
+	if len(u.src) < 4 {
+		u.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	n := binary.LittleEndian.Uint32(u.src)
+	u.src = u.src[4:]
+	return n
+}
+
+// nextLen reads the number of items with at least itemSize bytes each.
+//
+// It verifies that the remaining data may contain the given number of items.
+func (u *uint64Reader) nextLen(itemSize int) int {
+	n := u.next()
+	if u.err != nil {
+		return 0
+	}
+	if n > uint64(len(u.src)/itemSize) {
+		u.err = fmt.Errorf("too big length=%d for the remaining %d bytes", n, len(u.src))
+		return 0
+	}
+	return int(n)
+}
+
+func (u *uint64Reader) nextBytes(n int) []byte {
+	if u.err != nil {
+		return nil
+	}
+	if len(u.src) < n {
+		u.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := u.src[:n]
+	u.src = u.src[n:]
+	return b
+}
+
+// saveMetadata atomically writes sh to metadata.bin in s.
+//
+// The snapshot in s is complete once metadata.bin exists, since it is written after all the data files.
+func saveMetadata(sh *snapshotHeader, s SnapshotStore) error {
+	data := sh.Marshal(nil)
+	return writeObjectAtomic(s, metadataFilename, data)
+}
+
+func loadMetadata(s SnapshotStore) (*snapshotHeader, error) {
+	data, err := readObject(s, metadataFilename, maxMetadataSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 8 {
+		// Legacy format, which contains only maxBucketChunks.
+		maxBucketChunks := binary.LittleEndian.Uint64(data)
+		if maxBucketChunks == 0 {
+			return nil, fmt.Errorf("invalid maxBucketChunks=0 read from %q", metadataFilename)
+		}
+		sh := newSnapshotHeader(maxBucketChunks)
+		sh.version = 0
+		return sh, nil
+	}
+	var sh snapshotHeader
+	if err := sh.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %w", metadataFilename, err)
+	}
+	return &sh, nil
+}
+
+// crcWriter calculates CRC32C checksum for the data written to w.
+type crcWriter struct {
+	w   io.Writer
+	crc uint32
+}
+
+func (cw *crcWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.crc = crc32.Update(cw.crc, crc32cTable, p[:n])
+	return n, err
+}
+
+// crcReader calculates CRC32C checksum for the data read from r.
+type crcReader struct {
+	r   io.Reader
+	crc uint32
+}
+
+func (cr *crcReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc = crc32.Update(cr.crc, crc32cTable, p[:n])
+	return n, err
+}
+
+// countingWriter counts the number of bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += uint64(n)
+	return n, err
+}
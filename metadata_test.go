@@ -0,0 +1,230 @@
+package fastcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestSnapshotHeaderMarshalUnmarshal(t *testing.T) {
+	f := func(sh *snapshotHeader) {
+		t.Helper()
+		data := sh.Marshal(nil)
+		var sh2 snapshotHeader
+		if err := sh2.Unmarshal(data); err != nil {
+			t.Fatalf("cannot unmarshal header: %s", err)
+		}
+		if !reflect.DeepEqual(sh, &sh2) {
+			t.Fatalf("unexpected header after unmarshal\ngot\n%#v\nwant\n%#v", &sh2, sh)
+		}
+
+		// Verify that any corruption is detected.
+		for i := range data {
+			dataCopy := append([]byte{}, data...)
+			dataCopy[i]++
+			if err := sh2.Unmarshal(dataCopy); err == nil {
+				t.Fatalf("expecting non-nil error for corrupted byte at position %d", i)
+			}
+		}
+		// Verify that truncated header is detected.
+		for i := range data {
+			if err := sh2.Unmarshal(data[:i]); err == nil {
+				t.Fatalf("expecting non-nil error for header truncated to %d bytes", i)
+			}
+		}
+	}
+
+	sh := newSnapshotHeader(123)
+	sh.files = []snapshotFile{}
+	f(sh)
+
+	sh = newSnapshotHeader(1)
+	sh.files = []snapshotFile{
+		{
+			name:    "data.0.bin",
+			size:    1234,
+			buckets: []snapshotBucket{},
+		},
+		{
+			name: "data.1.bin",
+			size: 0,
+			buckets: []snapshotBucket{
+				{num: 0, crc: 0x12345678},
+				{num: 511, crc: 0},
+			},
+		},
+	}
+	f(sh)
+}
+
+func TestSnapshotHeaderUnmarshalInvalid(t *testing.T) {
+	f := func(sh *snapshotHeader, errSubstr string) {
+		t.Helper()
+		data := sh.Marshal(nil)
+		var sh2 snapshotHeader
+		err := sh2.Unmarshal(data)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !strings.Contains(err.Error(), errSubstr) {
+			t.Fatalf("unexpected error; got %q; want it containing %q", err, errSubstr)
+		}
+	}
+
+	sh := newSnapshotHeader(1)
+	sh.version = snapshotFormatVersion + 1
+	f(sh, "unsupported snapshot format version")
+
+	sh = newSnapshotHeader(1)
+	sh.chunkSize = 4096
+	f(sh, "incompatible cache geometry")
+
+	sh = newSnapshotHeader(0)
+	f(sh, "invalid maxBucketChunks")
+
+	sh = newSnapshotHeader(1)
+	sh.files = []snapshotFile{{name: "../data.0.bin"}}
+	f(sh, "invalid data file name")
+
+	sh = newSnapshotHeader(1)
+	sh.files = []snapshotFile{{name: "data.0.bin", buckets: []snapshotBucket{{num: bucketsCount}}}}
+	f(sh, "invalid bucket number")
+
+	sh = newSnapshotHeader(1)
+	sh.files = []snapshotFile{
+		{name: "data.0.bin", buckets: []snapshotBucket{{num: 1}}},
+		{name: "data.1.bin", buckets: []snapshotBucket{{num: 1}}},
+	}
+	f(sh, "duplicate bucket number")
+
+	// The magic without the checksum.
+	var sh2 snapshotHeader
+	err := sh2.Unmarshal([]byte(snapshotMagic + "\x00\x00\x00"))
+	if err == nil || !strings.Contains(err.Error(), "too short metadata") {
+		t.Fatalf("unexpected error for too short metadata: %v", err)
+	}
+}
+
+func TestLoadLegacySnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "legacy.fastcache")
+	if err := os.Mkdir(filePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(1)
+	defer c.Reset()
+	const itemsCount = 1000
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		c.Set(k, v)
+	}
+
+	// Write the cache in the legacy format.
+	metadataFile, err := os.Create(filePath + "/metadata.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeUint64(metadataFile, uint64(cap(c.buckets[0].chunks))); err != nil {
+		t.Fatal(err)
+	}
+	_ = metadataFile.Close()
+	dataFile, err := os.Create(filePath + "/data.0.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := snappy.NewBufferedWriter(dataFile)
+	for i := range c.buckets[:] {
+		if err := writeUint64(zw, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.buckets[i].Save(zw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = dataFile.Close()
+
+	c1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("cannot load legacy snapshot: %s", err)
+	}
+	defer c1.Reset()
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		if vv := c1.Get(nil, k); string(vv) != string(v) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, vv, v)
+		}
+	}
+}
+
+func TestLoadCorruptedSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	c := New(1)
+	defer c.Reset()
+	for i := range 1000 {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		c.Set(k, v)
+	}
+
+	f := func(name string, corrupt func(filePath string), errSubstr string) {
+		t.Helper()
+		filePath := filepath.Join(tmpDir, name)
+		if err := c.SaveToFile(filePath); err != nil {
+			t.Fatalf("SaveToFile error: %s", err)
+		}
+		corrupt(mustResolveSnapshotDir(t, filePath))
+		c1, err := LoadFromFile(filePath)
+		if err == nil {
+			c1.Reset()
+			t.Fatalf("expecting non-nil error")
+		}
+		if !strings.Contains(err.Error(), errSubstr) {
+			t.Fatalf("unexpected error; got %q; want it containing %q", err, errSubstr)
+		}
+	}
+
+	f("truncated", func(filePath string) {
+		dataPath := filePath + "/data.0.bin"
+		fi, err := os.Stat(dataPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(dataPath, fi.Size()/2); err != nil {
+			t.Fatal(err)
+		}
+	}, "the file may be truncated")
+
+	f("missing_data_file", func(filePath string) {
+		if err := os.Remove(filePath + "/data.0.bin"); err != nil {
+			t.Fatal(err)
+		}
+	}, "data.0.bin")
+
+	f("foreign_metadata", func(filePath string) {
+		if err := os.WriteFile(filePath+"/metadata.bin", []byte("foreign metadata file"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}, "missing snapshot magic")
+
+	f("checksum_mismatch", func(filePath string) {
+		sh, err := loadMetadata(NewFileSnapshotStore(filePath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sh.files[0].buckets[0].crc++
+		if err := saveMetadata(sh, NewFileSnapshotStore(filePath)); err != nil {
+			t.Fatal(err)
+		}
+	}, "checksum mismatch")
+}
@@ -0,0 +1,377 @@
+package fastcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync/atomic"
+	"unsafe"
+)
+
+// LoadFromFileMmap loads cache data from the given filePath by mapping
+// the snapshot data files into memory.
+//
+// The snapshot must be saved with CodecMmap in order to be mapped.
+// Bucket chunks reference the mapped file pages until the first write
+// to them, when the modified pages are copied into private memory.
+// This means the cache may serve reads immediately after LoadFromFileMmap
+// returns, while the data is read from disk on demand.
+// Checksums for mapped chunks aren't verified, since this would require
+// reading all the data. Use LoadFromFile for full verification.
+//
+// The mapped data files must not be truncated or modified in place while
+// the cache is in use. SaveToFile* may save cache data to the same filePath,
+// since it atomically replaces the snapshot instead of modifying its files.
+// The mapped chunks are reused for new cache entries after the loaded entries
+// are overwritten. The mapped data files are unmapped when the cache releases
+// all their chunks on Reset. Close leaves the mapped chunks in place, so the data
+// files remain mapped until the cache releases their chunks.
+//
+// Snapshots saved with other codecs are loaded in the same way as LoadFromFile does.
+// The snapshot is also loaded in the same way as LoadFromFile does on platforms
+// without mmap support.
+func LoadFromFileMmap(filePath string) (*Cache, error) {
+	c, _, err := loadSnapshotFile(filePath, 0, true, nil, nil, nil)
+	return c, err
+}
+
+// mappedRegion is a data file mapped into memory by LoadFromFileMmap.
+//
+// Bucket chunks may reference the region. The whole region is unmapped
+// when the last reference to it is released.
+type mappedRegion struct {
+	data []byte
+
+	// refs is the number of references to the region.
+	refs atomic.Int64
+}
+
+// newMappedRegion returns the region for data mapped via mapFile.
+//
+// The returned region holds a reference, which must be released by the caller.
+func newMappedRegion(data []byte) *mappedRegion {
+	r := &mappedRegion{
+		data: data,
+	}
+	r.refs.Store(1)
+	return r
+}
+
+// contains returns true if chunk belongs to r and r isn't unmapped yet.
+func (r *mappedRegion) contains(chunk []byte) bool {
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(chunk)))
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(r.data)))
+	return p >= start && p-start < uintptr(len(r.data)) && r.refs.Load() > 0
+}
+
+// acquire adds n references to r.
+func (r *mappedRegion) acquire(n uint64) {
+	r.refs.Add(int64(n))
+}
+
+// release releases a reference to r.
+//
+// r is unmapped when the last reference is released. true is returned in this case.
+func (r *mappedRegion) release() bool {
+	n := r.refs.Add(-1)
+	if n > 0 {
+		return false
+	}
+	if n < 0 {
+		panic(fmt.Errorf("BUG: too many releases for the mapped region at %p", unsafe.SliceData(r.data)))
+	}
+	if err := unmapFile(r.data); err != nil {
+		panic(fmt.Errorf("cannot unmap region at %p: %s", unsafe.SliceData(r.data), err))
+	}
+	return true
+}
+
+// addMappedRegion registers r, which is referenced by b.chunks.
+//
+// b mustn't be used concurrently.
+func (b *bucket) addMappedRegion(r *mappedRegion) {
+	if !slices.Contains(b.mapped, r) {
+		b.mapped = append(b.mapped, r)
+	}
+}
+
+func (b *bucket) isMappedChunkLocked(chunk []byte) bool {
+	for _, r := range b.mapped {
+		if r.contains(chunk) {
+			return true
+		}
+	}
+	return false
+}
+
+// errMmapUnsupported is returned by mapFile on platforms without mmap support.
+var errMmapUnsupported = errors.New("mmap isn't supported on this platform")
+
+// zeroPadding is used for aligning chunks in data files saved with CodecMmap.
+var zeroPadding [chunkSize]byte
+
+// saveAlignedBuckets saves buckets received from workCh to data.<workerNum>.bin file in s using CodecMmap layout.
+//
+// Every bucket is stored as the bucket number followed by the data written by bucket.Save.
+// Chunks are aligned to chunkSize in the file, so they may be mapped directly into memory.
+// Padding before chunks isn't included into bucket checksums.
+func saveAlignedBuckets(buckets []bucket, workCh <-chan int, s SnapshotStore, workerNum int, filter func(k, v []byte) bool, ic *ioControl) (snapshotFile, error) {
+	f := snapshotFile{
+		name: fmt.Sprintf("data.%d.bin", workerNum),
+	}
+	dataPath := f.name
+	dataFile, err := s.Create(dataPath)
+	if err != nil {
+		return f, fmt.Errorf("cannot create %q: %s", dataPath, err)
+	}
+	defer func() {
+		if dataFile != nil {
+			_ = dataFile.Close()
+		}
+	}()
+	bw := bufio.NewWriterSize(ic.writer(dataFile), chunkSize)
+	fw := &countingWriter{
+		w: bw,
+	}
+	cw := &crcWriter{
+		w: fw,
+	}
+	for bucketNum := range workCh {
+		if err := ic.err(); err != nil {
+			return f, fmt.Errorf("cannot save bucket[%d] to %q: %w", bucketNum, dataPath, err)
+		}
+		n := fw.n
+		if err := writeUint64(fw, uint64(bucketNum)); err != nil {
+			return f, fmt.Errorf("cannot write bucketNum=%d to %q: %s", bucketNum, dataPath, err)
+		}
+		cw.crc = 0
+		b := &buckets[bucketNum]
+		if filter != nil {
+			b = b.filtered(filter)
+		}
+		err := b.saveAligned(cw, fw)
+		if filter != nil {
+			b.unload()
+		}
+		if err != nil {
+			return f, fmt.Errorf("cannot save bucket[%d] to %q: %s", bucketNum, dataPath, err)
+		}
+		f.buckets = append(f.buckets, snapshotBucket{
+			num: uint64(bucketNum),
+			crc: cw.crc,
+		})
+		ic.bucketProcessed(fw.n - n)
+	}
+	if err := bw.Flush(); err != nil {
+		return f, fmt.Errorf("cannot flush data to %q: %s", dataPath, err)
+	}
+	err = dataFile.Close()
+	dataFile = nil
+	if err != nil {
+		return f, fmt.Errorf("cannot close %q: %s", dataPath, err)
+	}
+	f.size = fw.n
+	return f, nil
+}
+
+// saveAligned writes b to cw in the same format as bucket.Save does,
+// while aligning chunks to chunkSize in fw.
+//
+// cw must write to fw.
+func (b *bucket) saveAligned(cw *crcWriter, fw *countingWriter) error {
+	bc := getBucketCopy()
+	defer putBucketCopy(bc)
+	b.copyForSave(bc, false, false)
+
+	if _, err := cw.Write(bc.header.B); err != nil {
+		return fmt.Errorf("cannot write bucket index: %s", err)
+	}
+	if len(bc.chunks) == 0 {
+		return nil
+	}
+	if _, err := fw.Write(zeroPadding[:alignmentPadding(fw.n)]); err != nil {
+		return fmt.Errorf("cannot write padding for b.chunks: %s", err)
+	}
+	for chunkIdx, chunk := range bc.chunks {
+		if _, err := cw.Write(chunk); err != nil {
+			return fmt.Errorf("cannot write b.chunks[%d]: %s", chunkIdx, err)
+		}
+	}
+	return nil
+}
+
+// alignmentPadding returns the number of bytes needed for aligning the given offset to chunkSize.
+func alignmentPadding(offset uint64) uint64 {
+	return (chunkSize - offset%chunkSize) % chunkSize
+}
+
+// loadAlignedBuckets loads buckets from the data file f saved with CodecMmap layout
+// for the snapshot sh located in s.
+//
+// Bucket chunks reference the file mapped into memory if mapped is set, s stores f in a file
+// and the platform supports it.
+// Otherwise chunks are read from the file and verified against the checksums from the manifest.
+// Every bucket is claimed in claims before loading it. claims must be shared by all the data files of the snapshot.
+// onLoaded is called for every loaded bucket if it isn't nil.
+func loadAlignedBuckets(buckets []bucket, claims *bucketClaims, s SnapshotStore, f *snapshotFile, sh *snapshotHeader, mapped bool, ic *ioControl, onLoaded func(bucketNum uint64) error) error {
+	dataPath := f.name
+	dataFile, err := s.Open(dataPath)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %s", dataPath, err)
+	}
+	defer func() {
+		_ = dataFile.Close()
+	}()
+	if size := uint64(dataFile.Size()); size != f.size {
+		return corruptionErrorf("unexpected size for %q; got %d bytes; want %d bytes; the file may be truncated or overwritten", dataPath, size, f.size)
+	}
+	var data []byte
+	var region *mappedRegion
+	if fo, ok := dataFile.(*fileObject); ok && mapped && f.size > 0 {
+		data, err = mapFile(fo.File, f.size)
+		if err != nil && err != errMmapUnsupported {
+			return fmt.Errorf("cannot map %q into memory: %w", dataPath, err)
+		}
+		if data != nil {
+			region = newMappedRegion(data)
+			// Unmap the region on error or if no chunks reference it.
+			defer region.release()
+		}
+	}
+	expectedCRCs := make(map[uint64]uint32, len(f.buckets))
+	for _, b := range f.buckets {
+		expectedCRCs[b.num] = b.crc
+	}
+
+	var fr *offsetReader
+	if data != nil {
+		fr = &offsetReader{
+			r: bytes.NewReader(data),
+		}
+	} else {
+		fr = &offsetReader{
+			r: bufio.NewReaderSize(dataFile, chunkSize),
+		}
+	}
+	cr := &crcReader{
+		r: fr,
+	}
+	maxChunks := sh.maxBucketChunks
+	for {
+		if err := ic.err(); err != nil {
+			return fmt.Errorf("cannot load buckets from %q: %w", dataPath, err)
+		}
+		n := fr.n
+		bucketNum, err := readUint64(fr)
+		if err == io.EOF {
+			// Reached the end of file.
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read bucketNum from %q: %s", dataPath, err)
+		}
+		if bucketNum >= uint64(len(buckets)) {
+			return corruptionErrorf("unexpected bucketNum read from %q: %d; must be smaller than %d", dataPath, bucketNum, len(buckets))
+		}
+		crcExpected, ok := expectedCRCs[bucketNum]
+		if !ok {
+			return corruptionErrorf("unexpected bucket[%d] in %q; it is missing in the manifest or duplicated", bucketNum, dataPath)
+		}
+		delete(expectedCRCs, bucketNum)
+		if !claims.claim(bucketNum) {
+			return corruptionErrorf("duplicate bucket[%d] in %q; it is already loaded from another data file", bucketNum, dataPath)
+		}
+
+		cr.crc = 0
+		bIdx, bGen, m, err := readBucketIndex(cr, maxChunks)
+		if err != nil {
+			return fmt.Errorf("cannot load bucket[%d] from %q: %w", bucketNum, dataPath, err)
+		}
+		chunksLen, err := readChunksLen(cr, bIdx, maxChunks)
+		if err != nil {
+			return fmt.Errorf("cannot load bucket[%d] from %q: %w", bucketNum, dataPath, err)
+		}
+		chunks := make([][]byte, maxChunks)
+		if chunksLen > 0 {
+			if err := fr.skip(alignmentPadding(fr.n)); err != nil {
+				return fmt.Errorf("cannot skip padding for bucket[%d] in %q: %s", bucketNum, dataPath, err)
+			}
+		}
+		if data != nil {
+			offset := fr.n
+			if offset+chunksLen*chunkSize > uint64(len(data)) {
+				return corruptionErrorf("cannot map b.chunks for bucket[%d] in %q; the file may be truncated", bucketNum, dataPath)
+			}
+			for chunkIdx := range chunksLen {
+				start := offset + chunkIdx*chunkSize
+				end := start + chunkSize
+				chunks[chunkIdx] = data[start:end:end]
+			}
+			if err := fr.skip(chunksLen * chunkSize); err != nil {
+				return fmt.Errorf("cannot skip b.chunks for bucket[%d] in %q: %s", bucketNum, dataPath, err)
+			}
+			if chunksLen > 0 {
+				region.acquire(chunksLen)
+				buckets[bucketNum].addMappedRegion(region)
+			}
+		} else {
+			for chunkIdx := range chunksLen {
+				chunk := buckets[bucketNum].getChunk()
+				chunks[chunkIdx] = chunk
+				if _, err := io.ReadFull(cr, chunk); err != nil {
+					for _, chunk := range chunks {
+						buckets[bucketNum].putChunk(chunk)
+					}
+					return fmt.Errorf("cannot read b.chunks[%d] for bucket[%d] from %q: %s", chunkIdx, bucketNum, dataPath, err)
+				}
+			}
+			if cr.crc != crcExpected {
+				for _, chunk := range chunks {
+					buckets[bucketNum].putChunk(chunk)
+				}
+				return corruptionErrorf("checksum mismatch for bucket[%d] in %q; got 0x%08x; want 0x%08x", bucketNum, dataPath, cr.crc, crcExpected)
+			}
+		}
+		buckets[bucketNum].setLoaded(chunks, chunksLen, m, bIdx, bGen)
+		ic.bucketProcessed(fr.n - n)
+		if onLoaded != nil {
+			if err := onLoaded(bucketNum); err != nil {
+				return err
+			}
+		}
+	}
+	if len(expectedCRCs) > 0 {
+		return corruptionErrorf("%d buckets listed in the manifest are missing in %q", len(expectedCRCs), dataPath)
+	}
+	return nil
+}
+
+// offsetReader tracks the offset for the data read from r.
+type offsetReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (or *offsetReader) Read(p []byte) (int, error) {
+	n, err := or.r.Read(p)
+	or.n += uint64(n)
+	return n, err
+}
+
+// skip skips n bytes in or.
+//
+// It doesn't read the skipped data if the underlying reader supports seeking.
+func (or *offsetReader) skip(n uint64) error {
+	if s, ok := or.r.(io.Seeker); ok {
+		if _, err := s.Seek(int64(n), io.SeekCurrent); err != nil {
+			return err
+		}
+	} else if _, err := io.CopyN(io.Discard, or.r, int64(n)); err != nil {
+		return err
+	}
+	or.n += n
+	return nil
+}
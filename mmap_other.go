@@ -0,0 +1,14 @@
+//go:build appengine || windows || wasm || tinygo.wasm || js
+// +build appengine windows wasm tinygo.wasm js
+
+package fastcache
+
+import "os"
+
+func mapFile(f *os.File, size uint64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func unmapFile(data []byte) error {
+	return errMmapUnsupported
+}
@@ -0,0 +1,277 @@
+package fastcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadFromFileMmap(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "TestLoadFromFileMmap")
+
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+	const itemsCount = 10000
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		c.Set(k, v)
+	}
+	opts := &SaveOptions{
+		Codec: CodecMmap,
+	}
+	if err := c.SaveToFileOptions(filePath, opts); err != nil {
+		t.Fatalf("SaveToFileOptions error: %s", err)
+	}
+	dataPath := filepath.Join(mustResolveSnapshotDir(t, filePath), "data.0.bin")
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", dataPath, err)
+	}
+
+	checkItems := func(c *Cache, prefix string) {
+		t.Helper()
+		for i := range itemsCount {
+			k := []byte(fmt.Sprintf("key %d", i))
+			v := []byte(fmt.Sprintf("%s %d", prefix, i))
+			if vv := c.Get(nil, k); string(vv) != string(v) {
+				t.Fatalf("unexpected value for key %q; got %q; want %q", k, vv, v)
+			}
+		}
+	}
+
+	// The snapshot must be readable by LoadFromFile.
+	c1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	checkItems(c1, "value")
+	c1.Reset()
+
+	c2, err := LoadFromFileMmap(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFileMmap error: %s", err)
+	}
+	checkItems(c2, "value")
+
+	// Overwrite the loaded entries. This mustn't modify the snapshot.
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("new value %d", i))
+		c2.Set(k, v)
+	}
+	overflowValue := make([]byte, 1000)
+	for i := range 2 * bucketsCount * chunkSize * 2 / len(overflowValue) {
+		c2.Set([]byte(fmt.Sprintf("overflow key %d", i)), overflowValue)
+	}
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		c2.Set(k, []byte(fmt.Sprintf("new value %d", i)))
+	}
+	checkItems(c2, "new value")
+	dataNew, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", dataPath, err)
+	}
+	if string(data) != string(dataNew) {
+		t.Fatalf("the snapshot has been modified by writes to the mapped cache")
+	}
+
+	// The mapped cache may be saved to the same path.
+	if err := c2.SaveToFileOptions(filePath, opts); err != nil {
+		t.Fatalf("SaveToFileOptions error for the mapped cache: %s", err)
+	}
+	checkItems(c2, "new value")
+	c2.Reset()
+
+	// Chunks returned by the mapped cache must be usable by other caches.
+	c3, err := LoadFromFileMmap(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFileMmap error: %s", err)
+	}
+	checkItems(c3, "new value")
+	c4 := New(bucketsCount * chunkSize * 2)
+	defer c4.Reset()
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		c4.Set(k, []byte(fmt.Sprintf("value %d", i)))
+	}
+	checkItems(c4, "value")
+	checkItems(c3, "new value")
+	c3.Reset()
+}
+
+func TestLoadFromFileMmapOtherCodec(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "TestLoadFromFileMmapOtherCodec")
+
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	c1, err := LoadFromFileMmap(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFileMmap error: %s", err)
+	}
+	defer c1.Reset()
+	if v := c1.Get(nil, []byte("foo")); string(v) != "bar" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "bar")
+	}
+}
+
+func TestLoadFromFileMmapCorrupted(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "TestLoadFromFileMmapCorrupted")
+
+	c := New(bucketsCount * chunkSize)
+	defer c.Reset()
+	for i := range 1000 {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	opts := &SaveOptions{
+		Codec: CodecMmap,
+	}
+	if err := c.SaveToFileOptions(filePath, opts); err != nil {
+		t.Fatalf("SaveToFileOptions error: %s", err)
+	}
+
+	// Corrupt the last chunk. LoadFromFile must detect the corruption.
+	dataPath := filepath.Join(mustResolveSnapshotDir(t, filePath), "data.0.bin")
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", dataPath, err)
+	}
+	data[len(data)-1]++
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatalf("cannot write %q: %s", dataPath, err)
+	}
+	if _, err := LoadFromFile(filePath); err == nil {
+		t.Fatalf("expecting non-nil error when loading corrupted snapshot")
+	}
+
+	// Truncate the file.
+	if err := os.WriteFile(dataPath, data[:len(data)-chunkSize], 0644); err != nil {
+		t.Fatalf("cannot write %q: %s", dataPath, err)
+	}
+	if _, err := LoadFromFile(filePath); err == nil {
+		t.Fatalf("expecting non-nil error when loading truncated snapshot")
+	}
+	if _, err := LoadFromFileMmap(filePath); err == nil {
+		t.Fatalf("expecting non-nil error when mapping truncated snapshot")
+	}
+}
+
+func TestLoadFromFileMmapUnmap(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "TestLoadFromFileMmapUnmap")
+
+	c := New(bucketsCount * chunkSize)
+	defer c.Reset()
+	for i := range 1000 {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	opts := &SaveOptions{
+		Codec: CodecMmap,
+	}
+	if err := c.SaveToFileOptions(filePath, opts); err != nil {
+		t.Fatalf("SaveToFileOptions error: %s", err)
+	}
+	dataPath := filepath.Join(mustResolveSnapshotDir(t, filePath), "data.0.bin")
+
+	mappedRegions := func(c *Cache) []*mappedRegion {
+		var rs []*mappedRegion
+		for i := range c.buckets[:] {
+			for _, r := range c.buckets[i].mapped {
+				if !slices.Contains(rs, r) {
+					rs = append(rs, r)
+				}
+			}
+		}
+		return rs
+	}
+	checkUnmapped := func(rs []*mappedRegion) {
+		t.Helper()
+		for _, r := range rs {
+			if n := r.refs.Load(); n != 0 {
+				t.Fatalf("the mapped region must be unmapped; it has %d references", n)
+			}
+		}
+		if n, ok := fileMappingsCount(dataPath); ok && n > 0 {
+			t.Fatalf("%q is still mapped into memory", dataPath)
+		}
+	}
+
+	// Reset must unmap the whole data file.
+	c1, err := LoadFromFileMmap(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFileMmap error: %s", err)
+	}
+	rs := mappedRegions(c1)
+	if len(rs) == 0 {
+		c1.Reset()
+		t.Skipf("mmap isn't supported on this platform")
+	}
+	c1.Reset()
+	checkUnmapped(rs)
+
+	// Close mustn't copy the mapped chunks into memory, while the cache must remain usable.
+	c2, err := LoadFromFileMmap(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFileMmap error: %s", err)
+	}
+	defer c2.Reset()
+	rs = mappedRegions(c2)
+	mappedChunks := func(c *Cache) int {
+		n := 0
+		for i := range c.buckets[:] {
+			b := &c.buckets[i]
+			for _, chunk := range b.chunks {
+				if chunk != nil && b.isMappedChunkLocked(chunk) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	n := mappedChunks(c2)
+	if err := c2.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	if nAfter := mappedChunks(c2); nAfter != n {
+		t.Fatalf("Close mustn't copy the mapped chunks; mapped chunks before Close: %d; after Close: %d", n, nAfter)
+	}
+	for i := range 1000 {
+		k := fmt.Sprintf("key %d", i)
+		if v := c2.Get(nil, []byte(k)); string(v) != fmt.Sprintf("value %d", i) {
+			t.Fatalf("unexpected value for key %q after Close: %q", k, v)
+		}
+	}
+	c2.Reset()
+	checkUnmapped(rs)
+
+	// The data file must be unmapped on load error.
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", dataPath, err)
+	}
+	if err := os.WriteFile(dataPath, data[:len(data)-chunkSize], 0644); err != nil {
+		t.Fatalf("cannot write %q: %s", dataPath, err)
+	}
+	if _, err := LoadFromFileMmap(filePath); err == nil {
+		t.Fatalf("expecting non-nil error when mapping truncated snapshot")
+	}
+	checkUnmapped(nil)
+}
+
+// fileMappingsCount returns the number of mappings for the file at path in the current process.
+//
+// false is returned if the mappings cannot be obtained on the current platform.
+func fileMappingsCount(path string) (int, bool) {
+	data, err := os.ReadFile("/proc/self/maps")
+	if err != nil {
+		return 0, false
+	}
+	return strings.Count(string(data), path), true
+}
@@ -0,0 +1,26 @@
+//go:build !appengine && !windows && !wasm && !tinygo.wasm && !js
+// +build !appengine,!windows,!wasm,!tinygo.wasm,!js
+
+package fastcache
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile maps size bytes of f into memory.
+//
+// The mapping is private, so writes to the returned memory aren't propagated to f.
+func mapFile(f *os.File, size uint64) ([]byte, error) {
+	if uint64(int(size)) != size || int(size) < 0 {
+		return nil, fmt.Errorf("too big file size=%d for mapping into memory", size)
+	}
+	return unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE)
+}
+
+// unmapFile unmaps data obtained via mapFile.
+func unmapFile(data []byte) error {
+	return unix.Munmap(data)
+}
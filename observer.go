@@ -0,0 +1,186 @@
+package fastcache
+
+import (
+	"sync/atomic"
+)
+
+// Observer receives notifications about cache operations.
+//
+// Observer may be used for tracing and collecting latency metrics without
+// modifying the cache code. Install it via Config.Observer.
+//
+// Observer methods are called synchronously by the goroutine performing
+// the operation, so they must be fast and safe for concurrent use.
+// Byte slices passed to Observer methods must not be modified or retained
+// after the method returns.
+//
+// Embed NopObserver into custom observers in order to implement only
+// the needed methods.
+type Observer interface {
+	// OnGetHit is called when Get, HasGet or Has finds the entry for k.
+	OnGetHit(k []byte)
+
+	// OnGetMiss is called when Get, HasGet or Has cannot find the entry for k.
+	OnGetMiss(k []byte)
+
+	// OnSet is called when (k, v) is passed to Set.
+	OnSet(k, v []byte)
+
+	// OnDel is called when k is passed to Del.
+	OnDel(k []byte)
+
+	// OnEvict is called when n entries are evicted from a bucket
+	// due to cache overflow.
+	OnEvict(n int)
+
+	// OnCollision is called when the entry found by hash(k) has a different key.
+	OnCollision(k []byte)
+
+	// OnCorruption is called when a corrupted entry is detected.
+	OnCorruption()
+
+	// OnSaveStart is called when saving the cache to filePath starts.
+	//
+	// It is called by all the Cache.Save* functions and by Cache.WriteTo.
+	// filePath is empty if the cache is saved to io.Writer or SnapshotStore.
+	OnSaveStart(filePath string)
+
+	// OnSaveFinish is called when saving the cache to filePath finishes.
+	//
+	// err is nil if the cache has been saved successfully.
+	OnSaveFinish(filePath string, err error)
+
+	// OnLoadStart is called when loading the cache from filePath starts.
+	//
+	// It is called by Cache.LoadFrom and by the functions creating a new cache
+	// from the given Config such as LoadFromFileConfig and ReadFromConfig.
+	// Other functions creating a new cache such as LoadFromFile and ReadFrom
+	// have no observer to notify.
+	// filePath is empty if the cache is loaded from io.Reader.
+	OnLoadStart(filePath string)
+
+	// OnLoadFinish is called when loading the cache from filePath finishes.
+	//
+	// err is nil if the cache has been loaded successfully.
+	OnLoadFinish(filePath string, err error)
+}
+
+// notifySave calls save and notifies c.obs about it.
+func (c *Cache) notifySave(filePath string, save func() error) error {
+	return notify(c.obs, filePath, save, Observer.OnSaveStart, Observer.OnSaveFinish)
+}
+
+// notifyLoad calls load and notifies obs about it.
+//
+// obs may be nil.
+func notifyLoad(obs Observer, filePath string, load func() error) error {
+	return notify(obs, filePath, load, Observer.OnLoadStart, Observer.OnLoadFinish)
+}
+
+func notify(obs Observer, filePath string, f func() error, onStart func(Observer, string), onFinish func(Observer, string, error)) error {
+	if obs == nil {
+		return f()
+	}
+	onStart(obs, filePath)
+	err := f()
+	onFinish(obs, filePath, err)
+	return err
+}
+
+// NopObserver is an Observer, which does nothing.
+//
+// It may be embedded into custom observers.
+type NopObserver struct{}
+
+// OnGetHit implements Observer.
+func (NopObserver) OnGetHit(k []byte) {}
+
+// OnGetMiss implements Observer.
+func (NopObserver) OnGetMiss(k []byte) {}
+
+// OnSet implements Observer.
+func (NopObserver) OnSet(k, v []byte) {}
+
+// OnDel implements Observer.
+func (NopObserver) OnDel(k []byte) {}
+
+// OnEvict implements Observer.
+func (NopObserver) OnEvict(n int) {}
+
+// OnCollision implements Observer.
+func (NopObserver) OnCollision(k []byte) {}
+
+// OnCorruption implements Observer.
+func (NopObserver) OnCorruption() {}
+
+// OnSaveStart implements Observer.
+func (NopObserver) OnSaveStart(filePath string) {}
+
+// OnSaveFinish implements Observer.
+func (NopObserver) OnSaveFinish(filePath string, err error) {}
+
+// OnLoadStart implements Observer.
+func (NopObserver) OnLoadStart(filePath string) {}
+
+// OnLoadFinish implements Observer.
+func (NopObserver) OnLoadFinish(filePath string, err error) {}
+
+// StatsObserver is an Observer, which counts cache operations
+// in the same way as the counters exposed via Stats.
+//
+// It is safe to use a single StatsObserver for multiple caches.
+type StatsObserver struct {
+	NopObserver
+
+	getCalls    uint64
+	setCalls    uint64
+	misses      uint64
+	collisions  uint64
+	corruptions uint64
+}
+
+// OnGetHit implements Observer.
+func (so *StatsObserver) OnGetHit(k []byte) {
+	atomic.AddUint64(&so.getCalls, 1)
+}
+
+// OnGetMiss implements Observer.
+func (so *StatsObserver) OnGetMiss(k []byte) {
+	atomic.AddUint64(&so.getCalls, 1)
+	atomic.AddUint64(&so.misses, 1)
+}
+
+// OnSet implements Observer.
+func (so *StatsObserver) OnSet(k, v []byte) {
+	atomic.AddUint64(&so.setCalls, 1)
+}
+
+// OnCollision implements Observer.
+func (so *StatsObserver) OnCollision(k []byte) {
+	atomic.AddUint64(&so.collisions, 1)
+}
+
+// OnCorruption implements Observer.
+func (so *StatsObserver) OnCorruption() {
+	atomic.AddUint64(&so.corruptions, 1)
+}
+
+// UpdateStats adds the counters collected by so to s.
+//
+// Only GetCalls, SetCalls, Misses, Collisions and Corruptions are updated.
+func (so *StatsObserver) UpdateStats(s *Stats) {
+	s.GetCalls += atomic.LoadUint64(&so.getCalls)
+	s.SetCalls += atomic.LoadUint64(&so.setCalls)
+	s.Misses += atomic.LoadUint64(&so.misses)
+	s.Collisions += atomic.LoadUint64(&so.collisions)
+	s.Corruptions += atomic.LoadUint64(&so.corruptions)
+}
+
+// Reset resets all the counters in so.
+func (so *StatsObserver) Reset() {
+	atomic.StoreUint64(&so.getCalls, 0)
+	atomic.StoreUint64(&so.setCalls, 0)
+	atomic.StoreUint64(&so.misses, 0)
+	atomic.StoreUint64(&so.collisions, 0)
+	atomic.StoreUint64(&so.corruptions, 0)
+}
@@ -0,0 +1,296 @@
+package fastcache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type testObserver struct {
+	NopObserver
+
+	mu         sync.Mutex
+	hits       int
+	misses     int
+	sets       int
+	dels       int
+	evicted    int
+	saveStarts int
+	saveErrs   []error
+	loadStarts int
+	loadErrs   []error
+}
+
+func (to *testObserver) OnGetHit(k []byte) {
+	to.mu.Lock()
+	to.hits++
+	to.mu.Unlock()
+}
+
+func (to *testObserver) OnGetMiss(k []byte) {
+	to.mu.Lock()
+	to.misses++
+	to.mu.Unlock()
+}
+
+func (to *testObserver) OnSet(k, v []byte) {
+	to.mu.Lock()
+	to.sets++
+	to.mu.Unlock()
+}
+
+func (to *testObserver) OnDel(k []byte) {
+	to.mu.Lock()
+	to.dels++
+	to.mu.Unlock()
+}
+
+func (to *testObserver) OnEvict(n int) {
+	to.mu.Lock()
+	to.evicted += n
+	to.mu.Unlock()
+}
+
+func (to *testObserver) OnSaveStart(filePath string) {
+	to.mu.Lock()
+	to.saveStarts++
+	to.mu.Unlock()
+}
+
+func (to *testObserver) OnSaveFinish(filePath string, err error) {
+	to.mu.Lock()
+	to.saveErrs = append(to.saveErrs, err)
+	to.mu.Unlock()
+}
+
+func (to *testObserver) OnLoadStart(filePath string) {
+	to.mu.Lock()
+	to.loadStarts++
+	to.mu.Unlock()
+}
+
+func (to *testObserver) OnLoadFinish(filePath string, err error) {
+	to.mu.Lock()
+	to.loadErrs = append(to.loadErrs, err)
+	to.mu.Unlock()
+}
+
+func TestObserver(t *testing.T) {
+	var to testObserver
+	c, err := NewFromConfig(&Config{
+		MaxBytes: 1,
+		Observer: &to,
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+
+	const itemsCount = 100
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		c.Set(k, v)
+	}
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if !c.Has(k) {
+			t.Fatalf("cannot find key %q", k)
+		}
+		c.Del(k)
+		if c.Has(k) {
+			t.Fatalf("unexpected key %q found after deletion", k)
+		}
+	}
+	if to.sets != itemsCount {
+		t.Fatalf("unexpected number of sets; got %d; want %d", to.sets, itemsCount)
+	}
+	if to.dels != itemsCount {
+		t.Fatalf("unexpected number of dels; got %d; want %d", to.dels, itemsCount)
+	}
+	if to.hits != itemsCount {
+		t.Fatalf("unexpected number of hits; got %d; want %d", to.hits, itemsCount)
+	}
+	if to.misses != itemsCount {
+		t.Fatalf("unexpected number of misses; got %d; want %d", to.misses, itemsCount)
+	}
+
+	// Overflow the cache in order to trigger evictions.
+	v := make([]byte, 1024)
+	for i := range 2 * bucketsCount * chunkSize / len(v) {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), v)
+	}
+	if to.evicted == 0 {
+		t.Fatalf("expecting non-zero number of evicted entries")
+	}
+}
+
+func TestObserverSaveLoad(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filePath := filepath.Join(tmpDir, "TestObserverSaveLoad.fastcache")
+
+	var to testObserver
+	c, err := NewFromConfig(&Config{
+		MaxBytes: 1,
+		Observer: &to,
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	if to.saveStarts != 1 || len(to.saveErrs) != 1 || to.saveErrs[0] != nil {
+		t.Fatalf("unexpected save notifications; starts=%d, errs=%v", to.saveStarts, to.saveErrs)
+	}
+
+	var toLoad testObserver
+	c1, err := LoadFromFileConfig(filePath, &Config{
+		Observer: &toLoad,
+	})
+	if err != nil {
+		t.Fatalf("LoadFromFileConfig error: %s", err)
+	}
+	defer c1.Reset()
+	if toLoad.loadStarts != 1 || len(toLoad.loadErrs) != 1 || toLoad.loadErrs[0] != nil {
+		t.Fatalf("unexpected load notifications; starts=%d, errs=%v", toLoad.loadStarts, toLoad.loadErrs)
+	}
+	if v := c1.Get(nil, []byte("foo")); string(v) != "bar" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "bar")
+	}
+	if toLoad.hits != 1 {
+		t.Fatalf("unexpected number of hits on the loaded cache; got %d; want 1", toLoad.hits)
+	}
+
+	// Verify the error is passed to OnLoadFinish.
+	toLoad = testObserver{}
+	if _, err := LoadFromFileConfig(filepath.Join(tmpDir, "non-existing"), &Config{Observer: &toLoad}); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if toLoad.loadStarts != 1 || len(toLoad.loadErrs) != 1 || toLoad.loadErrs[0] == nil {
+		t.Fatalf("unexpected load notifications; starts=%d, errs=%v", toLoad.loadStarts, toLoad.loadErrs)
+	}
+}
+
+func TestStatsObserver(t *testing.T) {
+	var so StatsObserver
+	c, err := NewFromConfig(&Config{
+		MaxBytes: 1024 * 1024,
+		Observer: &so,
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+
+	for i := range 10000 {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		c.Set(k, v)
+		_ = c.Get(nil, k)
+		_ = c.Get(nil, v)
+	}
+
+	var s, sObserver Stats
+	c.UpdateStats(&s)
+	so.UpdateStats(&sObserver)
+	if sObserver.GetCalls != s.GetCalls {
+		t.Fatalf("unexpected GetCalls; got %d; want %d", sObserver.GetCalls, s.GetCalls)
+	}
+	if sObserver.SetCalls != s.SetCalls {
+		t.Fatalf("unexpected SetCalls; got %d; want %d", sObserver.SetCalls, s.SetCalls)
+	}
+	if sObserver.Misses != s.Misses {
+		t.Fatalf("unexpected Misses; got %d; want %d", sObserver.Misses, s.Misses)
+	}
+	if sObserver.Collisions != s.Collisions {
+		t.Fatalf("unexpected Collisions; got %d; want %d", sObserver.Collisions, s.Collisions)
+	}
+
+	so.Reset()
+	sObserver.Reset()
+	so.UpdateStats(&sObserver)
+	if sObserver.GetCalls != 0 || sObserver.SetCalls != 0 || sObserver.Misses != 0 {
+		t.Fatalf("unexpected non-zero stats after Reset: %+v", sObserver)
+	}
+}
+
+func TestNewFromConfigInvalidMaxBytes(t *testing.T) {
+	c, err := NewFromConfig(&Config{})
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if c != nil {
+		t.Fatalf("expecting nil cache")
+	}
+}
+
+func TestObserverSaveWriteTo(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filePath := filepath.Join(tmpDir, "TestObserverSaveWriteTo.fastcache")
+
+	var to testObserver
+	c, err := NewFromConfig(&Config{
+		MaxBytes: 1,
+		Observer: &to,
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	var bb bytes.Buffer
+	if _, err := c.WriteTo(&bb); err != nil {
+		t.Fatalf("WriteTo error: %s", err)
+	}
+	if to.saveStarts != 2 || len(to.saveErrs) != 2 || to.saveErrs[0] != nil || to.saveErrs[1] != nil {
+		t.Fatalf("unexpected save notifications; starts=%d, errs=%v", to.saveStarts, to.saveErrs)
+	}
+
+	// Verify the error is passed to OnSaveFinish.
+	if _, err := c.WriteTo(failingWriter{}); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if to.saveStarts != 3 || len(to.saveErrs) != 3 || to.saveErrs[2] == nil {
+		t.Fatalf("unexpected save notifications; starts=%d, errs=%v", to.saveStarts, to.saveErrs)
+	}
+
+	var toLoad testObserver
+	c1, err := ReadFromConfig(&bb, &Config{
+		MaxBytes: 1,
+		Observer: &toLoad,
+	})
+	if err != nil {
+		t.Fatalf("ReadFromConfig error: %s", err)
+	}
+	defer c1.Reset()
+	if toLoad.loadStarts != 1 || len(toLoad.loadErrs) != 1 || toLoad.loadErrs[0] != nil {
+		t.Fatalf("unexpected load notifications; starts=%d, errs=%v", toLoad.loadStarts, toLoad.loadErrs)
+	}
+	if v := c1.Get(nil, []byte("foo")); string(v) != "bar" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "bar")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("write error")
+}
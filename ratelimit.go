@@ -0,0 +1,71 @@
+package fastcache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the rate of bytes written by concurrent writers.
+type rateLimiter struct {
+	bytesPerSecond int64
+
+	mu sync.Mutex
+
+	// next is the time when the next write may start.
+	next time.Time
+}
+
+// newRateLimiter returns rate limiter for the given bytesPerSecond.
+//
+// nil is returned if bytesPerSecond <= 0, which means no rate limit.
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		bytesPerSecond: bytesPerSecond,
+	}
+}
+
+// wait blocks until n bytes may be written or ctx is done.
+func (rl *rateLimiter) wait(ctx context.Context, n int) error {
+	d := time.Duration(float64(n) / float64(rl.bytesPerSecond) * float64(time.Second))
+
+	rl.mu.Lock()
+	now := time.Now()
+	start := rl.next
+	if start.Before(now) {
+		start = now
+	}
+	rl.next = start.Add(d)
+	rl.mu.Unlock()
+
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitedWriter writes to w at the rate limited by rl.
+type rateLimitedWriter struct {
+	w   io.Writer
+	rl  *rateLimiter
+	ctx context.Context
+}
+
+func (rw *rateLimitedWriter) Write(p []byte) (int, error) {
+	if err := rw.rl.wait(rw.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return rw.w.Write(p)
+}
@@ -0,0 +1,57 @@
+package fastcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if rl := newRateLimiter(0); rl != nil {
+		t.Fatalf("expecting nil rate limiter for zero rate")
+	}
+	var bb bytes.Buffer
+	if w := newIOControl(context.Background(), 0, nil).writer(&bb); w != &bb {
+		t.Fatalf("expecting the original writer for zero rate")
+	}
+
+	const bytesPerSecond = 4 << 20
+	w := newIOControl(context.Background(), bytesPerSecond, nil).writer(&bb)
+	data := make([]byte, chunkSize)
+	startTime := time.Now()
+	for range 17 {
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	// The first write isn't delayed, so 16 writes must be delayed by 250ms in total.
+	if d := time.Since(startTime); d < 200*time.Millisecond {
+		t.Fatalf("too fast writes; got %s; want at least %s", d, 250*time.Millisecond)
+	}
+	if bb.Len() != 17*len(data) {
+		t.Fatalf("unexpected number of written bytes; got %d; want %d", bb.Len(), 17*len(data))
+	}
+}
+
+func TestSaveToFileRateLimit(t *testing.T) {
+	c := New(1)
+	defer c.Reset()
+	for i := range 10 {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte("value"))
+	}
+
+	// Every non-empty bucket is saved with a 64KB chunk, so the snapshot is bigger than 512KB.
+	opts := &SaveOptions{
+		Codec:             CodecNone,
+		MaxBytesPerSecond: 1 << 20,
+	}
+	startTime := time.Now()
+	if err := c.SaveToFileOptions(t.TempDir()+"/snapshot", opts); err != nil {
+		t.Fatalf("SaveToFileOptions error: %s", err)
+	}
+	if d := time.Since(startTime); d < 300*time.Millisecond {
+		t.Fatalf("too fast save; got %s; want at least %s", d, 300*time.Millisecond)
+	}
+}
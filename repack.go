@@ -0,0 +1,147 @@
+package fastcache
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// LoadFromFileRepack loads cache data from the given filePath into the cache
+// with maxBytes capacity.
+//
+// If the capacity of the saved cache differs from maxBytes, then the entries
+// of every bucket are re-packed into the new capacity. The newest entries
+// are kept if all the entries don't fit the new capacity.
+// The number of dropped entries is reported in Stats.RepackDroppedEntries.
+//
+// See also LoadFromFileMaxBytes, which returns an error on capacity mismatch.
+func LoadFromFileRepack(filePath string, maxBytes int) (*Cache, error) {
+	maxBucketChunks, err := maxBucketChunksForBytes(maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	c, sh, err := loadSnapshotFile(filePath, 0, false, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if sh.maxBucketChunks == maxBucketChunks {
+		return c, nil
+	}
+	dropped := 0
+	for i := range c.buckets[:] {
+		dropped += c.buckets[i].repack(maxBucketChunks)
+	}
+	atomic.StoreUint64(&c.repackDroppedEntries, uint64(dropped))
+	return c, nil
+}
+
+// maxBucketChunksForBytes returns the number of chunks per bucket for the cache with maxBytes capacity.
+func maxBucketChunksForBytes(maxBytes int) (uint64, error) {
+	if maxBytes <= 0 {
+		return 0, fmt.Errorf("maxBytes must be greater than 0; got %d", maxBytes)
+	}
+	maxBucketBytes := uint64((maxBytes + bucketsCount - 1) / bucketsCount)
+	if maxBucketBytes >= maxBucketSize {
+		return 0, fmt.Errorf("too big maxBytes=%d; should be smaller than %d", maxBytes, maxBucketSize*bucketsCount)
+	}
+	return (maxBucketBytes + chunkSize - 1) / chunkSize, nil
+}
+
+// bucketEntry is an entry in the bucket chunks.
+type bucketEntry struct {
+	h uint64
+
+	// idx points to the entry in the bucket chunks.
+	idx uint64
+
+	// order is the write order of the entry in the bucket.
+	order uint64
+}
+
+// entriesLocked returns entries from b sorted in the order they were written to b.
+//
+// b.m must be cleaned before the call.
+func (b *bucket) entriesLocked() []bucketEntry {
+	bGen := b.gen & ((1 << genSizeBits) - 1)
+	ringSize := uint64(len(b.chunks)) * chunkSize
+	entries := make([]bucketEntry, 0, len(b.m))
+	for h, v := range b.m {
+		gen := v >> bucketSizeBits
+		idx := v & ((1 << bucketSizeBits) - 1)
+		order := idx
+		if gen == bGen {
+			// Entries from the current generation are newer than entries from the previous generation.
+			order += ringSize
+		}
+		entries = append(entries, bucketEntry{
+			h:     h,
+			idx:   idx,
+			order: order,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].order < entries[j].order
+	})
+	return entries
+}
+
+// repack re-packs entries from b into a new ring buffer with maxChunks chunks.
+//
+// Entries are written to the new ring buffer in the order they were written to b,
+// so the oldest entries are overwritten if all the entries don't fit.
+//
+// It returns the number of dropped entries.
+func (b *bucket) repack(maxChunks uint64) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cleanLocked()
+	entries := b.entriesLocked()
+
+	chunks := b.chunks
+	b.chunks = make([][]byte, maxChunks)
+	b.dirtyChunks = make([]bool, maxChunks)
+	b.m = make(map[uint64]uint64, len(entries))
+	b.idx = 0
+	b.gen = 1
+	for _, e := range entries {
+		k, v, ok := readChunksEntry(chunks, e.idx)
+		if !ok {
+			// Corrupted data loaded from file. Drop the entry.
+			continue
+		}
+		b.setLocked(k, v, e.h)
+	}
+	// Remove entries for the overwritten chunks, so len(b.m) contains only the kept entries.
+	b.cleanLocked()
+	for i := range chunks {
+		b.putChunk(chunks[i])
+	}
+	return len(entries) - len(b.m)
+}
+
+// readChunksEntry returns (k, v) pair stored at idx in chunks.
+//
+// false is returned if the data at idx is corrupted.
+func readChunksEntry(chunks [][]byte, idx uint64) ([]byte, []byte, bool) {
+	chunkIdx := idx / chunkSize
+	if chunkIdx >= uint64(len(chunks)) {
+		return nil, nil, false
+	}
+	// The entry may be located beyond len(chunk) if the chunk is partially overwritten.
+	chunk := chunks[chunkIdx]
+	chunk = chunk[:cap(chunk)]
+	idx %= chunkSize
+	if idx+4 > uint64(len(chunk)) {
+		return nil, nil, false
+	}
+	kvLenBuf := chunk[idx : idx+4]
+	keyLen := (uint64(kvLenBuf[0]) << 8) | uint64(kvLenBuf[1])
+	valLen := (uint64(kvLenBuf[2]) << 8) | uint64(kvLenBuf[3])
+	idx += 4
+	if idx+keyLen+valLen > uint64(len(chunk)) {
+		return nil, nil, false
+	}
+	return chunk[idx : idx+keyLen], chunk[idx+keyLen : idx+keyLen+valLen], true
+}
@@ -0,0 +1,105 @@
+package fastcache
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadFromFileRepack(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	const maxBytes = bucketsCount * chunkSize * 4
+	c := New(maxBytes)
+	defer c.Reset()
+
+	// Fill the cache, so the ring buffers in buckets are wrapped.
+	const itemsCount = 200000
+	value := make([]byte, 1000)
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		c.Set(k, append(k, value...))
+	}
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	checkEntries := func(c *Cache, n int) {
+		t.Helper()
+		for i := itemsCount - n; i < itemsCount; i++ {
+			k := []byte(fmt.Sprintf("key %d", i))
+			if v := c.Get(nil, k); string(v) != string(k)+string(value) {
+				t.Fatalf("unexpected value for key %q; got %d bytes; want %d bytes", k, len(v), len(k)+len(value))
+			}
+		}
+	}
+
+	// The same capacity.
+	c1, err := LoadFromFileRepack(filePath, maxBytes)
+	if err != nil {
+		t.Fatalf("LoadFromFileRepack error: %s", err)
+	}
+	var s1 Stats
+	c1.UpdateStats(&s1)
+	if s1.RepackDroppedEntries != 0 {
+		t.Fatalf("unexpected dropped entries for the same capacity: %d", s1.RepackDroppedEntries)
+	}
+	entriesCount := s1.EntriesCount
+	if entriesCount >= itemsCount {
+		t.Fatalf("the cache must be overflown; got %d entries", entriesCount)
+	}
+	checkEntries(c1, int(entriesCount)/2)
+	c1.Reset()
+
+	f := func(maxBytesNew int) (*Cache, *Stats) {
+		t.Helper()
+		c1, err := LoadFromFileRepack(filePath, maxBytesNew)
+		if err != nil {
+			t.Fatalf("LoadFromFileRepack error: %s", err)
+		}
+		var s Stats
+		c1.UpdateStats(&s)
+		if s.MaxBytesSize != uint64(maxBytesNew) {
+			t.Fatalf("unexpected MaxBytesSize; got %d; want %d", s.MaxBytesSize, maxBytesNew)
+		}
+		if s.EntriesCount+s.RepackDroppedEntries != entriesCount {
+			t.Fatalf("unexpected number of entries; got %d entries and %d dropped entries; want %d entries in total",
+				s.EntriesCount, s.RepackDroppedEntries, entriesCount)
+		}
+		return c1, &s
+	}
+
+	// Bigger capacity. All the entries must be kept.
+	c2, s2 := f(maxBytes * 2)
+	if s2.RepackDroppedEntries != 0 {
+		t.Fatalf("unexpected dropped entries for bigger capacity: %d", s2.RepackDroppedEntries)
+	}
+	checkEntries(c2, int(entriesCount)/2)
+	c2.Reset()
+
+	// Smaller capacity. The newest entries must be kept.
+	c3, s3 := f(maxBytes / 4)
+	if s3.RepackDroppedEntries == 0 {
+		t.Fatalf("expecting dropped entries for smaller capacity")
+	}
+	checkEntries(c3, int(s3.EntriesCount)/2)
+	// The cache must remain usable after re-packing.
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("new key %d", i))
+		c3.Set(k, k)
+	}
+	checkNew := []byte(fmt.Sprintf("new key %d", itemsCount-1))
+	if v := c3.Get(nil, checkNew); string(v) != string(checkNew) {
+		t.Fatalf("unexpected value for key %q; got %q", checkNew, v)
+	}
+	c3.Reset()
+	var sReset Stats
+	c3.UpdateStats(&sReset)
+	if sReset.RepackDroppedEntries != 0 {
+		t.Fatalf("RepackDroppedEntries must be reset; got %d", sReset.RepackDroppedEntries)
+	}
+
+	// Invalid capacity.
+	if _, err := LoadFromFileRepack(filePath, 0); err == nil {
+		t.Fatalf("expecting non-nil error for zero maxBytes")
+	}
+}
@@ -0,0 +1,123 @@
+package fastcache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// LoadReport describes the cache data loaded by LoadFromFileWithReport.
+type LoadReport struct {
+	// BucketsRestored is the number of buckets restored from data files.
+	BucketsRestored int
+
+	// BucketsReset is the number of buckets, which were reset to the empty state,
+	// since they were missing or corrupted in data files.
+	BucketsReset int
+
+	// InvalidEntries is the number of dropped index entries, which point past valid chunks.
+	InvalidEntries uint64
+
+	// FailedFiles contains data files, which couldn't be loaded.
+	FailedFiles []FailedFile
+}
+
+// FailedFile describes the data file, which couldn't be loaded.
+type FailedFile struct {
+	// Name is the name of the data file.
+	Name string
+
+	// Err is the error occurred during loading the file.
+	Err error
+}
+
+// LoadFromFileWithReport loads cache data from the given filePath
+// and returns the report describing the loaded data.
+//
+// Unlike LoadFromFile, it doesn't fail on corrupted data files. Buckets from such files,
+// which couldn't be loaded, are reset to the empty state, while the rest of buckets
+// are restored. The failed files are listed in LoadReport.FailedFiles.
+//
+// An error is returned only if the snapshot metadata cannot be loaded.
+func LoadFromFileWithReport(filePath string) (*Cache, *LoadReport, error) {
+	var report LoadReport
+	c, _, err := loadSnapshotFile(filePath, 0, false, nil, nil, &report)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, &report, nil
+}
+
+// tolerantLoader returns loadFile, which registers failed files in report instead of returning errors.
+func (report *LoadReport) tolerantLoader(loadFile func(f *snapshotFile) error) func(f *snapshotFile) error {
+	var mu sync.Mutex
+	return func(f *snapshotFile) error {
+		if err := loadFile(f); err != nil {
+			mu.Lock()
+			report.FailedFiles = append(report.FailedFiles, FailedFile{
+				Name: f.name,
+				Err:  err,
+			})
+			mu.Unlock()
+		}
+		return nil
+	}
+}
+
+// unload releases the data loaded into b, so b is initialized as a missing bucket.
+//
+// b mustn't be used concurrently.
+func (b *bucket) unload() {
+	for _, chunk := range b.chunks {
+		b.putChunk(chunk)
+	}
+	b.chunks = nil
+	b.dirtyChunks = nil
+	b.m = nil
+	b.idx = 0
+	b.gen = 0
+}
+
+// verify drops index entries, which point past valid chunks in b.
+//
+// This prevents from lazy detection of corrupted entries in bucket.Get.
+// The number of dropped entries is added to Stats.Corruptions and is returned.
+//
+// b mustn't be used concurrently.
+func (b *bucket) verify() uint64 {
+	var dropped uint64
+	for h, v := range b.m {
+		idx := v & ((1 << bucketSizeBits) - 1)
+		if b.isValidEntryIdx(idx) {
+			continue
+		}
+		delete(b.m, h)
+		dropped++
+	}
+	atomic.AddUint64(&b.corruptions, dropped)
+	return dropped
+}
+
+// isValidEntryIdx returns true if the entry at idx fits the chunk it points to.
+//
+// The checks must be in sync with bucket.Get.
+func (b *bucket) isValidEntryIdx(idx uint64) bool {
+	chunkIdx := idx / chunkSize
+	if chunkIdx >= uint64(len(b.chunks)) {
+		return false
+	}
+	chunk := b.chunks[chunkIdx]
+	if chunk == nil {
+		return false
+	}
+	// The entry may be located beyond len(chunk) if the chunk is partially overwritten.
+	chunk = chunk[:cap(chunk)]
+	idx %= chunkSize
+	if idx+4 >= uint64(len(chunk)) {
+		return false
+	}
+	kvLenBuf := chunk[idx : idx+4]
+	keyLen := (uint64(kvLenBuf[0]) << 8) | uint64(kvLenBuf[1])
+	valLen := (uint64(kvLenBuf[2]) << 8) | uint64(kvLenBuf[3])
+	idx += 4
+	return idx+keyLen+valLen < uint64(len(chunk))
+}
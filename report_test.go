@@ -0,0 +1,154 @@
+package fastcache
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+func TestLoadFromFileWithReport(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	const itemsCount = 1000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	c1, report, err := LoadFromFileWithReport(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFileWithReport error: %s", err)
+	}
+	defer c1.Reset()
+	if report.BucketsRestored != bucketsCount || report.BucketsReset != 0 || report.InvalidEntries != 0 || len(report.FailedFiles) != 0 {
+		t.Fatalf("unexpected report for valid snapshot: %+v", report)
+	}
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		vExpected := fmt.Sprintf("value %d", i)
+		if v := c1.Get(nil, k); string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+
+	if _, _, err := LoadFromFileWithReport(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatalf("expecting non-nil error for missing snapshot")
+	}
+}
+
+func TestLoadFromFileWithReportChecksumMismatch(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	const itemsCount = 1000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	// Corrupt the checksum for the last bucket in the data file.
+	snapshotDir := mustResolveSnapshotDir(t, filePath)
+	sh, err := loadMetadata(NewFileSnapshotStore(snapshotDir))
+	if err != nil {
+		t.Fatalf("cannot load metadata: %s", err)
+	}
+	buckets := sh.files[0].buckets
+	corruptedBucketNum := buckets[len(buckets)-1].num
+	buckets[len(buckets)-1].crc++
+	if err := saveMetadata(sh, NewFileSnapshotStore(snapshotDir)); err != nil {
+		t.Fatalf("cannot save metadata: %s", err)
+	}
+
+	if _, err := LoadFromFile(filePath); err == nil {
+		t.Fatalf("expecting non-nil error for corrupted snapshot")
+	}
+	c1, report, err := LoadFromFileWithReport(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFileWithReport error: %s", err)
+	}
+	defer c1.Reset()
+	if report.BucketsRestored != bucketsCount-1 || report.BucketsReset != 1 {
+		t.Fatalf("unexpected number of restored and reset buckets: %+v", report)
+	}
+	if len(report.FailedFiles) != 1 || report.FailedFiles[0].Name != sh.files[0].name || report.FailedFiles[0].Err == nil {
+		t.Fatalf("unexpected failed files: %+v", report.FailedFiles)
+	}
+
+	// Entries from the restored buckets must be available, while the corrupted bucket must be empty.
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := c1.Get(nil, k)
+		if h := xxhash.Sum64(k); h%bucketsCount == corruptedBucketNum {
+			if len(v) > 0 {
+				t.Fatalf("unexpected value for key %q from the corrupted bucket: %q", k, v)
+			}
+			continue
+		}
+		if vExpected := fmt.Sprintf("value %d", i); string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+
+	// The reset bucket must be usable.
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("new key %d", i))
+		c1.Set(k, k)
+		if v := c1.Get(nil, k); string(v) != string(k) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, k)
+		}
+	}
+}
+
+func TestLoadFromFileWithReportInvalidEntries(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "snapshot")
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("key"), []byte("value"))
+
+	// Add live index entries pointing past the chunks of the bucket with the key.
+	b := &c.buckets[xxhash.Sum64([]byte("key"))%bucketsCount]
+	b.mu.Lock()
+	prevGen := (b.gen - 1) << bucketSizeBits
+	b.m[1] = prevGen | uint64(len(b.chunks))*chunkSize
+	b.m[2] = prevGen | (chunkSize - 2)
+	b.mu.Unlock()
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	c1, report, err := LoadFromFileWithReport(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFileWithReport error: %s", err)
+	}
+	defer c1.Reset()
+	if report.InvalidEntries != 2 {
+		t.Fatalf("unexpected InvalidEntries; got %d; want 2", report.InvalidEntries)
+	}
+	var s Stats
+	c1.UpdateStats(&s)
+	if s.Corruptions != 2 {
+		t.Fatalf("unexpected Corruptions; got %d; want 2", s.Corruptions)
+	}
+	if v := c1.Get(nil, []byte("key")); string(v) != "value" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "key", v, "value")
+	}
+
+	// Invalid entries must be dropped by the ordinary load too.
+	c2, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c2.Reset()
+	s.Reset()
+	c2.UpdateStats(&s)
+	if s.Corruptions != 2 {
+		t.Fatalf("unexpected Corruptions; got %d; want 2", s.Corruptions)
+	}
+}
@@ -0,0 +1,521 @@
+package fastcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SnapshotStore stores named objects for cache snapshots.
+//
+// Object names are slash-separated paths relative to the store root,
+// such as "version.0000000000000001/data.0.bin". They never start or end with a slash
+// and never contain "." or ".." elements.
+//
+// SaveToFile* and LoadFromFile* work with the store returned by NewFileSnapshotStore.
+// Use Cache.SaveToStore and LoadFromStore for saving and loading snapshots with other stores,
+// for example with object storage clients.
+//
+// SnapshotStore methods may be called concurrently.
+type SnapshotStore interface {
+	// Create creates the object with the given name and returns the writer for its contents.
+	//
+	// The existing object with the same name is replaced.
+	// The object contents must be durably stored when Close returns nil.
+	Create(name string) (io.WriteCloser, error)
+
+	// Open opens the object with the given name for reading.
+	//
+	// The returned error must wrap fs.ErrNotExist if the object doesn't exist.
+	Open(name string) (SnapshotObject, error)
+
+	// List returns sorted names of all the objects starting with the given prefix.
+	//
+	// The prefix isn't necessarily a whole path element.
+	List(prefix string) ([]string, error)
+
+	// Remove removes the object with the given name.
+	//
+	// It returns nil if the object doesn't exist.
+	Remove(name string) error
+
+	// Rename atomically renames the object with oldName to newName.
+	//
+	// The existing object with newName is replaced.
+	Rename(oldName, newName string) error
+}
+
+// SnapshotObject is the object opened by SnapshotStore.Open.
+type SnapshotObject interface {
+	io.ReadCloser
+
+	// Size returns the object size in bytes.
+	Size() int64
+}
+
+// SaveToStore atomically saves cache data to s using the given opts.
+//
+// The data is saved in the same layout as SaveToFile* uses inside filePath.
+// It may be loaded with LoadFromStore. Concurrent calls for the same s aren't supported.
+//
+// The save is cancelled when ctx is done. The previous snapshot in s
+// remains untouched in this case and ctx.Err() is returned.
+//
+// opts may be nil.
+func (c *Cache) SaveToStore(ctx context.Context, s SnapshotStore, opts *SaveOptions) error {
+	var o SaveOptions
+	if opts != nil {
+		o = *opts
+	}
+	return c.notifySave("", func() error {
+		return c.saveToStore(ctx, s, &o)
+	})
+}
+
+// LoadFromStore loads cache data saved by Cache.SaveToStore from s using the given opts.
+//
+// The load is cancelled when ctx is done. ctx.Err() is returned in this case.
+//
+// opts may be nil.
+func LoadFromStore(ctx context.Context, s SnapshotStore, opts *LoadOptions) (*Cache, error) {
+	var o LoadOptions
+	if opts != nil {
+		o = *opts
+	}
+	ic := newIOControl(ctx, 0, o.Progress)
+	c, _, err := loadSnapshot(s, o.MaxBytes, false, ic, o.EncryptionKeys, nil)
+	return c, err
+}
+
+// NewFileSnapshotStore returns SnapshotStore, which stores objects as files inside dir.
+//
+// Object names are mapped to file paths relative to dir. Missing directories are created
+// on demand, while directories left empty after removing objects are removed.
+// Files and directories are fsynced, so the stored objects persist on power loss.
+func NewFileSnapshotStore(dir string) SnapshotStore {
+	return &fileSnapshotStore{
+		dir: filepath.Clean(dir),
+	}
+}
+
+type fileSnapshotStore struct {
+	dir string
+}
+
+func (s *fileSnapshotStore) path(name string) (string, error) {
+	if err := validateObjectName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+func (s *fileSnapshotStore) Create(name string) (io.WriteCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := createDirSync(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileObjectWriter{
+		f: f,
+	}, nil
+}
+
+func (s *fileSnapshotStore) Open(name string) (SnapshotObject, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &fileObject{
+		File: f,
+		size: fi.Size(),
+	}, nil
+}
+
+func (s *fileSnapshotStore) List(prefix string) ([]string, error) {
+	// Walk only the dir containing the objects with the given prefix.
+	root := s.dir
+	if n := strings.LastIndexByte(prefix, '/'); n >= 0 {
+		root = filepath.Join(s.dir, filepath.FromSlash(prefix[:n]))
+	}
+	var names []string
+	err := filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !de.Type().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *fileSnapshotStore) Remove(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(s.removeEmptyDirs(filepath.Dir(path)))
+}
+
+// removeEmptyDirs removes dir and its parent dirs inside s while they are empty.
+//
+// It returns the dir containing the last removed dir.
+func (s *fileSnapshotStore) removeEmptyDirs(dir string) string {
+	for dir != s.dir && os.Remove(dir) == nil {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+func (s *fileSnapshotStore) Rename(oldName, newName string) error {
+	oldPath, err := s.path(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.path(newName)
+	if err != nil {
+		return err
+	}
+	newDir := filepath.Dir(newPath)
+	if err := createDirSync(newDir); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	if err := syncDir(newDir); err != nil {
+		return err
+	}
+	if oldDir := filepath.Dir(oldPath); oldDir != newDir {
+		return syncDir(s.removeEmptyDirs(oldDir))
+	}
+	return nil
+}
+
+// fileObjectWriter writes the object created by fileSnapshotStore.
+type fileObjectWriter struct {
+	f *os.File
+}
+
+func (w *fileObjectWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+// Close fsyncs the file and the dir containing it before closing the file.
+func (w *fileObjectWriter) Close() error {
+	if err := w.f.Sync(); err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(w.f.Name()))
+}
+
+// fileObject is the object opened by fileSnapshotStore.
+//
+// It exposes the underlying file, so it may be mapped into memory.
+type fileObject struct {
+	*os.File
+	size int64
+}
+
+func (fo *fileObject) Size() int64 {
+	return fo.size
+}
+
+// createDirSync creates dir with missing parent dirs if it doesn't exist
+// and persists the new dir entries in the parent dirs.
+func createDirSync(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("cannot stat %q: %s", dir, err)
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := createDirSync(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("cannot create dir %q: %s", dir, err)
+	}
+	return syncDir(parent)
+}
+
+// NewMemorySnapshotStore returns SnapshotStore, which keeps objects in memory.
+//
+// It is intended for tests.
+func NewMemorySnapshotStore() SnapshotStore {
+	return &memorySnapshotStore{
+		objects: make(map[string][]byte),
+	}
+}
+
+type memorySnapshotStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *memorySnapshotStore) Create(name string) (io.WriteCloser, error) {
+	if err := validateObjectName(name); err != nil {
+		return nil, err
+	}
+	return &memoryObjectWriter{
+		s:    s,
+		name: name,
+	}, nil
+}
+
+func (s *memorySnapshotStore) Open(name string) (SnapshotObject, error) {
+	if err := validateObjectName(name); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	data, ok := s.objects[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("cannot open %q: %w", name, fs.ErrNotExist)
+	}
+	return &memoryObject{
+		Reader: bytes.NewReader(data),
+	}, nil
+}
+
+func (s *memorySnapshotStore) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memorySnapshotStore) Remove(name string) error {
+	if err := validateObjectName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.objects, name)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memorySnapshotStore) Rename(oldName, newName string) error {
+	if err := validateObjectName(oldName); err != nil {
+		return err
+	}
+	if err := validateObjectName(newName); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[oldName]
+	if !ok {
+		return fmt.Errorf("cannot rename %q: %w", oldName, fs.ErrNotExist)
+	}
+	delete(s.objects, oldName)
+	s.objects[newName] = data
+	return nil
+}
+
+// memoryObjectWriter buffers the object contents until Close.
+type memoryObjectWriter struct {
+	s    *memorySnapshotStore
+	name string
+	buf  []byte
+}
+
+func (w *memoryObjectWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *memoryObjectWriter) Close() error {
+	w.s.mu.Lock()
+	w.s.objects[w.name] = w.buf
+	w.s.mu.Unlock()
+	w.buf = nil
+	return nil
+}
+
+type memoryObject struct {
+	*bytes.Reader
+}
+
+func (mo *memoryObject) Close() error {
+	return nil
+}
+
+func validateObjectName(name string) error {
+	if name == "." || !fs.ValidPath(name) {
+		return fmt.Errorf("invalid object name %q", name)
+	}
+	return nil
+}
+
+// prefixStore provides access to the objects in s with names starting with prefix.
+type prefixStore struct {
+	s      SnapshotStore
+	prefix string
+}
+
+// subStore returns the store for the objects inside dir in s.
+func subStore(s SnapshotStore, dir string) SnapshotStore {
+	if ps, ok := s.(*prefixStore); ok {
+		return &prefixStore{
+			s:      ps.s,
+			prefix: ps.prefix + dir + "/",
+		}
+	}
+	return &prefixStore{
+		s:      s,
+		prefix: dir + "/",
+	}
+}
+
+func (ps *prefixStore) Create(name string) (io.WriteCloser, error) {
+	return ps.s.Create(ps.prefix + name)
+}
+
+func (ps *prefixStore) Open(name string) (SnapshotObject, error) {
+	return ps.s.Open(ps.prefix + name)
+}
+
+func (ps *prefixStore) List(prefix string) ([]string, error) {
+	names, err := ps.s.List(ps.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		names[i] = strings.TrimPrefix(name, ps.prefix)
+	}
+	return names, nil
+}
+
+func (ps *prefixStore) Remove(name string) error {
+	return ps.s.Remove(ps.prefix + name)
+}
+
+func (ps *prefixStore) Rename(oldName, newName string) error {
+	return ps.s.Rename(ps.prefix+oldName, ps.prefix+newName)
+}
+
+// readObject reads the object with the given name from s.
+//
+// The object cannot exceed maxSize bytes.
+func readObject(s SnapshotStore, name string, maxSize int64) ([]byte, error) {
+	obj, err := s.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q: %w", name, err)
+	}
+	defer func() {
+		_ = obj.Close()
+	}()
+	data, err := io.ReadAll(io.LimitReader(obj, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", name, err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("too big %q; it cannot exceed %d bytes", name, maxSize)
+	}
+	return data, nil
+}
+
+// writeObjectAtomic atomically and durably writes data to the object with the given name in s.
+//
+// The object is written under a temporary name and then renamed,
+// so readers never observe partially written object.
+func writeObjectAtomic(s SnapshotStore, name string, data []byte) error {
+	tmpName := name + ".tmp"
+	w, err := s.Create(tmpName)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %w", tmpName, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("cannot write data to %q: %w", tmpName, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot close %q: %w", tmpName, err)
+	}
+	if err := s.Rename(tmpName, name); err != nil {
+		return fmt.Errorf("cannot rename %q to %q: %w", tmpName, name, err)
+	}
+	return nil
+}
+
+// objectExists returns true if the object with the given name exists in s.
+func objectExists(s SnapshotStore, name string) bool {
+	obj, err := s.Open(name)
+	if err != nil {
+		return false
+	}
+	_ = obj.Close()
+	return true
+}
+
+// removeObjects removes all the objects inside dir in s.
+func removeObjects(s SnapshotStore, dir string) error {
+	names, err := s.List(dir + "/")
+	if err != nil {
+		return fmt.Errorf("cannot list objects inside %q: %w", dir, err)
+	}
+	for _, name := range names {
+		if err := s.Remove(name); err != nil {
+			return fmt.Errorf("cannot remove %q: %w", name, err)
+		}
+	}
+	return nil
+}
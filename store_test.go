@@ -0,0 +1,225 @@
+package fastcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoadStore(t *testing.T) {
+	for _, codec := range []Codec{CodecSnappy, CodecNone, CodecFlate, CodecMmap} {
+		t.Run(codec.String(), func(t *testing.T) {
+			testSaveLoadStore(t, codec)
+		})
+	}
+}
+
+func testSaveLoadStore(t *testing.T, codec Codec) {
+	const itemsCount = 10000
+	c := New(1)
+	defer c.Reset()
+	s := NewMemorySnapshotStore()
+	for n := range 3 {
+		for i := range itemsCount {
+			k := []byte(fmt.Sprintf("key %d", i))
+			v := []byte(fmt.Sprintf("value %d %d", n, i))
+			c.Set(k, v)
+		}
+		opts := &SaveOptions{
+			Concurrency: 3,
+			Codec:       codec,
+		}
+		if err := c.SaveToStore(context.Background(), s, opts); err != nil {
+			t.Fatalf("SaveToStore error: %s", err)
+		}
+
+		// Only the current snapshot must remain in s.
+		name, err := readCurrentSnapshotName(s)
+		if err != nil {
+			t.Fatalf("cannot read the current snapshot name: %s", err)
+		}
+		names, err := s.List("")
+		if err != nil {
+			t.Fatalf("List error: %s", err)
+		}
+		for _, objectName := range names {
+			if objectName != currentSnapshotFilename && !strings.HasPrefix(objectName, name+"/") {
+				t.Fatalf("unexpected object %q left in the store; current snapshot is %q", objectName, name)
+			}
+		}
+
+		c1, err := LoadFromStore(context.Background(), s, nil)
+		if err != nil {
+			t.Fatalf("LoadFromStore error: %s", err)
+		}
+		for i := range itemsCount {
+			k := []byte(fmt.Sprintf("key %d", i))
+			vExpected := fmt.Sprintf("value %d %d", n, i)
+			if v := c1.Get(nil, k); string(v) != vExpected {
+				c1.Reset()
+				t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+			}
+		}
+		c1.Reset()
+	}
+}
+
+func TestSaveToStoreCancelled(t *testing.T) {
+	c := New(1)
+	defer c.Reset()
+	s := NewMemorySnapshotStore()
+	c.Set([]byte("key"), []byte("value"))
+	if err := c.SaveToStore(context.Background(), s, nil); err != nil {
+		t.Fatalf("SaveToStore error: %s", err)
+	}
+	namesExpected, err := s.List("")
+	if err != nil {
+		t.Fatalf("List error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Set([]byte("key"), []byte("new value"))
+	if err := c.SaveToStore(ctx, s, &SaveOptions{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.Canceled)
+	}
+	names, err := s.List("")
+	if err != nil {
+		t.Fatalf("List error: %s", err)
+	}
+	if fmt.Sprint(names) != fmt.Sprint(namesExpected) {
+		t.Fatalf("unexpected objects after the cancelled save; got %q; want %q", names, namesExpected)
+	}
+	c1, err := LoadFromStore(context.Background(), s, nil)
+	if err != nil {
+		t.Fatalf("LoadFromStore error: %s", err)
+	}
+	defer c1.Reset()
+	if v := c1.Get(nil, []byte("key")); string(v) != "value" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "value")
+	}
+}
+
+func TestLoadFromStoreEmpty(t *testing.T) {
+	_, err := LoadFromStore(context.Background(), NewMemorySnapshotStore(), nil)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected error; got %v; want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "store")
+		testSnapshotStore(t, NewFileSnapshotStore(dir))
+
+		// Dirs must be removed together with the last object inside them.
+		des, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("cannot read %q: %s", dir, err)
+		}
+		if len(des) != 0 {
+			t.Fatalf("unexpected entries left in %q: %d", dir, len(des))
+		}
+	})
+	t.Run("memory", func(t *testing.T) {
+		testSnapshotStore(t, NewMemorySnapshotStore())
+	})
+}
+
+func testSnapshotStore(t *testing.T, s SnapshotStore) {
+	t.Helper()
+
+	writeObject := func(name, data string) {
+		t.Helper()
+		w, err := s.Create(name)
+		if err != nil {
+			t.Fatalf("cannot create %q: %s", name, err)
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			t.Fatalf("cannot write %q: %s", name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("cannot close %q: %s", name, err)
+		}
+	}
+	checkObject := func(name, dataExpected string) {
+		t.Helper()
+		obj, err := s.Open(name)
+		if err != nil {
+			t.Fatalf("cannot open %q: %s", name, err)
+		}
+		defer obj.Close()
+		if n := obj.Size(); n != int64(len(dataExpected)) {
+			t.Fatalf("unexpected size for %q; got %d; want %d", name, n, len(dataExpected))
+		}
+		data, err := io.ReadAll(obj)
+		if err != nil {
+			t.Fatalf("cannot read %q: %s", name, err)
+		}
+		if string(data) != dataExpected {
+			t.Fatalf("unexpected contents of %q; got %q; want %q", name, data, dataExpected)
+		}
+	}
+	checkList := func(prefix string, namesExpected ...string) {
+		t.Helper()
+		names, err := s.List(prefix)
+		if err != nil {
+			t.Fatalf("cannot list %q: %s", prefix, err)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(namesExpected) {
+			t.Fatalf("unexpected objects for prefix %q; got %q; want %q", prefix, names, namesExpected)
+		}
+	}
+
+	checkList("")
+	if _, err := s.Open("foo"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected error for missing object; got %v; want %v", err, fs.ErrNotExist)
+	}
+	for _, name := range []string{"", ".", "/foo", "foo/", "foo/../bar", "./foo"} {
+		if _, err := s.Create(name); err == nil {
+			t.Fatalf("expecting non-nil error for invalid name %q", name)
+		}
+	}
+
+	writeObject("foo", "bar")
+	writeObject("a/b/c", "abc")
+	writeObject("a/d", "ad")
+	writeObject("a.b", "a.b")
+	checkObject("foo", "bar")
+	checkObject("a/b/c", "abc")
+	checkList("", "a.b", "a/b/c", "a/d", "foo")
+	checkList("a/", "a/b/c", "a/d")
+	checkList("a/b", "a/b/c")
+	checkList("a", "a.b", "a/b/c", "a/d")
+	checkList("missing/")
+
+	// Overwrite the object.
+	writeObject("foo", "new bar")
+	checkObject("foo", "new bar")
+
+	if err := s.Rename("a/b/c", "x/y"); err != nil {
+		t.Fatalf("cannot rename: %s", err)
+	}
+	checkObject("x/y", "abc")
+	if err := s.Rename("foo", "x/y"); err != nil {
+		t.Fatalf("cannot rename: %s", err)
+	}
+	checkObject("x/y", "new bar")
+	checkList("", "a.b", "a/d", "x/y")
+	if err := s.Rename("missing", "foo"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected error for renaming missing object; got %v; want %v", err, fs.ErrNotExist)
+	}
+
+	for _, name := range []string{"a.b", "a/d", "x/y", "missing"} {
+		if err := s.Remove(name); err != nil {
+			t.Fatalf("cannot remove %q: %s", name, err)
+		}
+	}
+	checkList("")
+}
@@ -0,0 +1,203 @@
+package fastcache
+
+import (
+	"fmt"
+	"io"
+)
+
+// streamMagic is written at the beginning of the stream produced by Cache.WriteTo.
+const streamMagic = "FCSTRM\x00\x01"
+
+// streamEndMarker is written instead of bucket number after the last bucket in the stream.
+//
+// It allows detecting truncated streams.
+const streamEndMarker = ^uint64(0)
+
+// maxStreamMetadataSize is the maximum size of metadata in the stream.
+const maxStreamMetadataSize = 1024 * 1024
+
+// WriteTo writes cache data to w as a single self-describing stream.
+//
+// The stream contains the cache metadata followed by all the buckets.
+// It may be written to any destination such as object storage or a pipe
+// and then loaded with ReadFrom.
+//
+// WriteTo may be called concurrently with other operations on the cache.
+//
+// WriteTo returns the number of bytes written to w.
+func (c *Cache) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{
+		w: w,
+	}
+	err := c.notifySave("", func() error {
+		return c.writeStream(cw)
+	})
+	return int64(cw.n), err
+}
+
+func (c *Cache) writeStream(w io.Writer) error {
+	sh := newSnapshotHeader(uint64(cap(c.buckets[0].chunks)))
+	metadata := sh.Marshal(nil)
+	if _, err := io.WriteString(w, streamMagic); err != nil {
+		return fmt.Errorf("cannot write stream magic: %w", err)
+	}
+	if err := writeUint64(w, uint64(len(metadata))); err != nil {
+		return fmt.Errorf("cannot write metadata length: %w", err)
+	}
+	if _, err := w.Write(metadata); err != nil {
+		return fmt.Errorf("cannot write metadata: %w", err)
+	}
+
+	zw, err := newCodecWriter(sh.codec, w)
+	if err != nil {
+		return err
+	}
+	cw := &crcWriter{
+		w: zw,
+	}
+	for bucketNum := range c.buckets[:] {
+		if err := writeUint64(zw, uint64(bucketNum)); err != nil {
+			return fmt.Errorf("cannot write bucketNum=%d: %w", bucketNum, err)
+		}
+		cw.crc = 0
+		if err := c.buckets[bucketNum].Save(cw); err != nil {
+			return fmt.Errorf("cannot save bucket[%d]: %w", bucketNum, err)
+		}
+		if err := writeUint64(zw, uint64(cw.crc)); err != nil {
+			return fmt.Errorf("cannot write checksum for bucket[%d]: %w", bucketNum, err)
+		}
+	}
+	if err := writeUint64(zw, streamEndMarker); err != nil {
+		return fmt.Errorf("cannot write end marker: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("cannot close %s writer: %w", sh.codec, err)
+	}
+	return nil
+}
+
+// ReadFrom reads cache data from the stream written by Cache.WriteTo.
+//
+// ReadFrom may read more data from r than the stream contains,
+// so r shouldn't contain other data after the stream.
+func ReadFrom(r io.Reader) (*Cache, error) {
+	var c Cache
+	if err := c.readStream(r); err != nil {
+		c.Reset()
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ReadFromConfig reads cache data from the stream written by Cache.WriteTo
+// and applies the given cfg to the loaded cache.
+//
+// cfg.MaxBytes is enforced in the same way as in LoadFromFileMaxBytes
+// if it is greater than 0.
+//
+// See ReadFrom for details.
+func ReadFromConfig(r io.Reader, cfg *Config) (*Cache, error) {
+	var c *Cache
+	err := notifyLoad(cfg.Observer, "", func() error {
+		var err error
+		c, err = ReadFrom(r)
+		if err != nil {
+			return err
+		}
+		if cfg.MaxBytes > 0 {
+			maxBucketBytes := uint64((cfg.MaxBytes + bucketsCount - 1) / bucketsCount)
+			expectedBucketChunks := (maxBucketBytes + chunkSize - 1) / chunkSize
+			if n := uint64(cap(c.buckets[0].chunks)); n != expectedBucketChunks {
+				return fmt.Errorf("stream contains unexpected number of bucket chunks; got %d; want %d", n, expectedBucketChunks)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if c != nil {
+			c.Reset()
+		}
+		return nil, err
+	}
+	if err := c.applyConfig(cfg); err != nil {
+		_ = c.Close()
+		c.Reset()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cache) readStream(r io.Reader) error {
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return fmt.Errorf("cannot read stream magic: %w", err)
+	}
+	if string(magic) != streamMagic {
+		return fmt.Errorf("missing stream magic; the stream wasn't written by Cache.WriteTo")
+	}
+	metadataLen, err := readUint64(r)
+	if err != nil {
+		return fmt.Errorf("cannot read metadata length: %w", err)
+	}
+	if metadataLen > maxStreamMetadataSize {
+		return fmt.Errorf("too big metadata length=%d; it cannot exceed %d", metadataLen, maxStreamMetadataSize)
+	}
+	metadata := make([]byte, metadataLen)
+	if _, err := io.ReadFull(r, metadata); err != nil {
+		return fmt.Errorf("cannot read metadata: %w", err)
+	}
+	var sh snapshotHeader
+	if err := sh.Unmarshal(metadata); err != nil {
+		return fmt.Errorf("cannot parse metadata: %w", err)
+	}
+	if sh.keyID != "" {
+		return fmt.Errorf("unexpected encrypted stream; streams written by Cache.WriteTo aren't encrypted")
+	}
+
+	zr, err := newCodecReader(sh.codec, r)
+	if err != nil {
+		return err
+	}
+	cr := &crcReader{
+		r: zr,
+	}
+	for {
+		bucketNum, err := readUint64(zr)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("cannot read bucketNum; the stream may be truncated: %w", err)
+		}
+		if bucketNum == streamEndMarker {
+			break
+		}
+		if bucketNum >= bucketsCount {
+			return fmt.Errorf("unexpected bucketNum=%d; must be smaller than %d", bucketNum, bucketsCount)
+		}
+		b := &c.buckets[bucketNum]
+		if b.chunks != nil {
+			return fmt.Errorf("duplicate bucket[%d]", bucketNum)
+		}
+		cr.crc = 0
+		if err := b.Load(cr, sh.maxBucketChunks); err != nil {
+			return fmt.Errorf("cannot load bucket[%d]: %w", bucketNum, err)
+		}
+		crc, err := readUint64(zr)
+		if err != nil {
+			return fmt.Errorf("cannot read checksum for bucket[%d]: %w", bucketNum, err)
+		}
+		if uint64(cr.crc) != crc {
+			return fmt.Errorf("checksum mismatch for bucket[%d]; got 0x%08x; want 0x%08x", bucketNum, cr.crc, crc)
+		}
+	}
+	for i := range c.buckets[:] {
+		b := &c.buckets[i]
+		if b.chunks == nil {
+			return fmt.Errorf("missing bucket[%d] in the stream", i)
+		}
+		// Drop invalid index entries in the same way as LoadFromFile does.
+		b.verify()
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package fastcache
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+func TestWriteToReadFrom(t *testing.T) {
+	c := New(bucketsCount * chunkSize * 2)
+	defer c.Reset()
+	const itemsCount = 10000
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		c.Set(k, v)
+	}
+
+	var bb bytes.Buffer
+	n, err := c.WriteTo(&bb)
+	if err != nil {
+		t.Fatalf("WriteTo error: %s", err)
+	}
+	if n != int64(bb.Len()) {
+		t.Fatalf("unexpected number of bytes written; got %d; want %d", n, bb.Len())
+	}
+	data := bb.Bytes()
+
+	c1, err := ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadFrom error: %s", err)
+	}
+	defer c1.Reset()
+	var s Stats
+	c1.UpdateStats(&s)
+	if s.EntriesCount != itemsCount {
+		t.Fatalf("unexpected entriesCount; got %d; want %d", s.EntriesCount, itemsCount)
+	}
+	if s.MaxBytesSize != bucketsCount*chunkSize*2 {
+		t.Fatalf("unexpected MaxBytesSize; got %d; want %d", s.MaxBytesSize, bucketsCount*chunkSize*2)
+	}
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		if vv := c1.Get(nil, k); string(vv) != string(v) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, vv, v)
+		}
+	}
+
+	// Verify truncated streams are rejected.
+	for _, n := range []int{0, 5, len(streamMagic) + 8, len(data) / 2, len(data) - 1} {
+		c2, err := ReadFrom(bytes.NewReader(data[:n]))
+		if err == nil {
+			c2.Reset()
+			t.Fatalf("expecting non-nil error for the stream truncated to %d bytes", n)
+		}
+	}
+
+	// Verify foreign streams are rejected.
+	_, err = ReadFrom(strings.NewReader("foreign stream contents"))
+	if err == nil {
+		t.Fatalf("expecting non-nil error for foreign stream")
+	}
+	if !strings.Contains(err.Error(), "missing stream magic") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestReadFromInvalidEntries(t *testing.T) {
+	c := New(1)
+	defer c.Reset()
+	c.Set([]byte("key"), []byte("value"))
+
+	// Add live index entries pointing past the chunks of the bucket with the key.
+	// The stream checksums remain valid, since the entries are written by WriteTo.
+	b := &c.buckets[xxhash.Sum64([]byte("key"))%bucketsCount]
+	b.mu.Lock()
+	prevGen := (b.gen - 1) << bucketSizeBits
+	b.m[1] = prevGen | uint64(len(b.chunks))*chunkSize
+	b.m[2] = prevGen | (chunkSize - 2)
+	b.mu.Unlock()
+	var bb bytes.Buffer
+	if _, err := c.WriteTo(&bb); err != nil {
+		t.Fatalf("WriteTo error: %s", err)
+	}
+
+	c1, err := ReadFrom(&bb)
+	if err != nil {
+		t.Fatalf("ReadFrom error: %s", err)
+	}
+	defer c1.Reset()
+	var s Stats
+	c1.UpdateStats(&s)
+	if s.Corruptions != 2 {
+		t.Fatalf("unexpected Corruptions; got %d; want 2", s.Corruptions)
+	}
+	if s.EntriesCount != 1 {
+		t.Fatalf("unexpected EntriesCount; got %d; want 1", s.EntriesCount)
+	}
+	if v := c1.Get(nil, []byte("key")); string(v) != "value" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "key", v, "value")
+	}
+}
@@ -0,0 +1,605 @@
+package fastcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WALSyncMode defines durability guarantees for the write-ahead log.
+//
+// See Config.WALPath for details.
+type WALSyncMode int
+
+const (
+	// WALSyncPeriodic writes the WAL to disk and fsyncs it every Config.WALFlushInterval.
+	//
+	// Writes made during the last Config.WALFlushInterval may be lost on crash.
+	// This is the default mode.
+	WALSyncPeriodic WALSyncMode = 0
+
+	// WALSyncNone writes the WAL to the operating system every Config.WALFlushInterval without fsync.
+	//
+	// The written data survives the process crash, but may be lost on power loss.
+	WALSyncNone WALSyncMode = 1
+
+	// WALSyncAlways makes Set, SetBig, Del and Reset wait until the WAL record for the operation is fsynced.
+	//
+	// Records from concurrently running operations are fsynced together.
+	// Records, which couldn't be written, remain buffered until the next successful flush.
+	// Use Cache.WALError for detecting such records.
+	WALSyncAlways WALSyncMode = 2
+)
+
+// String returns human-readable sync mode name.
+func (mode WALSyncMode) String() string {
+	switch mode {
+	case WALSyncPeriodic:
+		return "periodic"
+	case WALSyncNone:
+		return "none"
+	case WALSyncAlways:
+		return "always"
+	default:
+		return fmt.Sprintf("WALSyncMode(%d)", int(mode))
+	}
+}
+
+func (mode WALSyncMode) validate() error {
+	switch mode {
+	case WALSyncPeriodic, WALSyncNone, WALSyncAlways:
+		return nil
+	default:
+		return fmt.Errorf("unsupported WAL sync mode %s", mode)
+	}
+}
+
+// defaultWALFlushInterval is the default value for Config.WALFlushInterval.
+const defaultWALFlushInterval = time.Second
+
+// walMaxBufferSize is the maximum size of buffered WAL records.
+//
+// Buffered records are written to the WAL file without waiting for the next flush if their size exceeds walMaxBufferSize.
+const walMaxBufferSize = 1024 * 1024
+
+// WAL record operations.
+const (
+	walOpSet    = 1
+	walOpSetBig = 2
+	walOpDel    = 3
+	walOpReset  = 4
+)
+
+// walRecordHeaderSize is the size of the record header: the payload length followed by CRC32C of the payload.
+const walRecordHeaderSize = 8
+
+// wal is an append-only write-ahead log for cache modifications.
+//
+// The log consists of segments. A new segment is started when the snapshot is saved,
+// so the previous segments may be removed after the snapshot is successfully saved.
+type wal struct {
+	dir      string
+	syncMode WALSyncMode
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// buf contains records, which aren't written to f yet.
+	buf   []byte
+	spare []byte
+
+	// seq is the sequence number of the last appended record.
+	seq uint64
+
+	// flushedSeq is the sequence number of the last record written to f.
+	flushedSeq uint64
+
+	// syncedSeq is the sequence number of the last record synced to disk.
+	syncedSeq uint64
+
+	// flushing is set while a goroutine writes buffered records to f.
+	flushing bool
+
+	f         *os.File
+	segmentID uint64
+	closed    bool
+
+	// closing is set when close is called. It prevents from closing stopCh multiple times.
+	closing bool
+
+	// offset is the size of the records written to f.
+	offset int64
+
+	// lastErr is the error for the last failed flush. It is reset after the successful flush.
+	lastErr error
+
+	// saveMu serializes snapshots, which truncate the WAL.
+	saveMu sync.Mutex
+
+	// resetMu prevents from starting a new segment while Cache.Reset is in progress.
+	//
+	// Otherwise the snapshot started after the rotation may capture the data
+	// removed by Reset, while the Reset record remains in the previous segment.
+	resetMu sync.Mutex
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	writes       uint64
+	bytesWritten uint64
+	syncs        uint64
+	errors       uint64
+}
+
+var walSegmentRegexp = regexp.MustCompile(`^[0-9a-f]{16}\.wal$`)
+
+// readWALSegmentIDs returns sorted ids of WAL segments at dir.
+func readWALSegmentIDs(dir string) ([]uint64, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read WAL dir %q: %s", dir, err)
+	}
+	var ids []uint64
+	for _, de := range des {
+		name := de.Name()
+		if de.IsDir() || !walSegmentRegexp.MatchString(name) {
+			continue
+		}
+		id, err := strconv.ParseUint(name[:16], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse WAL segment id from %q: %s", name, err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+func walSegmentPath(dir string, segmentID uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016x.wal", segmentID))
+}
+
+// openWAL starts a new WAL segment with the given segmentID at dir.
+func openWAL(dir string, segmentID uint64, syncMode WALSyncMode, flushInterval time.Duration) (*wal, error) {
+	if err := syncMode.validate(); err != nil {
+		return nil, err
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultWALFlushInterval
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create WAL dir %q: %s", dir, err)
+	}
+	f, err := createWALSegment(dir, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{
+		dir:       dir,
+		syncMode:  syncMode,
+		f:         f,
+		segmentID: segmentID,
+		stopCh:    make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	if syncMode != WALSyncAlways {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.runFlusher(flushInterval)
+		}()
+	}
+	return w, nil
+}
+
+func createWALSegment(dir string, segmentID uint64) (*os.File, error) {
+	path := walSegmentPath(dir, segmentID)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create WAL segment: %s", err)
+	}
+	return f, nil
+}
+
+func (w *wal) runFlusher(flushInterval time.Duration) {
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-t.C:
+			_, _ = w.flush(w.lastSeq(), w.syncMode == WALSyncPeriodic, false)
+		}
+	}
+}
+
+func (w *wal) lastSeq() uint64 {
+	w.mu.Lock()
+	seq := w.seq
+	w.mu.Unlock()
+	return seq
+}
+
+// append appends the encoded record rec to w and returns its sequence number.
+//
+// The record must be committed with commit after the operation is applied to the cache.
+// 0 is returned if w is closed.
+func (w *wal) append(rec []byte) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0
+	}
+	w.buf = append(w.buf, rec...)
+	w.seq++
+	return w.seq
+}
+
+// commit makes sure the record with the given seq is persisted according to w.syncMode.
+//
+// The record isn't persisted if an error is returned. It remains buffered, so it is written by the next flush.
+// The error is also counted in Stats.WALErrors and is returned by Cache.WALError.
+func (w *wal) commit(seq uint64) error {
+	if w.syncMode == WALSyncAlways {
+		_, err := w.flush(seq, true, false)
+		return err
+	}
+	w.mu.Lock()
+	n := len(w.buf)
+	w.mu.Unlock()
+	if n >= walMaxBufferSize {
+		_, err := w.flush(seq, false, false)
+		return err
+	}
+	return nil
+}
+
+// err returns the error for the last failed flush.
+//
+// nil is returned if the last flush succeeded.
+func (w *wal) err() error {
+	w.mu.Lock()
+	err := w.lastErr
+	w.mu.Unlock()
+	return err
+}
+
+// flush makes sure records up to seq are written to the WAL file and are synced to disk if needSync is set.
+//
+// If rotate is set, then all the buffered records are synced to the current segment
+// and a new segment is started. The id of the new segment is returned in this case.
+//
+// Concurrent callers share a single write and fsync.
+func (w *wal) flush(seq uint64, needSync, rotate bool) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.flushing {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0, errWALClosed
+	}
+	if !rotate && w.flushedSeq >= seq && (!needSync || w.syncedSeq >= seq) {
+		return w.segmentID, nil
+	}
+
+	// Write all the buffered records without holding the lock, so other goroutines may continue appending records.
+	w.flushing = true
+	buf := w.buf
+	w.buf = w.spare[:0]
+	target := w.seq
+	f := w.f
+	offset := w.offset
+	segmentID := w.segmentID
+	w.mu.Unlock()
+
+	needSync = needSync || rotate
+	synced := false
+	err := w.write(f, offset, buf)
+	written := err == nil
+	if written && needSync {
+		err = w.sync(f)
+		synced = err == nil
+	}
+	var newF *os.File
+	if rotate && err == nil {
+		newF, err = createWALSegment(w.dir, segmentID+1)
+	}
+
+	w.mu.Lock()
+	w.flushing = false
+	if written {
+		w.spare = buf[:0]
+		w.offset += int64(len(buf))
+		w.flushedSeq = target
+		if synced {
+			w.syncedSeq = target
+		}
+	} else {
+		// Return the records to the buffer, so they are written by the next flush.
+		pending := w.buf
+		w.buf = append(buf, pending...)
+		w.spare = pending[:0]
+	}
+	if newF != nil {
+		_ = w.f.Close()
+		w.f = newF
+		w.offset = 0
+		w.segmentID = segmentID + 1
+	}
+	w.lastErr = err
+	w.cond.Broadcast()
+	if err != nil {
+		atomic.AddUint64(&w.errors, 1)
+		return 0, err
+	}
+	return w.segmentID, nil
+}
+
+// write writes buf to f at the given offset.
+//
+// Partially written data is removed from f on error, so buf may be written again.
+func (w *wal) write(f *os.File, offset int64, buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if _, err := f.Write(buf); err != nil {
+		if errTruncate := truncateWALSegment(f, offset); errTruncate != nil {
+			return fmt.Errorf("cannot write to WAL segment %q: %s; cannot remove partially written data: %s", f.Name(), err, errTruncate)
+		}
+		return fmt.Errorf("cannot write to WAL segment %q: %s", f.Name(), err)
+	}
+	atomic.AddUint64(&w.writes, 1)
+	atomic.AddUint64(&w.bytesWritten, uint64(len(buf)))
+	return nil
+}
+
+func (w *wal) sync(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("cannot sync WAL segment %q: %s", f.Name(), err)
+	}
+	atomic.AddUint64(&w.syncs, 1)
+	return nil
+}
+
+// truncateWALSegment truncates f to the given size and moves the write position to its end.
+func truncateWALSegment(f *os.File, size int64) error {
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	_, err := f.Seek(size, io.SeekStart)
+	return err
+}
+
+// errWALClosed is returned when flushing the closed WAL.
+var errWALClosed = errors.New("the WAL is closed")
+
+// rotate syncs all the buffered records and starts a new WAL segment.
+//
+// It returns the id of the new segment.
+func (w *wal) rotate() (uint64, error) {
+	w.resetMu.Lock()
+	defer w.resetMu.Unlock()
+	return w.flush(0, true, true)
+}
+
+// removeSegmentsBefore removes WAL segments with ids smaller than segmentID.
+func (w *wal) removeSegmentsBefore(segmentID uint64) error {
+	ids, err := readWALSegmentIDs(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id >= segmentID {
+			break
+		}
+		path := walSegmentPath(w.dir, id)
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("cannot remove WAL segment: %s", err)
+		}
+	}
+	return nil
+}
+
+// close flushes and syncs all the buffered records and closes w.
+//
+// It is safe to call close concurrently. Subsequent calls are no-op.
+func (w *wal) close() error {
+	w.mu.Lock()
+	closing := w.closing
+	w.closing = true
+	w.mu.Unlock()
+	if closing {
+		return nil
+	}
+	close(w.stopCh)
+	w.wg.Wait()
+	_, err := w.flush(w.lastSeq(), true, false)
+
+	w.mu.Lock()
+	w.closed = true
+	if errClose := w.f.Close(); errClose != nil && err == nil {
+		err = fmt.Errorf("cannot close WAL segment: %s", errClose)
+	}
+	w.mu.Unlock()
+	return err
+}
+
+func (w *wal) UpdateStats(s *Stats) {
+	s.WALWrites += atomic.LoadUint64(&w.writes)
+	s.WALBytesWritten += atomic.LoadUint64(&w.bytesWritten)
+	s.WALSyncs += atomic.LoadUint64(&w.syncs)
+	s.WALErrors += atomic.LoadUint64(&w.errors)
+}
+
+// appendWALRecord appends the record for the operation op with the given k and v to dst and returns the result.
+func appendWALRecord(dst []byte, op byte, k, v []byte) []byte {
+	payloadLen := 1 + 4 + len(k) + 4 + len(v)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(payloadLen))
+	crcOffset := len(dst)
+	dst = binary.LittleEndian.AppendUint32(dst, 0)
+	payloadOffset := len(dst)
+	dst = append(dst, op)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(k)))
+	dst = append(dst, k...)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(v)))
+	dst = append(dst, v...)
+	crc := crc32.Checksum(dst[payloadOffset:], crc32cTable)
+	binary.LittleEndian.PutUint32(dst[crcOffset:], crc)
+	return dst
+}
+
+// parseWALRecordPayload parses the record payload written by appendWALRecord.
+func parseWALRecordPayload(payload []byte) (byte, []byte, []byte, error) {
+	if len(payload) < 1+4+4 {
+		return 0, nil, nil, fmt.Errorf("too short WAL record payload; got %d bytes; want at least %d bytes", len(payload), 1+4+4)
+	}
+	op := payload[0]
+	payload = payload[1:]
+	keyLen := uint64(binary.LittleEndian.Uint32(payload))
+	payload = payload[4:]
+	if keyLen+4 > uint64(len(payload)) {
+		return 0, nil, nil, fmt.Errorf("too big key length in WAL record: %d bytes", keyLen)
+	}
+	k := payload[:keyLen]
+	payload = payload[keyLen:]
+	valueLen := uint64(binary.LittleEndian.Uint32(payload))
+	payload = payload[4:]
+	if valueLen != uint64(len(payload)) {
+		return 0, nil, nil, fmt.Errorf("unexpected value length in WAL record; got %d bytes; want %d bytes", valueLen, len(payload))
+	}
+	return op, k, payload, nil
+}
+
+// WALError returns the error for the last failed write to the write-ahead log of c.
+//
+// Records, which couldn't be written, remain buffered and are written by the next flush.
+// nil is returned if the last write succeeded or if the write-ahead log isn't configured.
+func (c *Cache) WALError() error {
+	if c.wal == nil {
+		return nil
+	}
+	return c.wal.err()
+}
+
+// replayWAL applies the records from WAL segments with the given segmentIDs at dir to c.
+//
+// The rest of the segment is skipped after the first record with invalid checksum, since it is usually caused
+// by a torn write during a crash. The skipped bytes are counted in Stats.WALReplaySkippedBytes.
+// CorruptionError is returned for records with valid checksum, which cannot be applied.
+func (c *Cache) replayWAL(dir string, segmentIDs []uint64) error {
+	for _, id := range segmentIDs {
+		if err := c.replayWALSegment(walSegmentPath(dir, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) replayWALSegment(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open WAL segment: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat WAL segment %q: %s", path, err)
+	}
+	remaining := uint64(fi.Size())
+	br := bufio.NewReaderSize(f, 64*1024)
+	var header [walRecordHeaderSize]byte
+	var payload []byte
+	size := remaining
+	for remaining >= walRecordHeaderSize {
+		offset := size - remaining
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return fmt.Errorf("cannot read WAL record header from %q: %s", path, err)
+		}
+		remaining -= walRecordHeaderSize
+		payloadLen := uint64(binary.LittleEndian.Uint32(header[:]))
+		crc := binary.LittleEndian.Uint32(header[4:])
+		if payloadLen > remaining {
+			// Torn write.
+			c.skipWALReplay(walRecordHeaderSize + remaining)
+			return nil
+		}
+		payload = slices.Grow(payload[:0], int(payloadLen))[:payloadLen]
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return fmt.Errorf("cannot read WAL record from %q: %s", path, err)
+		}
+		remaining -= payloadLen
+		if crc32.Checksum(payload, crc32cTable) != crc {
+			// Torn write.
+			c.skipWALReplay(walRecordHeaderSize + payloadLen + remaining)
+			return nil
+		}
+		op, k, v, err := parseWALRecordPayload(payload)
+		if err != nil {
+			return corruptionErrorf("cannot parse WAL record at offset %d in %q: %s", offset, path, err)
+		}
+		switch op {
+		case walOpSet:
+			c.Set(k, v)
+		case walOpSetBig:
+			c.SetBig(k, v)
+		case walOpDel:
+			c.Del(k)
+		case walOpReset:
+			c.Reset()
+		default:
+			return corruptionErrorf("unknown operation %d in WAL record at offset %d in %q", op, offset, path)
+		}
+	}
+	c.skipWALReplay(remaining)
+	return nil
+}
+
+// skipWALReplay registers n bytes skipped when replaying the WAL.
+func (c *Cache) skipWALReplay(n uint64) {
+	atomic.AddUint64(&c.walReplaySkippedBytes, n)
+}
+
+// setWAL enables the WAL w for b.
+//
+// It must be called before b is used concurrently.
+func (b *bucket) setWAL(w *wal) {
+	b.wal = w
+}
+
+func getWALBuf() *bytesBuf {
+	v := walBufPool.Get()
+	if v == nil {
+		return &bytesBuf{}
+	}
+	return v.(*bytesBuf)
+}
+
+func putWALBuf(bb *bytesBuf) {
+	bb.B = bb.B[:0]
+	walBufPool.Put(bb)
+}
+
+var walBufPool sync.Pool
@@ -0,0 +1,499 @@
+package fastcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	for _, mode := range []WALSyncMode{WALSyncPeriodic, WALSyncNone, WALSyncAlways} {
+		t.Run(mode.String(), func(t *testing.T) {
+			testWALReplay(t, mode)
+		})
+	}
+}
+
+func testWALReplay(t *testing.T, mode WALSyncMode) {
+	cfg := &Config{
+		MaxBytes:         bucketsCount * chunkSize * 4,
+		WALPath:          filepath.Join(t.TempDir(), "wal"),
+		WALSyncMode:      mode,
+		WALFlushInterval: 10 * time.Millisecond,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+
+	const itemsCount = 1000
+	for i := range itemsCount {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	for i := range itemsCount / 2 {
+		c.Del([]byte(fmt.Sprintf("key %d", i)))
+	}
+	bigValue := bytes.Repeat([]byte("big"), 3*chunkSize)
+	c.SetBig([]byte("big key"), bigValue)
+	if mode == WALSyncAlways {
+		// Simulate a crash, since all the operations must be already persisted.
+		// Stop the WAL in order to release the opened file.
+		defer func() {
+			_ = c.Close()
+		}()
+	} else if err := c.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	c1, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c1.Reset()
+	defer func() {
+		_ = c1.Close()
+	}()
+	for i := range itemsCount {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v, ok := c1.HasGet(nil, k)
+		if i < itemsCount/2 {
+			if ok {
+				t.Fatalf("unexpected value for the deleted key %q: %q", k, v)
+			}
+			continue
+		}
+		if vExpected := fmt.Sprintf("value %d", i); string(v) != vExpected {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+		}
+	}
+	if v := c1.GetBig(nil, []byte("big key")); !bytes.Equal(v, bigValue) {
+		t.Fatalf("unexpected value for the big key; got %d bytes; want %d bytes", len(v), len(bigValue))
+	}
+	var s Stats
+	c.UpdateStats(&s)
+	if s.WALWrites == 0 || s.WALBytesWritten == 0 || s.WALSyncs == 0 {
+		t.Fatalf("expecting non-zero WAL stats; got %+v", s)
+	}
+	if s.WALErrors != 0 {
+		t.Fatalf("unexpected WAL errors: %d", s.WALErrors)
+	}
+
+	// Reset must be recorded in the WAL.
+	c1.Reset()
+	if err := c1.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	c2, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c2.Reset()
+	defer func() {
+		_ = c2.Close()
+	}()
+	s.Reset()
+	c2.UpdateStats(&s)
+	if s.EntriesCount != 0 {
+		t.Fatalf("unexpected number of entries after replaying Reset; got %d; want 0", s.EntriesCount)
+	}
+}
+
+func TestWALSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "snapshot")
+	cfg := &Config{
+		MaxBytes:    bucketsCount * chunkSize,
+		WALPath:     filepath.Join(dir, "wal"),
+		WALSyncMode: WALSyncAlways,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	defer func() {
+		_ = c.Close()
+	}()
+	c.Set([]byte("foo"), []byte("bar"))
+	c.Set([]byte("aaa"), []byte("bbb"))
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	// The WAL must be truncated after the snapshot.
+	ids, err := readWALSegmentIDs(cfg.WALPath)
+	if err != nil {
+		t.Fatalf("cannot read WAL segments: %s", err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("unexpected number of WAL segments after the snapshot; got %d; want 1", len(ids))
+	}
+	fi, err := os.Stat(walSegmentPath(cfg.WALPath, ids[0]))
+	if err != nil {
+		t.Fatalf("cannot stat WAL segment: %s", err)
+	}
+	if fi.Size() != 0 {
+		t.Fatalf("unexpected WAL segment size after the snapshot; got %d bytes; want 0 bytes", fi.Size())
+	}
+
+	// Operations after the snapshot must be replayed on top of the snapshot.
+	c.Set([]byte("foo"), []byte("baz"))
+	c.Del([]byte("aaa"))
+	c.Set([]byte("new"), []byte("value"))
+
+	c1, err := LoadFromFileConfig(filePath, cfg)
+	if err != nil {
+		t.Fatalf("LoadFromFileConfig error: %s", err)
+	}
+	defer c1.Reset()
+	defer func() {
+		_ = c1.Close()
+	}()
+	if v := c1.Get(nil, []byte("foo")); string(v) != "baz" {
+		t.Fatalf("unexpected value for foo; got %q; want %q", v, "baz")
+	}
+	if v, ok := c1.HasGet(nil, []byte("aaa")); ok {
+		t.Fatalf("unexpected value for the deleted key: %q", v)
+	}
+	if v := c1.Get(nil, []byte("new")); string(v) != "value" {
+		t.Fatalf("unexpected value for new; got %q; want %q", v, "value")
+	}
+}
+
+func TestWALTornWrite(t *testing.T) {
+	cfg := &Config{
+		MaxBytes:    bucketsCount * chunkSize,
+		WALPath:     filepath.Join(t.TempDir(), "wal"),
+		WALSyncMode: WALSyncAlways,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	// Simulate a torn write at the end of the segment.
+	ids, err := readWALSegmentIDs(cfg.WALPath)
+	if err != nil {
+		t.Fatalf("cannot read WAL segments: %s", err)
+	}
+	path := walSegmentPath(cfg.WALPath, ids[len(ids)-1])
+	rec := appendWALRecord(nil, walOpSet, []byte("torn"), []byte("value"))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("cannot open %q: %s", path, err)
+	}
+	if _, err := f.Write(rec[:len(rec)-1]); err != nil {
+		t.Fatalf("cannot write to %q: %s", path, err)
+	}
+	_ = f.Close()
+
+	// The records before the torn write and the records in the next segments must be replayed.
+	c1, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c1.Reset()
+	if v := c1.Get(nil, []byte("foo")); string(v) != "bar" {
+		t.Fatalf("unexpected value for foo; got %q; want %q", v, "bar")
+	}
+	if v, ok := c1.HasGet(nil, []byte("torn")); ok {
+		t.Fatalf("unexpected value for the torn record: %q", v)
+	}
+	var s Stats
+	c1.UpdateStats(&s)
+	if s.WALReplaySkippedBytes != uint64(len(rec)-1) {
+		t.Fatalf("unexpected WALReplaySkippedBytes; got %d; want %d", s.WALReplaySkippedBytes, len(rec)-1)
+	}
+	c1.Set([]byte("foo"), []byte("baz"))
+	if err := c1.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	c2, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c2.Reset()
+	defer func() {
+		_ = c2.Close()
+	}()
+	if v := c2.Get(nil, []byte("foo")); string(v) != "baz" {
+		t.Fatalf("unexpected value for foo; got %q; want %q", v, "baz")
+	}
+}
+
+func TestWALWriteError(t *testing.T) {
+	cfg := &Config{
+		MaxBytes:    bucketsCount * chunkSize,
+		WALPath:     filepath.Join(t.TempDir(), "wal"),
+		WALSyncMode: WALSyncAlways,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+	if err := c.WALError(); err != nil {
+		t.Fatalf("unexpected WAL error: %s", err)
+	}
+
+	// Make writes to the current segment fail.
+	w := c.wal
+	path := w.f.Name()
+	fRead, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("cannot open %q: %s", path, err)
+	}
+	w.mu.Lock()
+	fWrite := w.f
+	w.f = fRead
+	w.mu.Unlock()
+
+	c.Set([]byte("baz"), []byte("qux"))
+	if err := c.WALError(); err == nil {
+		t.Fatalf("expecting non-nil WAL error")
+	}
+	var s Stats
+	c.UpdateStats(&s)
+	if s.WALErrors == 0 {
+		t.Fatalf("expecting non-zero WALErrors")
+	}
+	w.mu.Lock()
+	seq := w.seq
+	syncedSeq := w.syncedSeq
+	w.f = fWrite
+	w.mu.Unlock()
+	_ = fRead.Close()
+	if syncedSeq >= seq {
+		t.Fatalf("the failed record mustn't be marked as synced; syncedSeq=%d, seq=%d", syncedSeq, seq)
+	}
+
+	// The failed record must be written by the next flush.
+	c.Set([]byte("foo"), []byte("new"))
+	if err := c.WALError(); err != nil {
+		t.Fatalf("unexpected WAL error: %s", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	c1, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c1.Reset()
+	defer func() {
+		_ = c1.Close()
+	}()
+	if v := c1.Get(nil, []byte("baz")); string(v) != "qux" {
+		t.Fatalf("unexpected value for baz; got %q; want %q", v, "qux")
+	}
+	if v := c1.Get(nil, []byte("foo")); string(v) != "new" {
+		t.Fatalf("unexpected value for foo; got %q; want %q", v, "new")
+	}
+}
+
+func TestWALConcurrentClose(t *testing.T) {
+	cfg := &Config{
+		MaxBytes:         bucketsCount * chunkSize,
+		WALPath:          filepath.Join(t.TempDir(), "wal"),
+		WALFlushInterval: time.Millisecond,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+
+	const workersCount = 4
+	ch := make(chan error, workersCount)
+	for range workersCount {
+		go func() {
+			ch <- c.Close()
+		}()
+	}
+	for range workersCount {
+		if err := <-ch; err != nil {
+			t.Fatalf("Close error: %s", err)
+		}
+	}
+}
+
+func TestWALSaveAfterClose(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &Config{
+		MaxBytes: bucketsCount * chunkSize,
+		WALPath:  filepath.Join(tmpDir, "wal"),
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	// c must remain usable as an in-memory cache after Close.
+	c.Set([]byte("baz"), []byte("qux"))
+	filePath := filepath.Join(tmpDir, "snapshot")
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error after Close: %s", err)
+	}
+	c1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c1.Reset()
+	for _, kv := range [][2]string{{"foo", "bar"}, {"baz", "qux"}} {
+		if v := c1.Get(nil, []byte(kv[0])); string(v) != kv[1] {
+			t.Fatalf("unexpected value for %q; got %q; want %q", kv[0], v, kv[1])
+		}
+	}
+}
+
+func TestWALCorruptedRecord(t *testing.T) {
+	cfg := &Config{
+		MaxBytes:    bucketsCount * chunkSize,
+		WALPath:     filepath.Join(t.TempDir(), "wal"),
+		WALSyncMode: WALSyncAlways,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+	c.Set([]byte("foo"), []byte("bar"))
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	// Append a record with valid checksum and unknown operation.
+	ids, err := readWALSegmentIDs(cfg.WALPath)
+	if err != nil {
+		t.Fatalf("cannot read WAL segments: %s", err)
+	}
+	path := walSegmentPath(cfg.WALPath, ids[len(ids)-1])
+	rec := appendWALRecord(nil, 100, []byte("foo"), []byte("baz"))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("cannot open %q: %s", path, err)
+	}
+	if _, err := f.Write(rec); err != nil {
+		t.Fatalf("cannot write to %q: %s", path, err)
+	}
+	_ = f.Close()
+
+	_, err = NewFromConfig(cfg)
+	var ce *CorruptionError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expecting CorruptionError; got %v", err)
+	}
+}
+
+func TestWALInvalidConfig(t *testing.T) {
+	cfg := &Config{
+		MaxBytes:    bucketsCount * chunkSize,
+		WALPath:     filepath.Join(t.TempDir(), "wal"),
+		WALSyncMode: WALSyncMode(100),
+	}
+	if _, err := NewFromConfig(cfg); err == nil {
+		t.Fatalf("expecting non-nil error for invalid WALSyncMode")
+	}
+}
+
+func TestWALRecordMarshalUnmarshal(t *testing.T) {
+	f := func(op byte, k, v string) {
+		t.Helper()
+		rec := appendWALRecord(nil, op, []byte(k), []byte(v))
+		if len(rec) < walRecordHeaderSize {
+			t.Fatalf("too short record: %d bytes", len(rec))
+		}
+		opResult, kResult, vResult, err := parseWALRecordPayload(rec[walRecordHeaderSize:])
+		if err != nil {
+			t.Fatalf("cannot parse record: %s", err)
+		}
+		if opResult != op || string(kResult) != k || string(vResult) != v {
+			t.Fatalf("unexpected record; got op=%d, k=%q, v=%q; want op=%d, k=%q, v=%q", opResult, kResult, vResult, op, k, v)
+		}
+		if _, _, _, err := parseWALRecordPayload(rec[walRecordHeaderSize : len(rec)-1]); err == nil {
+			t.Fatalf("expecting non-nil error for truncated record")
+		}
+	}
+	f(walOpSet, "foo", "bar")
+	f(walOpSet, "", "")
+	f(walOpDel, "foo", "")
+	f(walOpReset, "", "")
+	f(walOpSetBig, "foo", string(make([]byte, 100000)))
+}
+
+func TestWALConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		MaxBytes:    bucketsCount * chunkSize * 4,
+		WALPath:     filepath.Join(dir, "wal"),
+		WALSyncMode: WALSyncAlways,
+	}
+	c, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewFromConfig error: %s", err)
+	}
+	defer c.Reset()
+
+	const workers = 4
+	const itemsCount = 1000
+	resultCh := make(chan error, workers)
+	for n := range workers {
+		go func() {
+			for i := range itemsCount {
+				c.Set([]byte(fmt.Sprintf("key %d-%d", n, i)), []byte(fmt.Sprintf("value %d-%d", n, i)))
+				if i%100 == 0 && n == 0 {
+					if err := c.SaveToFile(filepath.Join(dir, "snapshot")); err != nil {
+						resultCh <- fmt.Errorf("SaveToFile error: %w", err)
+						return
+					}
+				}
+			}
+			resultCh <- nil
+		}()
+	}
+	for range workers {
+		if err := <-resultCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	c1, err := LoadFromFileConfig(filepath.Join(dir, "snapshot"), cfg)
+	if err != nil {
+		t.Fatalf("LoadFromFileConfig error: %s", err)
+	}
+	defer c1.Reset()
+	defer func() {
+		_ = c1.Close()
+	}()
+	for n := range workers {
+		for i := range itemsCount {
+			k := []byte(fmt.Sprintf("key %d-%d", n, i))
+			vExpected := fmt.Sprintf("value %d-%d", n, i)
+			if v := c1.Get(nil, k); string(v) != vExpected {
+				t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, vExpected)
+			}
+		}
+	}
+}